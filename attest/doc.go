@@ -0,0 +1,3 @@
+// Package attest verifies DSSE envelopes and the SLSA provenance statements
+// they carry.
+package attest
@@ -0,0 +1,129 @@
+package attest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Envelope is a DSSE (Dead Simple Signing Envelope), as used to sign in-toto
+// attestations
+type Envelope struct {
+	PayloadType string      `json:"payloadType"`
+	Payload     string      `json:"payload"`
+	Signatures  []Signature `json:"signatures"`
+}
+
+// Signature is one signature of an Envelope
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// ParseEnvelope reads a JSON encoded Envelope
+func ParseEnvelope(buf []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(buf, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// DecodePayload returns the raw payload of the envelope
+func (env Envelope) DecodePayload() ([]byte, error) {
+	return decodeBase64(env.Payload)
+}
+
+// PAE is the DSSE pre-authentication encoding of the payload, which is what
+// is actually signed
+func PAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// ErrNoValidSignature is returned when none of an envelope's signatures
+// verify with the trusted keys
+var ErrNoValidSignature = errors.New("no valid signature from a trusted key")
+
+// Keys are the public keys trusted to sign envelopes, by key ID. Keys with an
+// empty ID are tried against every signature.
+type Keys map[string]crypto.PublicKey
+
+// LoadKeys reads PEM encoded public keys from the files given, using each
+// file name as the key ID
+func LoadKeys(filenames ...string) (Keys, error) {
+	keys := Keys{}
+	for _, filename := range filenames {
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", filename)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		keys[filename] = key
+	}
+	return keys, nil
+}
+
+// Verify checks that at least one signature of the envelope is valid for one
+// of the keys, returning the ID of the key that verified
+func (env Envelope) Verify(keys Keys) (string, error) {
+	payload, err := env.DecodePayload()
+	if err != nil {
+		return "", err
+	}
+	msg := PAE(env.PayloadType, payload)
+	for _, s := range env.Signatures {
+		sig, err := decodeBase64(s.Sig)
+		if err != nil {
+			continue
+		}
+		for id, key := range keys {
+			if s.KeyID != "" && id != "" && s.KeyID != id {
+				continue
+			}
+			if verifySignature(key, msg, sig) {
+				return id, nil
+			}
+		}
+	}
+	return "", ErrNoValidSignature
+}
+
+func verifySignature(key crypto.PublicKey, msg, sig []byte) bool {
+	digest := sha256.Sum256(msg)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
+	case *rsa.PublicKey:
+		if rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil {
+			return true
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+// decodeBase64 accepts both the standard and URL-safe encodings
+func decodeBase64(s string) ([]byte, error) {
+	if buf, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return buf, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
@@ -0,0 +1,152 @@
+package attest
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// InTotoPayloadType is the DSSE payload type of in-toto statements
+	InTotoPayloadType = "application/vnd.in-toto+json"
+	// SLSAPredicatePrefix prefixes the predicate types of all SLSA
+	// provenance versions
+	SLSAPredicatePrefix = "https://slsa.dev/provenance/"
+)
+
+// Statement is an in-toto attestation statement
+type Statement struct {
+	Type          string          `json:"_type"`
+	Subject       []Subject       `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// Subject is an artifact that a Statement is about
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Provenance is the verified summary of a SLSA provenance attestation
+type Provenance struct {
+	PredicateType string    `json:"predicate_type"`
+	BuilderID     string    `json:"builder_id"`
+	BuildType     string    `json:"build_type,omitempty"`
+	Subjects      []Subject `json:"subjects"`
+	// KeyID is the trusted key that signed the attestation
+	KeyID string `json:"key_id"`
+}
+
+// ProvenancePolicy is what a provenance attestation must satisfy
+type ProvenancePolicy struct {
+	Keys Keys
+	// TrustedBuilders are path.Match patterns of the builder IDs accepted.
+	// Any builder is accepted when empty.
+	TrustedBuilders []string
+}
+
+// ProvenanceError is returned when an attestation does not verify
+type ProvenanceError struct {
+	Reason string
+}
+
+func (e ProvenanceError) Error() string {
+	return "provenance verification failed: " + e.Reason
+}
+
+// VerifyProvenance verifies the DSSE envelope of a SLSA provenance
+// attestation against the policy, and that it is about the content with the
+// digest given (like "sha256:abc..."). SLSA provenance v0.2 and v1 are
+// understood.
+func VerifyProvenance(envelope []byte, policy ProvenancePolicy, digest string) (*Provenance, error) {
+	env, err := ParseEnvelope(envelope)
+	if err != nil {
+		return nil, ProvenanceError{fmt.Sprintf("invalid envelope: %s", err)}
+	}
+	if env.PayloadType != InTotoPayloadType {
+		return nil, ProvenanceError{fmt.Sprintf("unexpected payload type %q", env.PayloadType)}
+	}
+	keyID, err := env.Verify(policy.Keys)
+	if err != nil {
+		return nil, ProvenanceError{err.Error()}
+	}
+
+	payload, err := env.DecodePayload()
+	if err != nil {
+		return nil, ProvenanceError{err.Error()}
+	}
+	st := Statement{}
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return nil, ProvenanceError{fmt.Sprintf("invalid statement: %s", err)}
+	}
+	if !strings.HasPrefix(st.PredicateType, SLSAPredicatePrefix) {
+		return nil, ProvenanceError{fmt.Sprintf("predicate %q is not SLSA provenance", st.PredicateType)}
+	}
+	if !st.About(digest) {
+		return nil, ProvenanceError{fmt.Sprintf("attestation is not about %s", digest)}
+	}
+
+	var pred struct {
+		// v0.2
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		BuildType string `json:"buildType"`
+		// v1
+		BuildDefinition struct {
+			BuildType string `json:"buildType"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+		} `json:"runDetails"`
+	}
+	if err := json.Unmarshal(st.Predicate, &pred); err != nil {
+		return nil, ProvenanceError{fmt.Sprintf("invalid predicate: %s", err)}
+	}
+	prov := &Provenance{
+		PredicateType: st.PredicateType,
+		BuilderID:     pred.Builder.ID,
+		BuildType:     pred.BuildType,
+		Subjects:      st.Subject,
+		KeyID:         keyID,
+	}
+	if prov.BuilderID == "" {
+		prov.BuilderID = pred.RunDetails.Builder.ID
+		prov.BuildType = pred.BuildDefinition.BuildType
+	}
+	if !policy.trustsBuilder(prov.BuilderID) {
+		return nil, ProvenanceError{fmt.Sprintf("builder %q is not trusted", prov.BuilderID)}
+	}
+	return prov, nil
+}
+
+// About reports whether digest (like "sha256:abc...") is a subject of the
+// statement
+func (st Statement) About(digest string) bool {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	for _, s := range st.Subject {
+		if s.Digest[parts[0]] == parts[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ProvenancePolicy) trustsBuilder(id string) bool {
+	if len(p.TrustedBuilders) == 0 {
+		return true
+	}
+	for _, pattern := range p.TrustedBuilders {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
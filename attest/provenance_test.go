@@ -0,0 +1,77 @@
+package attest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func signedProvenance(t *testing.T, key *ecdsa.PrivateKey, builder, digest string) []byte {
+	statement := map[string]interface{}{
+		"_type":         "https://in-toto.io/Statement/v0.1",
+		"subject":       []Subject{{Name: "docker.io/library/busybox", Digest: map[string]string{"sha256": digest}}},
+		"predicateType": "https://slsa.dev/provenance/v0.2",
+		"predicate": map[string]interface{}{
+			"builder":   map[string]string{"id": builder},
+			"buildType": "https://example.com/build@v1",
+		},
+	}
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(PAE(InTotoPayloadType, payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := json.Marshal(Envelope{
+		PayloadType: InTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []Signature{{KeyID: "ci", Sig: base64.StdEncoding.EncodeToString(sig)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestVerifyProvenance(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := "4986bf8c15363d1c5d15512d5266f8777bfba4974ac56e3270e7760f6f0a8125"
+	env := signedProvenance(t, key, "https://github.com/actions/runner", digest)
+	policy := ProvenancePolicy{
+		Keys:            Keys{"ci": &key.PublicKey},
+		TrustedBuilders: []string{"https://github.com/*/runner"},
+	}
+
+	prov, err := VerifyProvenance(env, policy, "sha256:"+digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.BuilderID != "https://github.com/actions/runner" || prov.KeyID != "ci" {
+		t.Errorf("unexpected provenance %#v", prov)
+	}
+
+	if _, err := VerifyProvenance(env, policy, "sha256:deadbeef"); err == nil {
+		t.Error("expected a different subject to fail")
+	}
+	if _, err := VerifyProvenance(env, ProvenancePolicy{Keys: Keys{"ci": &other.PublicKey}}, "sha256:"+digest); err == nil {
+		t.Error("expected an untrusted key to fail")
+	}
+	policy.TrustedBuilders = []string{"https://builder.example.com/*"}
+	if _, err := VerifyProvenance(env, policy, "sha256:"+digest); err == nil {
+		t.Error("expected an untrusted builder to fail")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// blobCommand downloads a single blob of a repository, like a layer or a
+// config, by its digest
+func blobCommand(args []string) error {
+	output := "-"
+	cmd := flag.NewFlagSet("blob", flag.ExitOnError)
+	cmd.StringVar(&output, []string{"o", "-output"}, output, "output to file (default stdout)")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch blob [OPTIONS] REPOSITORY@DIGEST")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected a repository and the digest of one of its blobs")
+	}
+	img, err := fetch.ParseImageRef(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	if !img.Pinned() {
+		return fmt.Errorf("%s: expected REPOSITORY@DIGEST", cmd.Arg(0))
+	}
+	re, err := newRegistry(img.Host())
+	if err != nil {
+		return err
+	}
+	rc, _, err := re.FetchBlob(img, img.Digest())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if output == "-" {
+		// written as it downloads: a mismatch is only known at the end, as
+		// the error of the command
+		_, err = io.Copy(os.Stdout, rc)
+		return err
+	}
+	// the file is only there once the whole blob has matched its digest
+	fh, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	_, err = io.Copy(fh, rc)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), output)
+}
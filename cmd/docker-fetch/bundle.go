@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/export"
+	"github.com/vbatts/docker-utils/opts"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// loadBundleCommand checks a bundle written with --bundle against its
+// bundle.json, and the signatures of that against the keys given, before
+// loading any of its images into the local docker daemon, containerd, or a
+// registry
+func loadBundleCommand(args []string) error {
+	var (
+		keys       = opts.List{}
+		target     = "docker"
+		registry   = ""
+		namespace  = "default"
+		verifyOnly = false
+		hashLayers = false
+		compress   = "none"
+		workers    = 1
+		pushRate   = opts.ByteSize(0)
+	)
+	cmd := flag.NewFlagSet("load-bundle", flag.ExitOnError)
+	cmd.Var(&keys, []string{"-key"}, "require the bundle.json to be signed by this ed25519 public key (PEM), or this key of the --key-dir; may be given more than once")
+	cmd.StringVar(&target, []string{"-to"}, target, "where to load the images: docker, containerd or registry")
+	cmd.StringVar(&registry, []string{"-registry"}, registry, "the registry to push the images to, like localhost:5000 (with --to registry)")
+	cmd.StringVar(&namespace, []string{"-namespace"}, namespace, "the containerd namespace to import the images into (with --to containerd)")
+	cmd.StringVar(&compress, []string{"-compression"}, compress, "compress the layers pushed with gzip or zstd, at a level like gzip:1 or zstd:3 (with --to registry)")
+	cmd.IntVar(&workers, []string{"-push-workers"}, workers, "number of layers to push at once (with --to registry)")
+	cmd.Var(&pushRate, []string{"-push-rate"}, "limit the uploads to this many bytes per second, like 10M (with --to registry)")
+	cmd.BoolVar(&verifyOnly, []string{"-verify"}, verifyOnly, "only check the bundle, do not load it")
+	cmd.BoolVar(&hashLayers, []string{"-hash-layers"}, hashLayers, "also hash the layers tagged in the repositories file, against the checksums recorded when they were fetched")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch load-bundle [OPTIONS] BUNDLE")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected the bundle archive (or - for stdin)")
+	}
+	switch target {
+	case "docker", "containerd":
+	case "registry":
+		if registry == "" && !verifyOnly {
+			return fmt.Errorf("--to registry needs --registry")
+		}
+	default:
+		return fmt.Errorf("unknown --to %q", target)
+	}
+	compression, err := fetch.ParseCompression(compress)
+	if err != nil {
+		return err
+	}
+	pubKeys := []ed25519.PublicKey{}
+	for _, name := range keys.Args {
+		key, err := loadVerifyingKey(name)
+		if err != nil {
+			return err
+		}
+		pubKeys = append(pubKeys, key)
+	}
+
+	var r io.Reader = os.Stdin
+	if cmd.Arg(0) != "-" {
+		fh, err := os.Open(cmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		r = fh
+	}
+	dir, err := ioutil.TempDir("", "docker-fetch-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := export.UntarDirectory(r, dir); err != nil {
+		return err
+	}
+
+	m, err := fetch.LoadBundleManifest(filepath.Join(dir, fetch.BundleManifestFile))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s has no %s, it was not written with --bundle", cmd.Arg(0), fetch.BundleManifestFile)
+	}
+	if err != nil {
+		return err
+	}
+	if len(pubKeys) > 0 {
+		if err := m.Verify(pubKeys...); err != nil {
+			return err
+		}
+	} else if len(m.Signatures) > 0 {
+		return fmt.Errorf("%s is signed, give the --key to check its signatures against", cmd.Arg(0))
+	} else {
+		logrus.Warnf("%s: not signed, checking it against its %s only", cmd.Arg(0), fetch.BundleManifestFile)
+	}
+	if err := m.Check(dir); err != nil {
+		return err
+	}
+	// the layers named by digest are found through the manifest.json only,
+	// their digests checked against the bundle.json already
+	_, err = os.Stat(filepath.Join(dir, fetch.LayerNamesFile))
+	byDigest := err == nil
+	if byDigest && target == "registry" {
+		return fmt.Errorf("%s has its layers named by digest, which cannot be pushed to a registry", cmd.Arg(0))
+	}
+	if !byDigest {
+		if _, err := fetch.LoadRepositories(dir, hashLayers); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s: %d images, %s, made %s by %s: OK\n", cmd.Arg(0), len(m.Images), humanSize(m.Size), m.Created.Format("2006-01-02 15:04:05"), m.Tool)
+	if verifyOnly {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(dir, fetch.BundleManifestFile)); err != nil {
+		return err
+	}
+
+	switch target {
+	case "docker":
+		return pipeTo(exec.Command("docker", "load"), func(w io.Writer) error {
+			return export.TarDirectory(dir, w)
+		})
+	case "containerd":
+		if byDigest {
+			return pipeTo(exec.Command("ctr", "--namespace", namespace, "images", "import", "-"), func(w io.Writer) error {
+				return export.TarDirectory(dir, w)
+			})
+		}
+		for _, image := range m.Images {
+			img := bundleImageRef(image)
+			if err := pipeTo(exec.Command("ctr", "--namespace", namespace, "images", "import", "-"), func(w io.Writer) error {
+				return fetch.WriteDockerSaveTar(img, dir, w)
+			}); err != nil {
+				return fmt.Errorf("%s: %s", image.Ref, err)
+			}
+		}
+	case "registry":
+		// one throttle for all the uploads
+		var throttle *fetch.Throttle
+		if pushRate > 0 {
+			throttle = fetch.NewThrottle(int64(pushRate))
+		}
+		for _, image := range m.Images {
+			img := bundleImageRef(image)
+			dest := fetch.NewImageRef(registry + "/" + img.Name() + ":" + img.Tag())
+			re, err := newRegistry(dest.Host())
+			if err != nil {
+				return err
+			}
+			re.PushCompression = compression
+			re.PushParallelism = workers
+			re.PushThrottle = throttle
+			desc, err := re.PushImage(img, dir, dest)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "pushed %s as %s@%s\n", image.Ref, dest, desc.Digest)
+		}
+	}
+	return nil
+}
+
+// bundleImageRef is the reference to an image of a bundle, with its layers
+func bundleImageRef(image fetch.BundleImage) *fetch.ImageRef {
+	img := fetch.NewImageRef(image.Ref)
+	img.SetID(image.ID)
+	ids := []string{}
+	for _, layer := range image.Layers {
+		ids = append(ids, layer.ID)
+	}
+	img.SetAncestry(ids)
+	return img
+}
+
+// pipeTo runs cmd with what write writes as its input
+func pipeTo(cmd *exec.Cmd, write func(w io.Writer) error) error {
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = write(stdin)
+	if closeErr := stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if waitErr := cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("%s: %s", cmd.Path, waitErr)
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// completeCommand prints the image references starting with its argument,
+// one per line, for shell completion. Failures are only logged, so that
+// nothing but candidates ends up on the command line.
+func completeCommand(args []string) error {
+	partial := ""
+	if len(args) > 0 {
+		partial = args[0]
+	}
+	dir := filepath.Join(os.Getenv("HOME"), ".cache", "docker-fetch", "completion")
+	if cache := os.Getenv("XDG_CACHE_HOME"); cache != "" {
+		dir = filepath.Join(cache, "docker-fetch", "completion")
+	}
+	completer := fetch.NewCompleter(dir)
+	if creds, err := keychain(); err == nil {
+		completer.Credentials = creds
+	}
+	matches, err := completer.Complete(partial)
+	if err != nil {
+		logrus.Debugf("completing %q: %s", partial, err)
+	}
+	for _, m := range matches {
+		fmt.Println(m)
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/auth"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// job states, as reported by the daemon's API
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// job is a single fetch submitted to the daemon
+type job struct {
+	ID           string    `json:"id"`
+	Ref          string    `json:"ref"`
+	MetadataOnly bool      `json:"metadata_only,omitempty"`
+	Priority     int       `json:"priority"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	LayersTotal  int       `json:"layers_total"`
+	Protocol     string    `json:"protocol,omitempty"`
+	Layers       []string  `json:"layers,omitempty"`
+	Submitted    time.Time `json:"submitted"`
+	Started      time.Time `json:"started,omitempty"`
+	Finished     time.Time `json:"finished,omitempty"`
+
+	// Progress is how far the download of each layer has got, by layer ID
+	Progress map[string]layerProgress `json:"progress,omitempty"`
+
+	// creds, when set, are the registry credentials the job was submitted
+	// with, used instead of the daemon's own
+	creds *auth.Credentials
+}
+
+// layerProgress is the bytes of a layer downloaded so far, of Total, which is
+// -1 when the registry does not say
+type layerProgress struct {
+	Written int64 `json:"written"`
+	Total   int64 `json:"total"`
+}
+
+// snapshot is a copy of j for the API, sharing nothing with it
+func (j *job) snapshot() job {
+	cp := *j
+	if j.Progress != nil {
+		cp.Progress = make(map[string]layerProgress, len(j.Progress))
+		for id, p := range j.Progress {
+			cp.Progress[id] = p
+		}
+	}
+	return cp
+}
+
+// cachedLayer is an entry of the daemon's layer cache
+type cachedLayer struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+	// Metadata is set when only the json of the layer has been fetched
+	Metadata bool `json:"metadata_only,omitempty"`
+}
+
+// daemon fetches the images submitted over its HTTP API into a single cache
+// directory, as its scheduler allows. RegistryEndpoints (and so their
+// tokens) are reused across jobs, and each host shares one CircuitBreaker.
+type daemon struct {
+	cache       string
+	incremental string
+	scanCmd     string
+	layers      *fetch.LayerCache
+	scheduler   *scheduler
+
+	mu         sync.Mutex
+	jobs       map[string]*job
+	order      []string
+	registries map[string][]*fetch.RegistryEndpoint
+	breakers   map[string]*fetch.CircuitBreaker
+}
+
+// daemonCommand serves the HTTP API:
+//
+//	POST /jobs       {"ref": "busybox", "metadata_only": false, "priority": 0,
+//	                  "credentials": {"username": "joe", "password": "..."}}
+//	                 submits a fetch; higher priorities are started first, and
+//	                 the credentials, if any, are used instead of the daemon's
+//	GET  /jobs       lists the jobs
+//	GET  /jobs/<id>  reports the state of a job, and the progress of each of
+//	                 its layers
+//	GET  /cache      lists the layers in the cache
+func daemonCommand(args []string) error {
+	var (
+		listen      = "127.0.0.1:5050"
+		cache       = ""
+		workers     = 4
+		perRegistry = 2
+		rate        = 0.0
+		incremental = ""
+	)
+	cmd := flag.NewFlagSet("daemon", flag.ExitOnError)
+	cmd.StringVar(&listen, []string{"l", "-listen"}, listen, "address to serve the API on")
+	cmd.StringVar(&cache, []string{"-cache"}, cache, "directory to fetch layers into (default a temporary directory)")
+	cmd.StringVar(&incremental, []string{"-incremental"}, incremental, "skip the layers already in the cache that are complete, as checked by exists, size (and modification time, as recorded when fetched) or checksum")
+	cmd.IntVar(&workers, []string{"-workers"}, workers, fmt.Sprintf("number of jobs to run at once, not counting jobs of priority %d or more", urgentPriority))
+	cmd.IntVar(&perRegistry, []string{"-max-per-registry"}, perRegistry, fmt.Sprintf("number of jobs to run at once against a registry, not counting jobs of priority %d or more", urgentPriority))
+	cmd.Float64Var(&rate, []string{"-registry-rate"}, rate, "maximum jobs started per second against a registry (0 for no limit)")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch daemon [OPTIONS]")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if workers < 1 || perRegistry < 1 || rate < 0 {
+		return fmt.Errorf("--workers and --max-per-registry must be at least 1, and --registry-rate not negative")
+	}
+	incremental, err := fetch.ParseIncremental(incremental)
+	if err != nil {
+		return err
+	}
+
+	if cache == "" {
+		if cache, err = ioutil.TempDir("", "docker-fetch-"); err != nil {
+			return err
+		}
+	} else if err = os.MkdirAll(cache, 0755); err != nil {
+		return err
+	}
+
+	d := &daemon{
+		cache:       cache,
+		incremental: incremental,
+		scanCmd:     scanCommand,
+		jobs:        map[string]*job{},
+		registries:  map[string][]*fetch.RegistryEndpoint{},
+		breakers:    map[string]*fetch.CircuitBreaker{},
+	}
+	// the registries are made by newRegistry as the jobs need them: the
+	// flags it reads are checked now rather than by each job
+	if _, err = keychain(); err != nil {
+		return err
+	}
+	if _, err = parseRegistryURLs(); err != nil {
+		return err
+	}
+	if _, err = loadVetting(); err != nil {
+		return err
+	}
+	if d.layers, err = openLayerCache(); err != nil {
+		return err
+	}
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	d.scheduler = newScheduler(workers, perRegistry, interval, d.runJob)
+
+	logrus.Infof("serving on %s, caching in %s", listen, cache)
+	return http.ListenAndServe(listen, d.handler())
+}
+
+func (d *daemon) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", d.handleJobs)
+	mux.HandleFunc("/jobs/", d.handleJob)
+	mux.HandleFunc("/cache", d.handleCache)
+	return mux
+}
+
+func (d *daemon) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		d.mu.Lock()
+		jobs := make([]job, len(d.order))
+		for i, id := range d.order {
+			jobs[i] = d.jobs[id].snapshot()
+		}
+		d.mu.Unlock()
+		writeJSON(w, http.StatusOK, jobs)
+	case "POST":
+		var req struct {
+			Ref          string `json:"ref"`
+			MetadataOnly bool   `json:"metadata_only"`
+			Priority     int    `json:"priority"`
+			// like {"username": "joe", "password": "hunter2"}
+			Credentials *auth.Credentials `json:"credentials"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Ref) == "" {
+			http.Error(w, "no image reference provided", http.StatusBadRequest)
+			return
+		}
+		if _, err := fetch.ParseImageRef(req.Ref); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		j, err := d.submit(req.Ref, req.MetadataOnly, req.Priority, req.Credentials)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, j)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (d *daemon) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	d.mu.Lock()
+	j, ok := d.jobs[id]
+	var cp job
+	if ok {
+		cp = j.snapshot()
+	}
+	d.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, cp)
+}
+
+func (d *daemon) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	infos, err := ioutil.ReadDir(d.cache)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	layers := []cachedLayer{}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d.cache, info.Name(), "json")); err != nil {
+			continue
+		}
+		layer := cachedLayer{ID: info.Name()}
+		if fi, err := os.Stat(filepath.Join(d.cache, info.Name(), "layer.tar")); err == nil {
+			layer.Size = fi.Size()
+		} else {
+			layer.Metadata = true
+		}
+		layers = append(layers, layer)
+	}
+	writeJSON(w, http.StatusOK, layers)
+}
+
+// submit queues a fetch of ref, with creds if given, failing if the queue is
+// full
+func (d *daemon) submit(ref string, metadataOnly bool, priority int, creds *auth.Credentials) (job, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	j := &job{
+		ID:           strconv.Itoa(len(d.order) + 1),
+		Ref:          fetch.NewImageRef(ref).String(),
+		MetadataOnly: metadataOnly,
+		Priority:     priority,
+		State:        jobQueued,
+		Submitted:    time.Now(),
+		creds:        creds,
+	}
+	if err := d.scheduler.add(j); err != nil {
+		return job{}, err
+	}
+	d.jobs[j.ID] = j
+	d.order = append(d.order, j.ID)
+	return j.snapshot(), nil
+}
+
+// runJob runs j, recording its progress and outcome
+func (d *daemon) runJob(j *job) {
+	d.update(j, func(j *job) {
+		j.State = jobRunning
+		j.Started = time.Now()
+	})
+	layers, err := d.fetch(j)
+	d.update(j, func(j *job) {
+		j.Finished = time.Now()
+		if err != nil {
+			j.State = jobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.State = jobDone
+		j.Layers = layers
+	})
+	if err != nil {
+		logrus.Errorf("job %s: failed pulling %s: %s", j.ID, j.Ref, err)
+	}
+}
+
+// fetch fetches the image of j, with the credentials it was submitted with
+// if any. The RegistryEndpoints are shared by the jobs of every tenant, and
+// keep the tokens of each apart.
+func (d *daemon) fetch(j *job) ([]string, error) {
+	ref := fetch.NewImageRef(j.Ref)
+	re, err := d.registry(ref.Host())
+	if err != nil {
+		return nil, err
+	}
+	// the endpoint is this job's until released, and so is its Progress
+	re.Progress = d.progress(j)
+	defer func() {
+		re.Progress = nil
+		d.release(ref.Host(), re)
+	}()
+	ctx := context.Background()
+	if j.creds != nil {
+		ctx = fetch.WithCredentials(ctx, *j.creds)
+	}
+	ancestry, err := re.AncestryContext(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	d.update(j, func(j *job) {
+		j.LayersTotal = len(ancestry)
+		j.Protocol = re.Proto()
+	})
+	if j.MetadataOnly {
+		return re.FetchMetadataContext(ctx, ref, d.cache)
+	}
+	return re.FetchLayersContext(ctx, ref, d.cache)
+}
+
+// registry returns an idle RegistryEndpoint for host, for the use of a
+// single job until it is given back with release
+func (d *daemon) registry(host string) (*fetch.RegistryEndpoint, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if idle := d.registries[host]; len(idle) > 0 {
+		d.registries[host] = idle[:len(idle)-1]
+		return idle[len(idle)-1], nil
+	}
+	if d.breakers[host] == nil {
+		d.breakers[host] = fetch.NewCircuitBreaker(host, fetch.DefaultBreakerThreshold, fetch.DefaultBreakerWindow, fetch.DefaultBreakerCooldown)
+	}
+	re, err := newRegistry(host)
+	if err != nil {
+		return nil, err
+	}
+	re.Breaker = d.breakers[host]
+	re.Cache = d.layers
+	re.Incremental = d.incremental
+	if d.scanCmd != "" {
+		re.Scanner = fetch.NewExecScanner(d.scanCmd)
+	}
+	return re, nil
+}
+
+func (d *daemon) release(host string, re *fetch.RegistryEndpoint) {
+	d.mu.Lock()
+	d.registries[host] = append(d.registries[host], re)
+	d.mu.Unlock()
+}
+
+// progress records the progress of the layers of j
+func (d *daemon) progress(j *job) fetch.ProgressFunc {
+	return func(id string, written, total int64) {
+		d.update(j, func(j *job) {
+			if j.Progress == nil {
+				j.Progress = map[string]layerProgress{}
+			}
+			j.Progress[id] = layerProgress{Written: written, Total: total}
+		})
+	}
+}
+
+func (d *daemon) update(j *job, fn func(j *job)) {
+	d.mu.Lock()
+	fn(j)
+	d.mu.Unlock()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Debugf("writing response: %s", err)
+	}
+}
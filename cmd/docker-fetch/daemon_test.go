@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestDaemon is a daemon caching in a temporary directory, whose jobs are
+// queued but never run
+func newTestDaemon(t *testing.T) (*daemon, *httptest.Server) {
+	release := make(chan struct{})
+	d := &daemon{
+		cache:     t.TempDir(),
+		jobs:      map[string]*job{},
+		scheduler: newScheduler(1, 1, 0, func(j *job) { <-release }),
+	}
+	srv := httptest.NewServer(d.handler())
+	t.Cleanup(func() {
+		srv.Close()
+		close(release)
+	})
+	return d, srv
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestDaemonSubmit(t *testing.T) {
+	_, srv := newTestDaemon(t)
+
+	for _, body := range []string{`{`, `{"ref": " "}`, `{"ref": "Not A Ref"}`} {
+		resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", body, http.StatusBadRequest, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/jobs", "application/json", strings.NewReader(`{"ref": "busybox", "priority": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j job
+	err = json.NewDecoder(resp.Body).Decode(&j)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || j.ID != "1" || j.Priority != 3 || j.State != jobQueued {
+		t.Errorf("expected job 1 to be queued, got %d %#v", resp.StatusCode, j)
+	}
+
+	var jobs []job
+	if status := getJSON(t, srv.URL+"/jobs", &jobs); status != http.StatusOK || len(jobs) != 1 || jobs[0].ID != "1" {
+		t.Errorf("expected the job to be listed, got %d %#v", status, jobs)
+	}
+	if status := getJSON(t, srv.URL+"/jobs/1", &j); status != http.StatusOK || j.Ref != "docker.io/library/busybox:latest" {
+		t.Errorf("expected the job, got %d %#v", status, j)
+	}
+	if status := getJSON(t, srv.URL+"/jobs/2", nil); status != http.StatusNotFound {
+		t.Errorf("expected an unknown job to be not found, got %d", status)
+	}
+
+	req, _ := http.NewRequest("DELETE", srv.URL+"/jobs/1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected DELETE to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestDaemonJobProgress(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	submitted, err := d.submit("busybox", false, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := d.progress(d.jobs[submitted.ID])
+	progress("aaaa", 10, 100)
+	progress("bbbb", 5, -1)
+	progress("aaaa", 100, 100)
+
+	var j job
+	if status := getJSON(t, srv.URL+"/jobs/"+submitted.ID, &j); status != http.StatusOK {
+		t.Fatalf("expected the job, got %d", status)
+	}
+	if len(j.Progress) != 2 || j.Progress["aaaa"] != (layerProgress{100, 100}) || j.Progress["bbbb"] != (layerProgress{5, -1}) {
+		t.Errorf("expected the progress of both layers, got %#v", j.Progress)
+	}
+}
+
+func TestDaemonCache(t *testing.T) {
+	d, srv := newTestDaemon(t)
+	for id, files := range map[string][]string{
+		"full":    {"json", "layer.tar"},
+		"meta":    {"json"},
+		"partial": {"layer.tar"},
+	} {
+		if err := os.MkdirAll(filepath.Join(d.cache, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			if err := ioutil.WriteFile(filepath.Join(d.cache, id, name), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var layers []cachedLayer
+	if status := getJSON(t, srv.URL+"/cache", &layers); status != http.StatusOK {
+		t.Fatalf("expected the cache, got %d", status)
+	}
+	expected := []cachedLayer{{ID: "full", Size: 4}, {ID: "meta", Metadata: true}}
+	if len(layers) != len(expected) || layers[0] != expected[0] || layers[1] != expected[1] {
+		t.Errorf("expected %#v, got %#v", expected, layers)
+	}
+}
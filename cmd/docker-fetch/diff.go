@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// diffCommand compares the layers, and optionally the files, of two images
+func diffCommand(args []string) error {
+	var files bool
+	cmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	cmd.BoolVar(&files, []string{"-files"}, false, "also fetch the layers and list the paths added, removed or modified")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch [--platform os/arch] diff [OPTIONS] IMAGE_A IMAGE_B")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return fmt.Errorf("expected the two images to compare")
+	}
+	var err error
+	p := fetch.DefaultPlatform
+	if platform != "" {
+		if p, err = fetch.ParsePlatform(platform); err != nil {
+			return err
+		}
+	}
+
+	imgs := make([]*fetch.ImageRef, 2)
+	dirs := make([]string, 2)
+	for i, arg := range cmd.Args() {
+		img, err := fetch.ParseImageRef(arg)
+		if err != nil {
+			return err
+		}
+		img.SetPlatform(p)
+		re, err := newRegistry(img.Host())
+		if err != nil {
+			return err
+		}
+		if files {
+			if dirs[i], err = ioutil.TempDir("", "docker-fetch-diff."); err != nil {
+				return err
+			}
+			defer os.RemoveAll(dirs[i])
+			_, err = re.FetchLayers(img, dirs[i])
+		} else {
+			_, err = re.Ancestry(img)
+		}
+		if err != nil {
+			return err
+		}
+		imgs[i] = img
+	}
+
+	d := fetch.Diff(imgs[0], imgs[1])
+	if files {
+		if err := d.DiffFiles(imgs[0], dirs[0], imgs[1], dirs[1]); err != nil {
+			return err
+		}
+	}
+	buf, err := json.MarshalIndent(d, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(buf))
+	return err
+}
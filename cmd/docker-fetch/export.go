@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/vbatts/docker-utils/export"
+	"github.com/vbatts/docker-utils/registry/fetch"
+	"github.com/vbatts/docker-utils/version"
+)
+
+// exporters build a filesystem image file from a rootfs directory, keyed by
+// the --format name
+var exporters = map[string]func(root, out string) error{
+	"squashfs": export.SquashFS,
+	"erofs":    export.Erofs,
+	"cpio":     export.CPIO,
+}
+
+// exportRootFS flattens the fetched layers of ref in fetchRoot, builds the
+// filesystem image with exporter and copies it to output
+func exportRootFS(exporter func(root, out string) error, ref *fetch.ImageRef, fetchRoot string, output io.Writer) error {
+	root := filepath.Join(fetchRoot, "rootfs")
+	if err := export.ExtractLayers(fetchRoot, ref.Ancestry(), root); err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	image := filepath.Join(fetchRoot, "image")
+	if err := exporter(root, image); err != nil {
+		return err
+	}
+	defer os.Remove(image)
+
+	fh, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(output, fh)
+	return err
+}
+
+// exportOCI writes the fetched refs in fetchRoot as a tar of an OCI image
+// layout
+func exportOCI(refs []*fetch.ImageRef, fetchRoot string, output io.Writer) error {
+	layout := filepath.Join(fetchRoot, "oci")
+	defer os.RemoveAll(layout)
+	for _, ref := range refs {
+		if _, err := fetch.WriteOCILayout(ref, fetchRoot, layout); err != nil {
+			return err
+		}
+	}
+	return export.TarDirectory(layout, output)
+}
+
+// writeBundleManifest adds the bundle.json listing the fetched refs to
+// fetchRoot, signed with the --bundle-key if one is given
+func writeBundleManifest(refs []*fetch.ImageRef, fetchRoot string) error {
+	m, err := fetch.NewBundleManifest(fetchRoot, "docker-fetch "+version.VERSION, refs...)
+	if err != nil {
+		return err
+	}
+	if bundleKey != "" {
+		key, err := loadBundleKey(bundleKey)
+		if err != nil {
+			return err
+		}
+		if err := m.Sign(key); err != nil {
+			return err
+		}
+	}
+	return m.Write(fetchRoot)
+}
+
+// squashRefs squashes the layers of each of the fetched refs in fetchRoot as
+// --squash or --squash-above ask, then removes the layers no ref has any
+// more
+func squashRefs(refs []*fetch.ImageRef, fetchRoot string) error {
+	squashed := map[string]bool{}
+	for _, ref := range refs {
+		ancestry := ref.Ancestry()
+		var err error
+		if squashAbove != "" {
+			_, err = fetch.SquashAbove(ref, fetchRoot, squashAbove)
+		} else {
+			// images with fewer layers are squashed whole
+			n := squashLayers
+			if n > len(ancestry) {
+				n = len(ancestry)
+			}
+			_, err = fetch.Squash(ref, fetchRoot, n)
+		}
+		if err != nil {
+			return err
+		}
+		for _, id := range ancestry {
+			squashed[id] = true
+		}
+	}
+	for _, ref := range refs {
+		for _, id := range ref.Ancestry() {
+			delete(squashed, id)
+		}
+	}
+	for id := range squashed {
+		if err := os.RemoveAll(filepath.Join(fetchRoot, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// fsckCommand checks every entry of a layer cache, or of a directory images
+// were fetched into, against its digest
+func fsckCommand(args []string) error {
+	cmd := flag.NewFlagSet("fsck", flag.ExitOnError)
+	quarantine := cmd.String([]string{"-quarantine"}, "", "move the entries at fault into this directory")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch fsck [--quarantine DIR] [DIR]")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	dir := layerCacheDir
+	if cmd.NArg() > 0 {
+		dir = cmd.Arg(0)
+	}
+	if dir == "" || cmd.NArg() > 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected the directory of a layer cache, or of images fetched")
+	}
+	report, err := fetch.Fsck(dir, *quarantine)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		if p.Quarantined {
+			fmt.Printf("%s (quarantined)\n", p)
+		} else {
+			fmt.Println(p)
+		}
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%s: %d problems in %d entries", dir, len(report.Problems), report.Checked)
+	}
+	fmt.Printf("%s: %d entries OK\n", dir, report.Checked)
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// openLayerIndex is the sqlite LayerIndex in --index, if given
+func openLayerIndex() (*fetch.LayerIndex, error) {
+	if indexFile == "" {
+		return nil, nil
+	}
+	return fetch.OpenLayerIndex("sqlite3", indexFile)
+}
+
+// findCommand lists the files of the images indexed with --index whose path
+// is like a pattern, or whose content has a digest
+func findCommand(args []string) error {
+	var dbFile = ""
+	cmd := flag.NewFlagSet("find", flag.ExitOnError)
+	cmd.StringVar(&dbFile, []string{"-index"}, dbFile, "the index written by docker-fetch --index")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch find --index FILE PATTERN")
+		fmt.Fprintln(os.Stderr, "PATTERN is a path, with % matching anything (like '%/libssl.so.1.0.2%'), or a sha256: digest of the content")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 || dbFile == "" {
+		cmd.Usage()
+		return fmt.Errorf("expected --index and a pattern")
+	}
+	if _, err := os.Stat(dbFile); err != nil {
+		return err
+	}
+	index, err := fetch.OpenLayerIndex("sqlite3", dbFile)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	matches, err := index.Search(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tPATH\tSIZE\tDIGEST")
+	for _, m := range matches {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", m.Ref, m.Path, humanSize(m.Size), m.Digest)
+	}
+	return tw.Flush()
+}
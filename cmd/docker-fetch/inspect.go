@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// inspectCommand prints what the registry has about each image given, as a
+// JSON array like `docker inspect`, without fetching their layers, with their
+// provenance verified by --provenance-key
+func inspectCommand(args []string) error {
+	cmd := flag.NewFlagSet("inspect", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch [--platform os/arch] inspect IMAGE...")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() == 0 {
+		cmd.Usage()
+		return fmt.Errorf("expected an image to inspect")
+	}
+	var err error
+	p := fetch.DefaultPlatform
+	if platform != "" {
+		if p, err = fetch.ParsePlatform(platform); err != nil {
+			return err
+		}
+	}
+	inspects := []*fetch.ImageInspect{}
+	for _, arg := range cmd.Args() {
+		img, err := fetch.ParseImageRef(arg)
+		if err != nil {
+			return err
+		}
+		img.SetPlatform(p)
+		re, err := newRegistry(img.Host())
+		if err != nil {
+			return err
+		}
+		inspect, err := re.Inspect(img)
+		if err != nil {
+			return err
+		}
+		inspects = append(inspects, inspect)
+	}
+	buf, err := json.MarshalIndent(inspects, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(os.Stdout, string(buf))
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/export"
+)
+
+// joinCommand reassembles an archive written with --split-size, verifying
+// the checksums of each part
+func joinCommand(args []string) error {
+	var (
+		output     = "-"
+		verifyOnly = false
+	)
+	cmd := flag.NewFlagSet("join", flag.ExitOnError)
+	cmd.StringVar(&output, []string{"o", "-output"}, output, "output to file (default stdout)")
+	cmd.BoolVar(&verifyOnly, []string{"-verify"}, verifyOnly, "only verify the parts, do not write the archive")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch join [OPTIONS] MANIFEST")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected the manifest of the parts (like %s)", export.ManifestName("image.tar"))
+	}
+
+	var w io.WriteCloser
+	switch {
+	case verifyOnly:
+		w = nopCloser{ioutil.Discard}
+	case output == "-":
+		w = os.Stdout
+	default:
+		fh, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		w = fh
+	}
+	if err := export.JoinParts(cmd.Arg(0), w); err != nil {
+		w.Close()
+		if output != "-" && !verifyOnly {
+			os.Remove(output)
+		}
+		return err
+	}
+	if verifyOnly {
+		fmt.Fprintf(os.Stderr, "%s: OK\n", cmd.Arg(0))
+	}
+	return w.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
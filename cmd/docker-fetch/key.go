@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// passphraseEnv is where the passphrase of the signing keys is taken from,
+// when no --passphrase-file is given
+const passphraseEnv = "DOCKER_FETCH_KEY_PASSPHRASE"
+
+// keyCommand manages the signing keys kept in the --key-dir
+func keyCommand(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch [--key-dir DIR] key generate [OPTIONS] NAME")
+		fmt.Fprintln(os.Stderr, "       docker-fetch [--key-dir DIR] key list")
+		fmt.Fprintln(os.Stderr, "       docker-fetch [--key-dir DIR] key export [--private] NAME")
+	}
+	if len(args) == 0 {
+		usage()
+		return fmt.Errorf("expected generate, list or export")
+	}
+	ks := fetch.KeyStore{Dir: keyDir}
+	switch args[0] {
+	case "generate":
+		var (
+			noPassphrase   bool
+			passphraseFile string
+		)
+		cmd := flag.NewFlagSet("key generate", flag.ExitOnError)
+		cmd.BoolVar(&noPassphrase, []string{"-no-passphrase"}, false, "store the key unencrypted")
+		cmd.StringVar(&passphraseFile, []string{"-passphrase-file"}, "", "encrypt the key with the passphrase in this file (default $"+passphraseEnv+")")
+		cmd.Usage = func() {
+			usage()
+			cmd.PrintDefaults()
+		}
+		if err := cmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if cmd.NArg() != 1 {
+			cmd.Usage()
+			return fmt.Errorf("expected the name of the key")
+		}
+		var passphrase []byte
+		if !noPassphrase {
+			var err error
+			if passphrase, err = readPassphrase(passphraseFile); err != nil {
+				return err
+			}
+			if len(passphrase) == 0 {
+				return fmt.Errorf("no passphrase given, with --passphrase-file or $%s (or --no-passphrase)", passphraseEnv)
+			}
+		}
+		info, err := ks.Generate(cmd.Arg(0), passphrase)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "generated %s (%s) in %s\n", info.Name, info.KeyID, ks.Dir)
+		return nil
+	case "list":
+		keys, err := ks.List()
+		if err != nil {
+			return err
+		}
+		buf, err := json.MarshalIndent(keys, "", "    ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(os.Stdout, string(buf))
+		return err
+	case "export":
+		var private bool
+		cmd := flag.NewFlagSet("key export", flag.ExitOnError)
+		cmd.BoolVar(&private, []string{"-private"}, false, "export the private key, as stored (encrypted if it is), rather than the public key")
+		cmd.Usage = func() {
+			usage()
+			cmd.PrintDefaults()
+		}
+		if err := cmd.Parse(args[1:]); err != nil {
+			return err
+		}
+		if cmd.NArg() != 1 {
+			cmd.Usage()
+			return fmt.Errorf("expected the name of the key")
+		}
+		export := ks.PublicKey
+		if private {
+			export = ks.PrivateKey
+		}
+		buf, err := export(cmd.Arg(0))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(buf)
+		return err
+	}
+	usage()
+	return fmt.Errorf("unknown key command %q", args[0])
+}
+
+// readPassphrase reads the passphrase of the signing keys from filename, or
+// from the environment without one
+func readPassphrase(filename string) ([]byte, error) {
+	if filename == "" {
+		return []byte(os.Getenv(passphraseEnv)), nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(buf), "\r\n")), nil
+}
+
+// loadVerifyingKey is a --key of load-bundle: a PEM file, or else a key of
+// the --key-dir
+func loadVerifyingKey(name string) (ed25519.PublicKey, error) {
+	if _, err := os.Stat(name); err == nil || strings.ContainsRune(name, os.PathSeparator) {
+		return fetch.LoadVerifyingKey(name)
+	}
+	return fetch.KeyStore{Dir: keyDir}.VerifyingKey(name)
+}
+
+// loadBundleKey is the --bundle-key: a PEM file, or else a key of the
+// --key-dir, decrypted with the passphrase of the environment if it is
+// encrypted
+func loadBundleKey(name string) (ed25519.PrivateKey, error) {
+	passphrase, err := readPassphrase("")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(name); err == nil || strings.ContainsRune(name, os.PathSeparator) {
+		return fetch.LoadEncryptedSigningKey(name, passphrase)
+	}
+	return fetch.KeyStore{Dir: keyDir}.SigningKey(name, passphrase)
+}
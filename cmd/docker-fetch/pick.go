@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/docker/docker/pkg/term"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// pickParallelism is how many tags have their metadata fetched at once
+const pickParallelism = 8
+
+// tagRow is a tag offered to pick, with the size and platform of its image
+type tagRow struct {
+	Tag      string
+	Size     string
+	Platform string
+}
+
+// pickTags lists the tags of the repository of each reference in set, with
+// their size and platform, and asks which of them to fetch instead: in a
+// checklist on the terminal, or with a numbered prompt when there is none
+func pickTags(set fetch.ImageRefSet) (fetch.ImageRefSet, error) {
+	var tty *os.File
+	if fh, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer fh.Close()
+		if term.IsTerminal(fh.Fd()) {
+			tty = fh
+		}
+	}
+	answers := bufio.NewReader(os.Stdin)
+	creds, err := keychain()
+	if err != nil {
+		return nil, err
+	}
+	completer := fetch.NewCompleter("")
+	completer.Credentials = creds
+
+	picked := fetch.ImageRefSet{}
+	for _, batch := range set.Batches() {
+		batch.Registry.Credentials = creds
+		for _, ref := range batch.Refs {
+			repo := ref.Host() + "/" + ref.Name()
+			tags, err := completer.Complete(repo + ":")
+			if err != nil {
+				return nil, fmt.Errorf("listing the tags of %s: %s", repo, err)
+			}
+			if len(tags) == 0 {
+				fmt.Fprintf(os.Stderr, "%s has no tags that can be listed\n", repo)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Looking up the %d tags of %s...\n", len(tags), repo)
+			rows := describeTags(batch.Registry, repo, tags)
+
+			var selected []int
+			if tty != nil {
+				selected, err = pickInTerminal(tty, repo, rows)
+			} else {
+				selected, err = pickNumbered(answers, os.Stderr, repo, rows)
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, i := range selected {
+				picked = picked.Add(fetch.NewImageRef(tags[i]))
+			}
+		}
+	}
+	return picked, nil
+}
+
+// describeTags describes the tags of repo, pickParallelism at a time
+func describeTags(re *fetch.RegistryEndpoint, repo string, tags []string) []tagRow {
+	rows := make([]tagRow, len(tags))
+	sem := make(chan struct{}, pickParallelism)
+	var wg sync.WaitGroup
+	for i, tag := range tags {
+		wg.Add(1)
+		go func(i int, tag string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			size, platform := describeTag(re, tag)
+			rows[i] = tagRow{Tag: strings.TrimPrefix(tag, repo+":"), Size: size, Platform: platform}
+		}(i, tag)
+	}
+	wg.Wait()
+	return rows
+}
+
+// pickInTerminal asks which of rows to fetch with a checklist, the terminal
+// tty in raw mode while it is shown
+func pickInTerminal(tty *os.File, repo string, rows []tagRow) ([]int, error) {
+	state, err := term.MakeRaw(tty.Fd())
+	if err != nil {
+		return nil, err
+	}
+	defer term.RestoreTerminal(tty.Fd(), state)
+	return newChecklist(repo, rows).run(bufio.NewReader(tty), tty)
+}
+
+// pickNumbered asks which of rows to fetch with a numbered list, reading the
+// answer from answers
+func pickNumbered(answers *bufio.Reader, w io.Writer, repo string, rows []tagRow) ([]int, error) {
+	fmt.Fprintf(w, "%s:\n", repo)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, row := range rows {
+		fmt.Fprintf(tw, "%4d)\t%s\t%s\t%s\n", i+1, row.Tag, row.Size, row.Platform)
+	}
+	tw.Flush()
+	for {
+		fmt.Fprint(w, "Fetch which (like 1,3-5 or all, empty for none)? ")
+		line, err := answers.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, err
+		}
+		selected, err := parseSelection(line, len(rows))
+		if err != nil {
+			fmt.Fprintln(w, err)
+			continue
+		}
+		return selected, nil
+	}
+}
+
+// checklist keys, as read from a terminal in raw mode
+const (
+	keyUp    = "\x1b[A"
+	keyDown  = "\x1b[B"
+	keyCtrlC = "\x03"
+)
+
+// checklist is the terminal UI of pickTags: the rows, one of them under the
+// cursor, each checked or not
+type checklist struct {
+	repo    string
+	rows    []tagRow
+	cursor  int
+	checked []bool
+}
+
+func newChecklist(repo string, rows []tagRow) *checklist {
+	return &checklist{repo: repo, rows: rows, checked: make([]bool, len(rows))}
+}
+
+// run draws the checklist on w and handles the keys read from r until the
+// selection is accepted with enter, or skipped with q. Ctrl-C is an error.
+func (c *checklist) run(r *bufio.Reader, w io.Writer) ([]int, error) {
+	c.draw(w, false)
+	for {
+		key, err := readKey(r)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case keyUp, "k":
+			if c.cursor > 0 {
+				c.cursor--
+			}
+		case keyDown, "j":
+			if c.cursor < len(c.rows)-1 {
+				c.cursor++
+			}
+		case " ", "x":
+			c.checked[c.cursor] = !c.checked[c.cursor]
+		case "a":
+			all := !c.allChecked()
+			for i := range c.checked {
+				c.checked[i] = all
+			}
+		case "\r", "\n":
+			return c.selected(), nil
+		case "q":
+			return []int{}, nil
+		case keyCtrlC:
+			return nil, fmt.Errorf("interrupted")
+		}
+		c.draw(w, true)
+	}
+}
+
+func (c *checklist) allChecked() bool {
+	for _, checked := range c.checked {
+		if !checked {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checklist) selected() []int {
+	selected := []int{}
+	for i, checked := range c.checked {
+		if checked {
+			selected = append(selected, i)
+		}
+	}
+	return selected
+}
+
+// draw writes the checklist, over the one drawn before if redraw. The lines
+// end in "\r\n", as the terminal in raw mode does not return the carriage.
+func (c *checklist) draw(w io.Writer, redraw bool) {
+	buf := bytes.NewBuffer(nil)
+	if redraw {
+		fmt.Fprintf(buf, "\x1b[%dA", len(c.rows)+1)
+	}
+	fmt.Fprintf(buf, "\x1b[2K%s (up/down to move, space to check, a for all, enter to fetch, q to skip):\r\n", c.repo)
+	lines := bytes.NewBuffer(nil)
+	tw := tabwriter.NewWriter(lines, 0, 8, 2, ' ', 0)
+	for i, row := range c.rows {
+		cursor, box := " ", "[ ]"
+		if i == c.cursor {
+			cursor = ">"
+		}
+		if c.checked[i] {
+			box = "[x]"
+		}
+		fmt.Fprintf(tw, "%s %s %s\t%s\t%s\n", cursor, box, row.Tag, row.Size, row.Platform)
+	}
+	tw.Flush()
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(lines.String(), "\n"), "\n") {
+		fmt.Fprintf(buf, "\x1b[2K%s\r\n", strings.TrimSuffix(line, "\n"))
+	}
+	w.Write(buf.Bytes())
+}
+
+// readKey reads a key press from r: a single byte, or the escape sequence of
+// an arrow key
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b != 0x1b {
+		return string(b), nil
+	}
+	seq := []byte{b}
+	for len(seq) < 3 {
+		if r.Buffered() == 0 {
+			// a lone escape
+			break
+		}
+		next, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		seq = append(seq, next)
+	}
+	return string(seq), nil
+}
+
+// describeTag returns the total layer size and the platform of the image
+// tagged, from its metadata, or "?" for what could not be found out
+func describeTag(re *fetch.RegistryEndpoint, tag string) (string, string) {
+	size, platform := "?", "?"
+	tmp, err := ioutil.TempDir("", "docker-fetch-pick-")
+	if err != nil {
+		return size, platform
+	}
+	defer os.RemoveAll(tmp)
+
+	ref := fetch.NewImageRef(tag)
+	if _, err := re.FetchMetadata(ref, tmp); err != nil {
+		return size, err.Error()
+	}
+	if facts, err := fetch.LoadImageFacts(tmp, ref.Ancestry()); err == nil {
+		size = humanSize(facts.Size)
+	}
+	var config struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(tmp, ref.ID(), "json")); err == nil && json.Unmarshal(buf, &config) == nil && config.OS != "" {
+		platform = config.OS + "/" + config.Architecture
+	}
+	return size, platform
+}
+
+// parseSelection parses a list of 1-based numbers and ranges, like "1,3-5",
+// or "all", into 0-based indexes of n choices
+func parseSelection(input string, n int) ([]int, error) {
+	input = strings.TrimSpace(input)
+	if input == "all" {
+		all := make([]int, n)
+		for i := range all {
+			all[i] = i
+		}
+		return all, nil
+	}
+	selected := []int{}
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' }) {
+		from, to := field, field
+		if i := strings.Index(field, "-"); i > 0 {
+			from, to = field[:i], field[i+1:]
+		}
+		first, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number or range", field)
+		}
+		last, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number or range", field)
+		}
+		if first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("%q is not within 1-%d", field, n)
+		}
+		for i := first; i <= last; i++ {
+			selected = append(selected, i-1)
+		}
+	}
+	return selected, nil
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f := float64(n)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
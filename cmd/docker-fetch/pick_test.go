@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testRows = []tagRow{
+	{Tag: "22", Size: "72.3 MB", Platform: "linux/amd64"},
+	{Tag: "23", Size: "80.1 MB", Platform: "linux/amd64"},
+	{Tag: "latest", Size: "80.1 MB", Platform: "linux/arm64"},
+}
+
+func TestParseSelection(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Expected string
+	}{
+		{"", "[]"},
+		{"2\n", "[1]"},
+		{"1,3", "[0 2]"},
+		{"1-3", "[0 1 2]"},
+		{"all", "[0 1 2]"},
+		{"0", "error"},
+		{"2-4", "error"},
+		{"3-1", "error"},
+		{"x", "error"},
+	}
+	for _, c := range cases {
+		selected, err := parseSelection(c.Input, 3)
+		got := fmt.Sprint(selected)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.Expected {
+			t.Errorf("%q: expected %s, got %s (%v)", c.Input, c.Expected, got, err)
+		}
+	}
+}
+
+func TestPickNumbered(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	selected, err := pickNumbered(bufio.NewReader(strings.NewReader("9\n1,3\n")), out, "localhost:5000/fedora", testRows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(selected) != "[0 2]" {
+		t.Errorf("expected the answer after the invalid one, got %v", selected)
+	}
+	if !strings.Contains(out.String(), "   3)  latest  80.1 MB  linux/arm64") || !strings.Contains(out.String(), "not within 1-3") {
+		t.Errorf("expected the tags and the error, got %q", out.String())
+	}
+}
+
+func TestChecklist(t *testing.T) {
+	cases := []struct {
+		Keys     string
+		Expected string
+	}{
+		{"\r", "[]"},
+		{" \r", "[0]"},
+		{keyDown + keyDown + " " + keyUp + " \r", "[1 2]"},
+		{"jjkx\r", "[1]"},
+		// the cursor stays on the rows
+		{keyUp + " " + strings.Repeat(keyDown, 5) + " \n", "[0 2]"},
+		{"a\r", "[0 1 2]"},
+		{" a\r", "[0 1 2]"},
+		{"aa\r", "[]"},
+		{"aq", "[]"},
+		{keyCtrlC, "error"},
+		{" ", "error"},
+	}
+	for _, c := range cases {
+		out := bytes.NewBuffer(nil)
+		selected, err := newChecklist("localhost:5000/fedora", testRows).run(bufio.NewReader(strings.NewReader(c.Keys)), out)
+		got := fmt.Sprint(selected)
+		if err != nil {
+			got = "error"
+		}
+		if got != c.Expected {
+			t.Errorf("%q: expected %s, got %s (%v)", c.Keys, c.Expected, got, err)
+		}
+	}
+
+	out := bytes.NewBuffer(nil)
+	if _, err := newChecklist("localhost:5000/fedora", testRows).run(bufio.NewReader(strings.NewReader(keyDown+" \r")), out); err != nil {
+		t.Fatal(err)
+	}
+	screens := strings.Split(out.String(), "\x1b[4A")
+	if len(screens) != 3 {
+		t.Fatalf("expected the checklist to be drawn 3 times, got %q", out.String())
+	}
+	if last := screens[2]; !strings.Contains(last, "> [x] 23      80.1 MB  linux/amd64\r\n") || !strings.Contains(last, "  [ ] latest  80.1 MB  linux/arm64\r\n") {
+		t.Errorf("expected the second row checked under the cursor, got %q", last)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(keyUp + "a" + keyDown + "\x1b"))
+	for _, expected := range []string{keyUp, "a", keyDown, "\x1b"} {
+		key, err := readKey(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != expected {
+			t.Errorf("expected %q, got %q", expected, key)
+		}
+	}
+}
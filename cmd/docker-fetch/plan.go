@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// printPlan prints what fetching the images of batches into dest would
+// download, and take from the layer cache instead, without fetching them.
+// The images unchanged since the last run of --sync-state have nothing to
+// fetch.
+func printPlan(ctx context.Context, batches []fetch.HostBatch, dest string, syncState *fetch.SyncState) error {
+	planner := fetch.NewFetchPlanner(dest)
+	var download, cached int64
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IMAGE\tLAYERS\tDOWNLOAD\tFROM CACHE")
+	for _, batch := range batches {
+		for _, ref := range batch.Refs {
+			if syncState != nil {
+				digest, err := batch.Registry.ResolveContext(ctx, ref)
+				if err != nil {
+					return err
+				}
+				if syncState.Unchanged(ref, digest) {
+					fmt.Fprintf(tw, "%s\tunchanged\t%s\t%s\n", ref, humanSize(0), humanSize(0))
+					continue
+				}
+			}
+			plan, err := planner.PlanContext(ctx, batch.Registry, ref)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", ref, len(plan.Layers), humanSize(plan.Download), humanSize(plan.Cached))
+			download += plan.Download
+			cached += plan.Cached
+		}
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t%s\t%s\n", humanSize(download), humanSize(cached))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if cached > 0 {
+		fmt.Fprintf(os.Stderr, "The layer cache saves %s of %s (%.0f%%)\n", humanSize(cached), humanSize(download+cached), 100*float64(cached)/float64(download+cached))
+	}
+	return nil
+}
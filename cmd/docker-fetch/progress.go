@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often the progress of a layer is printed
+const progressInterval = time.Second
+
+// progressPrinter prints the progress of the layer downloads, a line per
+// layer at most every progressInterval, like `docker pull` does
+type progressPrinter struct {
+	w    io.Writer
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newProgressPrinter(w io.Writer) *progressPrinter {
+	return &progressPrinter{w: w, last: map[string]time.Time{}}
+}
+
+// report is a fetch.ProgressFunc
+func (p *progressPrinter) report(id string, written, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	short := id
+	if len(short) > 12 {
+		short = short[:12]
+	}
+	if total >= 0 && written >= total {
+		fmt.Fprintf(p.w, "%s: Download complete (%s)\n", short, humanSize(written))
+		delete(p.last, id)
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.last[id]) < progressInterval {
+		return
+	}
+	p.last[id] = now
+	if total < 0 {
+		fmt.Fprintf(p.w, "%s: Downloading %s\n", short, humanSize(written))
+		return
+	}
+	fmt.Fprintf(p.w, "%s: Downloading %s/%s\n", short, humanSize(written), humanSize(total))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// urgentPriority and above are allowed past the limits of workers and per
+// registry, so that an urgent pull is never stuck behind a background mirror
+// sync holding all of the slots
+const urgentPriority = 100
+
+// maxQueued is how many jobs may wait in the scheduler
+const maxQueued = 1000
+
+// scheduler starts queued jobs by priority (highest first, then in order of
+// submission), keeping at most workers jobs running overall and perRegistry
+// per registry host, but for urgent jobs, and starting jobs on a host no more
+// often than every interval. Running jobs are never interrupted.
+type scheduler struct {
+	workers     int
+	perRegistry int
+	interval    time.Duration
+	run         func(j *job)
+
+	mu        sync.Mutex
+	pending   []*job
+	running   int
+	byHost    map[string]int
+	lastStart map[string]time.Time
+	wake      chan struct{}
+}
+
+func newScheduler(workers, perRegistry int, interval time.Duration, run func(j *job)) *scheduler {
+	s := &scheduler{
+		workers:     workers,
+		perRegistry: perRegistry,
+		interval:    interval,
+		run:         run,
+		byHost:      map[string]int{},
+		lastStart:   map[string]time.Time{},
+		wake:        make(chan struct{}, 1),
+	}
+	go s.loop()
+	return s
+}
+
+// add queues j behind the jobs of the same or higher priority
+func (s *scheduler) add(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) >= maxQueued {
+		return fmt.Errorf("too many jobs queued")
+	}
+	i := len(s.pending)
+	for i > 0 && s.pending[i-1].Priority < j.Priority {
+		i--
+	}
+	s.pending = append(s.pending, nil)
+	copy(s.pending[i+1:], s.pending[i:])
+	s.pending[i] = j
+	s.signal()
+	return nil
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *scheduler) loop() {
+	for {
+		wait := s.startNext()
+		if wait > 0 {
+			select {
+			case <-s.wake:
+			case <-time.After(wait):
+			}
+		} else if wait < 0 {
+			<-s.wake
+		}
+	}
+}
+
+// startNext starts the first job that is allowed to run. It returns 0 if a
+// job was started, the time until a rate limited job may start, or -1 if
+// nothing can start until a job is added or finishes.
+func (s *scheduler) startNext() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := time.Duration(-1)
+	now := time.Now()
+	for i, j := range s.pending {
+		if s.running >= s.workers && j.Priority < urgentPriority {
+			// the jobs after are of no higher priority
+			break
+		}
+		host := fetch.NewImageRef(j.Ref).Host()
+		if s.byHost[host] >= s.perRegistry && j.Priority < urgentPriority {
+			continue
+		}
+		if next := s.lastStart[host].Add(s.interval); now.Before(next) {
+			if d := next.Sub(now); wait < 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		s.running++
+		s.byHost[host]++
+		s.lastStart[host] = now
+		go func() {
+			s.run(j)
+			s.mu.Lock()
+			s.running--
+			s.byHost[host]--
+			s.signal()
+			s.mu.Unlock()
+		}()
+		return 0
+	}
+	return wait
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerUrgent(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	s := newScheduler(1, 1, 0, func(j *job) {
+		started <- j.ID
+		if j.Priority < urgentPriority {
+			<-release
+		}
+	})
+	defer close(release)
+
+	expect := func(id string) {
+		select {
+		case got := <-started:
+			if got != id {
+				t.Fatalf("expected job %s to start, got %s", id, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected job %s to start", id)
+		}
+	}
+	// a mirror sync holding the only worker, and the only slot of the
+	// registry, with another queued behind it
+	if err := s.add(&job{ID: "sync", Ref: "registry.example.com/mirror/a"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("sync")
+	if err := s.add(&job{ID: "sync2", Ref: "registry.example.com/mirror/b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add(&job{ID: "urgent", Ref: "registry.example.com/team/app", Priority: urgentPriority}); err != nil {
+		t.Fatal(err)
+	}
+	expect("urgent")
+	select {
+	case id := <-started:
+		t.Errorf("expected job %s to wait for a worker", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// searchCommand lists the repositories matching a query, like `docker
+// search`
+func searchCommand(args []string) error {
+	var registry = fetch.DefaultHubNamespace
+	cmd := flag.NewFlagSet("search", flag.ExitOnError)
+	cmd.StringVar(&registry, []string{"-registry"}, registry, "the registry to search")
+	cmd.IntVar(&fetch.SearchLimit, []string{"-limit"}, fetch.SearchLimit, "the most results to list")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch search [OPTIONS] TERM")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected a term to search for")
+	}
+	re := fetch.NewRegistry(registry)
+	if err := configureTransport(&re); err != nil {
+		return err
+	}
+	results, err := re.Search(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDESCRIPTION\tSTARS\tOFFICIAL\tAUTOMATED")
+	for _, r := range results {
+		description := strings.Replace(r.Description, "\n", " ", -1)
+		if runes := []rune(description); len(runes) > 45 {
+			description = string(runes[:44]) + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", r.Name, description, r.Stars, mark(r.Official), mark(r.Automated))
+	}
+	return tw.Flush()
+}
+
+// mark is "[OK]" when b is set, as docker search shows it
+func mark(b bool) string {
+	if b {
+		return "[OK]"
+	}
+	return ""
+}
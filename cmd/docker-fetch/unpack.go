@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/export"
+	"github.com/vbatts/docker-utils/opts"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// unpackCommand extracts the root filesystem of an image onto a directory
+func unpackCommand(args []string) error {
+	var (
+		uidMaps = opts.List{}
+		gidMaps = opts.List{}
+	)
+	cmd := flag.NewFlagSet("unpack", flag.ExitOnError)
+	cmd.Var(&uidMaps, []string{"-uid-map"}, "map the owners of the files, as containerID:hostID:size, like 0:100000:65536; may be given more than once")
+	cmd.Var(&gidMaps, []string{"-gid-map"}, "map the groups of the files, as containerID:hostID:size; may be given more than once")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch [--platform os/arch] unpack [OPTIONS] IMAGE DIR")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 2 {
+		cmd.Usage()
+		return fmt.Errorf("expected an image and the directory to unpack it to")
+	}
+	img, err := fetch.ParseImageRef(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	if platform != "" {
+		p, err := fetch.ParsePlatform(platform)
+		if err != nil {
+			return err
+		}
+		img.SetPlatform(p)
+	}
+	if len(uidMaps.Get()) > 0 || len(gidMaps.Get()) > 0 {
+		m := &export.IDMapping{}
+		if m.UIDs, err = parseIDMaps(uidMaps.Get()); err != nil {
+			return err
+		}
+		if m.GIDs, err = parseIDMaps(gidMaps.Get()); err != nil {
+			return err
+		}
+		img.SetIDMapping(m)
+	}
+	re, err := newRegistry(img.Host())
+	if err != nil {
+		return err
+	}
+	return re.ExtractRootFS(img, cmd.Arg(1))
+}
+
+// parseIDMaps parses each --uid-map or --gid-map given
+func parseIDMaps(args []string) ([]export.IDMap, error) {
+	maps := []export.IDMap{}
+	for _, arg := range args {
+		m, err := export.ParseIDMap(arg)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// verifyCommand audits images fetched into a directory, without contacting
+// their registries
+func verifyCommand(args []string) error {
+	cmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch verify DIR [IMAGE...]")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() < 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected the directory the images were fetched into")
+	}
+	dir := cmd.Arg(0)
+	names := cmd.Args()[1:]
+	if len(names) == 0 {
+		// every image tagged in the repositories file
+		repos, err := fetch.ReadRepositories(dir)
+		if err != nil {
+			return err
+		}
+		for name, tags := range repos {
+			for tag := range tags {
+				names = append(names, name+":"+tag)
+			}
+		}
+		sort.Strings(names)
+	}
+	corrupted := 0
+	for _, name := range names {
+		img := fetch.NewImageRef(name)
+		err := fetch.VerifyLocal(dir, img)
+		if e, ok := err.(fetch.ErrLocalCorrupted); ok {
+			corrupted++
+			for _, p := range e.Problems {
+				fmt.Printf("%s: %s\n", name, p)
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: OK\n", name)
+	}
+	if corrupted > 0 {
+		return fmt.Errorf("%s: %d of %d images corrupted", dir, corrupted, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	flag "github.com/docker/docker/pkg/mflag"
+	"github.com/vbatts/docker-utils/opts"
+	"github.com/vbatts/docker-utils/registry/fetch"
+)
+
+// watchCommand polls the tags of a repository, printing a JSON line for each
+// tag added, moved or removed, and posting it to the webhooks given
+func watchCommand(args []string) error {
+	var (
+		interval  = time.Minute
+		tags      = opts.List{}
+		webhooks  = opts.List{}
+		stateFile = ""
+	)
+	cmd := flag.NewFlagSet("watch", flag.ExitOnError)
+	cmd.DurationVar(&interval, []string{"-interval"}, interval, "time between polls of the registry")
+	cmd.Var(&tags, []string{"-tag"}, "watch only this tag; may be given more than once")
+	cmd.Var(&webhooks, []string{"-webhook"}, "POST each event as JSON to this URL; may be given more than once")
+	cmd.StringVar(&stateFile, []string{"-state"}, stateFile, "keep the digests seen in this file, to report the changes made between runs")
+	cmd.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: docker-fetch watch [OPTIONS] REPOSITORY")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return err
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return fmt.Errorf("expected a repository to watch")
+	}
+	if interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	repo, err := fetch.ParseImageRef(cmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	re, err := newRegistry(repo.Host())
+	if err != nil {
+		return err
+	}
+	w := &fetch.Watcher{Registry: re, Repository: repo, Tags: tags.Get(), Interval: interval}
+	if stateFile != "" {
+		if w.State, err = fetch.LoadSyncState(stateFile); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	enc := json.NewEncoder(os.Stdout)
+	err = w.Watch(ctx, func(event fetch.TagEvent) error {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+		for _, url := range webhooks.Get() {
+			if err := postEvent(client, url, event); err != nil {
+				logrus.Warnf("webhook %s: %s", url, err)
+			}
+		}
+		if w.State != nil {
+			return w.State.Save()
+		}
+		return nil
+	})
+	if w.State != nil {
+		if saveErr := w.State.Save(); saveErr != nil {
+			logrus.Warnf("saving %s: %s", stateFile, saveErr)
+		}
+	}
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// postEvent posts event as JSON to url, which is to answer with a 2xx status
+func postEvent(client *http.Client, url string, event fetch.TagEvent) error {
+	buf, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("returned %q", resp.Status)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 
 	"github.com/vbatts/docker-utils/opts"
 	"github.com/vbatts/docker-utils/sum"
@@ -20,6 +21,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "%s - %s\n", os.Args[0], version.VERSION)
 		os.Exit(0)
 	}
+	if *flSWHID {
+		if err := printSWHIDs(flag.Args(), *flRootTar); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	tsVersion, err := sum.DetermineVersion(*flTarsumVersion)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -162,8 +170,48 @@ var (
 	flStream        = flag.Bool("s", true, "read FILEs (or stdin) as the output of `docker save` (this is default)")
 	flVersion       = flag.Bool("v", false, "show version")
 	flRootTar       = flag.Bool("r", false, "treat the tar(s) root filesystem archives (not a tar of layers)")
+	flSWHID         = flag.Bool("swhid", false, "print SWHID (git-style sha1) content identifiers of each layer, or each file with -r, instead of TarSums")
 )
 
 func init() {
 	flag.Var(&flChecks, "c", "read TarSums from the FILEs (or stdin) and check them")
 }
+
+// printSWHIDs prints the content identifiers of each layer in the `docker
+// save` archives named (or stdin), or of each file in them if rootTar
+func printSWHIDs(args []string, rootTar bool) error {
+	if len(args) == 0 {
+		args = []string{"-"}
+	}
+	for _, arg := range args {
+		fh := os.Stdin
+		if arg != "-" {
+			var err error
+			if fh, err = os.Open(arg); err != nil {
+				return err
+			}
+		}
+		var (
+			ids map[string]string
+			err error
+		)
+		if rootTar {
+			ids, err = sum.SWHIDTarFiles(fh)
+		} else {
+			ids, err = sum.SWHIDAllDockerSave(fh)
+		}
+		fh.Close()
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(ids))
+		for name := range ids {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%s%s%s:%s\n", ids[name], sum.DefaultSpacer, arg, name)
+		}
+	}
+	return nil
+}
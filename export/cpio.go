@@ -0,0 +1,155 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	cpioNewcMagic = "070701"
+	cpioTrailer   = "TRAILER!!!"
+	// cpioMaxSize is the largest file size the 8 hex digits of newc hold
+	cpioMaxSize = 1<<32 - 1
+
+	// mode type bits, as in stat(2)
+	cpioModeDir     = 0040000
+	cpioModeRegular = 0100000
+	cpioModeSymlink = 0120000
+)
+
+// CPIO writes the directory root to the file out as a "newc" cpio archive,
+// the format the Linux kernel accepts as an initramfs.
+func CPIO(root, out string) error {
+	fh, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := WriteCPIO(root, fh); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// WriteCPIO writes the directory root to w as a "newc" cpio archive. Every
+// entry is owned by 0:0, as an initramfs expects, and hard links are stored
+// as separate copies. Only directories, regular files and symlinks are
+// included. Files of 4 GiB or more do not fit the format, and are an error.
+func WriteCPIO(root string, w io.Writer) error {
+	cw := &cpioWriter{w: bufio.NewWriter(w)}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		perm := uint32(fi.Mode().Perm())
+		if fi.Mode()&os.ModeSetuid != 0 {
+			perm |= 04000
+		}
+		if fi.Mode()&os.ModeSetgid != 0 {
+			perm |= 02000
+		}
+		if fi.Mode()&os.ModeSticky != 0 {
+			perm |= 01000
+		}
+		mtime := fi.ModTime().Unix()
+
+		switch {
+		case fi.IsDir():
+			return cw.writeEntry(name, cpioModeDir|perm, 2, mtime, nil, 0)
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return cw.writeEntry(name, cpioModeSymlink|0777, 1, mtime, []byte(target), int64(len(target)))
+		case fi.Mode().IsRegular():
+			fh, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			return cw.writeEntry(name, cpioModeRegular|perm, 1, mtime, fh, fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := cw.writeEntry(cpioTrailer, 0, 1, 0, nil, 0); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+type cpioWriter struct {
+	w   *bufio.Writer
+	ino uint32
+	n   int64
+}
+
+// writeEntry writes the header, name and content of a single entry. body is
+// either nil, a []byte, or an io.Reader of size bytes.
+func (cw *cpioWriter) writeEntry(name string, mode, nlink uint32, mtime int64, body interface{}, size int64) error {
+	if size > cpioMaxSize {
+		return fmt.Errorf("%s: %d bytes is too large for a newc cpio archive", name, size)
+	}
+	cw.ino++
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioNewcMagic,
+		cw.ino,
+		mode,
+		0, // uid
+		0, // gid
+		nlink,
+		uint32(mtime),
+		uint32(size),
+		0, 0, // dev major, minor
+		0, 0, // rdev major, minor
+		len(name)+1,
+		0, // check
+	)
+	if err := cw.write([]byte(hdr + name + "\x00")); err != nil {
+		return err
+	}
+	if err := cw.pad(); err != nil {
+		return err
+	}
+	switch b := body.(type) {
+	case []byte:
+		if err := cw.write(b); err != nil {
+			return err
+		}
+	case io.Reader:
+		n, err := io.Copy(cw.w, b)
+		cw.n += n
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("%s changed size while archiving", name)
+		}
+	}
+	return cw.pad()
+}
+
+func (cw *cpioWriter) write(b []byte) error {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return err
+}
+
+// pad aligns the output to 4 bytes
+func (cw *cpioWriter) pad() error {
+	if rem := cw.n % 4; rem != 0 {
+		return cw.write(make([]byte, 4-rem))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package export
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteCPIO(t *testing.T) {
+	root, err := ioutil.TempDir("", "test.cpio.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "bin", "busybox"), []byte("#!ELF"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("busybox", filepath.Join(root, "bin", "sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteCPIO(root, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len()%4 != 0 {
+		t.Errorf("expected the archive to be 4 byte aligned, but it is %d bytes", buf.Len())
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, cpioNewcMagic) {
+		t.Errorf("expected the newc magic at the start of the archive")
+	}
+	for _, s := range []string{"bin/busybox\x00", "#!ELF", "bin/sh\x00", cpioTrailer + "\x00"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected %q in the archive", s)
+		}
+	}
+	// header of "bin/sh": mode is a symlink, and the size is that of the target
+	i := strings.Index(out, "bin/sh\x00")
+	hdr := out[i-110 : i]
+	if mode := hdr[14:22]; mode != "0000a1ff" {
+		t.Errorf("expected a symlink mode, got %q", mode)
+	}
+	if size := hdr[54:62]; size != "00000007" {
+		t.Errorf("expected a size of 7, got %q", size)
+	}
+}
+
+func TestWriteCPIOTooLarge(t *testing.T) {
+	root := t.TempDir()
+	// sparse, so the test takes no space
+	fh, err := os.Create(filepath.Join(root, "huge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Truncate(cpioMaxSize + 1)
+	fh.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCPIO(root, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected a file of 4 GiB to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// the Kinds of Changes
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change is a path that differs between two filesystems
+type Change struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+}
+
+// readLinkFS is a filesystem with symlinks, like an ImageFS
+type readLinkFS interface {
+	ReadLink(name string) (string, error)
+}
+
+// DiffFS compares the filesystems a and b, like the ImageFS of two images,
+// returning the paths added in b, removed from a, and modified, sorted by
+// path. A path is modified when its type, permissions, owner, size, symlink
+// target or content differ; modification times are not compared, as they
+// differ between any two builds. The paths below a directory added, removed
+// or replaced by something else are not listed.
+func DiffFS(a, b fs.FS) ([]Change, error) {
+	infosA, err := walkInfos(a)
+	if err != nil {
+		return nil, err
+	}
+	infosB, err := walkInfos(b)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for name, fiA := range infosA {
+		fiB, ok := infosB[name]
+		if !ok {
+			if !under(infosB, name) {
+				changes = append(changes, Change{Path: name, Kind: ChangeRemoved})
+			}
+			continue
+		}
+		modified, err := differs(a, b, name, fiA, fiB)
+		if err != nil {
+			return nil, err
+		}
+		if modified {
+			changes = append(changes, Change{Path: name, Kind: ChangeModified})
+		}
+	}
+	for name := range infosB {
+		if _, ok := infosA[name]; !ok && !under(infosA, name) {
+			changes = append(changes, Change{Path: name, Kind: ChangeAdded})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// walkInfos is the fs.FileInfo of every path of fsys
+func walkInfos(fsys fs.FS) (map[string]fs.FileInfo, error) {
+	infos := map[string]fs.FileInfo{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		infos[name] = fi
+		return nil
+	})
+	return infos, err
+}
+
+// under reports whether name, found in one filesystem but not in other, is
+// below a directory that is not in other either, or not a directory there,
+// and so is reported in its place
+func under(other map[string]fs.FileInfo, name string) bool {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return false
+	}
+	fi, ok := other[name[:i]]
+	return !ok || !fi.IsDir()
+}
+
+// differs reports whether name, in both a and b, was modified
+func differs(a, b fs.FS, name string, fiA, fiB fs.FileInfo) (bool, error) {
+	if fiA.Mode() != fiB.Mode() || fiA.Size() != fiB.Size() {
+		return true, nil
+	}
+	hdrA, okA := fiA.Sys().(*tar.Header)
+	hdrB, okB := fiB.Sys().(*tar.Header)
+	if okA && okB && (hdrA.Uid != hdrB.Uid || hdrA.Gid != hdrB.Gid) {
+		return true, nil
+	}
+	switch {
+	case fiA.Mode()&fs.ModeSymlink != 0:
+		rlA, okA := a.(readLinkFS)
+		rlB, okB := b.(readLinkFS)
+		if !okA || !okB {
+			return false, nil
+		}
+		targetA, err := rlA.ReadLink(name)
+		if err != nil {
+			return false, err
+		}
+		targetB, err := rlB.ReadLink(name)
+		if err != nil {
+			return false, err
+		}
+		return targetA != targetB, nil
+	case fiA.Mode().IsRegular():
+		return contentDiffers(a, b, name)
+	}
+	return false, nil
+}
+
+// contentDiffers compares the content of the regular file name in a and b
+func contentDiffers(a, b fs.FS, name string) (bool, error) {
+	fhA, err := a.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer fhA.Close()
+	fhB, err := b.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer fhB.Close()
+	bufA, bufB := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		nA, errA := io.ReadFull(fhA, bufA)
+		nB, errB := io.ReadFull(fhB, bufB)
+		if !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return true, nil
+		}
+		endA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		endB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !endA {
+			return false, errA
+		}
+		if errB != nil && !endB {
+			return false, errB
+		}
+		if endA || endB {
+			return endA != endB, nil
+		}
+	}
+}
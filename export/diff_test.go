@@ -0,0 +1,57 @@
+package export
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffFS(t *testing.T) {
+	src := writeImageLayers(t)
+	if err := os.MkdirAll(filepath.Join(src, "extra"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	extra := makeTar(t,
+		tarEntry{Name: "opt/", Type: tar.TypeDir},
+		tarEntry{Name: "opt/app/", Type: tar.TypeDir},
+		tarEntry{Name: "opt/app/run", Type: tar.TypeReg, Body: "run\n"},
+		tarEntry{Name: "bin", Type: tar.TypeSymlink, Linkname: "/usr/bin"},
+	)
+	if err := ioutil.WriteFile(filepath.Join(src, "extra", "layer.tar"), extra.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewImageFS(src, []string{"base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewImageFS(src, []string{"extra", "top", "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := DiffFS(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Path: "bin", Kind: ChangeModified},
+		{Path: "etc/issue", Kind: ChangeModified},
+		{Path: "etc/issue.net", Kind: ChangeAdded},
+		{Path: "etc/motd", Kind: ChangeRemoved},
+		{Path: "opt", Kind: ChangeAdded},
+		{Path: "var/cache/new", Kind: ChangeAdded},
+		{Path: "var/cache/old", Kind: ChangeRemoved},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+
+	if changes, err = DiffFS(b, b); err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 0 {
+		t.Errorf("expected no changes of an image with itself, got %v", changes)
+	}
+}
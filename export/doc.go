@@ -0,0 +1,6 @@
+// Package export writes fetched images out in other forms: `docker load`
+// archives, flattened root filesystems (squashfs, erofs, cpio) and split
+// archives, or reads their merged filesystem in place as an io/fs.FS. It
+// reads the `docker save` layout produced by registry/fetch, but does not
+// import it.
+package export
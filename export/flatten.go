@@ -0,0 +1,127 @@
+package export
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Flatten writes the merged root filesystem of the layers of an image
+// fetched into src, ancestry listing the layer IDs top-most first, to w as a
+// single tar archive, for chroots, LXC or `docker import`. Whiteouts and
+// opaque directories are applied, and ownership, modes, times and extended
+// attributes are kept as the layers have them, the layers being read in place
+// rather than unpacked. Files hard linked together stay so.
+func Flatten(src string, ancestry []string, w io.Writer) error {
+	ifs, err := NewImageFS(src, ancestry)
+	if err != nil {
+		return err
+	}
+	return ifs.WriteTar(w)
+}
+
+// WriteTar writes the filesystem to w as a tar archive, parents before what
+// is in them and otherwise by name
+func (ifs *ImageFS) WriteTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// the first name written of the content of each regular file, for the
+	// files hard linked to it
+	written := map[fsContent]string{}
+	if err := writeTarDir(tw, ifs.root, "", written); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// fsContent identifies the content of a regular file, which the files hard
+// linked together share
+type fsContent struct {
+	filename string
+	entry    int
+}
+
+func writeTarDir(tw *tar.Writer, dir *fsNode, name string, written map[fsContent]string) error {
+	names := []string{}
+	for childName := range dir.children {
+		names = append(names, childName)
+	}
+	sort.Strings(names)
+	for _, childName := range names {
+		child := dir.children[childName]
+		childPath := path.Join(name, childName)
+		hdr := flatHeader(child.hdr, childPath)
+		if child.hdr.Typeflag == tar.TypeReg {
+			key := fsContent{filename: child.filename, entry: child.entry}
+			if first, ok := written[key]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				written[key] = childPath
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			r, closer, err := child.content()
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, r)
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if child.isDir() {
+			if err := writeTarDir(tw, child, childPath, written); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// flatHeader is the header of the flattened entry named name, from the one
+// in its layer: keeping the ownership, mode, times and extended attributes,
+// but none of the records of how the layer was written
+func flatHeader(orig *tar.Header, name string) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag: orig.Typeflag,
+		Name:     name,
+		Linkname: orig.Linkname,
+		Size:     orig.Size,
+		Mode:     orig.Mode,
+		Uid:      orig.Uid,
+		Gid:      orig.Gid,
+		Uname:    orig.Uname,
+		Gname:    orig.Gname,
+		ModTime:  orig.ModTime,
+		Devmajor: orig.Devmajor,
+		Devminor: orig.Devminor,
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = time.Unix(0, 0)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		hdr.Name += "/"
+		hdr.Size = 0
+	case tar.TypeReg:
+	default:
+		hdr.Size = 0
+	}
+	for k, v := range orig.PAXRecords {
+		if strings.HasPrefix(k, "SCHILY.xattr.") {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords[k] = v
+		}
+	}
+	return hdr
+}
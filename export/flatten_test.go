@@ -0,0 +1,60 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := Flatten(writeImageLayers(t), []string{"top", "base"}, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	contents := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(content)
+		case tar.TypeLink, tar.TypeSymlink:
+			contents[hdr.Name] = "-> " + hdr.Linkname
+		}
+	}
+	expected := []string{
+		"bin", "escape",
+		"etc/", "etc/issue", "etc/issue.net",
+		"usr/", "usr/bin/", "usr/bin/sh",
+		"var/", "var/cache/", "var/cache/new",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+	for name, content := range map[string]string{
+		"etc/issue":     "top\n",
+		"etc/issue.net": "-> etc/issue",
+		"bin":           "-> usr/bin",
+		"var/cache/new": "new\n",
+	} {
+		if contents[name] != content {
+			t.Errorf("%s: expected %q, got %q", name, content, contents[name])
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package export
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImageFS is the merged filesystem of the layers of a fetched image, read in
+// place from their layer.tar files rather than unpacked. The layers are
+// indexed when it is made; the content of a file is read from its layer when
+// it is opened. Symlinks are followed within the image, as if it were the
+// filesystem root.
+type ImageFS struct {
+	root *fsNode
+}
+
+// fsNode is a path of an ImageFS
+type fsNode struct {
+	hdr *tar.Header
+	// layer is the index, in base first order, of the layer the node is
+	// from, and filename the layer.tar it is read from
+	layer    int
+	filename string
+	// offset is where the content of a regular file starts in filename, or
+	// for a sparse file, entry is its position in the archive, to be read
+	// through archive/tar instead
+	offset   int64
+	entry    int
+	sparse   bool
+	children map[string]*fsNode
+}
+
+func (n *fsNode) isDir() bool {
+	return n.hdr.Typeflag == tar.TypeDir
+}
+
+// newDirNode is a directory only implied by the paths of a layer
+func newDirNode(layer int) *fsNode {
+	return &fsNode{
+		hdr:      &tar.Header{Typeflag: tar.TypeDir, Mode: 0755},
+		layer:    layer,
+		children: map[string]*fsNode{},
+	}
+}
+
+// NewImageFS indexes the layers of an image fetched into src, a `docker
+// save` style directory containing <id>/layer.tar, where ancestry lists the
+// layer IDs top-most first, as returned by the registry. Whiteouts and
+// opaque directories are honored as ApplyLayer does.
+func NewImageFS(src string, ancestry []string) (*ImageFS, error) {
+	ifs := &ImageFS{root: newDirNode(0)}
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		filename := filepath.Join(src, ancestry[i], "layer.tar")
+		if err := ifs.addLayer(len(ancestry)-1-i, filename); err != nil {
+			return nil, fmt.Errorf("indexing layer %s: %w", ancestry[i], err)
+		}
+	}
+	return ifs, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// isSparse reports whether hdr is of a sparse file, whose content is not
+// stored as is
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// addLayer adds the entries of the layer.tar at filename on top of the
+// filesystem
+func (ifs *ImageFS) addLayer(layer int, filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	cr := &countingReader{r: fh}
+	t := tar.NewReader(cr)
+	opaques := []*fsNode{}
+	for entry := 0; ; entry++ {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parentName, base := path.Split(name)
+		parent := ifs.mkdirAll(layer, parentName)
+
+		if base == WhiteoutOpaque {
+			opaques = append(opaques, parent)
+			continue
+		}
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			delete(parent.children, strings.TrimPrefix(base, WhiteoutPrefix))
+			continue
+		}
+
+		node := &fsNode{hdr: hdr, layer: layer, filename: filename, offset: cr.n, entry: entry}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// a directory on a directory keeps what is in it
+			if existing, ok := parent.children[base]; ok && existing.isDir() {
+				existing.hdr, existing.layer = hdr, layer
+				continue
+			}
+			node.children = map[string]*fsNode{}
+		case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+			hdr.Typeflag = tar.TypeReg
+			node.sparse = isSparse(hdr)
+		case tar.TypeLink:
+			target := ifs.root.walk(path.Clean("/" + hdr.Linkname))
+			if target == nil || target.isDir() {
+				return fmt.Errorf("%s: hard link to %s, which is not a file of the layers so far", name, hdr.Linkname)
+			}
+			linked := *target
+			linked.hdr = new(tar.Header)
+			*linked.hdr = *target.hdr
+			linked.hdr.Name = hdr.Name
+			linked.layer = layer
+			node = &linked
+		}
+		parent.children[base] = node
+	}
+
+	for _, dir := range opaques {
+		dir.clearBelow(layer)
+	}
+	return nil
+}
+
+// mkdirAll returns the directory name, making it and its parents if need be,
+// and replacing what else is in the way, without following symlinks
+func (ifs *ImageFS) mkdirAll(layer int, name string) *fsNode {
+	dir := ifs.root
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" {
+			continue
+		}
+		child, ok := dir.children[elem]
+		if !ok || !child.isDir() {
+			child = newDirNode(layer)
+			dir.children[elem] = child
+		}
+		dir = child
+	}
+	return dir
+}
+
+// walk is the node at the clean, absolute name, without following symlinks,
+// or nil
+func (n *fsNode) walk(name string) *fsNode {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" {
+			continue
+		}
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[elem]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// clearBelow removes what is in the directory from layers under layer
+func (n *fsNode) clearBelow(layer int) {
+	for name, child := range n.children {
+		if child.layer < layer {
+			delete(n.children, name)
+		} else if child.isDir() {
+			child.clearBelow(layer)
+		}
+	}
+}
+
+// maxLinks bounds the symlinks followed to open a path
+const maxLinks = 255
+
+// lookup finds the node at name, following the symlinks on the way, and
+// the last one too when follow is set
+func (ifs *ImageFS) lookup(op, name string, follow bool) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	var (
+		dirs  = []*fsNode{ifs.root}
+		rest  = strings.Split(name, "/")
+		links = 0
+	)
+	node := ifs.root
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		dir := dirs[len(dirs)-1]
+		switch elem {
+		case "", ".":
+			node = dir
+			continue
+		case "..":
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			node = dirs[len(dirs)-1]
+			continue
+		}
+		child, ok := dir.children[elem]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if child.hdr.Typeflag == tar.TypeSymlink && (len(rest) > 0 || follow) {
+			links++
+			if links > maxLinks {
+				return nil, &fs.PathError{Op: op, Path: name, Err: errors.New("too many symlinks")}
+			}
+			if path.IsAbs(child.hdr.Linkname) {
+				dirs = dirs[:1]
+			}
+			rest = append(strings.Split(child.hdr.Linkname, "/"), rest...)
+			node = dirs[len(dirs)-1]
+			continue
+		}
+		if len(rest) > 0 && !child.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		node = child
+		if child.isDir() {
+			dirs = append(dirs, child)
+		}
+	}
+	return node, nil
+}
+
+// Open opens the file name, following symlinks
+func (ifs *ImageFS) Open(name string) (fs.File, error) {
+	node, err := ifs.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := fsInfo{name: path.Base(name), hdr: node.hdr}
+	if node.isDir() {
+		return &fsDir{info: info, node: node, path: name}, nil
+	}
+	r, closer, err := node.content()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &fsFile{info: info, r: r, closer: closer}, nil
+}
+
+// content opens the content of the node, read from its layer, which is a
+// seekable io.SectionReader unless the file is sparse
+func (n *fsNode) content() (io.Reader, io.Closer, error) {
+	if n.hdr.Typeflag != tar.TypeReg || n.hdr.Size == 0 {
+		return io.NewSectionReader(emptyReaderAt{}, 0, 0), nil, nil
+	}
+	fh, err := os.Open(n.filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !n.sparse {
+		return io.NewSectionReader(fh, n.offset, n.hdr.Size), fh, nil
+	}
+	t := tar.NewReader(fh)
+	for i := 0; i <= n.entry; i++ {
+		if _, err := t.Next(); err != nil {
+			fh.Close()
+			return nil, nil, err
+		}
+	}
+	return t, fh, nil
+}
+
+// Stat is the fs.FileInfo of name, following symlinks
+func (ifs *ImageFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := ifs.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsInfo{name: path.Base(name), hdr: node.hdr}, nil
+}
+
+// Lstat is the fs.FileInfo of name, not following a last symlink
+func (ifs *ImageFS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := ifs.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fsInfo{name: path.Base(name), hdr: node.hdr}, nil
+}
+
+// ReadLink is the destination of the symlink name
+func (ifs *ImageFS) ReadLink(name string) (string, error) {
+	node, err := ifs.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.hdr.Typeflag != tar.TypeSymlink {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.hdr.Linkname, nil
+}
+
+// fsInfo is the fs.FileInfo of a node, by the name it was opened as
+type fsInfo struct {
+	name string
+	hdr  *tar.Header
+}
+
+func (fi fsInfo) Name() string {
+	return fi.name
+}
+
+func (fi fsInfo) Size() int64 {
+	if fi.hdr.Typeflag != tar.TypeReg {
+		return 0
+	}
+	return fi.hdr.Size
+}
+
+func (fi fsInfo) Mode() fs.FileMode {
+	return fi.hdr.FileInfo().Mode()
+}
+
+func (fi fsInfo) ModTime() time.Time {
+	return fi.hdr.ModTime
+}
+
+func (fi fsInfo) IsDir() bool {
+	return fi.hdr.Typeflag == tar.TypeDir
+}
+
+// Sys is the *tar.Header of the file
+func (fi fsInfo) Sys() interface{} {
+	return fi.hdr
+}
+
+// fsFile is a file of an ImageFS opened
+type fsFile struct {
+	info   fsInfo
+	r      io.Reader
+	closer io.Closer
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+// Seek seeks, unless the file is sparse
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	s, ok := f.r.(io.Seeker)
+	if !ok {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: errors.ErrUnsupported}
+	}
+	return s.Seek(offset, whence)
+}
+
+// ReadAt reads at off, unless the file is sparse
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	ra, ok := f.r.(io.ReaderAt)
+	if !ok {
+		return 0, &fs.PathError{Op: "read", Path: f.info.name, Err: errors.ErrUnsupported}
+	}
+	return ra.ReadAt(p, off)
+}
+
+func (f *fsFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// emptyReaderAt is the content of files without any
+type emptyReaderAt struct{}
+
+func (emptyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
+
+// fsDir is a directory of an ImageFS opened
+type fsDir struct {
+	info    fsInfo
+	node    *fsNode
+	path    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *fsDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.path, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	return nil
+}
+
+// ReadDir lists the directory in the order of fs.ReadDirFile, by name
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		names := []string{}
+		for name := range d.node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(fsInfo{name: name, hdr: d.node.children[name].hdr}))
+		}
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
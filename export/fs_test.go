@@ -0,0 +1,78 @@
+package export
+
+import (
+	"archive/tar"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// writeImageLayers writes the layers of a test image in a temporary
+// directory, in the layout of FetchLayers: the IDs "top" and "base"
+func writeImageLayers(t *testing.T) string {
+	src, err := ioutil.TempDir("", "test.export.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(src) })
+
+	layers := map[string][]tarEntry{
+		"base": {
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/motd", Type: tar.TypeReg, Body: "hello\n"},
+			{Name: "etc/issue", Type: tar.TypeReg, Body: "base\n"},
+			{Name: "usr/bin/sh", Type: tar.TypeReg, Body: "#!\n"},
+			{Name: "bin", Type: tar.TypeSymlink, Linkname: "usr/bin"},
+			{Name: "var/cache/", Type: tar.TypeDir},
+			{Name: "var/cache/old", Type: tar.TypeReg, Body: "old\n"},
+			{Name: "escape", Type: tar.TypeSymlink, Linkname: "/../../../etc"},
+		},
+		"top": {
+			{Name: "etc/.wh.motd", Type: tar.TypeReg},
+			{Name: "etc/issue", Type: tar.TypeReg, Body: "top\n"},
+			{Name: "etc/issue.net", Type: tar.TypeLink, Linkname: "etc/issue"},
+			{Name: "var/cache/.wh..wh..opq", Type: tar.TypeReg},
+			{Name: "var/cache/new", Type: tar.TypeReg, Body: "new\n"},
+		},
+	}
+	for id, entries := range layers {
+		if err := os.MkdirAll(filepath.Join(src, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, id, "layer.tar"), makeTar(t, entries...).Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return src
+}
+
+func TestImageFS(t *testing.T) {
+	ifs, err := NewImageFS(writeImageLayers(t), []string{"top", "base"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(ifs, "etc/issue", "etc/issue.net", "usr/bin/sh", "var/cache/new"); err != nil {
+		t.Error(err)
+	}
+	for name, expected := range map[string]string{
+		"etc/issue":     "top\n",
+		"etc/issue.net": "top\n",
+		"bin/sh":        "#!\n",
+		"escape/issue":  "top\n",
+	} {
+		buf, err := fs.ReadFile(ifs, name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if string(buf) != expected {
+			t.Errorf("%s: expected %q, got %q", name, expected, buf)
+		}
+	}
+	for _, name := range []string{"etc/motd", "var/cache/old"} {
+		if _, err := fs.Stat(ifs, name); !os.IsNotExist(err) {
+			t.Errorf("%s: expected it to be removed, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package export
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IDMap maps Size IDs from ContainerID up, as owners in the layers, to the
+// IDs from HostID up, like a line of /etc/subuid or a uid_map
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// ParseIDMap parses "containerID:hostID:size", like "0:100000:65536"
+func ParseIDMap(s string) (IDMap, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return IDMap{}, fmt.Errorf("invalid ID map %q, expected containerID:hostID:size", s)
+	}
+	ids := make([]int, 3)
+	for i, part := range parts {
+		id, err := strconv.Atoi(part)
+		if err != nil || id < 0 {
+			return IDMap{}, fmt.Errorf("invalid ID map %q, expected containerID:hostID:size", s)
+		}
+		ids[i] = id
+	}
+	if ids[2] == 0 {
+		return IDMap{}, fmt.Errorf("invalid ID map %q, the size is zero", s)
+	}
+	return IDMap{ContainerID: ids[0], HostID: ids[1], Size: ids[2]}, nil
+}
+
+// IDMapping is how the owners of the files in the layers are changed as they
+// are unpacked, for a rootless container runtime (or one with user namespace
+// remapping) to use the root filesystem: like {0, 100000, 65536}, for the
+// range /etc/subuid gives the user. A nil IDMapping keeps the owners as they
+// are, and an empty UIDs or GIDs those IDs.
+type IDMapping struct {
+	UIDs []IDMap
+	GIDs []IDMap
+}
+
+// hostID is the host ID of id, by maps
+func hostID(maps []IDMap, id int) (int, bool) {
+	if len(maps) == 0 {
+		return id, true
+	}
+	for _, m := range maps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, true
+		}
+	}
+	return 0, false
+}
+
+// mapOwner changes the owner of hdr to the host's IDs, failing for IDs that
+// are not mapped
+func (m *IDMapping) mapOwner(hdr *tar.Header) error {
+	if m == nil {
+		return nil
+	}
+	uid, ok := hostID(m.UIDs, hdr.Uid)
+	if !ok {
+		return fmt.Errorf("%s: uid %d is not mapped", hdr.Name, hdr.Uid)
+	}
+	gid, ok := hostID(m.GIDs, hdr.Gid)
+	if !ok {
+		return fmt.Errorf("%s: gid %d is not mapped", hdr.Name, hdr.Gid)
+	}
+	hdr.Uid, hdr.Gid = uid, gid
+	return nil
+}
+
+// ExtractLayers is the package's ExtractLayers, with the owners of the files
+// mapped by m
+func (m *IDMapping) ExtractLayers(src string, ancestry []string, root string) error {
+	return extractLayers(src, ancestry, root, m)
+}
+
+// ApplyLayer is the package's ApplyLayer, with the owners of the files
+// mapped by m. The owners are set even when not running as root, so a
+// mapping to IDs the user may not give files fails.
+func (m *IDMapping) ApplyLayer(root string, r io.Reader) error {
+	return applyLayer(root, r, m)
+}
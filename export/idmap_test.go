@@ -0,0 +1,57 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap("0:100000:65536")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != (IDMap{ContainerID: 0, HostID: 100000, Size: 65536}) {
+		t.Errorf("unexpected map %#v", m)
+	}
+	for _, s := range []string{"0:100000", "0:-1:10", "a:1:1", "0:1:0"} {
+		if _, err := ParseIDMap(s); err == nil {
+			t.Errorf("expected %q to be refused", s)
+		}
+	}
+}
+
+func TestApplyLayerIDMapping(t *testing.T) {
+	root, err := ioutil.TempDir("", "test.idmap.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "home/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "home/user", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000})
+	tw.Close()
+	layer := buf.Bytes()
+
+	// everything to the user running the test, as for a rootless runtime
+	m := &IDMapping{
+		UIDs: []IDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}, {ContainerID: 1000, HostID: os.Getuid(), Size: 1}},
+		GIDs: []IDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}, {ContainerID: 1000, HostID: os.Getgid(), Size: 1}},
+	}
+	if err := m.ApplyLayer(root, bytes.NewReader(layer)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "home", "user")); err != nil {
+		t.Fatal(err)
+	}
+
+	m.UIDs = m.UIDs[:1]
+	if err := m.ApplyLayer(root, bytes.NewReader(layer)); err == nil {
+		t.Errorf("expected uid 1000 not to be mapped")
+	}
+}
@@ -0,0 +1,277 @@
+package export
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// WhiteoutPrefix marks a path removed in a layer
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque marks a directory whose lower contents are hidden
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// ExtractLayers unpacks the layers of a fetched image onto the directory
+// root. src is a `docker save` style directory containing <id>/layer.tar, and
+// ancestry lists the layer IDs top-most first, as returned by the registry.
+func ExtractLayers(src string, ancestry []string, root string) error {
+	return extractLayers(src, ancestry, root, nil)
+}
+
+func extractLayers(src string, ancestry []string, root string, m *IDMapping) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		err := func() error {
+			fh, err := os.Open(filepath.Join(src, ancestry[i], "layer.tar"))
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			return applyLayer(root, fh, m)
+		}()
+		if err != nil {
+			return fmt.Errorf("applying layer %s: %w", ancestry[i], err)
+		}
+	}
+	return nil
+}
+
+// ApplyLayer unpacks the layer tar archive read from r on top of root,
+// honoring whiteout files and opaque directories. No entry is written outside
+// of root, regardless of "../" names or symlinks in the archive. Device nodes
+// and fifos are skipped, and ownership is only restored when running as root.
+func ApplyLayer(root string, r io.Reader) error {
+	return applyLayer(root, r, nil)
+}
+
+func applyLayer(root string, r io.Reader, m *IDMapping) error {
+	t := tar.NewReader(r)
+	// paths unpacked by this layer, which an opaque whiteout must not remove
+	unpacked := map[string]bool{}
+	opaques := []string{}
+	dirs := []*tar.Header{}
+
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parent, base := path.Split(name)
+
+		if base == WhiteoutOpaque {
+			opaques = append(opaques, parent)
+			continue
+		}
+		dir, err := SecureJoin(root, parent)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, base)
+		unpacked[name] = true
+
+		// anything in the way, other than a directory being replaced by a
+		// directory, is replaced
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg, tar.TypeRegA:
+			fh, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(fh, t); err != nil {
+				fh.Close()
+				return err
+			}
+			if err := fh.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkParent, linkBase := path.Split(path.Clean("/" + hdr.Linkname))
+			linkDir, err := SecureJoin(root, linkParent)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(linkDir, linkBase), target); err != nil {
+				return err
+			}
+		default:
+			// devices and fifos need privileges, and are not content
+			delete(unpacked, name)
+			continue
+		}
+		if err := m.mapOwner(hdr); err != nil {
+			return err
+		}
+		if err := restoreMetadata(target, hdr, m != nil); err != nil {
+			return err
+		}
+	}
+
+	for _, parent := range opaques {
+		if err := clearOpaque(root, parent, unpacked); err != nil {
+			return err
+		}
+	}
+	// directory times are set last, since unpacking into them changes them
+	for _, hdr := range dirs {
+		target, err := SecureJoin(root, path.Clean("/"+hdr.Name))
+		if err != nil {
+			return err
+		}
+		os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// clearOpaque removes everything below parent that was not unpacked by the
+// current layer
+func clearOpaque(root, parent string, unpacked map[string]bool) error {
+	dir, err := SecureJoin(root, parent)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := path.Join(parent, entry)
+		if !unpacked[name] {
+			if err := os.RemoveAll(filepath.Join(dir, entry)); err != nil {
+				return err
+			}
+			continue
+		}
+		// directories from this layer may still hold lower content
+		if fi, err := os.Lstat(filepath.Join(dir, entry)); err == nil && fi.IsDir() {
+			if err := clearOpaque(root, name, unpacked); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return fh.Readdirnames(-1)
+}
+
+// restoreMetadata sets the mode and times of target from hdr, and its owner
+// when running as root or when chown is set
+func restoreMetadata(target string, hdr *tar.Header, chown bool) error {
+	if chown || os.Getuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(target, os.FileMode(hdr.Mode)&os.ModePerm|modeBits(hdr.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// modeBits converts the setuid, setgid and sticky bits of a tar mode
+func modeBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// SecureJoin joins the slash separated name onto root, resolving any
+// symlinks along the way as if root were the filesystem root, so the result
+// is always within root.
+func SecureJoin(root, name string) (string, error) {
+	const maxLinks = 255
+	var (
+		resolved = "/"
+		rest     = strings.Split(path.Clean("/"+name), "/")
+		links    = 0
+	)
+	for len(rest) > 0 {
+		elem := rest[0]
+		rest = rest[1:]
+		if elem == "" || elem == "." {
+			continue
+		}
+		if elem == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, elem)
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxLinks {
+			return "", fmt.Errorf("too many symlinks resolving %q", name)
+		}
+		dest, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(dest) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(dest, "/"), rest...)
+	}
+	return filepath.Join(root, filepath.FromSlash(resolved)), nil
+}
@@ -0,0 +1,93 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	Name     string
+	Type     byte
+	Body     string
+	Linkname string
+}
+
+func makeTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Typeflag: e.Type, Mode: 0644, Size: int64(len(e.Body)), Linkname: e.Linkname}
+		if e.Type == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.Type != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil && hdr.Size > 0 {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestApplyLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "test.export.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	base := makeTar(t,
+		tarEntry{Name: "etc/", Type: tar.TypeDir},
+		tarEntry{Name: "etc/motd", Type: tar.TypeReg, Body: "hello\n"},
+		tarEntry{Name: "etc/issue", Type: tar.TypeReg, Body: "base\n"},
+		tarEntry{Name: "var/cache/", Type: tar.TypeDir},
+		tarEntry{Name: "var/cache/old", Type: tar.TypeReg, Body: "old\n"},
+		tarEntry{Name: "escape", Type: tar.TypeSymlink, Linkname: "/../../../tmp"},
+	)
+	top := makeTar(t,
+		tarEntry{Name: "etc/.wh.motd", Type: tar.TypeReg},
+		tarEntry{Name: "etc/issue", Type: tar.TypeReg, Body: "top\n"},
+		tarEntry{Name: "var/cache/.wh..wh..opq", Type: tar.TypeReg},
+		tarEntry{Name: "var/cache/new", Type: tar.TypeReg, Body: "new\n"},
+		tarEntry{Name: "../../outside", Type: tar.TypeReg, Body: "nope\n"},
+		tarEntry{Name: "escape/through-link", Type: tar.TypeReg, Body: "nope\n"},
+	)
+	for _, layer := range []*bytes.Buffer{base, top} {
+		if err := ApplyLayer(root, layer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		"etc/issue":        "top\n",
+		"var/cache/new":    "new\n",
+		"outside":          "nope\n",
+		"tmp/through-link": "nope\n",
+	}
+	for name, content := range expected {
+		buf, err := ioutil.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(buf) != content {
+			t.Errorf("%s: expected %q, got %q", name, content, buf)
+		}
+	}
+	for _, name := range []string{"etc/motd", "var/cache/old"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be whited out", name)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package export
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SplitManifest describes an archive written as numbered parts, for moving
+// it across media with file size limits
+type SplitManifest struct {
+	// Name is the name of the original archive
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+	Parts  []Part `json:"parts"`
+}
+
+// Part is one piece of a split archive. Name is relative to the manifest.
+type Part struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// ManifestName is the file name of the manifest for a split archive name
+func ManifestName(name string) string {
+	return name + ".parts.json"
+}
+
+// NewSplitWriter returns a writer that writes to the files name.000,
+// name.001, etc. of at most partSize bytes each. On Close, the manifest is
+// written to ManifestName(name).
+func NewSplitWriter(name string, partSize int64) (*SplitWriter, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("invalid part size %d", partSize)
+	}
+	return &SplitWriter{
+		name:     name,
+		partSize: partSize,
+		total:    sha256.New(),
+		manifest: SplitManifest{Name: filepath.Base(name)},
+	}, nil
+}
+
+// SplitWriter is an io.WriteCloser over a split archive
+type SplitWriter struct {
+	name     string
+	partSize int64
+	total    hash.Hash
+	manifest SplitManifest
+
+	cur     *os.File
+	curHash hash.Hash
+	curSize int64
+}
+
+func (sw *SplitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if sw.cur == nil || sw.curSize == sw.partSize {
+			if err := sw.nextPart(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if room := sw.partSize - sw.curSize; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		n, err := sw.cur.Write(chunk)
+		sw.curHash.Write(chunk[:n])
+		sw.total.Write(chunk[:n])
+		sw.curSize += int64(n)
+		sw.manifest.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (sw *SplitWriter) nextPart() error {
+	if err := sw.closePart(); err != nil {
+		return err
+	}
+	fh, err := os.Create(fmt.Sprintf("%s.%03d", sw.name, len(sw.manifest.Parts)))
+	if err != nil {
+		return err
+	}
+	sw.cur = fh
+	sw.curHash = sha256.New()
+	sw.curSize = 0
+	return nil
+}
+
+func (sw *SplitWriter) closePart() error {
+	if sw.cur == nil {
+		return nil
+	}
+	sw.manifest.Parts = append(sw.manifest.Parts, Part{
+		Name:   filepath.Base(sw.cur.Name()),
+		Size:   sw.curSize,
+		Sha256: hex.EncodeToString(sw.curHash.Sum(nil)),
+	})
+	err := sw.cur.Close()
+	sw.cur = nil
+	return err
+}
+
+// Close finishes the last part and writes the manifest
+func (sw *SplitWriter) Close() error {
+	if sw.cur == nil && len(sw.manifest.Parts) == 0 {
+		// always have at least one part, even if empty
+		if err := sw.nextPart(); err != nil {
+			return err
+		}
+	}
+	if err := sw.closePart(); err != nil {
+		return err
+	}
+	sw.manifest.Sha256 = hex.EncodeToString(sw.total.Sum(nil))
+	buf, err := json.MarshalIndent(sw.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ManifestName(sw.name), buf, 0644)
+}
+
+// Manifest is the manifest of the parts written, once closed
+func (sw *SplitWriter) Manifest() SplitManifest {
+	return sw.manifest
+}
+
+// LoadSplitManifest reads the manifest of a split archive
+func LoadSplitManifest(filename string) (*SplitManifest, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sm := &SplitManifest{}
+	if err := json.Unmarshal(buf, sm); err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// PartError is returned when a part of a split archive is missing or does
+// not match its manifest
+type PartError struct {
+	Part   string
+	Reason string
+}
+
+func (e PartError) Error() string {
+	return fmt.Sprintf("part %s: %s", e.Part, e.Reason)
+}
+
+// JoinParts reassembles the split archive described by the manifest file
+// into w, verifying each part and the whole against their checksums. The
+// parts are looked for next to the manifest. Pass ioutil.Discard to only
+// verify.
+func JoinParts(manifestFile string, w io.Writer) error {
+	sm, err := LoadSplitManifest(manifestFile)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(manifestFile)
+	total := sha256.New()
+	var size int64
+	for _, part := range sm.Parts {
+		if filepath.Base(part.Name) != part.Name {
+			return PartError{part.Name, "not a plain file name"}
+		}
+		err := func() error {
+			fh, err := os.Open(filepath.Join(dir, part.Name))
+			if err != nil {
+				return PartError{part.Name, err.Error()}
+			}
+			defer fh.Close()
+			h := sha256.New()
+			n, err := io.Copy(io.MultiWriter(w, h, total), fh)
+			if err != nil {
+				return err
+			}
+			size += n
+			if n != part.Size {
+				return PartError{part.Name, fmt.Sprintf("expected %d bytes, found %d", part.Size, n)}
+			}
+			if sum := hex.EncodeToString(h.Sum(nil)); sum != part.Sha256 {
+				return PartError{part.Name, fmt.Sprintf("expected sha256 %s, found %s", part.Sha256, sum)}
+			}
+			return nil
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	if size != sm.Size {
+		return fmt.Errorf("%s: expected %d bytes in total, found %d", sm.Name, sm.Size, size)
+	}
+	if sum := hex.EncodeToString(total.Sum(nil)); sum != sm.Sha256 {
+		return fmt.Errorf("%s: expected sha256 %s, found %s", sm.Name, sm.Sha256, sum)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package export
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitAndJoin(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.split.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	name := filepath.Join(tdir, "image.tar")
+	sw, err := NewSplitWriter(name, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), 3) // 48 bytes
+	if _, err := sw.Write(content[:7]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write(content[7:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if parts := sw.Manifest().Parts; len(parts) != 5 || parts[4].Size != 8 {
+		t.Fatalf("expected 5 parts with the last having 8 bytes, got %#v", parts)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := JoinParts(ManifestName(name), buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), content) {
+		t.Errorf("joined content differs: %q", buf.Bytes())
+	}
+
+	// corrupt a part
+	if err := ioutil.WriteFile(name+".002", []byte("xxxxxxxxxx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = JoinParts(ManifestName(name), ioutil.Discard)
+	if perr, ok := err.(PartError); !ok || perr.Part != "image.tar.002" {
+		t.Errorf("expected a PartError for image.tar.002, got %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package export
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SquashLayers writes the layers ids of a fetched image in src, listed
+// top-most first like an ancestry, to w as a single layer tar archive with
+// the same effect on the layers below them: what the later layers replace or
+// remove is left out, and the whiteouts of what the layers remove from below
+// are kept, as are opaque directories. The entries are written in the order
+// they were applied, so the layer applies alike whether the whiteouts are
+// applied as they come or at the end. Files hard linked to content a later
+// layer replaced are written as regular files.
+func SquashLayers(src string, ids []string, w io.Writer) error {
+	s := &squash{tree: map[string]*squashEntry{}, opaque: map[string]squashPos{}, spool: map[*squashEntry]string{}}
+	defer s.cleanup()
+	filenames := make([]string, len(ids))
+	for i := range ids {
+		filenames[i] = filepath.Join(src, ids[len(ids)-1-i], "layer.tar")
+	}
+	for layer, filename := range filenames {
+		if err := eachTarEntry(filename, func(index int, hdr *tar.Header, _ io.Reader) error {
+			s.add(squashPos{layer: layer, index: index}, hdr)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return s.write(filenames, w)
+}
+
+// squashPos is where an entry is in the layers squashed, base first
+type squashPos struct {
+	layer, index int
+	// after is set for the opaque whiteouts made up for a directory that
+	// replaced something else, written after the directory's entry
+	after bool
+}
+
+type squashEntry struct {
+	pos      squashPos
+	hdr      *tar.Header
+	whiteout bool
+	// target is the entry a hard link was made to, nil when it is in the
+	// layers below those squashed
+	target *squashEntry
+}
+
+func (e *squashEntry) isDir() bool {
+	return !e.whiteout && e.hdr.Typeflag == tar.TypeDir
+}
+
+type squash struct {
+	// tree is what the layers squashed leave at each path
+	tree map[string]*squashEntry
+	// opaque are the directories hiding what is below them in the lower
+	// layers, and where their opaque whiteout goes
+	opaque map[string]squashPos
+	// spool has the content of the files hard links are made to which later
+	// layers replaced, once read
+	spool map[*squashEntry]string
+}
+
+// remove drops name and what is below it
+func (s *squash) remove(name string) {
+	delete(s.tree, name)
+	delete(s.opaque, name)
+	s.removeBelow(name)
+}
+
+// removeBelow drops what is below the directory name
+func (s *squash) removeBelow(name string) {
+	prefix := name + "/"
+	if name == "" {
+		prefix = ""
+	}
+	for p := range s.tree {
+		if strings.HasPrefix(p, prefix) {
+			delete(s.tree, p)
+		}
+	}
+	for p := range s.opaque {
+		if strings.HasPrefix(p, prefix) && p != name {
+			delete(s.opaque, p)
+		}
+	}
+}
+
+// add applies the entry hdr at pos to the tree
+func (s *squash) add(pos squashPos, hdr *tar.Header) {
+	name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+	if name == "" {
+		return
+	}
+	dir, base := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	switch {
+	case base == WhiteoutOpaque:
+		s.removeBelow(dir)
+		s.opaque[dir] = pos
+		return
+	case strings.HasPrefix(base, WhiteoutPrefix):
+		name = path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+		s.remove(name)
+		s.tree[name] = &squashEntry{pos: pos, hdr: hdr, whiteout: true}
+		return
+	}
+
+	e := &squashEntry{pos: pos, hdr: hdr}
+	existing, ok := s.tree[name]
+	if ok && existing.isDir() && e.isDir() {
+		// a directory over a directory only changes its metadata
+		existing.pos, existing.hdr = pos, hdr
+		return
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		target := s.tree[strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")]
+		if target != nil && target.hdr.Typeflag == tar.TypeLink {
+			target = target.target
+		}
+		if target != nil && !target.whiteout {
+			e.target = target
+		}
+	}
+	if ok {
+		s.remove(name)
+		if e.isDir() {
+			// whatever was below the file or whiteout it replaces stays
+			// hidden
+			s.opaque[name] = squashPos{layer: pos.layer, index: pos.index, after: true}
+		}
+	}
+	s.tree[name] = e
+}
+
+// write writes what is left in the tree in the order it was applied
+func (s *squash) write(filenames []string, w io.Writer) error {
+	kept := map[squashPos]*squashEntry{}
+	for _, e := range s.tree {
+		kept[e.pos] = e
+	}
+	opaques := map[squashPos]string{}
+	for dir, pos := range s.opaque {
+		opaques[pos] = dir
+	}
+	// the targets of links which are no longer there to link to, and so
+	// whose content is kept for the links as it is read
+	spooled := map[squashPos]*squashEntry{}
+	for _, e := range s.tree {
+		if e.target != nil && s.tree[strings.TrimPrefix(path.Clean("/"+e.target.hdr.Name), "/")] != e.target {
+			spooled[e.target.pos] = e.target
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	for layer, filename := range filenames {
+		err := eachTarEntry(filename, func(index int, hdr *tar.Header, r io.Reader) error {
+			pos := squashPos{layer: layer, index: index}
+			if dir, ok := opaques[pos]; ok {
+				return writeOpaque(tw, dir, hdr)
+			}
+			if target, ok := spooled[pos]; ok {
+				return s.spoolContent(target, r)
+			}
+			e, ok := kept[pos]
+			if !ok {
+				return nil
+			}
+			if e.target != nil && s.spool[e.target] != "" {
+				return s.writeSpooled(tw, hdr, e.target)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, r); err != nil {
+				return err
+			}
+			pos.after = true
+			if dir, ok := opaques[pos]; ok {
+				return writeOpaque(tw, dir, hdr)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// spoolContent keeps the content of e, read from r, for the links to it
+func (s *squash) spoolContent(e *squashEntry, r io.Reader) error {
+	fh, err := ioutil.TempFile("", "squash-")
+	if err != nil {
+		return err
+	}
+	s.spool[e] = fh.Name()
+	if _, err := io.Copy(fh, r); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// writeSpooled writes the entry hdr as a regular file of the content spooled
+// of target
+func (s *squash) writeSpooled(tw *tar.Writer, hdr *tar.Header, target *squashEntry) error {
+	fh, err := os.Open(s.spool[target])
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	cp := *hdr
+	cp.Typeflag, cp.Linkname, cp.Size = tar.TypeReg, "", fi.Size()
+	if hdr.Typeflag == tar.TypeLink {
+		cp.Mode, cp.Uid, cp.Gid, cp.Uname, cp.Gname = target.hdr.Mode, target.hdr.Uid, target.hdr.Gid, target.hdr.Uname, target.hdr.Gname
+		cp.ModTime = target.hdr.ModTime
+	}
+	if err := tw.WriteHeader(&cp); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fh)
+	return err
+}
+
+func (s *squash) cleanup() {
+	for _, filename := range s.spool {
+		os.Remove(filename)
+	}
+}
+
+// writeOpaque writes the opaque whiteout of dir, with the times of hdr
+func writeOpaque(tw *tar.Writer, dir string, hdr *tar.Header) error {
+	return tw.WriteHeader(&tar.Header{
+		Name:     path.Join(dir, WhiteoutOpaque),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		ModTime:  hdr.ModTime,
+	})
+}
+
+// eachTarEntry calls fn with each entry of the tar archive filename, counting
+// from zero
+func eachTarEntry(filename string, fn func(index int, hdr *tar.Header, r io.Reader) error) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	tr := tar.NewReader(fh)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(index, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
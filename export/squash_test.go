@@ -0,0 +1,137 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readTree is what is in root, each file by its content and each symlink by
+// its target
+func readTree(t *testing.T, root string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		switch {
+		case fi.IsDir():
+			tree[rel] = "dir"
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = "-> " + target
+		default:
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			tree[rel] = string(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestSquashLayers(t *testing.T) {
+	src, err := ioutil.TempDir("", "test.squash.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+
+	layers := map[string]*bytes.Buffer{
+		"base": makeTar(t,
+			tarEntry{Name: "etc/", Type: tar.TypeDir},
+			tarEntry{Name: "etc/motd", Type: tar.TypeReg, Body: "hello\n"},
+			tarEntry{Name: "etc/issue", Type: tar.TypeReg, Body: "base\n"},
+			tarEntry{Name: "var/cache/", Type: tar.TypeDir},
+			tarEntry{Name: "var/cache/old", Type: tar.TypeReg, Body: "old\n"},
+			tarEntry{Name: "opt/", Type: tar.TypeDir},
+			tarEntry{Name: "opt/tool", Type: tar.TypeReg, Body: "tool\n"},
+			tarEntry{Name: "srv/", Type: tar.TypeDir},
+			tarEntry{Name: "srv/data", Type: tar.TypeReg, Body: "data\n"},
+		),
+		"middle": makeTar(t,
+			tarEntry{Name: "etc/.wh.motd", Type: tar.TypeReg},
+			tarEntry{Name: "tmp/", Type: tar.TypeDir},
+			tarEntry{Name: "tmp/build", Type: tar.TypeReg, Body: "scratch\n"},
+			tarEntry{Name: "bin/", Type: tar.TypeDir},
+			tarEntry{Name: "bin/sh", Type: tar.TypeReg, Body: "old shell\n"},
+			tarEntry{Name: "bin/bash", Type: tar.TypeLink, Linkname: "bin/sh"},
+			tarEntry{Name: "opt", Type: tar.TypeReg, Body: "not a directory\n"},
+			tarEntry{Name: ".wh.srv", Type: tar.TypeReg},
+		),
+		"top": makeTar(t,
+			tarEntry{Name: "tmp/.wh.build", Type: tar.TypeReg},
+			tarEntry{Name: "etc/issue", Type: tar.TypeReg, Body: "top\n"},
+			tarEntry{Name: "var/cache/.wh..wh..opq", Type: tar.TypeReg},
+			tarEntry{Name: "var/cache/new", Type: tar.TypeReg, Body: "new\n"},
+			tarEntry{Name: "bin/sh", Type: tar.TypeReg, Body: "new shell\n"},
+			tarEntry{Name: "opt/", Type: tar.TypeDir},
+			tarEntry{Name: "opt/other", Type: tar.TypeReg, Body: "other\n"},
+			tarEntry{Name: "srv/", Type: tar.TypeDir},
+			tarEntry{Name: "link", Type: tar.TypeSymlink, Linkname: "etc/issue"},
+		),
+	}
+	for id, layer := range layers {
+		if err := os.MkdirAll(filepath.Join(src, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, id, "layer.tar"), layer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := filepath.Join(src, "expected")
+	if err := ExtractLayers(src, []string{"top", "middle", "base"}, expected); err != nil {
+		t.Fatal(err)
+	}
+	squashed := bytes.NewBuffer(nil)
+	if err := SquashLayers(src, []string{"top", "middle"}, squashed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "squashed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "squashed", "layer.tar"), squashed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	actual := filepath.Join(src, "actual")
+	if err := ExtractLayers(src, []string{"squashed", "base"}, actual); err != nil {
+		t.Fatal(err)
+	}
+	if e, a := readTree(t, expected), readTree(t, actual); !reflect.DeepEqual(e, a) {
+		t.Errorf("expected the squashed layer to apply as the layers did:\n%v\ngot\n%v", e, a)
+	}
+
+	entries := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(squashed.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		buf, _ := ioutil.ReadAll(tr)
+		entries[hdr.Name] = string(buf)
+		if hdr.Name == "bin/bash" && hdr.Typeflag != tar.TypeReg {
+			t.Errorf("expected the link to the replaced bin/sh to be a regular file, got %q", hdr.Typeflag)
+		}
+	}
+	if _, ok := entries["tmp/build"]; ok {
+		t.Errorf("expected tmp/build, removed by the top layer, to be left out")
+	}
+	if entries["bin/sh"] != "new shell\n" || entries["bin/bash"] != "old shell\n" {
+		t.Errorf("expected only the new bin/sh, and bin/bash with the old content, got %q and %q", entries["bin/sh"], entries["bin/bash"])
+	}
+}
@@ -0,0 +1,46 @@
+package export
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+var (
+	// MksquashfsPath is the mksquashfs(1) used to build squashfs images
+	MksquashfsPath = "mksquashfs"
+	// MkfsErofsPath is the mkfs.erofs(1) used to build erofs images
+	MkfsErofsPath = "mkfs.erofs"
+)
+
+// SquashFS builds a squashfs filesystem image at out from the directory
+// root, with mksquashfs. Ownership is taken as-is from root, so unprivileged
+// callers get every file owned by root:root.
+func SquashFS(root, out string) error {
+	args := []string{root, out, "-noappend", "-no-progress"}
+	if os.Getuid() != 0 {
+		args = append(args, "-all-root")
+	}
+	return run(MksquashfsPath, args...)
+}
+
+// Erofs builds an erofs filesystem image at out from the directory root,
+// with mkfs.erofs.
+func Erofs(root, out string) error {
+	args := []string{}
+	if os.Getuid() != 0 {
+		args = append(args, "--all-root")
+	}
+	return run(MkfsErofsPath, append(args, out, root)...)
+}
+
+func run(name string, args ...string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s is needed for this export format: %w", name, err)
+	}
+	cmd := exec.Command(name, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, output)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"strings"
+)
+
+// SSHCommand is the ssh client NewSSHWriter runs
+var SSHCommand = "ssh"
+
+// IsSSHDestination reports whether dest is a remote destination, like
+// "ssh://host/path"
+func IsSSHDestination(dest string) bool {
+	return strings.HasPrefix(dest, "ssh://")
+}
+
+// NewSSHWriter returns a writer streaming to the file at dest on a remote
+// machine, like "ssh://user@host:2222/srv/images/app.tar" (or
+// "ssh://host/~/app.tar" for a file in the home directory), through the ssh
+// client, so that nothing is staged on the local disk. The file is written
+// under a temporary name and renamed into place on Close, so an interrupted
+// transfer does not leave a truncated archive there.
+func NewSSHWriter(dest string) (*SSHWriter, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" || u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, fmt.Errorf("%q is not like ssh://[user@]host[:port]/path", dest)
+	}
+	filename := u.Path
+	if strings.HasPrefix(filename, "/~/") {
+		// relative to the home directory, where ssh starts
+		filename = filename[len("/~/"):]
+	}
+	args := []string{}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	host := u.Hostname()
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	partial := shellQuote(filename + ".partial")
+	args = append(args, "--", host, fmt.Sprintf("cat > %s && mv %s %s", partial, partial, shellQuote(filename)))
+
+	sw := &SSHWriter{dest: dest, cmd: exec.Command(SSHCommand, args...)}
+	sw.cmd.Stderr = &sw.stderr
+	if sw.stdin, err = sw.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := sw.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// SSHWriter is an io.WriteCloser over a file on a remote machine
+type SSHWriter struct {
+	dest   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+func (sw *SSHWriter) Write(p []byte) (int, error) {
+	n, err := sw.stdin.Write(p)
+	if err != nil {
+		return n, sw.wait(err)
+	}
+	return n, nil
+}
+
+// Close finishes the transfer, and waits for the file to be in place
+func (sw *SSHWriter) Close() error {
+	if sw.waited {
+		return sw.err
+	}
+	if err := sw.stdin.Close(); err != nil {
+		return sw.wait(err)
+	}
+	return sw.wait(nil)
+}
+
+// wait waits for ssh to exit, returning why it failed if it did, or else err
+func (sw *SSHWriter) wait(err error) error {
+	if sw.waited {
+		return sw.err
+	}
+	sw.waited = true
+	if waitErr := sw.cmd.Wait(); waitErr != nil {
+		err = waitErr
+	}
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(sw.stderr.String()); msg != "" {
+		sw.err = fmt.Errorf("%s: %s: %s", sw.dest, err, msg)
+	} else {
+		sw.err = fmt.Errorf("%s: %w", sw.dest, err)
+	}
+	return sw.err
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,63 @@
+package export
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSHWriter(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.ssh.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	// an ssh running the remote command locally
+	fakeSSH := filepath.Join(tdir, "ssh")
+	script := "#!/bin/sh\nwhile [ \"$1\" != -- ]; do shift; done\nshift 2\nexec sh -c \"$1\"\n"
+	if err := ioutil.WriteFile(fakeSSH, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(cmd string) { SSHCommand = cmd }(SSHCommand)
+	SSHCommand = fakeSSH
+
+	name := filepath.Join(tdir, "it's here.tar")
+	sw, err := NewSSHWriter("ssh://someone@example.com:2222" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sw.Write([]byte("archive")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected nothing in place before Close, got %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "archive" {
+		t.Errorf("expected %q, got %q", "archive", buf)
+	}
+
+	// failures of the remote command are reported
+	sw, err = NewSSHWriter("ssh://example.com" + filepath.Join(tdir, "missing", "image.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw.Write([]byte("archive"))
+	if err := sw.Close(); err == nil {
+		t.Errorf("expected an error writing to a missing directory")
+	}
+
+	for _, dest := range []string{"ssh://example.com", "ssh:///image.tar", "ssh://example.com/images/"} {
+		if _, err := NewSSHWriter(dest); err == nil {
+			t.Errorf("%q: expected an error", dest)
+		}
+	}
+}
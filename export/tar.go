@@ -0,0 +1,224 @@
+package export
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// PipelineBuffers and PipelineBufferSize bound the memory used to read
+	// ahead of the archive being written
+	PipelineBuffers    = 8
+	PipelineBufferSize = 1 << 20
+)
+
+// LayerChecksumFile and PartialSuffix name the bookkeeping files of the
+// fetches, which are not part of the images: the checksum recorded beside
+// each layer.tar, and the downloads in progress
+const (
+	LayerChecksumFile = "layer.tar.sum"
+	PartialSuffix     = ".partial"
+)
+
+// Excluded reports whether the file name, of a directory images were
+// fetched into, is bookkeeping left out of their archives
+func Excluded(name string) bool {
+	name = filepath.Base(name)
+	return name == LayerChecksumFile || strings.HasSuffix(name, PartialSuffix)
+}
+
+// pipelineItem is either the header of the next entry, a chunk of the
+// current entry's content, or an error from the reading side
+type pipelineItem struct {
+	hdr   *tar.Header
+	chunk []byte
+	err   error
+}
+
+// TarDirectory writes the contents of dir to w as a tar archive, with names
+// relative to dir, in a stable order. The content of the files is read ahead
+// by a separate goroutine into a bounded set of buffers (PipelineBuffers of
+// PipelineBufferSize), so that reading from the source disk overlaps with
+// writing the archive, while memory stays bounded however large the image.
+// The files that are Excluded are left out.
+func TarDirectory(dir string, w io.Writer) error {
+	var (
+		pool  = make(chan []byte, PipelineBuffers)
+		items = make(chan pipelineItem, PipelineBuffers)
+		done  = make(chan struct{})
+	)
+	for i := 0; i < PipelineBuffers; i++ {
+		pool <- make([]byte, PipelineBufferSize)
+	}
+	defer close(done)
+	go readAhead(dir, pool, items, done)
+
+	tw := tar.NewWriter(w)
+	for item := range items {
+		switch {
+		case item.err != nil:
+			return item.err
+		case item.hdr != nil:
+			if err := tw.WriteHeader(item.hdr); err != nil {
+				return err
+			}
+		default:
+			_, err := tw.Write(item.chunk)
+			pool <- item.chunk[:cap(item.chunk)]
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// readAhead walks dir, sending the header and content chunks of each entry
+// on items, until finished or done is closed
+func readAhead(dir string, pool chan []byte, items chan<- pipelineItem, done <-chan struct{}) {
+	defer close(items)
+	send := func(item pipelineItem) bool {
+		select {
+		case items <- item:
+			return true
+		case <-done:
+			return false
+		}
+	}
+
+	err := walkSorted(dir, func(p string, fi os.FileInfo) error {
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if name == "." || (!fi.IsDir() && Excluded(name)) {
+			return nil
+		}
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if !send(pipelineItem{hdr: hdr}) {
+			return errStopped
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		fh, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		remaining := fi.Size()
+		for remaining > 0 {
+			var buf []byte
+			select {
+			case buf = <-pool:
+			case <-done:
+				return errStopped
+			}
+			if int64(len(buf)) > remaining {
+				buf = buf[:remaining]
+			}
+			n, err := io.ReadFull(fh, buf)
+			if err != nil {
+				return err
+			}
+			remaining -= int64(n)
+			if !send(pipelineItem{chunk: buf[:n]}) {
+				return errStopped
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopped {
+		send(pipelineItem{err: err})
+	}
+}
+
+var errStopped = io.ErrClosedPipe
+
+// walkSorted is filepath.Walk, without following symlinks, visiting entries
+// in lexical order
+func walkSorted(p string, fn func(string, os.FileInfo) error) error {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if err := fn(p, fi); err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	names, err := readDirNames(p)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := walkSorted(filepath.Join(p, name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UntarDirectory extracts the tar archive read from r into dir, the reverse
+// of TarDirectory. Only directories and regular files are extracted, and
+// none outside of dir.
+func UntarDirectory(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := SecureJoin(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			fh, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(fh, tr)
+			if closeErr := fh.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unexpected entry of type %q", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
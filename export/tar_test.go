@@ -0,0 +1,100 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test.tar.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// bigger than all of the buffers, to exercise their reuse
+	origBuffers, origSize := PipelineBuffers, PipelineBufferSize
+	PipelineBuffers, PipelineBufferSize = 2, 16
+	defer func() { PipelineBuffers, PipelineBufferSize = origBuffers, origSize }()
+	big := bytes.Repeat([]byte("layer content! "), 20)
+
+	id := "511136ea3c5a64f264b78b5433614aec563103b4d4702f3ba7d4d2698e22c158"
+	if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"repositories":    []byte(`{"busybox":{"latest":"` + id + `"}}`),
+		id + "/json":      []byte(`{"id":"` + id + `"}`),
+		id + "/layer.tar": big,
+		id + "/VERSION":   []byte("1.0"),
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the bookkeeping of the fetches is left out
+	for _, name := range []string{id + "/" + LayerChecksumFile, id + "/layer.tar" + PartialSuffix} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := TarDirectory(dir, buf); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	tr := tar.NewReader(buf)
+	names := []string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if expected, ok := files[hdr.Name]; ok {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, expected) {
+				t.Errorf("%s: content differs", hdr.Name)
+			}
+		}
+	}
+	expected := []string{id + "/", id + "/VERSION", id + "/json", id + "/layer.tar", "repositories"}
+	if len(names) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("at %d: expected %q, got %q", i, expected[i], names[i])
+		}
+	}
+
+	// and back
+	out := filepath.Join(dir, "out")
+	if err := UntarDirectory(bytes.NewReader(archive), out); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		buf, err := ioutil.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, content) {
+			t.Errorf("%s: content differs once extracted", name)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package opts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ByteSize is a flag value for a size in bytes, accepting suffixes like
+// "512K", "100M", "4G" or "4GiB" (powers of 1024)
+type ByteSize int64
+
+func (bs *ByteSize) Set(arg string) error {
+	n, err := ParseByteSize(arg)
+	if err != nil {
+		return err
+	}
+	*bs = ByteSize(n)
+	return nil
+}
+
+func (bs ByteSize) String() string {
+	for _, u := range sizeUnits {
+		if bs != 0 && int64(bs)%u.mult == 0 {
+			return fmt.Sprintf("%d%s", int64(bs)/u.mult, strings.TrimSuffix(u.suffix, "B"))
+		}
+	}
+	return "0"
+}
+
+// ParseByteSize parses a size like "4G" into bytes
+func ParseByteSize(arg string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(arg))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSuffix(str, u.suffix)
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", arg)
+	}
+	return n * mult, nil
+}
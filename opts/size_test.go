@@ -0,0 +1,40 @@
+package opts
+
+import (
+	"testing"
+)
+
+func TestByteSize(t *testing.T) {
+	cases := []struct {
+		Arg      string
+		Expected int64
+		String   string
+	}{
+		{"100", 100, "100"},
+		{"512K", 512 << 10, "512K"},
+		{"4G", 4 << 30, "4G"},
+		{"4GiB", 4 << 30, "4G"},
+		{"650mb", 650 << 20, "650M"},
+		{"1536M", 1536 << 20, "1536M"},
+	}
+	for _, c := range cases {
+		var bs ByteSize
+		if err := bs.Set(c.Arg); err != nil {
+			t.Errorf("%q: %s", c.Arg, err)
+			continue
+		}
+		if int64(bs) != c.Expected {
+			t.Errorf("%q: expected %d, got %d", c.Arg, c.Expected, bs)
+		}
+		if bs.String() != c.String {
+			t.Errorf("%q: expected %q, got %q", c.Arg, c.String, bs.String())
+		}
+	}
+
+	for _, arg := range []string{"", "G", "-1", "4X"} {
+		var bs ByteSize
+		if err := bs.Set(arg); err == nil {
+			t.Errorf("%q: expected an error", arg)
+		}
+	}
+}
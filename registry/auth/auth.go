@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Doer sends HTTP requests, like an *http.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DoerFunc adapts a function to a Doer
+type DoerFunc func(req *http.Request) (*http.Response, error)
+
+func (f DoerFunc) Do(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ClientID identifies this tool to OAuth2 auth servers
+var ClientID = "docker-fetch"
+
+// ErrNoToken is returned when the auth server responds without a token
+var ErrNoToken = errors.New("auth server did not provide a token")
+
+// Challenge is a parsed WWW-Authenticate header
+type Challenge struct {
+	// Scheme is like "Bearer" or "Basic"
+	Scheme string
+	Params map[string]string
+}
+
+// IsBearer reports whether this is a challenge for a bearer token
+func (c Challenge) IsBearer() bool {
+	return strings.EqualFold(c.Scheme, "bearer")
+}
+
+// ParseChallenge parses a `Bearer realm="...",service="...",scope="..."`
+// style WWW-Authenticate header value
+func ParseChallenge(header string) Challenge {
+	c := Challenge{Params: map[string]string{}}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	c.Scheme = parts[0]
+	if len(parts) != 2 {
+		return c
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.Index(rest, ","); comma >= 0 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		c.Params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return c
+}
+
+// DefaultTokenLifetime is how long a bearer token is valid for when the auth
+// server does not say, in expires_in or the exp claim of a JWT
+var DefaultTokenLifetime = 60 * time.Second
+
+// expiryLeeway is taken off the lifetime of tokens, so that they are not
+// sent just as they expire
+const expiryLeeway = 5 * time.Second
+
+// BearerToken is a token from an auth server, valid until Expires
+type BearerToken struct {
+	Token   string
+	Expires time.Time
+}
+
+// Expired reports whether the token is expired, or about to be
+func (t BearerToken) Expired() bool {
+	return !time.Now().Add(expiryLeeway).Before(t.Expires)
+}
+
+// RequestToken requests a bearer token for scope. See RequestBearerToken.
+func RequestToken(client Doer, c Challenge, scope string, creds Credentials) (string, error) {
+	tok, err := RequestBearerToken(client, c, scope, creds)
+	return tok.Token, err
+}
+
+// StatusError is returned when the auth server responds with another status
+// than 200, like a 401 for credentials it refuses
+type StatusError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("%s(%q) returned %q", e.Method[:1]+strings.ToLower(e.Method[1:]), e.URL, e.Status)
+}
+
+// RequestBearerToken requests a bearer token for scope (like
+// "repository:library/busybox:pull") from the auth server named in the
+// challenge. Non-empty creds are sent as basic auth, or with an identity
+// token, exchanged through the OAuth2 refresh token grant.
+func RequestBearerToken(client Doer, c Challenge, scope string, creds Credentials) (BearerToken, error) {
+	realm, ok := c.Params["realm"]
+	if !c.IsBearer() || !ok {
+		return BearerToken{}, fmt.Errorf("unsupported auth challenge %s %v", c.Scheme, c.Params)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return BearerToken{}, err
+	}
+	q := u.Query()
+	if service, ok := c.Params["service"]; ok {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+
+	var req *http.Request
+	if creds.IdentityToken != "" {
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", creds.IdentityToken)
+		q.Set("client_id", ClientID)
+		req, err = http.NewRequest("POST", u.String(), strings.NewReader(q.Encode()))
+		if err != nil {
+			return BearerToken{}, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return BearerToken{}, err
+		}
+		if creds.Username != "" || creds.Password != "" {
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return BearerToken{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return BearerToken{}, StatusError{Method: req.Method, URL: u.String(), Status: resp.Status, StatusCode: resp.StatusCode}
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return BearerToken{}, err
+	}
+	if tr.Token == "" {
+		tr.Token = tr.AccessToken
+	}
+	if tr.Token == "" {
+		return BearerToken{}, ErrNoToken
+	}
+	expires := time.Now().Add(DefaultTokenLifetime)
+	if tr.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	} else if exp, ok := jwtExpiry(tr.Token); ok {
+		// by the auth server's clock, as issued_at, which is left alone
+		expires = exp
+	}
+	return BearerToken{Token: tr.Token, Expires: expires}, nil
+}
+
+// jwtExpiry is the exp claim of token, if it is a JWT with one
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseChallenge(t *testing.T) {
+	c := ParseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	if !c.IsBearer() {
+		t.Errorf("expected a bearer challenge, got %q", c.Scheme)
+	}
+	expected := map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/busybox:pull",
+	}
+	for k, v := range expected {
+		if c.Params[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, c.Params[k])
+		}
+	}
+	if c := ParseChallenge(`Basic realm="foo"`); c.IsBearer() || c.Params["realm"] != "foo" {
+		t.Errorf("unexpected basic challenge %#v", c)
+	}
+}
+
+func TestRequestBearerTokenExpiry(t *testing.T) {
+	expiresIn := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if expiresIn > 0 {
+			fmt.Fprintf(w, `{"token":"sekrit","expires_in":%d}`, expiresIn)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"sekrit"}`)
+	}))
+	defer ts.Close()
+	c := Challenge{Scheme: "Bearer", Params: map[string]string{"realm": ts.URL}}
+
+	for _, expiresIn = range []int{0, 300} {
+		before := time.Now()
+		tok, err := RequestBearerToken(http.DefaultClient, c, "repository:test/image:pull", Credentials{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lifetime := DefaultTokenLifetime
+		if expiresIn > 0 {
+			lifetime = time.Duration(expiresIn) * time.Second
+		}
+		if tok.Token != "sekrit" || tok.Expires.Before(before.Add(lifetime)) || tok.Expires.After(time.Now().Add(lifetime)) {
+			t.Errorf("expires_in %d: unexpected token %#v", expiresIn, tok)
+		}
+		if tok.Expired() {
+			t.Errorf("expires_in %d: expected the token to be valid", expiresIn)
+		}
+	}
+	// without expires_in, a JWT expires as its exp claim says
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	jwt := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix()))) + ".c2ln"
+	jwtServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"token":%q}`, jwt)
+	}))
+	defer jwtServer.Close()
+	c.Params["realm"] = jwtServer.URL
+	tok, err := RequestBearerToken(http.DefaultClient, c, "repository:test/image:pull", Credentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Expires.Equal(exp) {
+		t.Errorf("expected the token to expire at %s, got %s", exp, tok.Expires)
+	}
+	if !(BearerToken{Token: "sekrit", Expires: time.Now().Add(time.Second)}).Expired() {
+		t.Errorf("expected a token about to expire to be treated as expired")
+	}
+}
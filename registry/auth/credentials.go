@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials authenticate to a registry, with a username and password, or
+// an identity token (an OAuth2 refresh token)
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// Empty reports whether there are no credentials, for anonymous access
+func (c Credentials) Empty() bool {
+	return c.Username == "" && c.Password == "" && c.IdentityToken == ""
+}
+
+// Keychain provides the credentials to use for a registry host
+type Keychain interface {
+	// Credentials returns the credentials for host, which are Empty if there
+	// are none
+	Credentials(host string) (Credentials, error)
+}
+
+// Basic is a Keychain of the same username and password for every host
+func Basic(username, password string) Keychain {
+	return basicKeychain{Username: username, Password: password}
+}
+
+type basicKeychain Credentials
+
+func (b basicKeychain) Credentials(host string) (Credentials, error) {
+	return Credentials(b), nil
+}
+
+// HostKeychain is a Keychain of the credentials given for some hosts, and of
+// Keychain, if set, for the others
+type HostKeychain struct {
+	Hosts    map[string]Credentials
+	Keychain Keychain
+}
+
+func (hk HostKeychain) Credentials(host string) (Credentials, error) {
+	for key, creds := range hk.Hosts {
+		if normalizeHost(key) == normalizeHost(host) {
+			return creds, nil
+		}
+	}
+	if hk.Keychain == nil {
+		return Credentials{}, nil
+	}
+	return hk.Keychain.Credentials(host)
+}
+
+// DockerConfig is the part of a docker CLI config.json that concerns
+// credentials
+type DockerConfig struct {
+	Auths map[string]AuthConfig `json:"auths"`
+	// CredHelpers names the docker-credential-<name> helper per host
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+	// CredsStore is the helper for hosts without one in CredHelpers
+	CredsStore string `json:"credsStore,omitempty"`
+}
+
+// AuthConfig is an entry of the "auths" of a DockerConfig
+type AuthConfig struct {
+	// Auth is the base64 of "username:password"
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// DockerHubAuthKey is the key the docker CLI stores Docker Hub credentials
+// under
+const DockerHubAuthKey = "https://index.docker.io/v1/"
+
+// DefaultDockerConfigPath is the config.json the docker CLI uses: in
+// $DOCKER_CONFIG, or ~/.docker
+func DefaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// LoadDockerConfig reads a docker CLI config.json. A missing file is an
+// empty config.
+func LoadDockerConfig(filename string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, config); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return config, nil
+}
+
+// Credentials returns the credentials for host, like the docker CLI: from
+// its helper in CredHelpers, or else the CredsStore helper, or else from
+// Auths. The keys of these may be URLs (like DockerHubAuthKey) rather than
+// bare hosts.
+func (dc *DockerConfig) Credentials(host string) (Credentials, error) {
+	serverURL := host
+	if normalizeHost(host) == normalizeHost(hubHost) {
+		serverURL = DockerHubAuthKey
+	}
+	for key, helper := range dc.CredHelpers {
+		if authKeyHost(key) == normalizeHost(host) {
+			return HelperCredentials(helper, serverURL)
+		}
+	}
+	if dc.CredsStore != "" {
+		return HelperCredentials(dc.CredsStore, serverURL)
+	}
+
+	for key, ac := range dc.Auths {
+		if authKeyHost(key) != normalizeHost(host) {
+			continue
+		}
+		creds := Credentials{Username: ac.Username, Password: ac.Password, IdentityToken: ac.IdentityToken}
+		if ac.Auth != "" {
+			buf, err := base64.StdEncoding.DecodeString(ac.Auth)
+			if err != nil {
+				return Credentials{}, fmt.Errorf("auth for %s: %w", key, err)
+			}
+			parts := strings.SplitN(string(buf), ":", 2)
+			if len(parts) != 2 {
+				return Credentials{}, fmt.Errorf("auth for %s is not username:password", key)
+			}
+			creds.Username, creds.Password = parts[0], parts[1]
+		}
+		return creds, nil
+	}
+	return Credentials{}, nil
+}
+
+// authKeyHost is the host of a key of Auths, like "https://index.docker.io/v1/"
+func authKeyHost(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	if i := strings.Index(key, "/"); i >= 0 {
+		key = key[:i]
+	}
+	return normalizeHost(key)
+}
+
+// hubHost is the name the Docker Hub is normalized to
+const hubHost = "index.docker.io"
+
+// normalizeHost maps the names of the Docker Hub to one
+func normalizeHost(host string) string {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return hubHost
+	}
+	return host
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDockerConfigCredentials(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.auth.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	filename := filepath.Join(tdir, "config.json")
+	config := `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "am9lOmh1bnRlcjI="},
+		"localhost:5000": {"username": "jane", "password": "s3cret"},
+		"quay.io": {"identitytoken": "refresh-me"}
+	},
+	"credHelpers": {"123.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"}
+}`
+	if err := ioutil.WriteFile(filename, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dc, err := LoadDockerConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		Host     string
+		Expected Credentials
+	}{
+		{"index.docker.io", Credentials{Username: "joe", Password: "hunter2"}},
+		{"docker.io", Credentials{Username: "joe", Password: "hunter2"}},
+		{"localhost:5000", Credentials{Username: "jane", Password: "s3cret"}},
+		{"quay.io", Credentials{IdentityToken: "refresh-me"}},
+		{"example.com", Credentials{}},
+	}
+	for _, c := range cases {
+		creds, err := dc.Credentials(c.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds != c.Expected {
+			t.Errorf("%s: expected %#v, got %#v", c.Host, c.Expected, creds)
+		}
+	}
+	if dc.CredHelpers["123.dkr.ecr.us-east-1.amazonaws.com"] != "ecr-login" {
+		t.Errorf("expected the credHelpers to be read, got %v", dc.CredHelpers)
+	}
+
+	if dc, err := LoadDockerConfig(filepath.Join(tdir, "missing.json")); err != nil || len(dc.Auths) != 0 {
+		t.Errorf("expected a missing config to be empty, got %v, %v", dc, err)
+	}
+}
+
+func TestDockerConfigHelpers(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.auth.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	// a helper that knows of one server, and echoes its name as the username
+	helper := `#!/bin/sh
+read server
+case "$server" in
+	*.example.com|https://index.docker.io/v1/)
+		echo "{\"ServerURL\":\"$server\",\"Username\":\"$server\",\"Secret\":\"s3cret\"}" ;;
+	token.example.org)
+		echo '{"Username":"<token>","Secret":"refresh-me"}' ;;
+	*)
+		echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(tdir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	origPath := os.Getenv("PATH")
+	os.Setenv("PATH", tdir+string(os.PathListSeparator)+origPath)
+	defer os.Setenv("PATH", origPath)
+
+	dc := &DockerConfig{
+		Auths:       map[string]AuthConfig{"other.example.net": {Username: "jane", Password: "file"}},
+		CredHelpers: map[string]string{"registry.example.com": "test", "token.example.org": "test", "broken.example.com": "missing"},
+	}
+	cases := []struct {
+		Host     string
+		Expected Credentials
+	}{
+		{"registry.example.com", Credentials{Username: "registry.example.com", Password: "s3cret"}},
+		{"token.example.org", Credentials{IdentityToken: "refresh-me"}},
+		{"other.example.net", Credentials{Username: "jane", Password: "file"}},
+	}
+	for _, c := range cases {
+		creds, err := dc.Credentials(c.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds != c.Expected {
+			t.Errorf("%s: expected %#v, got %#v", c.Host, c.Expected, creds)
+		}
+	}
+	if _, err := dc.Credentials("broken.example.com"); err == nil {
+		t.Errorf("expected a missing helper to fail")
+	}
+
+	dc.CredsStore = "test"
+	if creds, err := dc.Credentials("docker.io"); err != nil || creds.Username != DockerHubAuthKey {
+		t.Errorf("expected the store to be asked for %s, got %#v, %v", DockerHubAuthKey, creds, err)
+	}
+	if creds, err := dc.Credentials("unknown.example.net"); err != nil || !creds.Empty() {
+		t.Errorf("expected no credentials, got %#v, %v", creds, err)
+	}
+}
+
+func TestHostKeychain(t *testing.T) {
+	hk := HostKeychain{
+		Hosts: map[string]Credentials{
+			"docker.io":      {Username: "joe", Password: "hunter2"},
+			"localhost:5000": {Username: "jane", Password: "s3cret"},
+		},
+		Keychain: &DockerConfig{Auths: map[string]AuthConfig{"quay.io": {Username: "bob", Password: "pass"}}},
+	}
+	cases := []struct {
+		Host     string
+		Expected Credentials
+	}{
+		{"index.docker.io", Credentials{Username: "joe", Password: "hunter2"}},
+		{"localhost:5000", Credentials{Username: "jane", Password: "s3cret"}},
+		{"quay.io", Credentials{Username: "bob", Password: "pass"}},
+		{"example.com", Credentials{}},
+	}
+	for _, c := range cases {
+		creds, err := hk.Credentials(c.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if creds != c.Expected {
+			t.Errorf("%s: expected %#v, got %#v", c.Host, c.Expected, creds)
+		}
+	}
+	if creds, err := (HostKeychain{}).Credentials("example.com"); err != nil || !creds.Empty() {
+		t.Errorf("expected no credentials, got %#v, %v", creds, err)
+	}
+}
@@ -0,0 +1,4 @@
+// Package auth implements the token authentication of Docker registries:
+// parsing WWW-Authenticate challenges and requesting bearer tokens. It has no
+// dependency on the rest of this repository.
+package auth
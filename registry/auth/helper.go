@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// CredentialHelperPrefix is prepended to the names of credential helpers
+// to get the program to run, like docker-credential-osxkeychain
+var CredentialHelperPrefix = "docker-credential-"
+
+// helperNotFound is what helpers print when they have no credentials for a
+// server
+const helperNotFound = "credentials not found in native keychain"
+
+// HelperCredentials gets the credentials for serverURL (a host, or
+// DockerHubAuthKey for the Docker Hub) from the docker credential helper
+// name, like "osxkeychain", "secretservice", "wincred" or "ecr-login". A
+// helper without credentials for the server gives Empty credentials.
+func HelperCredentials(name, serverURL string) (Credentials, error) {
+	program := CredentialHelperPrefix + name
+	cmd := exec.Command(program, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), helperNotFound) {
+			return Credentials{}, nil
+		}
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		return Credentials{}, fmt.Errorf("%s get %s: %s %s", program, serverURL, err, msg)
+	}
+	var out struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return Credentials{}, fmt.Errorf("%s get %s: %w", program, serverURL, err)
+	}
+	// identity tokens are stored with this placeholder username
+	if out.Username == "<token>" {
+		return Credentials{IdentityToken: out.Secret}, nil
+	}
+	return Credentials{Username: out.Username, Password: out.Secret}, nil
+}
@@ -0,0 +1,47 @@
+package fetch
+
+import (
+	"strings"
+)
+
+// AddAlias records name as another name of the image, like "myapp:latest"
+// for "myapp:1.2.3", or ":latest" for another tag of the same repository, so
+// that the image is tagged with it too when written out: in the
+// `repositories` file, the manifest.json of a `docker save` archive and the
+// index.json of an OCI layout, sharing the layers of the image rather than
+// duplicating them. A name that is not a valid reference fails, see
+// ParseImageRef.
+func (ir *ImageRef) AddAlias(name string) error {
+	if strings.HasPrefix(name, ":") {
+		name = ir.Host() + "/" + ir.Name() + name
+	}
+	alias, err := ParseImageRef(name)
+	if err != nil {
+		return err
+	}
+	for _, a := range ir.aliases {
+		if a.String() == alias.String() {
+			return nil
+		}
+	}
+	ir.aliases = append(ir.aliases, alias)
+	return nil
+}
+
+// Aliases are the names added with AddAlias
+func (ir ImageRef) Aliases() []*ImageRef {
+	return ir.aliases
+}
+
+// repoTags are the "name:tag" of img and of each of its aliases
+func (ir ImageRef) repoTags() []string {
+	tags := []string{ir.Name() + ":" + ir.Tag()}
+	seen := map[string]bool{tags[0]: true}
+	for _, a := range ir.aliases {
+		if tag := a.Name() + ":" + a.Tag(); !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,80 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImageAliases(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	src := t.TempDir()
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, src); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{":stable", "myapp:1.2.3", ":stable"} {
+		if err := ref.AddAlias(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ref.AddAlias("Not/Valid"); err == nil {
+		t.Error("expected an invalid name to be refused")
+	}
+	if len(ref.Aliases()) != 2 || ref.Aliases()[0].String() != tr.Host()+"/test/image:stable" {
+		t.Fatalf("expected the two aliases, got %v", ref.Aliases())
+	}
+
+	buf, err := FormatRepositories(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repos Repositories
+	if err := json.Unmarshal(buf, &repos); err != nil {
+		t.Fatal(err)
+	}
+	if repos["test/image"]["latest"] != ref.ID() || repos["test/image"]["stable"] != ref.ID() || repos["library/myapp"]["1.2.3"] != ref.ID() {
+		t.Errorf("expected every name tagged with %s, got %v", ref.ID(), repos)
+	}
+
+	manifest, _, err := FormatManifest(src, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []dockerSaveManifest
+	if err := json.Unmarshal(manifest, &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || strings.Join(entries[0].RepoTags, ",") != "test/image:latest,test/image:stable,library/myapp:1.2.3" {
+		t.Errorf("expected a single image with every tag, got %+v", entries)
+	}
+
+	dest := t.TempDir()
+	desc, err := WriteOCILayout(ref, src, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(dest, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(buf, &index); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, m := range index.Manifests {
+		if m.Digest != desc.Digest {
+			t.Errorf("expected the manifest %s under every name, got %s", desc.Digest, m.Digest)
+		}
+		names = append(names, m.Annotations[AnnotationRefName])
+	}
+	// the alias of another repository has the names qualified
+	expected := tr.Host() + "/test/image:latest," + tr.Host() + "/test/image:stable,docker.io/library/myapp:1.2.3"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("expected the ref names %s, got %v", expected, names)
+	}
+}
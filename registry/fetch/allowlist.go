@@ -0,0 +1,115 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DigestChecker vets the digest of the manifest of an image before any of
+// its layers is fetched, as for environments only allowed images recorded
+// by an allow-list service or a transparency log
+type DigestChecker interface {
+	// CheckDigest returns an ErrDigestNotAllowed when digest, of the
+	// manifest of img, may not be fetched
+	CheckDigest(ctx context.Context, img *ImageRef, digest string) error
+}
+
+// ErrDigestNotAllowed is returned when a DigestChecker refuses the digest of
+// an image
+type ErrDigestNotAllowed struct {
+	Ref    string
+	Digest string
+}
+
+func (e ErrDigestNotAllowed) Error() string {
+	return fmt.Sprintf("%s: digest %s is not allowed", e.Ref, e.Digest)
+}
+
+// HTTPDigestChecker looks digests up over HTTP: a GET of the URL, with
+// "{digest}" in it replaced by the digest, or else the digest appended as
+// the last element of its path. A 200 means the digest is present, and
+// allowed, and a 404 that it is not; any other status is an error, as the
+// check could not be made. The digests found are remembered.
+type HTTPDigestChecker struct {
+	URL string
+	// Header is sent with each lookup, like an Authorization for the service
+	Header http.Header
+	// Client is used for the lookups, or http.DefaultClient
+	Client *http.Client
+
+	mu      sync.Mutex
+	allowed map[string]bool
+}
+
+// NewHTTPDigestChecker returns an HTTPDigestChecker of the lookup URL, like
+// "https://allow.example.com/digests/{digest}"
+func NewHTTPDigestChecker(urlStr string) *HTTPDigestChecker {
+	return &HTTPDigestChecker{URL: urlStr, allowed: map[string]bool{}}
+}
+
+// lookupURL is the URL digest is looked up at
+func (c *HTTPDigestChecker) lookupURL(digest string) string {
+	if strings.Contains(c.URL, "{digest}") {
+		return strings.Replace(c.URL, "{digest}", digest, -1)
+	}
+	return strings.TrimSuffix(c.URL, "/") + "/" + digest
+}
+
+// CheckDigest looks digest up at the URL
+func (c *HTTPDigestChecker) CheckDigest(ctx context.Context, img *ImageRef, digest string) error {
+	c.mu.Lock()
+	allowed := c.allowed[digest]
+	c.mu.Unlock()
+	if allowed {
+		return nil
+	}
+
+	urlStr := c.lookupURL(digest)
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range c.Header {
+		req.Header[k] = v
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.mu.Lock()
+		if c.allowed == nil {
+			c.allowed = map[string]bool{}
+		}
+		c.allowed[digest] = true
+		c.mu.Unlock()
+		return nil
+	case http.StatusNotFound:
+		return ErrDigestNotAllowed{Ref: img.String(), Digest: digest}
+	default:
+		return newResponseError(urlStr, resp)
+	}
+}
+
+// checkDigest has the DigestChecker vet the digest of the manifest of img,
+// which must come from a v2 registry for it to have one. For a manifest list,
+// that is the manifest of the image for its platform.
+func (re *RegistryEndpoint) checkDigest(ctx context.Context, img *ImageRef) error {
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return fmt.Errorf("%s: images of v1 registries have no digest to check", img)
+	}
+	v2, err := re.v2Resolve(ctx, img)
+	if err != nil {
+		return err
+	}
+	return re.DigestChecker.CheckDigest(ctx, img, v2.manifestDigest)
+}
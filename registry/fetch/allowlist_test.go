@@ -0,0 +1,82 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDigestChecker(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var mu sync.Mutex
+	allowed := map[string]bool{}
+	lookups := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		if r.Header.Get("Authorization") != "Bearer log" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !allowed[strings.TrimPrefix(r.URL.Path, "/entries/")] {
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	checker := NewHTTPDigestChecker(ts.URL + "/entries/{digest}")
+	checker.Client = ts.Client()
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.DigestChecker = checker
+	if _, err := r.FetchLayers(ref, tdir); err == nil {
+		t.Errorf("expected the lookup to fail without authorization")
+	}
+	checker.Header = http.Header{"Authorization": {"Bearer log"}}
+	var notAllowed ErrDigestNotAllowed
+	if _, err := r.FetchLayers(tr.Ref(), tdir); !errors.As(err, &notAllowed) || notAllowed.Digest != digestOf(tr.manifest) {
+		t.Fatalf("expected the digest of the manifest to be refused, got %v", err)
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	tr.mu.Lock()
+	for _, layer := range manifest.Layers {
+		if n := tr.Requests["/v2/test/image/blobs/"+layer.Digest]; n > 0 {
+			t.Errorf("expected no layer to be fetched, got %d requests of %s", n, layer.Digest)
+		}
+	}
+	tr.mu.Unlock()
+
+	mu.Lock()
+	allowed[digestOf(tr.manifest)] = true
+	mu.Unlock()
+	if _, err := r.FetchLayers(tr.Ref(), tdir); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	before := lookups
+	mu.Unlock()
+	if _, err := r.FetchLayers(tr.Ref(), tdir); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if lookups != before {
+		t.Errorf("expected the digest allowed to be remembered")
+	}
+}
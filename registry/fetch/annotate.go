@@ -0,0 +1,91 @@
+package fetch
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Annotations recording where a re-published image was mirrored from. See
+// AnnotateSource.
+const (
+	AnnotationSource       = "io.github.vbatts.docker-utils.source"
+	AnnotationSourceDigest = "io.github.vbatts.docker-utils.source.digest"
+	AnnotationMirrored     = "io.github.vbatts.docker-utils.mirrored"
+)
+
+// SetAnnotation sets the manifest annotation key, overriding any of the
+// same key, for when the image is written out again as an OCI layout
+func (ir *ImageRef) SetAnnotation(key, value string) {
+	if ir.annotations == nil {
+		ir.annotations = map[string]string{}
+	}
+	ir.annotations[key] = value
+}
+
+// Annotations are those set with SetAnnotation
+func (ir ImageRef) Annotations() map[string]string {
+	return ir.annotations
+}
+
+// SetLabel sets the config label key, overriding any of the same key, for
+// when the image is written out again (as an OCI layout or a `docker save`
+// archive). This changes the config, and so the image ID.
+func (ir *ImageRef) SetLabel(key, value string) {
+	if ir.labels == nil {
+		ir.labels = map[string]string{}
+	}
+	ir.labels[key] = value
+}
+
+// Labels are those set with SetLabel
+func (ir ImageRef) Labels() map[string]string {
+	return ir.labels
+}
+
+// AnnotateSource sets annotations recording the reference the image was
+// fetched from, its manifest digest when known, and the time now, so that
+// consumers of a mirror can trace where its content came from
+func (ir *ImageRef) AnnotateSource() {
+	ir.SetAnnotation(AnnotationSource, ir.String())
+	if ir.Digest() != "" {
+		ir.SetAnnotation(AnnotationSourceDigest, ir.Digest())
+	}
+	ir.SetAnnotation(AnnotationMirrored, time.Now().UTC().Format(time.RFC3339))
+}
+
+// withLabels sets labels in the image config, keeping the rest of it as is
+func withLabels(config []byte, labels map[string]string) ([]byte, error) {
+	if len(labels) == 0 {
+		return config, nil
+	}
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(config, &image); err != nil {
+		return nil, err
+	}
+	var runConfig map[string]json.RawMessage
+	if buf, ok := image["config"]; ok && string(buf) != "null" {
+		if err := json.Unmarshal(buf, &runConfig); err != nil {
+			return nil, err
+		}
+	}
+	if runConfig == nil {
+		runConfig = map[string]json.RawMessage{}
+	}
+	merged := map[string]string{}
+	if buf, ok := runConfig["Labels"]; ok && string(buf) != "null" {
+		if err := json.Unmarshal(buf, &merged); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	var err error
+	if runConfig["Labels"], err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+	if image["config"], err = json.Marshal(runConfig); err != nil {
+		return nil, err
+	}
+	return json.Marshal(image)
+}
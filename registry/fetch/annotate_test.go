@@ -0,0 +1,89 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithLabels(t *testing.T) {
+	config := []byte(`{"architecture":"amd64","config":{"Cmd":["sh"],"Labels":{"a":"1","b":"2"}},"rootfs":{"type":"layers"}}`)
+	buf, err := withLabels(config, map[string]string{"b": "3", "c": "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var image struct {
+		Architecture string
+		Config       struct {
+			Cmd    []string
+			Labels map[string]string
+		}
+	}
+	if err := json.Unmarshal(buf, &image); err != nil {
+		t.Fatal(err)
+	}
+	if image.Architecture != "amd64" || len(image.Config.Cmd) != 1 {
+		t.Errorf("expected the rest of the config to be kept, got %s", buf)
+	}
+	expected := map[string]string{"a": "1", "b": "3", "c": "4"}
+	for k, v := range expected {
+		if image.Config.Labels[k] != v {
+			t.Errorf("label %s: expected %q, got %q", k, v, image.Config.Labels[k])
+		}
+	}
+
+	// configs without a config or labels get them
+	buf, err = withLabels([]byte(`{"config":null}`), map[string]string{"a": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), `"Labels":{"a":"1"}`) {
+		t.Errorf("expected the label to be added, got %s", buf)
+	}
+}
+
+func TestWriteOCILayoutAnnotations(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.oci.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	ref.SetLabel("mirror", "yes")
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, filepath.Join(tdir, "fetch")); err != nil {
+		t.Fatal(err)
+	}
+	ref.AnnotateSource()
+	ref.SetAnnotation("team", "infra")
+	desc, err := WriteOCILayout(ref, filepath.Join(tdir, "fetch"), filepath.Join(tdir, "oci"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := func(digest string) []byte {
+		buf, err := ioutil.ReadFile(filepath.Join(tdir, "oci", "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(blob(desc.Digest), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Annotations[AnnotationSource] != ref.String() || manifest.Annotations[AnnotationSourceDigest] != digestOf(tr.manifest) || manifest.Annotations["team"] != "infra" {
+		t.Errorf("unexpected annotations %v", manifest.Annotations)
+	}
+	if manifest.Annotations[AnnotationMirrored] == "" {
+		t.Errorf("expected the time of mirroring to be recorded")
+	}
+	if !strings.Contains(string(blob(manifest.Config.Digest)), `"mirror":"yes"`) {
+		t.Errorf("expected the label in the config, got %s", blob(manifest.Config.Digest))
+	}
+}
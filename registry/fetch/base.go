@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KnownBases maps the top-most layer ID (or digest) of well known base images
+// to a name for them, like "fedora:22" or "debian:jessie".
+type KnownBases map[string]string
+
+// ParseKnownBases reads the known base images from r, one per line as
+// "<name> <id>". Blank lines and '#' comments are skipped.
+func ParseKnownBases(r io.Reader) (KnownBases, error) {
+	bases := KnownBases{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"<name> <id>\", got %q", n, scanner.Text())
+		}
+		bases[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return bases, nil
+}
+
+// LoadKnownBases reads the known base images from filename
+func LoadKnownBases(filename string) (KnownBases, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ParseKnownBases(fh)
+}
+
+// BaseImage is the result of base image detection
+type BaseImage struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// Depth is the number of layers the image adds on top of its base
+	Depth int `json:"depth"`
+}
+
+// DetectBase finds the most specific known base image that the ancestry
+// (top-most layer first) is built upon. Since base images themselves stack
+// (e.g. a language runtime image on top of a distribution image), the known
+// base nearest the top of the ancestry wins. The image itself is not
+// considered its own base. ok is false if no known base matched.
+func (kb KnownBases) DetectBase(ancestry []string) (base BaseImage, ok bool) {
+	for i, id := range ancestry {
+		if i == 0 {
+			continue
+		}
+		if name, found := kb[id]; found {
+			return BaseImage{Name: name, ID: id, Depth: i}, true
+		}
+	}
+	return BaseImage{}, false
+}
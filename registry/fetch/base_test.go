@@ -0,0 +1,42 @@
+package fetch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectBase(t *testing.T) {
+	bases, err := ParseKnownBases(strings.NewReader(`
+# distributions
+fedora:22  aaaa
+python:3   cccc   # on fedora:22
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Ancestry []string
+		Expected string
+		Depth    int
+	}{
+		{[]string{"eeee", "dddd", "cccc", "bbbb", "aaaa"}, "python:3", 2},
+		{[]string{"dddd", "bbbb", "aaaa"}, "fedora:22", 2},
+		{[]string{"cccc", "bbbb", "aaaa"}, "fedora:22", 2},
+		{[]string{"dddd", "ffff"}, "", 0},
+	}
+	for _, c := range cases {
+		base, ok := bases.DetectBase(c.Ancestry)
+		if ok != (c.Expected != "") {
+			t.Errorf("%v: expected found to be %t", c.Ancestry, !ok)
+			continue
+		}
+		if base.Name != c.Expected || base.Depth != c.Depth {
+			t.Errorf("%v: expected %q at %d, got %q at %d", c.Ancestry, c.Expected, c.Depth, base.Name, base.Depth)
+		}
+	}
+
+	if _, err := ParseKnownBases(strings.NewReader("fedora:22\n")); err == nil {
+		t.Error("expected an error for a line without an ID")
+	}
+}
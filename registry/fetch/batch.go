@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"context"
+	"time"
+)
+
+var (
+	// DefaultBreakerThreshold, DefaultBreakerWindow and DefaultBreakerCooldown
+	// configure the CircuitBreaker given to each host in a bulk run
+	DefaultBreakerThreshold = 5
+	DefaultBreakerWindow    = time.Minute
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// HostBatch is the set of references that live on a single registry host,
+// along with the RegistryEndpoint that should be used for all of them.
+type HostBatch struct {
+	Host     string
+	Registry *RegistryEndpoint
+	Refs     ImageRefSet
+}
+
+// Batches splits the set into one HostBatch per registry host, ordered by
+// host. Working through a batch at a time lets the tokens, keep-alive
+// connections and rate-limit budget of a registry be reused across all of its
+// references, rather than interleaving hosts. Each registry is guarded by
+// its own CircuitBreaker so a dead host fails fast instead of stalling the
+// run.
+func (s ImageRefSet) Batches() []HostBatch {
+	groups := s.ByHost()
+	batches := []HostBatch{}
+	for _, host := range s.Hosts() {
+		re := NewRegistry(host)
+		re.Breaker = NewCircuitBreaker(host, DefaultBreakerThreshold, DefaultBreakerWindow, DefaultBreakerCooldown)
+		batches = append(batches, HostBatch{
+			Host:     host,
+			Registry: &re,
+			Refs:     groups[host],
+		})
+	}
+	return batches
+}
+
+// FetchResult is the outcome of fetching a single reference in a bulk run.
+type FetchResult struct {
+	Ref    *ImageRef
+	Layers []string
+	Err    error
+	// Skipped is set when the reference was already up to date
+	Skipped bool
+	// Scan is the outcome of the registry's Scanner, if any
+	Scan *ScanResult
+}
+
+// FetchSet fetches the layers of every reference in the set into dest, one
+// registry host at a time. A failure on one reference does not stop the
+// others; each outcome is reported in the returned results, in fetch order.
+// A registry in maintenance is paused and resumed, as RunBatches does.
+func FetchSet(set ImageRefSet, dest string) []FetchResult {
+	return RunBatches(context.Background(), set.Batches(), func(batch HostBatch, ref *ImageRef) FetchResult {
+		layers, err := batch.Registry.FetchLayers(ref, dest)
+		return FetchResult{Ref: ref, Layers: layers, Err: err, Scan: ref.ScanResult()}
+	})
+}
+
+// FetchMetadataSet is like FetchSet, but only fetches the json metadata of
+// each image (see RegistryEndpoint.FetchMetadata). This is cheap enough to
+// run across a whole fleet of images for auditing labels, base images and
+// build dates.
+func FetchMetadataSet(set ImageRefSet, dest string) []FetchResult {
+	return RunBatches(context.Background(), set.Batches(), func(batch HostBatch, ref *ImageRef) FetchResult {
+		ids, err := batch.Registry.FetchMetadata(ref, dest)
+		return FetchResult{Ref: ref, Layers: ids, Err: err}
+	})
+}
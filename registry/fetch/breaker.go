@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitOpenError is returned, without contacting the registry, while a
+// CircuitBreaker is open.
+type CircuitOpenError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open for %s until %s after repeated failures", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// NewCircuitBreaker returns a CircuitBreaker for host that opens after
+// threshold failures within window, and stays open for cooldown before
+// letting a probe request through.
+func NewCircuitBreaker(host string, threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Host:      host,
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+	}
+}
+
+// CircuitBreaker guards a registry host from being hammered once it is
+// failing. After Threshold failures within Window the circuit opens and every
+// request fails fast with a CircuitOpenError. Once Cooldown has passed, a
+// single probe request is let through; its success closes the circuit again,
+// and its failure re-opens it for another Cooldown.
+type CircuitBreaker struct {
+	Host      string
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  []time.Time
+	openUntil time.Time
+	probing   bool
+}
+
+// Allow returns nil if a request may be made now.
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(cb.openUntil) || cb.probing {
+		return CircuitOpenError{Host: cb.Host, Until: cb.openUntil}
+	}
+	cb.probing = true
+	return nil
+}
+
+// Record notes the outcome of a request that Allow let through.
+func (cb *CircuitBreaker) Record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	now := time.Now()
+	if success {
+		cb.failures = nil
+		cb.openUntil = time.Time{}
+		cb.probing = false
+		return
+	}
+	if cb.probing {
+		cb.probing = false
+		cb.openUntil = now.Add(cb.Cooldown)
+		return
+	}
+
+	recent := []time.Time{now}
+	for _, t := range cb.failures {
+		if now.Sub(t) < cb.Window {
+			recent = append(recent, t)
+		}
+	}
+	cb.failures = recent
+	if len(cb.failures) >= cb.Threshold {
+		cb.failures = nil
+		cb.openUntil = now.Add(cb.Cooldown)
+	}
+}
+
+// Open reports whether the circuit is currently rejecting requests.
+func (cb *CircuitBreaker) Open() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.openUntil.IsZero() && (time.Now().Before(cb.openUntil) || cb.probing)
+}
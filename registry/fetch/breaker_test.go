@@ -0,0 +1,41 @@
+package fetch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := NewCircuitBreaker("localhost:5000", 2, time.Minute, 10*time.Millisecond)
+	cb.Record(false)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("expected the circuit to be closed after one failure: %s", err)
+	}
+	cb.Record(false)
+	if err := cb.Allow(); err == nil {
+		t.Fatal("expected the circuit to be open")
+	} else if _, ok := err.(CircuitOpenError); !ok {
+		t.Errorf("expected a CircuitOpenError, got %T", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("expected a probe to be let through: %s", err)
+	}
+	if err := cb.Allow(); err == nil {
+		t.Fatal("expected only a single probe at a time")
+	}
+	cb.Record(false)
+	if !cb.Open() {
+		t.Fatal("expected a failed probe to re-open the circuit")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := cb.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	cb.Record(true)
+	if cb.Open() {
+		t.Error("expected a successful probe to close the circuit")
+	}
+}
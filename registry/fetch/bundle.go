@@ -0,0 +1,389 @@
+package fetch
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// BundleManifestFile is where the BundleManifest of an air-gap bundle is
+// written, at the top of the fetched directory
+const BundleManifestFile = "bundle.json"
+
+// BundleManifest is the bill of images of an air-gap bundle: what it holds,
+// down to the digest of each layer and of every other file, so that the
+// import side can check it all before loading anything. It may be signed with
+// ed25519 keys.
+type BundleManifest struct {
+	Created time.Time `json:"created"`
+	// Tool is what made the bundle, like "docker-fetch 1.0.1"
+	Tool   string        `json:"tool,omitempty"`
+	Images []BundleImage `json:"images"`
+	// Size is the total size of the layers of the images
+	Size int64 `json:"size"`
+	// Files are the digests of the files of the bundle other than the
+	// layer.tar of its layers, like the json of each layer, repositories
+	// and manifest.json, by their slash separated path in the bundle.
+	// Nothing else may be in the bundle.
+	Files      map[string]string `json:"files"`
+	Signatures []BundleSignature `json:"signatures,omitempty"`
+}
+
+// BundleImage is an image of a bundle
+type BundleImage struct {
+	Ref string `json:"ref"`
+	ID  string `json:"id"`
+	// Digest is the digest of the manifest, for images from v2 registries
+	Digest string `json:"digest,omitempty"`
+	// Platform is like "linux/amd64"
+	Platform string `json:"platform"`
+	Size     int64  `json:"size"`
+	// Layers are top-most first
+	Layers []BundleLayer `json:"layers"`
+}
+
+// BundleLayer is a layer of an image of a bundle, by its legacy ID and the
+// digest of its layer.tar
+type BundleLayer struct {
+	ID     string `json:"id"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// BundleSignature is an ed25519 signature of a BundleManifest, without its
+// signatures, as JSON
+type BundleSignature struct {
+	// KeyID is the sha256 digest of the public key, in PKIX form
+	KeyID     string `json:"keyid"`
+	Signature []byte `json:"sig"`
+}
+
+// NewBundleManifest lists imgs, fetched into src with FetchLayers, and every
+// file of src, in a BundleManifest made by tool. The layers of src may have
+// been named by NameLayersByDigest.
+func NewBundleManifest(src, tool string, imgs ...*ImageRef) (*BundleManifest, error) {
+	m := &BundleManifest{Created: time.Now().UTC(), Tool: tool, Images: []BundleImage{}}
+	names, err := readLayerNames(src)
+	if err != nil {
+		return nil, err
+	}
+	layers := map[string]bool{}
+	for _, img := range imgs {
+		ancestry := img.Ancestry()
+		if len(ancestry) == 0 {
+			return nil, fmt.Errorf("%s: no layers fetched", img)
+		}
+		image := BundleImage{Ref: img.String(), ID: img.ID(), Digest: img.Digest()}
+		buf, err := ioutil.ReadFile(filepath.Join(src, layerDirName(names, ancestry[0]), "json"))
+		if err != nil {
+			return nil, err
+		}
+		var md struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		}
+		if err := json.Unmarshal(buf, &md); err != nil {
+			return nil, fmt.Errorf("layer %s: %w", ancestry[0], err)
+		}
+		if md.OS == "" {
+			md.OS = "linux"
+		}
+		if md.Architecture == "" {
+			md.Architecture = "amd64"
+		}
+		image.Platform = md.OS + "/" + md.Architecture
+		for _, id := range ancestry {
+			dir := filepath.Join(src, layerDirName(names, id))
+			digest, err := layerDiffID(dir)
+			if err != nil {
+				return nil, err
+			}
+			fi, err := os.Stat(filepath.Join(dir, "layer.tar"))
+			if err != nil {
+				return nil, err
+			}
+			image.Layers = append(image.Layers, BundleLayer{ID: id, Digest: digest, Size: fi.Size()})
+			image.Size += fi.Size()
+			layers[layerDirName(names, id)+"/layer.tar"] = true
+		}
+		m.Images = append(m.Images, image)
+		m.Size += image.Size
+	}
+	m.Files = map[string]string{}
+	err = walkBundle(src, layers, func(name, filename string) error {
+		h := sha256.New()
+		if err := hashFile(h, filename); err != nil {
+			return err
+		}
+		m.Files[name] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// walkBundle calls fn with the slash separated path in the bundle dir, and
+// the file name, of each of its files but the BundleManifestFile, the
+// layer.tar of its layers, which are checked by their own digests, and the
+// bookkeeping of the fetches that is not exported with the bundle
+func walkBundle(dir string, layers map[string]bool, fn func(name, filename string) error) error {
+	return filepath.Walk(dir, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == BundleManifestFile || layers[name] || export.Excluded(name) {
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s: not a regular file", name)
+		}
+		return fn(name, filename)
+	})
+}
+
+// layerDirName is the name of the directory of the layer id, with the names
+// of NameLayersByDigest if any
+func layerDirName(names map[string]string, id string) string {
+	if digest, ok := names[id]; ok {
+		return strings.TrimPrefix(digest, "sha256:")
+	}
+	return id
+}
+
+// LoadBundleManifest reads the BundleManifest at filename
+func LoadBundleManifest(filename string) (*BundleManifest, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &BundleManifest{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return m, nil
+}
+
+// Write writes the manifest to BundleManifestFile in dir
+func (m *BundleManifest) Write(dir string) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, BundleManifestFile), buf, 0644)
+}
+
+// payload is what the signatures of the manifest are of
+func (m *BundleManifest) payload() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signatures = nil
+	return json.Marshal(unsigned)
+}
+
+// Sign adds the signature of key to the manifest
+func (m *BundleManifest) Sign(key ed25519.PrivateKey) error {
+	payload, err := m.payload()
+	if err != nil {
+		return err
+	}
+	keyID, err := bundleKeyID(key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+	m.Signatures = append(m.Signatures, BundleSignature{KeyID: keyID, Signature: ed25519.Sign(key, payload)})
+	return nil
+}
+
+// Verify checks that the manifest is signed by one of keys
+func (m *BundleManifest) Verify(keys ...ed25519.PublicKey) error {
+	payload, err := m.payload()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		keyID, err := bundleKeyID(key)
+		if err != nil {
+			return err
+		}
+		for _, sig := range m.Signatures {
+			if sig.KeyID == keyID && ed25519.Verify(key, payload, sig.Signature) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("the bundle is not signed by any of the %d keys given", len(keys))
+}
+
+// Check checks that the layers of the images listed, and the other files,
+// are in dir, the fetched directory of the bundle, with the digests listed,
+// and that it holds nothing else
+func (m *BundleManifest) Check(dir string) error {
+	names, err := readLayerNames(dir)
+	if err != nil {
+		return err
+	}
+	layers := map[string]bool{}
+	var total int64
+	for _, image := range m.Images {
+		var size int64
+		for _, layer := range image.Layers {
+			name := layerDirName(names, layer.ID)
+			layers[name+"/layer.tar"] = true
+			filename := filepath.Join(dir, name, "layer.tar")
+			fi, err := os.Stat(filename)
+			if err != nil {
+				return fmt.Errorf("%s: layer %s: %w", image.Ref, layer.ID, err)
+			}
+			if fi.Size() != layer.Size {
+				return fmt.Errorf("%s: layer %s: has %d bytes, not %d", image.Ref, layer.ID, fi.Size(), layer.Size)
+			}
+			h := sha256.New()
+			if err := hashFile(h, filename); err != nil {
+				return err
+			}
+			if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != layer.Digest {
+				return ErrDigestMismatch{ID: layer.ID, Expected: layer.Digest, Actual: actual}
+			}
+			size += layer.Size
+		}
+		if size != image.Size {
+			return fmt.Errorf("%s: layers total %d bytes, not %d", image.Ref, size, image.Size)
+		}
+		total += size
+	}
+	if total != m.Size {
+		return fmt.Errorf("images total %d bytes, not %d", total, m.Size)
+	}
+	found := map[string]bool{}
+	err = walkBundle(dir, layers, func(name, filename string) error {
+		expected, ok := m.Files[name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in the %s", name, BundleManifestFile)
+		}
+		h := sha256.New()
+		if err := hashFile(h, filename); err != nil {
+			return err
+		}
+		if actual := "sha256:" + hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("%s: expected digest %s, got %s", name, expected, actual)
+		}
+		found[name] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for name := range m.Files {
+		if !found[name] {
+			return fmt.Errorf("%s: listed in the %s, but missing", name, BundleManifestFile)
+		}
+	}
+	return nil
+}
+
+// readLayerNames reads the LayerNamesFile in dir, if NameLayersByDigest
+// wrote one
+func readLayerNames(dir string) (map[string]string, error) {
+	names := map[string]string{}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, LayerNamesFile))
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &names); err != nil {
+		return nil, fmt.Errorf("%s: %w", LayerNamesFile, err)
+	}
+	return names, nil
+}
+
+// bundleKeyID is the KeyID of key
+func bundleKeyID(key ed25519.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return digestOf(der), nil
+}
+
+// LoadSigningKey reads an ed25519 private key from a PEM file, like one made
+// with `openssl genpkey -algorithm ed25519`
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+	return LoadEncryptedSigningKey(filename, nil)
+}
+
+// LoadEncryptedSigningKey is LoadSigningKey, for a key that may be encrypted
+// with passphrase, like one made with `openssl genpkey -algorithm ed25519
+// -aes256`. Keys encrypted otherwise than with PBKDF2 and AES-256-CBC are not
+// supported.
+func LoadEncryptedSigningKey(filename string, passphrase []byte) (ed25519.PrivateKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	der, err := decryptPrivateKey(block, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", filename)
+	}
+	return priv, nil
+}
+
+// LoadVerifyingKey reads an ed25519 public key from a PEM file, like one made
+// with `openssl pkey -pubout`
+func LoadVerifyingKey(filename string) (ed25519.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 key", filename)
+	}
+	return pub, nil
+}
+
+// readPEM reads the first PEM block of filename
+func readPEM(filename string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filename)
+	}
+	return block, nil
+}
@@ -0,0 +1,152 @@
+package fetch
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundleManifest(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.bundle.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewBundleManifest(tdir, "test", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Images) != 1 || len(m.Images[0].Layers) != 2 || m.Images[0].Platform != "linux/amd64" {
+		t.Fatalf("expected one linux/amd64 image of two layers, got %#v", m.Images)
+	}
+	if m.Size != int64(len(testLayers[0].Layer)+len(testLayers[1].Layer)) {
+		t.Errorf("expected the size of both layers, got %d", m.Size)
+	}
+	if m.Images[0].Layers[1].Digest != digestOf(testLayers[1].Layer) {
+		t.Errorf("expected the digest of the base layer, got %s", m.Images[0].Layers[1].Digest)
+	}
+	for name := range m.Files {
+		if strings.HasSuffix(name, "/"+LayerChecksumFile) {
+			t.Errorf("expected the checksums of the layers not to be listed, got %s", name)
+		}
+	}
+
+	// signed with a key from a PEM file
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDir := t.TempDir()
+	keyFile := filepath.Join(keyDir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadSigningKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if der, err = x509.MarshalPKIXPublicKey(pub); err != nil {
+		t.Fatal(err)
+	}
+	pubFile := filepath.Join(keyDir, "key.pub")
+	if err := ioutil.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pub, err = LoadVerifyingKey(pubFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Write(tdir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBundleManifest(filepath.Join(tdir, BundleManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Verify(pub); err != nil {
+		t.Error(err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := loaded.Verify(other); err == nil {
+		t.Errorf("expected the signature of another key to be refused")
+	}
+	loaded.Size++
+	if err := loaded.Verify(pub); err == nil {
+		t.Errorf("expected a changed manifest to fail verification")
+	}
+	loaded.Size--
+
+	if err := loaded.Check(tdir); err != nil {
+		t.Error(err)
+	}
+	// the other files are checked too, and no file may be added
+	config := filepath.Join(tdir, testLayers[0].ID, "json")
+	buf, err := ioutil.ReadFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config, []byte(strings.Replace(string(buf), "}", `,"config":{"Entrypoint":["/evil"]}}`, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Check(tdir); err == nil || !strings.Contains(err.Error(), testLayers[0].ID+"/json") {
+		t.Errorf("expected the changed config of the layer to be refused, got %v", err)
+	}
+	if err := ioutil.WriteFile(config, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(tdir, "extra"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, "extra", "json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Check(tdir); err == nil || !strings.Contains(err.Error(), "extra/json is not listed") {
+		t.Errorf("expected the file added to be refused, got %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(tdir, "extra")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the layers named by digest are listed as they are named
+	if _, err := NameLayersByDigest(tdir, ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Check(tdir); err == nil {
+		t.Errorf("expected the layers renamed since the bundle was made to be refused")
+	}
+	if m, err = NewBundleManifest(tdir, "test", ref); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(tdir); err != nil {
+		t.Error(err)
+	}
+	layer := filepath.Join(tdir, strings.TrimPrefix(digestOf(testLayers[1].Layer), "sha256:"), "layer.tar")
+	if err := ioutil.WriteFile(layer, []byte(strings.ToUpper(string(testLayers[1].Layer))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch ErrDigestMismatch
+	if err := m.Check(tdir); !errors.As(err, &mismatch) {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+}
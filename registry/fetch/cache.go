@@ -0,0 +1,148 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LayerCache is a directory of layers kept across fetches, so that the layers
+// shared by several images, or fetched again, are downloaded once. The layers
+// are stored by the digest of their content under sha256/, and each key a
+// layer is fetched by (the digest of its blob from v2 registries, or its ID
+// from v1 registries) is recorded under keys/ with the digest of the content.
+// A LayerCache may be shared by concurrent fetches.
+type LayerCache struct {
+	Dir string
+}
+
+// NewLayerCache returns the LayerCache in dir, creating it if needed
+func NewLayerCache(dir string) (*LayerCache, error) {
+	for _, sub := range []string{"sha256", "keys"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &LayerCache{Dir: dir}, nil
+}
+
+// layerCacheKey is the key of the layer id of img in a LayerCache
+func layerCacheKey(img *ImageRef, id string, apiV2 bool) string {
+	if apiV2 {
+		return img.v2.layers[id].Digest
+	}
+	return "v1:" + id
+}
+
+// keyFile is where the digest of the layer known by key is recorded, or ""
+// if key cannot be a file name
+func (c *LayerCache) keyFile(key string) string {
+	name := strings.Replace(key, ":", "-", -1)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return filepath.Join(c.Dir, "keys", name)
+}
+
+// blobFile is where the content of digest is stored
+func (c *LayerCache) blobFile(digest string) string {
+	return filepath.Join(c.Dir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// get puts the layer cached under key in dir as its layer.tar, with its
+// checksum, returning false if it is not cached. A layer not matching pinned,
+// the digest set with ImageRef.SetLayerDigest if any, is not used.
+func (c *LayerCache) get(key, pinned, dir string) (bool, error) {
+	digest, fi, err := c.lookup(key, pinned)
+	if err != nil || fi == nil {
+		return false, err
+	}
+	layer := filepath.Join(dir, "layer.tar")
+	if err := linkFile(c.blobFile(digest), layer+PartialSuffix); err != nil {
+		os.Remove(layer + PartialSuffix)
+		return false, err
+	}
+	if err := os.Rename(layer+PartialSuffix, layer); err != nil {
+		return false, err
+	}
+	return true, writeLayerChecksum(dir, digest)
+}
+
+// lookup returns the digest and blob of the layer cached under key, with a
+// nil blob if it is not cached, or does not match pinned as for get
+func (c *LayerCache) lookup(key, pinned string) (string, os.FileInfo, error) {
+	keyFile := c.keyFile(key)
+	if keyFile == "" {
+		return "", nil, nil
+	}
+	buf, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	digest := strings.TrimSpace(string(buf))
+	if !strings.HasPrefix(digest, "sha256:") || (pinned != "" && pinned != key && pinned != digest) {
+		return "", nil, nil
+	}
+	fi, err := os.Stat(c.blobFile(digest))
+	if os.IsNotExist(err) {
+		return "", nil, nil
+	}
+	return digest, fi, err
+}
+
+// put adds the layer.tar fetched into dir to the cache under key
+func (c *LayerCache) put(key, dir string) error {
+	keyFile := c.keyFile(key)
+	if keyFile == "" {
+		return nil
+	}
+	sum, ok, err := readLayerChecksum(dir)
+	if err != nil || !ok {
+		return err
+	}
+	blob := c.blobFile(sum.Digest)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		tmp := blob + "." + filepath.Base(dir) + PartialSuffix
+		if err := linkFile(filepath.Join(dir, "layer.tar"), tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, blob); err != nil {
+			return err
+		}
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(keyFile), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if err := fh.Chmod(0644); err != nil {
+		fh.Close()
+		return err
+	}
+	if _, err := fh.WriteString(sum.Digest + "\n"); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), keyFile)
+}
+
+// linkFile hard links src to dest, or copies it where they cannot be linked,
+// like across filesystems
+func linkFile(src, dest string) error {
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	logrus.Debugf("cannot link %s, copying it", src)
+	return copyFile(src, dest)
+}
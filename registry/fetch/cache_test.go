@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRegistryLayerCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "test.cache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	cache, err := NewLayerCache(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v2 := range []bool{false, true} {
+		var tr *testRegistry
+		if v2 {
+			tr = newTestRegistryV2(t, testLayers...)
+		} else {
+			tr = newTestRegistry(t, testLayers...)
+		}
+		layerPaths := []string{}
+		if v2 {
+			var manifest ManifestV2
+			if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range manifest.Layers {
+				layerPaths = append(layerPaths, "/v2/test/image/blobs/"+l.Digest)
+			}
+		} else {
+			for _, l := range testLayers {
+				layerPaths = append(layerPaths, "/v1/images/"+l.ID+"/layer")
+			}
+		}
+		downloads := func() int {
+			n := 0
+			for _, p := range layerPaths {
+				n += tr.Requests[p]
+			}
+			return n
+		}
+
+		for i := 0; i < 2; i++ {
+			tdir, err := ioutil.TempDir("", "test.fetch.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tdir)
+			ref := tr.Ref()
+			r := NewRegistry(ref.Host())
+			r.Cache = cache
+			ids, err := r.FetchLayers(ref, tdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j, id := range ids {
+				buf, err := ioutil.ReadFile(path.Join(tdir, id, "layer.tar"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(buf) != string(testLayers[j].Layer) {
+					t.Errorf("v2 %t, fetch %d: expected layer %q, got %q", v2, i, testLayers[j].Layer, buf)
+				}
+				if err := VerifyLayer(tdir, id, true); err != nil {
+					t.Errorf("v2 %t, fetch %d: %s", v2, i, err)
+				}
+			}
+			if downloads() != len(layerPaths) {
+				t.Errorf("v2 %t, fetch %d: expected the layers to be downloaded once, got %d downloads", v2, i, downloads())
+			}
+		}
+
+		// a layer pinned to another digest is not taken from the cache
+		tdir, err := ioutil.TempDir("", "test.fetch.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		r.Cache = cache
+		if _, err := r.Ancestry(ref); err != nil {
+			t.Fatal(err)
+		}
+		ref.SetLayerDigest(ref.Ancestry()[0], digestOf([]byte("something else")))
+		if _, err := r.FetchLayers(ref, tdir); err == nil {
+			t.Errorf("v2 %t: expected the pinned digest to fail the download", v2)
+		}
+	}
+}
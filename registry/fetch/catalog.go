@@ -0,0 +1,152 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Catalog lists the repositories of a v2 registry. Not every registry allows
+// this; the Docker Hub does not.
+func (re *RegistryEndpoint) Catalog() ([]string, error) {
+	return re.CatalogContext(context.Background())
+}
+
+// CatalogContext is Catalog, giving up when ctx is done.
+func (re *RegistryEndpoint) CatalogContext(ctx context.Context) ([]string, error) {
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return nil, fmt.Errorf("%s: listing repositories needs the v2 API", re.Host)
+	}
+	return re.v2List(ctx, "registry:catalog:*", re.apiURL(re.v2Host(), "/v2/_catalog"))
+}
+
+// Tags lists the tags of the repository of img, following the pages of the
+// list from v2 registries. The tags from v1 registries are sorted.
+func (re *RegistryEndpoint) Tags(img *ImageRef) ([]string, error) {
+	return re.TagsContext(context.Background(), img)
+}
+
+// TagsContext is Tags, giving up when ctx is done.
+func (re *RegistryEndpoint) TagsContext(ctx context.Context, img *ImageRef) ([]string, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		return re.v2Tags(ctx, img)
+	}
+	return re.v1Tags(ctx, img)
+}
+
+// v1Tags lists the tags of the repository of img from a v1 registry, which
+// gives them as {"<tag>": "<image id>", ...}, or by the oldest registries
+// as [{"name": "<tag>", "layer": "<image id>"}, ...]
+func (re *RegistryEndpoint) v1Tags(ctx context.Context, img *ImageRef) ([]string, error) {
+	if !re.hasToken(ctx, img) {
+		if _, err := re.TokenContext(ctx, img); err != nil {
+			return nil, err
+		}
+	}
+	endpoint := re.v1Endpoint()
+	urlStr := re.apiURL(endpoint, fmt.Sprintf("/v1/repositories/%s/tags", img.Name()))
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := re.authorize(req, img); err != nil {
+		return nil, err
+	}
+	resp, err := re.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newResponseError(urlStr, resp)
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	var byName map[string]string
+	if err := json.Unmarshal(body, &byName); err == nil {
+		for tag := range byName {
+			tags = append(tags, tag)
+		}
+	} else {
+		var list []struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("%s: %w", urlStr, err)
+		}
+		for _, t := range list {
+			tags = append(tags, t.Name)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// v2Tags lists the tags of the repository of img
+func (re *RegistryEndpoint) v2Tags(ctx context.Context, img *ImageRef) ([]string, error) {
+	return re.v2List(ctx, fmt.Sprintf("repository:%s:pull", re.v2Name(img)), re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/tags/list", re.v2Name(img))))
+}
+
+// v2List gets the "repositories" or "tags" listed at urlStr, following the
+// Link headers of paginated responses
+func (re *RegistryEndpoint) v2List(ctx context.Context, scope, urlStr string) ([]string, error) {
+	items := []string{}
+	for urlStr != "" {
+		resp, err := re.v2DoScope(ctx, scope, "GET", urlStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Repositories []string `json:"repositories"`
+			Tags         []string `json:"tags"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := newResponseError(urlStr, resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Repositories...)
+		items = append(items, page.Tags...)
+
+		next, err := nextLink(resp.Request.URL, resp.Header.Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+		// the registry behind a gateway links to its own paths, without the
+		// prefix or query of the BaseURL
+		if u, err := url.Parse(next); err == nil && re.BaseURL != "" && strings.HasPrefix(u.Path, "/v2/") {
+			next = re.apiURL(u.Host, u.RequestURI())
+		}
+		urlStr = next
+	}
+	return items, nil
+}
+
+// nextLink resolves the `<url>; rel="next"` of a Link header against base,
+// or returns "" when there is no next page
+func nextLink(base *url.URL, link string) (string, error) {
+	for _, l := range strings.Split(link, ",") {
+		parts := strings.Split(l, ";")
+		if len(parts) < 2 || !strings.Contains(parts[1], `rel="next"`) {
+			continue
+		}
+		u, err := base.Parse(strings.Trim(strings.TrimSpace(parts[0]), "<>"))
+		if err != nil {
+			return "", err
+		}
+		return u.String(), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,124 @@
+package fetch
+
+import (
+	"encoding"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// CheckpointSuffix is appended to the name of a partial file for the
+// checkpoint of its download: how far it got, and the state of the hash of
+// the content up to there. Resuming a download after a crash then only
+// hashes what was written since the checkpoint, rather than the whole
+// partial file again.
+const CheckpointSuffix = ".checkpoint"
+
+// CheckpointInterval is how many bytes are downloaded between checkpoints.
+// Files smaller than this are never checkpointed.
+var CheckpointInterval int64 = 64 << 20
+
+type checkpoint struct {
+	Offset int64  `json:"offset"`
+	State  []byte `json:"state"`
+}
+
+// checkpointer is written to after each write to the partial file fh and
+// its hash h, saving a checkpoint every CheckpointInterval bytes
+type checkpointer struct {
+	fh     *os.File
+	h      hash.Hash
+	offset int64
+	last   int64
+}
+
+func newCheckpointer(fh *os.File, h hash.Hash, offset int64) *checkpointer {
+	return &checkpointer{fh: fh, h: h, offset: offset, last: offset}
+}
+
+func (c *checkpointer) Write(p []byte) (int, error) {
+	c.offset += int64(len(p))
+	if c.offset-c.last >= CheckpointInterval {
+		if err := c.save(); err != nil {
+			logrus.Warnf("%s: not checkpointing the download: %s", c.fh.Name(), err)
+		}
+		c.last = c.offset
+	}
+	return len(p), nil
+}
+
+// save records the checkpoint, once the partial file is on disk up to it
+func (c *checkpointer) save() error {
+	m, ok := c.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := c.fh.Sync(); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(checkpoint{Offset: c.offset, State: state})
+	if err != nil {
+		return err
+	}
+	name := c.fh.Name() + CheckpointSuffix
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// restoreHash brings h to the hash of the first size bytes of the partial
+// file, from its checkpoint where there is a usable one
+func restoreHash(h hash.Hash, partial string, size int64) error {
+	fh, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	var from int64
+	if cp, ok := readCheckpoint(partial); ok && cp.Offset <= size {
+		if u, ok := h.(encoding.BinaryUnmarshaler); ok && u.UnmarshalBinary(cp.State) == nil {
+			logrus.Debugf("resuming the hash of %s from %d bytes", partial, cp.Offset)
+			from = cp.Offset
+		} else {
+			h.Reset()
+		}
+	}
+	if _, err := fh.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(h, fh, size-from)
+	return err
+}
+
+// readCheckpoint reads the checkpoint of the partial file, if any
+func readCheckpoint(partial string) (checkpoint, bool) {
+	var cp checkpoint
+	buf, err := ioutil.ReadFile(partial + CheckpointSuffix)
+	if err != nil {
+		return cp, false
+	}
+	if err := json.Unmarshal(buf, &cp); err != nil {
+		logrus.Debugf("ignoring the checkpoint of %s: %s", partial, err)
+		return cp, false
+	}
+	return cp, true
+}
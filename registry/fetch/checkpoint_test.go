@@ -0,0 +1,110 @@
+package fetch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpointRestoreHash(t *testing.T) {
+	defer func(interval int64) { CheckpointInterval = interval }(CheckpointInterval)
+	CheckpointInterval = 6
+
+	tdir, err := ioutil.TempDir("", "test.checkpoint.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	partial := filepath.Join(tdir, "layer.blob"+PartialSuffix)
+	fh, err := os.Create(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("0123456789")
+	h := sha256.New()
+	cp := newCheckpointer(fh, h, 0)
+	for _, chunk := range [][]byte{content[:5], content[5:8], content[8:]} {
+		fh.Write(chunk)
+		h.Write(chunk)
+		cp.Write(chunk)
+	}
+	fh.Close()
+	saved, ok := readCheckpoint(partial)
+	if !ok || saved.Offset != 8 {
+		t.Fatalf("expected a checkpoint at 8 bytes, got %v at %d", ok, saved.Offset)
+	}
+	expected := sha256.Sum256(content)
+
+	// the start of the file is not read again: spoil it to prove it
+	if err := ioutil.WriteFile(partial, append(bytes.Repeat([]byte("x"), 8), content[8:]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h = sha256.New()
+	if err := restoreHash(h, partial, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Errorf("expected the hash to carry on from the checkpoint")
+	}
+
+	// a checkpoint past the end of the file is no good
+	if err := ioutil.WriteFile(partial, content[:6], 0644); err != nil {
+		t.Fatal(err)
+	}
+	h = sha256.New()
+	if err := restoreHash(h, partial, 6); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(content[:6]); !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Errorf("expected the whole partial file to be hashed, got %s", hex.EncodeToString(h.Sum(nil)))
+	}
+}
+
+func TestRegistryFetchLayersCheckpoint(t *testing.T) {
+	defer func(interval int64) { CheckpointInterval = interval }(CheckpointInterval)
+	CheckpointInterval = 1
+
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.Ancestry(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a partial download of the top layer, with a checkpoint part way
+	partial := path.Join(tdir, ids[0], "layer.tar"+PartialSuffix)
+	if err := os.MkdirAll(path.Dir(partial), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Create(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(testLayers[0].Layer[:3])
+	fh.Write(testLayers[0].Layer[:5])
+	newCheckpointer(fh, h, 0).Write(testLayers[0].Layer[:3])
+	fh.Close()
+
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if err := VerifyLayer(tdir, id, true); err != nil {
+			t.Errorf("layer %d: %s", i, err)
+		}
+		if matches, _ := filepath.Glob(path.Join(tdir, id, "*"+CheckpointSuffix)); len(matches) > 0 {
+			t.Errorf("layer %d: expected the checkpoints to be removed, got %v", i, matches)
+		}
+	}
+}
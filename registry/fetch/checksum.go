@@ -0,0 +1,111 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// LayerChecksumFile is written beside each layer.tar fetched, recording its
+// digest, size and modification time, so that the layer can be checked
+// before it is reused. It is left out of the archives of the images.
+const LayerChecksumFile = export.LayerChecksumFile
+
+type layerChecksum struct {
+	Digest  string    `json:"digest"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// writeLayerChecksum records digest, and the size and modification time of
+// the layer.tar in dir
+func writeLayerChecksum(dir, digest string) error {
+	fi, err := os.Stat(filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(layerChecksum{Digest: digest, Size: fi.Size(), ModTime: fi.ModTime()})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, LayerChecksumFile), buf, 0644)
+}
+
+// readLayerChecksum reads the checksum recorded in dir, returning ok false
+// if there is none
+func readLayerChecksum(dir string) (sum layerChecksum, ok bool, err error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, LayerChecksumFile))
+	if os.IsNotExist(err) {
+		return sum, false, nil
+	}
+	if err != nil {
+		return sum, false, err
+	}
+	if err := json.Unmarshal(buf, &sum); err != nil {
+		return sum, false, fmt.Errorf("%s: %w", filepath.Join(dir, LayerChecksumFile), err)
+	}
+	return sum, true, nil
+}
+
+// checkLayerChecksum compares digest, just computed for the layer.tar of
+// the layer id in dir, with any checksum recorded when it was fetched
+func checkLayerChecksum(id, dir, digest string) error {
+	sum, ok, err := readLayerChecksum(dir)
+	if err != nil || !ok {
+		return err
+	}
+	if sum.Digest != digest {
+		return ErrDigestMismatch{ID: id, Expected: sum.Digest, Actual: digest}
+	}
+	return nil
+}
+
+// VerifyLayer checks the layer.tar of the layer id, fetched into src,
+// against the checksum recorded when it was downloaded, so that a corrupted
+// cache is not exported. Unless full is set, only the size and modification
+// time of the file are compared, rather than hashing it again. Layers fetched
+// without a checksum recorded fail verification.
+func VerifyLayer(src, id string, full bool) error {
+	dir := filepath.Join(src, id)
+	sum, ok, err := readLayerChecksum(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("layer %s: no checksum recorded", id)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	if !full {
+		if fi.Size() != sum.Size || !fi.ModTime().Equal(sum.ModTime) {
+			return fmt.Errorf("layer %s: changed since it was fetched", id)
+		}
+		return nil
+	}
+	h := sha256.New()
+	if err := hashFile(h, filepath.Join(dir, "layer.tar")); err != nil {
+		return err
+	}
+	return checkLayerChecksum(id, dir, "sha256:"+hex.EncodeToString(h.Sum(nil)))
+}
+
+// VerifyLayers is VerifyLayer for each layer of img, adding the time it takes
+// to the Verify timing of img
+func VerifyLayers(img *ImageRef, src string, full bool) error {
+	defer img.Timings().addVerify(time.Now())
+	for _, id := range img.Ancestry() {
+		if err := VerifyLayer(src, id, full); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyLayers(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		tdir, err := ioutil.TempDir("", "test.checksum.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		if _, err := r.FetchLayers(ref, tdir); err != nil {
+			t.Fatal(err)
+		}
+		for _, full := range []bool{false, true} {
+			if err := VerifyLayers(ref, tdir, full); err != nil {
+				t.Errorf("%s: expected the fetched layers to verify, got %s", r.APIVersion(), err)
+			}
+		}
+
+		// corrupt a layer in place, keeping its size and modification time,
+		// so only hashing it again notices
+		id := ref.Ancestry()[0]
+		layer := filepath.Join(tdir, id, "layer.tar")
+		fi, err := os.Stat(layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf[0] ^= 0xff
+		if err := ioutil.WriteFile(layer, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(layer, time.Now(), fi.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyLayers(ref, tdir, false); err != nil {
+			t.Errorf("%s: expected the quick check to pass, got %s", r.APIVersion(), err)
+		}
+		if err := VerifyLayers(ref, tdir, true); err == nil {
+			t.Errorf("%s: expected the corrupted layer to fail verification", r.APIVersion())
+		} else if _, ok := err.(ErrDigestMismatch); !ok {
+			t.Errorf("%s: expected ErrDigestMismatch, got %s", r.APIVersion(), err)
+		}
+		if _, err := WriteOCILayout(ref, tdir, filepath.Join(tdir, "oci")); err == nil {
+			t.Errorf("%s: expected the corrupted layer not to be exported", r.APIVersion())
+		}
+
+		if err := os.Chtimes(layer, time.Now(), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyLayers(ref, tdir, false); err == nil {
+			t.Errorf("%s: expected the quick check to notice the changed layer", r.APIVersion())
+		}
+
+		os.Remove(filepath.Join(tdir, id, LayerChecksumFile))
+		if err := VerifyLayer(tdir, id, false); err == nil {
+			t.Errorf("%s: expected a layer without a checksum to fail verification", r.APIVersion())
+		}
+	}
+}
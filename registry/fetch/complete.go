@@ -0,0 +1,127 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+// DefaultCompletionMaxAge is how long a Completer uses cached listings for
+var DefaultCompletionMaxAge = time.Hour
+
+// Completer completes partial image references from the repository and tag
+// listings of registries, caching the listings on disk so that it is quick
+// enough for shell completion and interactive pickers.
+type Completer struct {
+	// Dir is where the listings are cached, or "" to not cache them
+	Dir string
+	// MaxAge is how long a cached listing is used before it is fetched again
+	MaxAge time.Duration
+	// Credentials, when set, are used for listing private registries
+	Credentials auth.Keychain
+
+	registries map[string]*RegistryEndpoint
+}
+
+// NewCompleter returns a Completer caching its listings in dir
+func NewCompleter(dir string) *Completer {
+	return &Completer{
+		Dir:        dir,
+		MaxAge:     DefaultCompletionMaxAge,
+		registries: map[string]*RegistryEndpoint{},
+	}
+}
+
+// Complete returns the references that start with partial. A partial ending
+// in a tag (like "localhost:5000/fedora:2" or "fedora:2") is completed from
+// the tags of the repository, and otherwise from the repositories of the
+// registry (like "localhost:5000/fed", or "localhost:5000" for all of them).
+// Registries that do not allow listing their repositories, like the Docker
+// Hub, only complete tags.
+func (c *Completer) Complete(partial string) ([]string, error) {
+	matches := []string{}
+	slash := strings.LastIndex(partial, "/")
+	if i := strings.LastIndex(partial, ":"); i > slash && (slash >= 0 || !isRegistryHost(partial[:i])) {
+		repo, prefix := partial[:i], partial[i+1:]
+		ref := NewImageRef(repo)
+		tags, err := c.cached("tags "+ref.Host()+"/"+ref.Name(), func() ([]string, error) {
+			return c.registry(ref.Host()).Tags(ref)
+		})
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, prefix) {
+				matches = append(matches, repo+":"+tag)
+			}
+		}
+		return matches, err
+	}
+
+	host, prefix := NewImageRef(partial).Host(), ""
+	if slash < 0 && isRegistryHost(partial) {
+		host = partial
+	}
+	if strings.HasPrefix(partial, host+"/") || host == partial {
+		prefix = host + "/"
+	}
+	names, err := c.cached("catalog "+host, c.registry(host).Catalog)
+	for _, name := range names {
+		if strings.HasPrefix(prefix+name, partial) {
+			matches = append(matches, prefix+name)
+		}
+	}
+	return matches, err
+}
+
+func (c *Completer) registry(host string) *RegistryEndpoint {
+	if re, ok := c.registries[host]; ok {
+		return re
+	}
+	re := NewRegistry(host)
+	re.Credentials = c.Credentials
+	c.registries[host] = &re
+	return &re
+}
+
+// completionCache is a listing cached by a Completer
+type completionCache struct {
+	Fetched time.Time
+	Items   []string
+}
+
+// cached returns the listing for key from the cache, or from list when it
+// is missing or too old. A failed listing is not cached, so that it is asked
+// for again on the next completion.
+func (c *Completer) cached(key string, list func() ([]string, error)) ([]string, error) {
+	filename := filepath.Join(c.Dir, url.QueryEscape(key)+".json")
+	if c.Dir != "" {
+		var cache completionCache
+		if buf, err := ioutil.ReadFile(filename); err == nil && json.Unmarshal(buf, &cache) == nil {
+			if time.Since(cache.Fetched) < c.MaxAge {
+				return cache.Items, nil
+			}
+		}
+	}
+
+	items, err := list()
+	if err != nil {
+		return []string{}, err
+	}
+	if c.Dir != "" {
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return items, err
+		}
+		buf, err := json.Marshal(completionCache{Fetched: time.Now(), Items: items})
+		if err != nil {
+			return items, err
+		}
+		if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+			return items, err
+		}
+	}
+	return items, nil
+}
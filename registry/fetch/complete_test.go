@@ -0,0 +1,60 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompleter(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.complete.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	cases := []struct {
+		Partial  string
+		Expected []string
+	}{
+		{tr.Host() + "/test/", []string{tr.Host() + "/test/image", tr.Host() + "/test/other"}},
+		{tr.Host() + "/test/o", []string{tr.Host() + "/test/other"}},
+		{tr.Host() + "/test/image:", []string{tr.Host() + "/test/image:latest", tr.Host() + "/test/image:v1.0"}},
+		{tr.Host() + "/test/image:v", []string{tr.Host() + "/test/image:v1.0"}},
+		{tr.Host() + "/nope", []string{}},
+		// a host with a port is not a repository and a tag
+		{tr.Host(), []string{tr.Host() + "/test/image", tr.Host() + "/test/other"}},
+	}
+	for _, c := range cases {
+		matches, err := NewCompleter(tdir).Complete(c.Partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(matches, " ") != strings.Join(c.Expected, " ") {
+			t.Errorf("%q: expected %v, got %v", c.Partial, c.Expected, matches)
+		}
+	}
+
+	// the listings are cached
+	before := tr.Requests["/v2/_catalog"]
+	if _, err := NewCompleter(tdir).Complete(tr.Host() + "/t"); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Requests["/v2/_catalog"] != before {
+		t.Errorf("expected the cached catalog to be used")
+	}
+
+	// a failed listing is not cached
+	failing := t.TempDir()
+	tr.Fail["/v2/test/image/tags/list"] = http.StatusNotFound
+	if _, err := NewCompleter(failing).Complete(tr.Host() + "/test/image:"); err == nil {
+		t.Fatal("expected the listing to fail")
+	}
+	delete(tr.Fail, "/v2/test/image/tags/list")
+	if matches, err := NewCompleter(failing).Complete(tr.Host() + "/test/image:"); err != nil || len(matches) == 0 {
+		t.Errorf("expected the tags to be listed again, got %v, %v", matches, err)
+	}
+}
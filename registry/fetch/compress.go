@@ -0,0 +1,133 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the algorithms the uncompressed layers of the images pushed can be
+// compressed with
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ZstdPath is the zstd(1) layers are compressed with, as the standard
+// library only has a gzip encoder
+var ZstdPath = "zstd"
+
+// Compression is how to compress the uncompressed layers pushed. The zero
+// Compression pushes them as they are.
+type Compression struct {
+	// Algorithm is CompressionGzip, CompressionZstd, or empty for none
+	Algorithm string
+	// Level trades speed for size, from 1, the fastest, to 9 for gzip and
+	// 19 for zstd; 0 is the default of the algorithm
+	Level int
+}
+
+// ParseCompression parses a Compression given as its algorithm, "none", or
+// the algorithm and a level, like "gzip:1" or "zstd:3"
+func ParseCompression(s string) (Compression, error) {
+	parts := strings.SplitN(s, ":", 2)
+	c := Compression{Algorithm: parts[0]}
+	max := 0
+	switch c.Algorithm {
+	case "none":
+		if len(parts) > 1 {
+			return Compression{}, fmt.Errorf("invalid compression %q: no level without compression", s)
+		}
+		return Compression{}, nil
+	case CompressionGzip:
+		max = gzip.BestCompression
+	case CompressionZstd:
+		max = 19
+	default:
+		return Compression{}, fmt.Errorf("invalid compression %q: expected gzip, zstd or none", s)
+	}
+	if len(parts) > 1 {
+		level, err := strconv.Atoi(parts[1])
+		if err != nil || level < 1 || level > max {
+			return Compression{}, fmt.Errorf("invalid compression %q: the level of %s is from 1 to %d", s, c.Algorithm, max)
+		}
+		c.Level = level
+	}
+	return c, nil
+}
+
+func (c Compression) String() string {
+	if c.Algorithm == "" {
+		return "none"
+	}
+	if c.Level == 0 {
+		return c.Algorithm
+	}
+	return fmt.Sprintf("%s:%d", c.Algorithm, c.Level)
+}
+
+// mediaType is that of the OCI layers compressed with c
+func (c Compression) mediaType() string {
+	if c.Algorithm == CompressionZstd {
+		return MediaTypeOCILayerZstd
+	}
+	return MediaTypeOCILayerGzip
+}
+
+// compress writes what is read from r to w, compressed with c
+func (c Compression) compress(w io.Writer, r io.Reader) error {
+	switch c.Algorithm {
+	case CompressionGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(gz, r); err != nil {
+			return err
+		}
+		return gz.Close()
+	case CompressionZstd:
+		if _, err := exec.LookPath(ZstdPath); err != nil {
+			return fmt.Errorf("%s is needed to compress with zstd: %w", ZstdPath, err)
+		}
+		args := []string{"-q", "-c"}
+		if c.Level > 0 {
+			args = append(args, "-"+strconv.Itoa(c.Level))
+		}
+		stderr := bytes.NewBuffer(nil)
+		cmd := exec.Command(ZstdPath, args...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = r, w, stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %s: %s", ZstdPath, err, stderr)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", c.Algorithm)
+}
+
+// compressBlob stores the blob filename compressed with c in the OCI image
+// layout dest
+func (c Compression) compressBlob(filename, dest string) (Descriptor, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer fh.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.compress(pw, fh))
+	}()
+	desc, err := writeBlob(dest, c.mediaType(), pr)
+	// stops the compression, if the blob could not be written
+	pr.Close()
+	return desc, err
+}
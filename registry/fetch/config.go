@@ -0,0 +1,132 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ImageConfig is the configuration of an image: what it runs and how, and
+// how it was built
+type ImageConfig struct {
+	Created      time.Time       `json:"created"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	// History is base first
+	History []History `json:"history,omitempty"`
+}
+
+// ContainerConfig is what the containers of an image run with
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+}
+
+// History is a step of the build of an image
+type History struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// Platform is the platform the image is for
+func (c ImageConfig) Platform() Platform {
+	return Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+}
+
+// ImageConfig fetches the configuration of the image without any of its
+// layers: the config blob from v2 registries, and from v1 registries the json
+// of each layer, the history being made up from those of the layers under
+// the top-most.
+func (re *RegistryEndpoint) ImageConfig(img *ImageRef) (*ImageConfig, error) {
+	return re.ImageConfigContext(context.Background(), img)
+}
+
+// ImageConfigContext is ImageConfig, giving up when ctx is done.
+func (re *RegistryEndpoint) ImageConfigContext(ctx context.Context, img *ImageRef) (*ImageConfig, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		v2, err := re.v2Resolve(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		config := &ImageConfig{}
+		if err := json.Unmarshal(v2.config, config); err != nil {
+			return nil, fmt.Errorf("%s: config: %w", img, err)
+		}
+		return config, nil
+	}
+	config, _, err := re.v1ImageConfig(ctx, img)
+	return config, err
+}
+
+// v1ImageConfig makes up the ImageConfig of an image of a v1 registry from
+// the json of its layers, with the size of each layer, top-most first
+func (re *RegistryEndpoint) v1ImageConfig(ctx context.Context, img *ImageRef) (*ImageConfig, []int64, error) {
+	if !re.hasToken(ctx, img) {
+		if _, err := re.TokenContext(ctx, img); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(img.Ancestry()) == 0 {
+		if _, err := re.AncestryContext(ctx, img); err != nil {
+			return nil, nil, err
+		}
+	}
+	endpoint := re.v1Endpoint()
+	config := &ImageConfig{}
+	ancestry := img.Ancestry()
+	sizes := make([]int64, len(ancestry))
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		buf, err := re.v1LayerJSON(ctx, img, endpoint, ancestry[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		var md struct {
+			Created         time.Time `json:"created"`
+			Author          string    `json:"author"`
+			Comment         string    `json:"comment"`
+			Size            int64     `json:"Size"`
+			ContainerConfig struct {
+				Cmd []string
+			} `json:"container_config"`
+		}
+		if err := json.Unmarshal(buf, &md); err != nil {
+			return nil, nil, fmt.Errorf("layer %s: %w", ancestry[i], err)
+		}
+		sizes[i] = md.Size
+		if i == 0 {
+			history := config.History
+			if err := json.Unmarshal(buf, config); err != nil {
+				return nil, nil, fmt.Errorf("layer %s: %w", ancestry[i], err)
+			}
+			config.History = history
+		}
+		config.History = append(config.History, History{
+			Created:   md.Created,
+			CreatedBy: strings.Join(md.ContainerConfig.Cmd, " "),
+			Author:    md.Author,
+			Comment:   md.Comment,
+		})
+	}
+	if config.Architecture == "" {
+		config.Architecture = "amd64"
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	return config, sizes, nil
+}
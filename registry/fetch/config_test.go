@@ -0,0 +1,53 @@
+package fetch
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRegistryImageConfig(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	config, err := r.ImageConfig(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Platform() != (Platform{OS: "linux", Architecture: "amd64"}) || config.Config.Labels["license"] != "MIT" {
+		t.Errorf("expected a linux/amd64 config labeled license=MIT, got %#v", config)
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, layer := range manifest.Layers {
+		if n := tr.Requests["/v2/test/image/blobs/"+layer.Digest]; n > 0 {
+			t.Errorf("expected no layer to be fetched, got %d requests of %s", n, layer.Digest)
+		}
+	}
+}
+
+func TestRegistryImageConfigV1(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	config, err := r.ImageConfig(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.History) != len(testLayers) {
+		t.Errorf("expected the history of %d layers, got %d", len(testLayers), len(config.History))
+	}
+	if config.OS != "linux" || config.Architecture != "amd64" {
+		t.Errorf("expected the platform to default to linux/amd64, got %s", config.Platform())
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, l := range testLayers {
+		if n := tr.Requests["/v1/images/"+l.ID+"/layer"]; n > 0 {
+			t.Errorf("expected no layer to be fetched, got %d requests of %s", n, l.ID)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// Copy copies the image src to dst, from registry to registry, with a new
+// RegistryEndpoint for each. See CopyTo.
+func Copy(src, dst *ImageRef) (Descriptor, error) {
+	from, to := NewRegistry(src.Host()), NewRegistry(dst.Host())
+	return from.CopyTo(&to, src, dst)
+}
+
+// CopyTo copies the image src on this registry to dst on the registry to,
+// which must speak the v2 API. From v2 registries the blobs are streamed from
+// one registry to the other without being written to disk, and the manifest
+// is copied as is, keeping its digest; the blobs the destination has already
+// are skipped. The destination checks the digest of each blob it is sent. A
+// manifest list is copied with the manifests of all of its platforms, each
+// pushed by digest before the list.
+// Images from v1 registries are fetched into a temporary directory and pushed
+// with PushImage. The image is vetted as FetchLayers vets it. The descriptor
+// of the manifest pushed is returned.
+func (re *RegistryEndpoint) CopyTo(to *RegistryEndpoint, src, dst *ImageRef) (Descriptor, error) {
+	return re.CopyToContext(context.Background(), to, src, dst)
+}
+
+// CopyToContext is CopyTo, giving up when ctx is done.
+func (re *RegistryEndpoint) CopyToContext(ctx context.Context, to *RegistryEndpoint, src, dst *ImageRef) (Descriptor, error) {
+	if to.APIVersionContext(ctx) != APIVersion2 {
+		return Descriptor{}, fmt.Errorf("%s: pushing needs a v2 registry", to.Host)
+	}
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		tmp, err := ioutil.TempDir("", "docker-fetch-copy-")
+		if err != nil {
+			return Descriptor{}, err
+		}
+		defer os.RemoveAll(tmp)
+		if _, err := re.FetchLayersContext(ctx, src, tmp); err != nil {
+			return Descriptor{}, err
+		}
+		return to.PushImageContext(ctx, src, tmp, dst)
+	}
+
+	if err := re.vet(ctx, src); err != nil {
+		return Descriptor{}, err
+	}
+	buf, mediaType, _, err := re.v2Manifest(ctx, src, src.manifestReference())
+	if err != nil {
+		return Descriptor{}, err
+	}
+	digest := digestOf(buf)
+	if src.Pinned() && digest != src.Digest() {
+		return Descriptor{}, fmt.Errorf("%s: manifest has digest %s", src, digest)
+	}
+	if dst.Pinned() && digest != dst.Digest() {
+		return Descriptor{}, fmt.Errorf("%s: manifest has digest %s", dst, digest)
+	}
+	if !isManifestList(mediaType, buf) {
+		return re.copyManifest(ctx, to, src, dst, mediaType, buf)
+	}
+
+	var list OCIIndex
+	if err := json.Unmarshal(buf, &list); err != nil {
+		return Descriptor{}, fmt.Errorf("%s: %w", src, err)
+	}
+	if list.MediaType != "" {
+		mediaType = list.MediaType
+	}
+	for _, desc := range list.Manifests {
+		child, childType, _, err := re.v2Manifest(ctx, src, desc.Digest)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		if actual := digestOf(child); actual != desc.Digest {
+			return Descriptor{}, fmt.Errorf("%s: manifest %s has digest %s", src, desc.Digest, actual)
+		}
+		if isManifestList(childType, child) {
+			return Descriptor{}, fmt.Errorf("%s: manifest %s is a manifest list itself", src, desc.Digest)
+		}
+		if _, err := re.copyManifest(ctx, to, src, NewImageRef(dst.Host()+"/"+dst.Name()+"@"+desc.Digest), childType, child); err != nil {
+			return Descriptor{}, err
+		}
+	}
+	return to.pushManifest(ctx, dst, mediaType, buf)
+}
+
+// copyManifest copies the blobs of the image manifest buf of src to dst on
+// the registry to, then the manifest
+func (re *RegistryEndpoint) copyManifest(ctx context.Context, to *RegistryEndpoint, src, dst *ImageRef, mediaType string, buf []byte) (Descriptor, error) {
+	var manifest ManifestV2
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return Descriptor{}, fmt.Errorf("%s: %w", src, err)
+	}
+	if manifest.SchemaVersion != 2 {
+		return Descriptor{}, fmt.Errorf("%s has an unsupported manifest schema version %d", src, manifest.SchemaVersion)
+	}
+	if manifest.MediaType != "" {
+		mediaType = manifest.MediaType
+	}
+	if err := to.pushBlobs(ctx, dst, append([]Descriptor{manifest.Config}, manifest.Layers...), func(blob Descriptor) func(offset, size int64) *requestBody {
+		return func(offset, size int64) *requestBody {
+			return re.v2BlobBody(ctx, src, blob.Digest, offset, size, blob.Size)
+		}
+	}); err != nil {
+		return Descriptor{}, err
+	}
+	return to.pushManifest(ctx, dst, mediaType, buf)
+}
+
+// v2BlobBody is the size bytes from offset of the blob digest of img, total
+// bytes long, as a request body downloaded as it is sent
+func (re *RegistryEndpoint) v2BlobBody(ctx context.Context, img *ImageRef, digest string, offset, size, total int64) *requestBody {
+	if size == 0 {
+		return nil
+	}
+	return &requestBody{size: size, open: func() (io.ReadCloser, error) {
+		urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(img), digest))
+		header := http.Header{}
+		if offset > 0 || size < total {
+			header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+		}
+		resp, err := re.v2Do(ctx, img, "GET", urlStr, header)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// the range was ignored
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		default:
+			defer resp.Body.Close()
+			return nil, newResponseError(urlStr, resp)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, size), resp.Body}, nil
+	}}
+}
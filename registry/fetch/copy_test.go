@@ -0,0 +1,125 @@
+package fetch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRegistryCopy(t *testing.T) {
+	src := newTestRegistryV2(t, testLayers...)
+	dst := newTestRegistryV2(t)
+
+	// in chunks smaller than the layers, fetched with ranges
+	from, to := NewRegistry(src.Host()), NewRegistry(dst.Host())
+	to.PushChunkSize = 5
+	desc, err := from.CopyTo(&to, src.Ref(), NewImageRef(dst.Host()+"/test/copy:v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digestOf(src.manifest) || string(dst.Pushed["test/copy:v1"]) != string(src.manifest) {
+		t.Fatalf("expected the manifest %s copied as is, got %s", digestOf(src.manifest), desc.Digest)
+	}
+	for digest, blob := range src.blobs {
+		if string(dst.blobs[digest]) != string(blob) {
+			t.Errorf("%s: expected the blob copied", digest)
+		}
+	}
+
+	// copying again transfers no blobs
+	blobGets := 0
+	for p, n := range src.Requests {
+		if strings.HasPrefix(p, "/v2/test/image/blobs/") {
+			blobGets += n
+		}
+	}
+	uploads := dst.Requests["/v2/test/copy/blobs/uploads/"]
+	if _, err := Copy(src.Ref(), NewImageRef(dst.Host()+"/test/copy:v2")); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Requests["/v2/test/copy/blobs/uploads/"] != uploads {
+		t.Errorf("expected no more uploads, got %d", dst.Requests["/v2/test/copy/blobs/uploads/"]-uploads)
+	}
+	for p, n := range src.Requests {
+		if strings.HasPrefix(p, "/v2/test/image/blobs/") {
+			blobGets -= n
+		}
+	}
+	// only the config, to resolve the image
+	if blobGets != -1 {
+		t.Errorf("expected only the config fetched again, got %d blob requests", -blobGets)
+	}
+
+	// images from v1 registries are pushed as OCI images
+	v1 := newTestRegistry(t, testLayers...)
+	if _, err := Copy(v1.Ref(), NewImageRef(dst.Host()+"/test/v1:latest")); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Pushed["test/v1:latest"] == nil {
+		t.Errorf("expected the v1 image pushed")
+	}
+
+	// the Policy is enforced as when fetching
+	from.Policy = &Policy{MaxSize: 1}
+	if _, err := from.CopyTo(&to, src.Ref(), NewImageRef(dst.Host()+"/test/copy:big")); err == nil || !strings.Contains(err.Error(), "max_size") {
+		t.Errorf("expected an image over the max_size of the policy to be refused, got %v", err)
+	}
+	from.Policy = &Policy{AllowedRegistries: []string{"registry.example.com"}}
+	if _, err := from.CopyTo(&to, src.Ref(), NewImageRef(dst.Host()+"/test/copy:denied")); err == nil || !strings.Contains(err.Error(), "allowed_registries") {
+		t.Errorf("expected an image of a registry not allowed to be refused, got %v", err)
+	}
+	if dst.Pushed["test/copy:big"] != nil || dst.Pushed["test/copy:denied"] != nil {
+		t.Errorf("expected the images refused not to be pushed")
+	}
+}
+
+func TestRegistryCopyManifestList(t *testing.T) {
+	src := newTestRegistryV2(t, testLayers...)
+	dst := newTestRegistryV2(t)
+
+	// an arm64 image of the same layers, next to the amd64 one
+	var manifest ManifestV2
+	if err := json.Unmarshal(src.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	config := []byte(strings.Replace(string(src.blobs[manifest.Config.Digest]), `"amd64"`, `"arm64"`, 1))
+	manifest.Config = Descriptor{MediaType: MediaTypeImageConfig, Size: int64(len(config)), Digest: digestOf(config)}
+	arm, _ := json.Marshal(manifest)
+	src.blobs[digestOf(config)] = config
+	src.Pushed["test/image:"+digestOf(arm)] = arm
+	src.manifestList, _ = json.Marshal(OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifestList,
+		Manifests: []Descriptor{
+			{MediaType: MediaTypeManifestV2, Size: int64(len(arm)), Digest: digestOf(arm), Platform: &Platform{OS: "linux", Architecture: "arm64"}},
+			{MediaType: MediaTypeManifestV2, Size: int64(len(src.manifest)), Digest: digestOf(src.manifest), Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	})
+
+	desc, err := Copy(NewImageRef(src.Host()+"/test/image:multi"), NewImageRef(dst.Host()+"/test/copy:multi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digestOf(src.manifestList) || string(dst.Pushed["test/copy:multi"]) != string(src.manifestList) {
+		t.Fatalf("expected the manifest list %s copied as is, got %s", digestOf(src.manifestList), desc.Digest)
+	}
+	for _, m := range [][]byte{arm, src.manifest} {
+		if string(dst.Pushed["test/copy:"+digestOf(m)]) != string(m) {
+			t.Errorf("expected the manifest %s copied by digest", digestOf(m))
+		}
+	}
+	for digest, blob := range src.blobs {
+		if string(dst.blobs[digest]) != string(blob) {
+			t.Errorf("%s: expected the blob copied", digest)
+		}
+	}
+
+	// a list with a manifest missing is not copied
+	delete(src.Pushed, "test/image:"+digestOf(arm))
+	if _, err := Copy(NewImageRef(src.Host()+"/test/image:multi"), NewImageRef(dst.Host()+"/test/missing:multi")); err == nil {
+		t.Errorf("expected the list with a missing manifest not to be copied")
+	}
+	if dst.Pushed["test/missing:multi"] != nil {
+		t.Errorf("expected the list not to be pushed")
+	}
+}
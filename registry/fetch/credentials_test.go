@@ -0,0 +1,69 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+func TestRegistryV2Credentials(t *testing.T) {
+	for _, basic := range []bool{false, true} {
+		tr := newTestRegistryV2(t, testLayers...)
+		tr.Auth = "joe:hunter2"
+		tr.Basic = basic
+		tdir, err := ioutil.TempDir("", "test.fetch.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		var unauthorized ErrUnauthorized
+		if _, err := r.FetchLayers(ref, tdir); !errors.As(err, &unauthorized) {
+			t.Errorf("basic %v: expected a failure without credentials, got %v", basic, err)
+		}
+
+		ref = tr.Ref()
+		r = NewRegistry(ref.Host())
+		r.Credentials = auth.Basic("joe", "hunter2")
+		if _, err := r.FetchLayers(ref, tdir); err != nil {
+			t.Errorf("basic %v: %s", basic, err)
+		}
+	}
+}
+
+func TestRegistryTenantTokens(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tr.Auth = "joe:hunter2"
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+
+	joe := WithCredentials(context.Background(), auth.Credentials{Username: "joe", Password: "hunter2"})
+	if _, err := r.AncestryContext(joe, NewImageRef(ref.String())); err != nil {
+		t.Fatal(err)
+	}
+	// the same endpoint, for tenants without joe's password
+	mallory := WithCredentials(context.Background(), auth.Credentials{Username: "joe", Password: "guess"})
+	for name, ctx := range map[string]context.Context{"other credentials": mallory, "anonymous": context.Background()} {
+		if _, err := r.AncestryContext(ctx, NewImageRef(ref.String())); err == nil {
+			t.Errorf("%s: expected joe's token not to be reused", name)
+		}
+	}
+	tr.mu.Lock()
+	tr.Requests["/token"] = 0
+	tr.mu.Unlock()
+	if _, err := r.AncestryContext(joe, NewImageRef(ref.String())); err != nil {
+		t.Fatal(err)
+	}
+	tr.mu.Lock()
+	n := tr.Requests["/token"]
+	tr.mu.Unlock()
+	if n != 0 {
+		t.Errorf("expected joe's token to be reused for joe, got %d token requests", n)
+	}
+}
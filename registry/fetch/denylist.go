@@ -0,0 +1,134 @@
+package fetch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LayerDenyList is a list of known-bad layer digests, like those of layers
+// with a compromised package, that images referencing them are refused, or
+// reported, for. The digests are of the compressed blobs of v2 registries, or
+// of the uncompressed content (the diff_ids of the image config, and the
+// layer.tar of v1 registries). The images of v2 registries are checked before
+// any layer is downloaded, those of v1 registries once their layers are.
+type LayerDenyList struct {
+	// Digests are the digests denied, like "sha256:...", each with the
+	// reason it is, if any
+	Digests map[string]string
+	// Warn only logs the images referencing the digests, and fetches them
+	Warn bool
+}
+
+// ErrLayerDenied is returned when an image references a layer of the
+// LayerDenyList
+type ErrLayerDenied struct {
+	Ref    string
+	Digest string
+	Reason string
+}
+
+func (e ErrLayerDenied) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("%s: layer %s is denied", e.Ref, e.Digest)
+	}
+	return fmt.Sprintf("%s: layer %s is denied: %s", e.Ref, e.Digest, e.Reason)
+}
+
+// LoadLayerDenyList reads a LayerDenyList from filename, with a digest per
+// line, optionally followed by the reason it is denied, like
+//
+//	# the xz backdoor, CVE-2024-3094
+//	sha256:1b1c... liblzma 5.6.1
+//
+// Empty lines and lines starting with "#" are ignored.
+func LoadLayerDenyList(filename string) (*LayerDenyList, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	l := &LayerDenyList{Digests: map[string]string{}}
+	scanner := bufio.NewScanner(fh)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if !referenceDigest.MatchString(fields[0]) {
+			return nil, fmt.Errorf("%s:%d: invalid digest %q", filename, n, fields[0])
+		}
+		reason := ""
+		if len(fields) == 2 {
+			reason = strings.TrimSpace(fields[1])
+		}
+		l.Digests[strings.ToLower(fields[0])] = reason
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Check returns an ErrLayerDenied for the first of the layer digests of img
+// that is denied, or logs each of them when Warn is set
+func (l *LayerDenyList) Check(img *ImageRef, digests []string) error {
+	for _, digest := range digests {
+		reason, denied := l.Digests[strings.ToLower(digest)]
+		if !denied {
+			continue
+		}
+		err := ErrLayerDenied{Ref: img.String(), Digest: digest, Reason: reason}
+		if !l.Warn {
+			return err
+		}
+		logrus.Warn(err)
+	}
+	return nil
+}
+
+// checkDeniedLayers checks the layers of img, of a v2 registry, against the
+// LayerDenyList, by the digests of their blobs and of their content
+func (re *RegistryEndpoint) checkDeniedLayers(ctx context.Context, img *ImageRef) error {
+	v2, err := re.v2Resolve(ctx, img)
+	if err != nil {
+		return err
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(v2.config, &config); err != nil {
+		return err
+	}
+	digests := append([]string{}, config.RootFS.DiffIDs...)
+	for _, layer := range v2.manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return re.LayerDenyList.Check(img, digests)
+}
+
+// checkDeniedLayerFiles checks the layers ids of img, fetched into dest from
+// a v1 registry, against the LayerDenyList, by the checksums of their
+// layer.tar
+func (re *RegistryEndpoint) checkDeniedLayerFiles(img *ImageRef, ids []string, dest string) error {
+	digests := []string{}
+	for _, id := range ids {
+		sum, ok, err := readLayerChecksum(filepath.Join(dest, id))
+		if err != nil {
+			return err
+		}
+		if ok {
+			digests = append(digests, sum.Digest)
+		}
+	}
+	return re.LayerDenyList.Check(img, digests)
+}
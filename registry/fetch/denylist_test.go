@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayerDenyList(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	tr := newTestRegistryV2(t, testLayers...)
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	bad := manifest.Layers[0].Digest
+	listFile := filepath.Join(tdir, "denied.txt")
+	list := "# incident 42\n\n" + strings.ToUpper(bad[:7]) + bad[7:] + " compromised libfoo\n"
+	if err := ioutil.WriteFile(listFile, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	denied, err := LoadLayerDenyList(listFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, ok := denied.Digests[bad]; !ok || reason != "compromised libfoo" {
+		t.Fatalf("expected %s to be denied, got %v", bad, denied.Digests)
+	}
+
+	r := NewRegistry(tr.Host())
+	r.LayerDenyList = denied
+	var e ErrLayerDenied
+	if _, err := r.FetchLayers(tr.Ref(), filepath.Join(tdir, "v2")); !errors.As(err, &e) || e.Digest != bad || e.Reason != "compromised libfoo" {
+		t.Fatalf("expected layer %s to be denied, got %v", bad, err)
+	}
+	for path, n := range tr.Requests {
+		if strings.Contains(path, "/blobs/"+bad) && n > 0 {
+			t.Errorf("expected the denied layer not to be downloaded, got %d requests", n)
+		}
+	}
+	if _, err := r.CopyTo(&r, tr.Ref(), NewImageRef(tr.Host()+"/test/copy")); !errors.As(err, &e) {
+		t.Errorf("expected the copy to be refused, got %v", err)
+	}
+	if _, err := r.FetchMetadata(tr.Ref(), filepath.Join(tdir, "v2")); !errors.As(err, &e) {
+		t.Errorf("expected the metadata fetch to be refused, got %v", err)
+	}
+	denied.Warn = true
+	if _, err := r.FetchLayers(tr.Ref(), filepath.Join(tdir, "v2")); err != nil {
+		t.Errorf("expected the image to be fetched with a warning, got %v", err)
+	}
+
+	// v1 registries are checked by the content of the layers fetched
+	tr1 := newTestRegistry(t, testLayers...)
+	denied = &LayerDenyList{Digests: map[string]string{digestOf(testLayers[1].Layer): ""}}
+	r = NewRegistry(tr1.Host())
+	r.LayerDenyList = denied
+	if _, err := r.FetchLayers(tr1.Ref(), filepath.Join(tdir, "v1")); !errors.As(err, &e) || e.Digest != digestOf(testLayers[1].Layer) {
+		t.Errorf("expected the base layer to be denied, got %v", err)
+	}
+
+	if err := ioutil.WriteFile(listFile, []byte("sha256:nothex\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLayerDenyList(listFile); err == nil {
+		t.Error("expected an invalid digest to be refused")
+	}
+}
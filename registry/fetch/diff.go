@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"github.com/vbatts/docker-utils/export"
+)
+
+// ImageDiff is how two images compare, layer by layer and, when asked for,
+// file by file
+type ImageDiff struct {
+	A string `json:"a"`
+	B string `json:"b"`
+	// Shared are the layers both images have, and OnlyA and OnlyB those of
+	// one of them only, each top-most first
+	Shared []DiffLayer `json:"shared"`
+	OnlyA  []DiffLayer `json:"only_a"`
+	OnlyB  []DiffLayer `json:"only_b"`
+	// Files are the paths added in B, removed from A, or modified
+	Files []export.Change `json:"files,omitempty"`
+}
+
+// DiffLayer is a layer of an ImageDiff
+type DiffLayer struct {
+	ID string `json:"id"`
+	// Digest is of the blob of the layer, on v2 registries
+	Digest string `json:"digest,omitempty"`
+}
+
+// diffLayers are the layers of img, with what identifies their content
+func diffLayers(img *ImageRef) ([]DiffLayer, []string) {
+	layers := []DiffLayer{}
+	keys := []string{}
+	for _, id := range img.Ancestry() {
+		layer := DiffLayer{ID: id}
+		key := "v1:" + id
+		// the legacy IDs of v2 images depend on the layers below, and the
+		// top-most on the config, so the same content is matched by digest
+		if img.v2 != nil {
+			layer.Digest = img.v2.layers[id].Digest
+			key = layer.Digest
+		}
+		layers = append(layers, layer)
+		keys = append(keys, key)
+	}
+	return layers, keys
+}
+
+// Diff compares the layers of the images a and b, whose ancestries have been
+// resolved, like with Ancestry or FetchLayers: the layers of v2 images by the
+// digest of their content, and those of v1 images by ID.
+func Diff(a, b *ImageRef) *ImageDiff {
+	d := &ImageDiff{A: a.String(), B: b.String(), Shared: []DiffLayer{}, OnlyA: []DiffLayer{}, OnlyB: []DiffLayer{}}
+	layersA, keysA := diffLayers(a)
+	layersB, keysB := diffLayers(b)
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, key := range keysA {
+		inA[key] = true
+	}
+	for _, key := range keysB {
+		inB[key] = true
+	}
+	for i, layer := range layersA {
+		if inB[keysA[i]] {
+			d.Shared = append(d.Shared, layer)
+		} else {
+			d.OnlyA = append(d.OnlyA, layer)
+		}
+	}
+	for i, layer := range layersB {
+		if !inA[keysB[i]] {
+			d.OnlyB = append(d.OnlyB, layer)
+		}
+	}
+	return d
+}
+
+// DiffFiles compares the filesystems of the images a and b, fetched into srcA
+// and srcB with FetchLayers, and adds the paths that differ to d. See
+// export.DiffFS.
+func (d *ImageDiff) DiffFiles(a *ImageRef, srcA string, b *ImageRef, srcB string) error {
+	fsA, err := export.NewImageFS(srcA, a.Ancestry())
+	if err != nil {
+		return err
+	}
+	fsB, err := export.NewImageFS(srcB, b.Ancestry())
+	if err != nil {
+		return err
+	}
+	d.Files, err = export.DiffFS(fsA, fsB)
+	return err
+}
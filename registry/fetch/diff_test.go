@@ -0,0 +1,71 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+func TestDiff(t *testing.T) {
+	layer := func(name, content string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+		tw.Close()
+		return buf.Bytes()
+	}
+	base := layer("etc/os-release", "ID=test\n")
+	trA := newTestRegistryV2(t,
+		testLayer{ID: strings.Repeat("b", 64), Parent: strings.Repeat("a", 64), Layer: layer("app/run", "v1\n")},
+		testLayer{ID: strings.Repeat("a", 64), Layer: base},
+	)
+	trB := newTestRegistryV2(t,
+		testLayer{ID: strings.Repeat("c", 64), Parent: strings.Repeat("a", 64), Layer: layer("app/run", "v2\n")},
+		testLayer{ID: strings.Repeat("a", 64), Layer: base},
+	)
+	tdirA, err := ioutil.TempDir("", "test.diff.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdirA)
+	tdirB, err := ioutil.TempDir("", "test.diff.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdirB)
+
+	a, b := trA.Ref(), trB.Ref()
+	rA, rB := NewRegistry(a.Host()), NewRegistry(b.Host())
+	if _, err := rA.FetchLayers(a, tdirA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rB.FetchLayers(b, tdirB); err != nil {
+		t.Fatal(err)
+	}
+
+	d := Diff(a, b)
+	if len(d.Shared) != 1 || d.Shared[0].ID != a.Ancestry()[1] || d.Shared[0].Digest == "" {
+		t.Errorf("expected the base layer to be shared, got %v", d.Shared)
+	}
+	if len(d.OnlyA) != 1 || d.OnlyA[0].ID != a.Ancestry()[0] {
+		t.Errorf("expected the top layer of a only in a, got %v", d.OnlyA)
+	}
+	if len(d.OnlyB) != 1 || d.OnlyB[0].ID != b.Ancestry()[0] {
+		t.Errorf("expected the top layer of b only in b, got %v", d.OnlyB)
+	}
+
+	if err := d.DiffFiles(a, tdirA, b, tdirB); err != nil {
+		t.Fatal(err)
+	}
+	expected := []export.Change{{Path: "app/run", Kind: export.ChangeModified}}
+	if !reflect.DeepEqual(d.Files, expected) {
+		t.Errorf("expected %v, got %v", expected, d.Files)
+	}
+}
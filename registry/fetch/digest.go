@@ -0,0 +1,37 @@
+package fetch
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrDigestMismatch is the failure of a downloaded layer to match its
+// expected digest. The corrupted download is removed.
+type ErrDigestMismatch struct {
+	ID       string
+	Expected string
+	Actual   string
+}
+
+func (e ErrDigestMismatch) Error() string {
+	return fmt.Sprintf("layer %s: expected digest %s, got %s", e.ID, e.Expected, e.Actual)
+}
+
+// verifyDigest checks the digest of the download of the layer id against
+// each of the expected digests that are set, removing filename on a mismatch
+func verifyDigest(id, filename, digest string, expected ...string) error {
+	for _, e := range expected {
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, "sha256:") {
+			return fmt.Errorf("layer %s: unsupported digest %q", id, e)
+		}
+		if e != digest {
+			os.Remove(filename)
+			return ErrDigestMismatch{ID: id, Expected: e, Actual: digest}
+		}
+	}
+	return nil
+}
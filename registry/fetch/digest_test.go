@@ -0,0 +1,69 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRegistryFetchLayersDigest(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ref.SetLayerDigest(testLayers[0].ID, digestOf(testLayers[0].Layer))
+	ref.SetLayerDigest(testLayers[1].ID, digestOf([]byte("something else")))
+	_, err = r.FetchLayers(ref, tdir)
+	var mismatch ErrDigestMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected an ErrDigestMismatch, got %v", err)
+	}
+	if mismatch.ID != testLayers[1].ID || mismatch.Actual != digestOf(testLayers[1].Layer) {
+		t.Errorf("unexpected mismatch %#v", mismatch)
+	}
+	if _, err := os.Stat(path.Join(tdir, testLayers[1].ID, "layer.tar"+PartialSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupted layer to be removed")
+	}
+	if _, err := os.Stat(path.Join(tdir, testLayers[0].ID, "layer.tar")); err != nil {
+		t.Errorf("expected the good layer to be kept: %s", err)
+	}
+}
+
+func TestRegistryV2FetchLayersDigest(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	base := manifest.Layers[0].Digest
+	tr.blobs[base] = append([]byte{}, tr.blobs[base]...)
+	tr.blobs[base][len(tr.blobs[base])-1] ^= 0xff
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	_, err = r.FetchLayers(ref, tdir)
+	var mismatch ErrDigestMismatch
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected an ErrDigestMismatch, got %v", err)
+	}
+	if mismatch.Expected != base || mismatch.ID != ref.Ancestry()[1] {
+		t.Errorf("unexpected mismatch %#v", mismatch)
+	}
+	if _, err := os.Stat(path.Join(tdir, mismatch.ID, "layer.blob"+PartialSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupted blob to be removed")
+	}
+}
@@ -0,0 +1,8 @@
+// Package fetch retrieves images from Docker registries (v1 and v2) into the
+// legacy `docker save` layout, without a docker daemon.
+//
+// The exported API (ImageRef, ImageRefSet, RegistryEndpoint and the types
+// they return) is meant to be embedded by other programs and only changes in
+// backwards compatible ways. Flags and output of cmd/docker-fetch are not
+// part of this API.
+package fetch
@@ -0,0 +1,224 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxErrorBody is how much of the body of a failed response is read for the
+// errors in it
+const maxErrorBody = 64 << 10
+
+// RegistryError is one of the errors listed in the body of a failed response
+// of a v2 registry, like
+//
+//	{"code": "MANIFEST_UNKNOWN", "message": "manifest unknown", "detail": {"Tag": "v1.99"}}
+type RegistryError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message,omitempty"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// Error reads like "manifest unknown (tag v1.99)" or "denied: requested
+// access to the resource is denied", from the code, message and detail given
+func (e RegistryError) Error() string {
+	msg := strings.ToLower(strings.Replace(e.Code, "_", " ", -1))
+	if e.Message != "" && !strings.EqualFold(e.Message, msg) {
+		if msg == "" {
+			msg = e.Message
+		} else {
+			msg += ": " + e.Message
+		}
+	}
+	if detail := errorDetail(e.Detail); detail != "" {
+		msg += " (" + detail + ")"
+	}
+	return msg
+}
+
+// errorDetail is the detail of a RegistryError as text, if it says anything
+func errorDetail(detail json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(detail, &s); err == nil {
+		return s
+	}
+	// like {"Tag": "v1.99"}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(detail, &fields); err == nil && len(fields) > 0 {
+		keys := []string{}
+		scalar := true
+		for k, v := range fields {
+			switch v.(type) {
+			case string, float64, bool:
+			default:
+				scalar = false
+			}
+			keys = append(keys, k)
+		}
+		if scalar {
+			sort.Strings(keys)
+			parts := make([]string, len(keys))
+			for i, k := range keys {
+				parts[i] = fmt.Sprintf("%s %v", strings.ToLower(k), fields[k])
+			}
+			return strings.Join(parts, ", ")
+		}
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := json.Compact(buf, detail); err != nil {
+		return ""
+	}
+	switch buf.String() {
+	case "null", "{}", "[]":
+		return ""
+	}
+	return buf.String()
+}
+
+// ResponseError is returned when a registry responds with an unexpected
+// status. The Errors listed in the body of the response, by v2 registries,
+// make up its message in place of the bare status.
+type ResponseError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Errors     []RegistryError
+	// RetryAfter is the wait the Retry-After header of the response asked
+	// for, if any
+	RetryAfter time.Duration
+	// RateLimitRemaining is the RateLimit-Remaining header of the
+	// response, if any
+	RateLimitRemaining string
+}
+
+func (e ResponseError) Error() string {
+	method := e.Method
+	if method != "" {
+		method = method[:1] + strings.ToLower(method[1:])
+	}
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("%s(%q) returned %q", method, e.URL, e.Status)
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, regErr := range e.Errors {
+		msgs[i] = regErr.Error()
+	}
+	return fmt.Sprintf("%s(%q): %s", method, e.URL, strings.Join(msgs, "; "))
+}
+
+// HasCode reports whether code, like "MANIFEST_UNKNOWN", is among the
+// errors the registry gave
+func (e ResponseError) HasCode(code string) bool {
+	for _, regErr := range e.Errors {
+		if regErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// newResponseError is the ResponseError of resp, a response to the request
+// for urlStr, reading the errors listed in its body if any
+func newResponseError(urlStr string, resp *http.Response) error {
+	e := ResponseError{
+		Method:             resp.Request.Method,
+		URL:                urlStr,
+		Status:             resp.Status,
+		StatusCode:         resp.StatusCode,
+		RetryAfter:         parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		RateLimitRemaining: resp.Header.Get("RateLimit-Remaining"),
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil || len(bytes.TrimSpace(buf)) == 0 {
+		return e
+	}
+	var body struct {
+		Errors []RegistryError `json:"errors"`
+	}
+	if err := json.Unmarshal(buf, &body); err == nil {
+		for _, regErr := range body.Errors {
+			if regErr.Code != "" || regErr.Message != "" {
+				e.Errors = append(e.Errors, regErr)
+			}
+		}
+	}
+	return e
+}
+
+// As makes a ResponseError available as the error of its failure mode, to
+// branch on with errors.As: ErrNotFound, ErrUnauthorized, ErrManifestUnknown,
+// ErrBlobUnknown or ErrRateLimited.
+func (e ResponseError) As(target interface{}) bool {
+	switch t := target.(type) {
+	case *ErrNotFound:
+		if e.StatusCode == http.StatusNotFound {
+			*t = ErrNotFound{e}
+			return true
+		}
+	case *ErrUnauthorized:
+		if e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden {
+			*t = ErrUnauthorized{e}
+			return true
+		}
+	case *ErrManifestUnknown:
+		if e.HasCode("MANIFEST_UNKNOWN") || (e.StatusCode == http.StatusNotFound && strings.Contains(e.URL, "/manifests/")) {
+			*t = ErrManifestUnknown{e}
+			return true
+		}
+	case *ErrBlobUnknown:
+		if e.HasCode("BLOB_UNKNOWN") || (e.StatusCode == http.StatusNotFound && strings.Contains(e.URL, "/blobs/")) {
+			*t = ErrBlobUnknown{e}
+			return true
+		}
+	case *ErrRateLimited:
+		if e.StatusCode == http.StatusTooManyRequests {
+			*t = ErrRateLimited{Host: e.URL, RetryAfter: e.RetryAfter, Remaining: e.RateLimitRemaining}
+			if u, err := url.Parse(e.URL); err == nil {
+				t.Host = u.Host
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNotFound is a ResponseError of a registry answering that what was asked
+// for does not exist
+type ErrNotFound struct {
+	ResponseError
+}
+
+// ErrUnauthorized is a ResponseError of a registry refusing the credentials,
+// or access to what was asked for with them (a 401 or 403)
+type ErrUnauthorized struct {
+	ResponseError
+}
+
+// ErrManifestUnknown is a ResponseError of a registry not having the manifest
+// of a tag or digest, which is also an ErrNotFound
+type ErrManifestUnknown struct {
+	ResponseError
+}
+
+// ErrBlobUnknown is a ResponseError of a registry not having a blob, a layer
+// or a config, which is also an ErrNotFound
+type ErrBlobUnknown struct {
+	ResponseError
+}
+
+// isNotFound reports whether err is the registry responding that what was
+// asked for does not exist
+func isNotFound(err error) bool {
+	var e ErrNotFound
+	return errors.As(err, &e)
+}
@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryErrorMessage(t *testing.T) {
+	for _, c := range []struct {
+		body     string
+		expected string
+	}{
+		{`{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"Tag":"v1.99"}}`, "manifest unknown (tag v1.99)"},
+		{`{"code":"DENIED","message":"requested access to the resource is denied"}`, "denied: requested access to the resource is denied"},
+		{`{"code":"BLOB_UNKNOWN","message":"blob unknown to registry","detail":"sha256:abc"}`, "blob unknown: blob unknown to registry (sha256:abc)"},
+		{`{"code":"UNSUPPORTED","detail":null}`, "unsupported"},
+		{`{"message":"quota exceeded","detail":{"used":[1,2]}}`, `quota exceeded ({"used":[1,2]})`},
+	} {
+		var e RegistryError
+		if err := json.Unmarshal([]byte(c.body), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Error() != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.body, c.expected, e.Error())
+		}
+	}
+}
+
+func TestRegistryV2ErrorBody(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := NewImageRef(tr.Host() + "/test/image:v1.99")
+	r := NewRegistry(ref.Host())
+	_, err := r.Ancestry(ref)
+	var resp ResponseError
+	if !errors.As(err, &resp) {
+		t.Fatalf("expected a ResponseError, got %v", err)
+	}
+	if resp.StatusCode != http.StatusNotFound || !resp.HasCode("MANIFEST_UNKNOWN") {
+		t.Errorf("expected a 404 with MANIFEST_UNKNOWN, got %d and %v", resp.StatusCode, resp.Errors)
+	}
+	expected := `Get("https://` + tr.Host() + `/v2/test/image/manifests/v1.99"): manifest unknown (tag v1.99)`
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	// without errors in the body, the status is given
+	tr.Fail["/v2/test/image/manifests/latest"] = http.StatusBadGateway
+	if _, err := r.Ancestry(tr.Ref()); err == nil || err.Error() != `Get("https://`+tr.Host()+`/v2/test/image/manifests/latest") returned "502 Bad Gateway"` {
+		t.Errorf("expected the bare status, got %v", err)
+	}
+}
+
+func TestResponseErrorAs(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	r := NewRegistry(tr.Host())
+
+	_, err := r.Ancestry(NewImageRef(tr.Host() + "/test/image:v1.99"))
+	var (
+		notFound        ErrNotFound
+		manifestUnknown ErrManifestUnknown
+		blobUnknown     ErrBlobUnknown
+		unauthorized    ErrUnauthorized
+		limited         ErrRateLimited
+	)
+	if !errors.As(err, &manifestUnknown) || !errors.As(err, &notFound) || notFound.StatusCode != http.StatusNotFound {
+		t.Errorf("expected an unknown manifest, got %v", err)
+	}
+	if errors.As(err, &blobUnknown) || errors.As(err, &unauthorized) {
+		t.Errorf("expected only an unknown manifest, got %v", err)
+	}
+
+	_, _, err = r.FetchBlob(tr.Ref(), "sha256:"+strings.Repeat("0", 64))
+	if !errors.As(err, &blobUnknown) || !errors.As(err, &notFound) || errors.As(err, &manifestUnknown) {
+		t.Errorf("expected an unknown blob, got %v", err)
+	}
+
+	tr.Fail["/v2/test/image/manifests/latest"] = http.StatusForbidden
+	if _, err := r.Ancestry(tr.Ref()); !errors.As(err, &unauthorized) || errors.As(err, &notFound) {
+		t.Errorf("expected the access to be refused, got %v", err)
+	}
+
+	err = fmt.Errorf("wrapped: %w", ResponseError{Method: "GET", URL: "https://registry.example.com/v2/", StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute, RateLimitRemaining: "0;w=21600"})
+	if !errors.As(err, &limited) || limited.Host != "registry.example.com" || limited.RetryAfter != time.Minute || limited.Remaining != "0;w=21600" {
+		t.Errorf("expected a rate limit by registry.example.com, for a minute, got %v (%#v)", err, limited)
+	}
+}
+
+func TestResponseErrorRetryAfter(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://registry.example.com/v2/test/image/manifests/latest", nil)
+	resp := &http.Response{
+		Request:    req,
+		Status:     "429 Too Many Requests",
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": {"120"}},
+		Body:       http.NoBody,
+	}
+	err := fmt.Errorf("test/image: %w", newResponseError(req.URL.String(), resp))
+	var limited ErrRateLimited
+	if !errors.As(err, &limited) || limited.RetryAfter != 2*time.Minute {
+		t.Errorf("expected to retry after 2m, got %v (%#v)", err, limited)
+	}
+}
@@ -1,10 +1,19 @@
 package fetch
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestImageRefHost(t *testing.T) {
@@ -19,7 +28,8 @@ func TestImageRefHost(t *testing.T) {
 		{"docker.io/tianon/true:hurr", DefaultHubNamespace, "tianon/true", "hurr"},
 		{"tianon/true", DefaultHubNamespace, "tianon/true", DefaultTag},
 		{"tianon/true:latest", DefaultHubNamespace, "tianon/true", DefaultTag},
-		{"fedora:latest", DefaultHubNamespace, "fedora", DefaultTag},
+		{"fedora:latest", DefaultHubNamespace, "library/fedora", DefaultTag},
+		{"index.docker.io/fedora", DefaultHubNamespace, "library/fedora", DefaultTag},
 		{"localhost:5000/fedora", "localhost:5000", "fedora", DefaultTag},
 		{"localhost:5000/fedora:latest", "localhost:5000", "fedora", DefaultTag},
 		{"localhost/fedora", "localhost", "fedora", DefaultTag},
@@ -44,6 +54,119 @@ func TestImageRefHost(t *testing.T) {
 	}
 }
 
+func TestImageRefDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	cases := []struct {
+		Name           string
+		ExpectedName   string
+		ExpectedTag    string
+		ExpectedString string
+	}{
+		{"busybox@" + digest, "library/busybox", DefaultTag, "docker.io/library/busybox@" + digest},
+		{"busybox:1.36@" + digest, "library/busybox", "1.36", "docker.io/library/busybox:1.36@" + digest},
+		{"localhost:5000/fedora@" + digest, "fedora", DefaultTag, "localhost:5000/fedora@" + digest},
+	}
+	for _, c := range cases {
+		ref := NewImageRef(c.Name)
+		if !ref.Pinned() || ref.Digest() != digest {
+			t.Errorf("from %q: expected to be pinned to %s, got %q", c.Name, digest, ref.Digest())
+		}
+		if ref.Name() != c.ExpectedName || ref.Tag() != c.ExpectedTag {
+			t.Errorf("from %q: expected %s:%s, got %s:%s", c.Name, c.ExpectedName, c.ExpectedTag, ref.Name(), ref.Tag())
+		}
+		if ref.String() != c.ExpectedString {
+			t.Errorf("from %q: expected %q, got %q", c.Name, c.ExpectedString, ref.String())
+		}
+		if again := NewImageRef(ref.String()); again.String() != ref.String() {
+			t.Errorf("from %q: expected to parse %q again, got %q", c.Name, ref.String(), again.String())
+		}
+	}
+	if ref := NewImageRef("busybox"); ref.Pinned() || ref.Digest() != "" {
+		t.Errorf("expected no digest, got %q", ref.Digest())
+	}
+}
+
+func TestParseImageRef(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	for name, expected := range map[string]string{
+		"busybox":                                                    "docker.io/library/busybox:latest",
+		"docker.io/library/busybox":                                  "docker.io/library/busybox:latest",
+		"busybox@" + digest:                                          "docker.io/library/busybox@" + digest,
+		"localhost:5000/a/b/c:v1.0_rc-1":                             "localhost:5000/a/b/c:v1.0_rc-1",
+		"registry.example.com/my__app.x-y:2":                         "registry.example.com/my__app.x-y:2",
+		"Registry.Example.com/app":                                   "Registry.Example.com/app:latest",
+		"localhost:5000/fedora:22@" + digest:                         "localhost:5000/fedora:22@" + digest,
+		"example.com:443/team/app@sha512:" + digest[7:] + digest[7:]: "example.com:443/team/app@sha512:" + digest[7:] + digest[7:],
+		"[::1]:5000/foo":                                             "[::1]:5000/foo:latest",
+		"[::1]/foo:bar":                                              "[::1]/foo:bar",
+		"[2001:db8::1]:5000/team/app:1.0@" + digest:                  "[2001:db8::1]:5000/team/app:1.0@" + digest,
+		"[::ffff:192.0.2.1]:443/app":                                 "[::ffff:192.0.2.1]:443/app:latest",
+	} {
+		ref, err := ParseImageRef(name)
+		if err != nil {
+			t.Errorf("%q: %s", name, err)
+			continue
+		}
+		if ref.String() != expected {
+			t.Errorf("%q: expected %q, got %q", name, expected, ref.String())
+		}
+	}
+	for _, name := range []string{
+		"",
+		":latest",
+		"Busybox",
+		"busybox:",
+		"busybox::latest",
+		"busybox:la:test",
+		"busybox@sha256:abc",
+		"busybox@" + digest + "@" + digest,
+		"-busybox",
+		"busybox-",
+		"a//b",
+		"localhost:port/busybox",
+		"[::1:5000/foo",
+		"::1:5000/foo",
+		"[192.0.2.1]:5000/foo",
+		"[::1::2]:5000/foo",
+		"[::1]:/foo",
+		"[::1]:5000:6000/foo",
+		"busybox:" + strings.Repeat("t", 129),
+		"example.com/" + strings.Repeat("a", 255),
+	} {
+		if ref, err := ParseImageRef(name); err == nil {
+			t.Errorf("%q: expected an error, got %s", name, ref)
+		}
+	}
+}
+
+func TestImageRefHostPort(t *testing.T) {
+	for name, expected := range map[string][4]string{
+		"localhost:5000/foo:bar":          {"localhost:5000", "localhost", "5000", "bar"},
+		"localhost/foo":                   {"localhost", "localhost", "", "latest"},
+		"[::1]:5000/foo":                  {"[::1]:5000", "::1", "5000", "latest"},
+		"[::1]/foo:bar":                   {"[::1]", "::1", "", "bar"},
+		"[fe80::1]:5000/a/b:1.0":          {"[fe80::1]:5000", "fe80::1", "5000", "1.0"},
+		"registry.example.com:8443/app:2": {"registry.example.com:8443", "registry.example.com", "8443", "2"},
+		"busybox":                         {"docker.io", "docker.io", "", "latest"},
+	} {
+		ref, err := ParseImageRef(name)
+		if err != nil {
+			t.Errorf("%q: %s", name, err)
+			continue
+		}
+		got := [4]string{ref.Host(), ref.Hostname(), ref.Port(), ref.Tag()}
+		if got != expected {
+			t.Errorf("%q: expected host, hostname, port and tag %q, got %q", name, expected, got)
+		}
+	}
+	// the registry is asked at the host as it is, brackets and port included
+	ref := NewImageRef("[::1]:5000/foo")
+	re := NewRegistry(ref.Host())
+	if u := re.apiURL(ref.Host(), "/v2/"); u != "https://[::1]:5000/v2/" {
+		t.Errorf("expected the URL https://[::1]:5000/v2/, got %s", u)
+	}
+}
+
 func TestRegistryFetchToken(t *testing.T) {
 	ref := NewImageRef("tianon/true")
 	r := NewRegistry(ref.Host())
@@ -110,3 +233,358 @@ func TestRegistryImageRepositoriesFile(t *testing.T) {
 	}
 	// TODO test multiple ImageRef arguments
 }
+
+func TestRegistryAncestryFallback(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tr.Fail["/v1/images/"+testLayers[0].ID+"/ancestry"] = http.StatusInternalServerError
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchMetadata(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{testLayers[0].ID, testLayers[1].ID}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the ancestry %v from the parents of the layers, got %v", expected, ids)
+	}
+	local, err := LocalAncestry(tdir, testLayers[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(local, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected the local ancestry %v, got %v", expected, local)
+	}
+
+	// parents in a loop are refused
+	if _, err := walkParents("a", func(id string) (string, error) { return map[string]string{"a": "b", "b": "a"}[id], nil }); err == nil {
+		t.Errorf("expected a loop of parents to fail")
+	}
+}
+
+func TestRegistryLayerIDPaths(t *testing.T) {
+	tr := newTestRegistry(t,
+		testLayer{ID: strings.Repeat("b", 64), Parent: "../escape", Layer: []byte("top layer")},
+		testLayer{ID: "../escape", Layer: []byte("base layer")},
+	)
+	tdir := t.TempDir()
+	dest := filepath.Join(tdir, "dest")
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, dest); err == nil || !strings.Contains(err.Error(), "invalid layer ID") {
+		t.Errorf("expected an ID with a path to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tdir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing written out of the destination, got %v", err)
+	}
+
+	for _, id := range []string{strings.Repeat("a", 64), strings.Repeat("A", 64), "sha256:" + strings.Repeat("a", 64), strings.Repeat("a", 63), ".."} {
+		if isLayerID(id) != (id == strings.Repeat("a", 64)) {
+			t.Errorf("%q: expected isLayerID to be %t", id, !isLayerID(id))
+		}
+	}
+}
+
+func TestRegistryFetchMetadata(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchMetadata(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 layers, got %d", len(ids))
+	}
+	for _, id := range ids {
+		if _, err := os.Stat(path.Join(tdir, id, "json")); err != nil {
+			t.Error(err)
+		}
+		if _, err := os.Stat(path.Join(tdir, id, "layer.tar")); !os.IsNotExist(err) {
+			t.Errorf("expected no layer.tar for %s", id)
+		}
+	}
+}
+
+func TestRegistryStandalone(t *testing.T) {
+	for _, token := range []string{"", "false"} {
+		tr := newTestRegistry(t, testLayers...)
+		tr.Standalone, tr.StandaloneToken = true, token
+		tdir, err := ioutil.TempDir("", "test.fetch.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		if tok, err := r.Token(ref); err != nil || tok != "" {
+			t.Fatalf("X-Docker-Token %q: expected an empty token, got %q and %v", token, tok, err)
+		}
+		ids, err := r.FetchLayers(ref, tdir)
+		if err != nil {
+			t.Fatalf("X-Docker-Token %q: %s", token, err)
+		}
+		if len(ids) != len(testLayers) {
+			t.Errorf("X-Docker-Token %q: expected %d layers, got %d", token, len(testLayers), len(ids))
+		}
+	}
+
+	tr := newTestRegistryV2(t, testLayers...)
+	tr.Standalone = true
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Requests["/token"] != 0 {
+		t.Errorf("expected no token requests, got %d", tr.Requests["/token"])
+	}
+}
+
+func TestRegistryFetchLayersPolicy(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Policy = &Policy{MaxSize: 5}
+	if _, err := r.FetchLayers(ref, tdir); err == nil {
+		t.Fatal("expected the image to violate the policy")
+	} else if _, ok := err.(PolicyError); !ok {
+		t.Fatalf("expected a PolicyError, got %#v", err)
+	}
+	for _, l := range testLayers {
+		if tr.Requests["/v1/images/"+l.ID+"/layer"] != 0 {
+			t.Errorf("expected layer %s not to be downloaded", l.ID)
+		}
+	}
+
+	r.Policy.MaxSize = 1000
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range testLayers {
+		if _, err := os.Stat(path.Join(tdir, l.ID, "layer.tar")); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRegistryFetchLayersRequireSignature(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	r := NewRegistry(tr.Host())
+	r.Policy = &Policy{RequireSignature: true}
+	if _, err := r.FetchLayers(tr.Ref(), tdir); err != ErrNoSignatureVerifier {
+		t.Errorf("expected require_signature to need a verifier, got %v", err)
+	}
+	// a trust policy not asking for signatures leaves the image unsigned
+	r.Trust = &TrustPolicy{Default: []TrustRequirement{{Type: TrustAcceptAnything}}}
+	if _, err := r.FetchLayers(tr.Ref(), tdir); err == nil || !strings.Contains(err.Error(), "require_signature") {
+		t.Errorf("expected the unsigned image to violate the policy, got %v", err)
+	}
+}
+
+func TestRegistryFetchLayersParallel(t *testing.T) {
+	layers := []testLayer{}
+	for i := 5; i >= 0; i-- {
+		l := testLayer{ID: strings.Repeat(fmt.Sprint(i), 64), Layer: []byte(fmt.Sprintf("layer %d", i))}
+		if i > 0 {
+			l.Parent = strings.Repeat(fmt.Sprint(i-1), 64)
+		}
+		layers = append(layers, l)
+	}
+	tr := newTestRegistry(t, layers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Parallelism = 3
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range layers {
+		buf, err := ioutil.ReadFile(path.Join(tdir, l.ID, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(l.Layer) {
+			t.Errorf("layer %s: expected %q, got %q", l.ID, l.Layer, buf)
+		}
+	}
+	if timings := ref.Timings().Layers; len(timings) != len(layers) || timings[0].ID != layers[0].ID {
+		t.Errorf("expected the layer timings in ancestry order, got %v", timings)
+	}
+
+	tr.Fail["/v1/images/"+layers[2].ID+"/layer"] = http.StatusInternalServerError
+	ref = tr.Ref()
+	_, err = r.FetchLayers(ref, tdir)
+	errs, ok := err.(LayerErrors)
+	if !ok {
+		t.Fatalf("expected LayerErrors, got %#v", err)
+	}
+	if len(errs) != 1 || errs[0].ID != layers[2].ID {
+		t.Errorf("expected only layer %s to fail, got %v", layers[2].ID, errs)
+	}
+}
+
+func TestRegistryFetchLayersInterrupt(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	interrupt := make(chan struct{})
+	close(interrupt)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Interrupt = interrupt
+	if _, err := r.FetchLayers(ref, tdir); err != ErrInterrupted {
+		t.Fatalf("expected ErrInterrupted, got %v", err)
+	}
+	for _, l := range testLayers {
+		if tr.Requests["/v1/images/"+l.ID+"/layer"] != 0 {
+			t.Errorf("expected layer %s not to be downloaded", l.ID)
+		}
+	}
+}
+
+func TestRegistryFetchLayersContext(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]bool{}
+	for _, l := range manifest.Layers {
+		layers["/v2/test/image/blobs/"+l.Digest] = true
+	}
+	// a registry that starts sending the layers, then stalls
+	stalled := make(chan struct{}, len(testLayers))
+	slow := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !layers[r.URL.Path] {
+			tr.serve(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		stalled <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stalled
+		// give the client the time to start writing the partial file
+		for i := 0; i < 100; i++ {
+			if partials, _ := filepath.Glob(path.Join(tdir, "*", "layer.blob"+PartialSuffix)); len(partials) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	ref := NewImageRef(strings.TrimPrefix(slow.URL, "https://") + "/test/image")
+	r := NewRegistry(ref.Host())
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.FetchLayersContext(ctx, ref, tdir)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected cancelling the context to abort the download")
+	}
+	if partials, _ := filepath.Glob(path.Join(tdir, "*", "layer.blob"+PartialSuffix)); len(partials) == 0 {
+		t.Errorf("expected the partial download to be kept")
+	}
+
+	// a done context does not decide the API version for good
+	r = NewRegistry(ref.Host())
+	if _, err := r.AncestryContext(ctx, NewImageRef(ref.String())); err == nil {
+		t.Errorf("expected a done context to fail")
+	}
+	if r.apiVersion != "" {
+		t.Errorf("expected the API version not to be settled, got %q", r.apiVersion)
+	}
+}
+
+func TestAPIVersionConcurrent(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	r := NewRegistry(tr.Host())
+	var wg sync.WaitGroup
+	versions := make([]string, 8)
+	for i := range versions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			versions[i] = r.APIVersion()
+		}(i)
+	}
+	wg.Wait()
+	for i, version := range versions {
+		if version != APIVersion2 {
+			t.Errorf("caller %d: expected %s while the registry is pinged, got %s", i, APIVersion2, version)
+		}
+	}
+	if n := tr.Requests["/v2/"]; n != 1 {
+		t.Errorf("expected the registry to be pinged once, got %d pings", n)
+	}
+}
+
+func TestRegistryTags(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		tags, err := r.Tags(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(tags, ",") != "latest,v1.0" {
+			t.Errorf("v2 %v: expected the tags latest and v1.0, got %v", tr.V2, tags)
+		}
+	}
+}
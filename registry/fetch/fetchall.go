@@ -0,0 +1,86 @@
+package fetch
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// FetchAll fetches the layers of all of refs, images of this registry, into
+// dest, with a `repositories` file tagging each of them, as a `docker load`
+// archive of them all would have. The ancestries of all the images are
+// resolved, and the images vetted, before any layer is downloaded, and the
+// layers the images share are downloaded once. It returns the union of the
+// layer IDs, in the order they are first found.
+func (re *RegistryEndpoint) FetchAll(dest string, refs ...*ImageRef) ([]string, error) {
+	return re.FetchAllContext(context.Background(), dest, refs...)
+}
+
+// FetchAllContext is FetchAll, giving up when ctx is done.
+func (re *RegistryEndpoint) FetchAllContext(ctx context.Context, dest string, refs ...*ImageRef) ([]string, error) {
+	emptySet := []string{}
+	for _, img := range refs {
+		if NewRegistry(img.Host()).Host != re.Host {
+			return emptySet, fmt.Errorf("%s: not an image of %s", img, re.Host)
+		}
+	}
+	for _, img := range refs {
+		if err := re.fetchVetted(ctx, img, dest); err != nil {
+			return emptySet, err
+		}
+	}
+
+	skip := re.incremental(dest)
+	var (
+		all     = []string{}
+		seen    = map[string]bool{}
+		fetched = map[string]bool{}
+	)
+	for _, img := range refs {
+		ids := []string{}
+		for _, id := range img.Ancestry() {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			all = append(all, id)
+			if skip != nil {
+				ok, err := skip(id)
+				if err != nil {
+					return emptySet, err
+				}
+				if ok {
+					continue
+				}
+			}
+			ids = append(ids, id)
+		}
+		if err := re.fetchLayerSet(ctx, img, ids, dest); err != nil {
+			return emptySet, err
+		}
+		for _, id := range ids {
+			fetched[id] = true
+		}
+
+		// a layer shared with an image before it is scanned for this one too
+		scan := []string{}
+		for _, id := range img.Ancestry() {
+			if fetched[id] {
+				scan = append(scan, id)
+			}
+		}
+		if err := re.scanLayers(img, scan, dest); err != nil {
+			return emptySet, err
+		}
+	}
+
+	buf, err := FormatRepositories(refs...)
+	if err != nil {
+		return emptySet, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "repositories"), buf, 0644); err != nil {
+		return emptySet, err
+	}
+	return all, nil
+}
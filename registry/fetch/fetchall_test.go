@@ -0,0 +1,81 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchAll(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+
+	// test/image:slim is the base layer of test/image:latest, with another
+	// layer on top
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	top := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(top)
+	gz.Write([]byte("slim layer"))
+	gz.Close()
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(testLayers[1].Layer), digestOf([]byte("slim layer"))}},
+	})
+	shared := manifest.Layers[0]
+	manifest.Layers = []Descriptor{shared, {MediaType: MediaTypeLayerGzip, Size: int64(top.Len()), Digest: digestOf(top.Bytes())}}
+	manifest.Config = Descriptor{MediaType: MediaTypeImageConfig, Size: int64(len(config)), Digest: digestOf(config)}
+	slim, _ := json.Marshal(manifest)
+	tr.mu.Lock()
+	tr.blobs[digestOf(config)] = config
+	tr.blobs[digestOf(top.Bytes())] = top.Bytes()
+	tr.Pushed["test/image:slim"] = slim
+	tr.mu.Unlock()
+
+	latest := tr.Ref()
+	slimRef := NewImageRef(tr.Host() + "/test/image:slim")
+	r := NewRegistry(latest.Host())
+	dest := t.TempDir()
+	ids, err := r.FetchAll(dest, latest, slimRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("expected the 3 layers of the images, got %v", ids)
+	}
+	if base := slimRef.Ancestry(); len(base) != 2 || base[1] != latest.Ancestry()[1] {
+		t.Errorf("expected the images to share their base layer, got %v and %v", base, latest.Ancestry())
+	}
+	if n := tr.Requests["/v2/test/image/blobs/"+shared.Digest]; n != 1 {
+		t.Errorf("expected the shared layer to be downloaded once, got %d", n)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dest, "repositories"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repos map[string]map[string]string
+	if err := json.Unmarshal(buf, &repos); err != nil {
+		t.Fatal(err)
+	}
+	if tags := repos[latest.Name()]; tags["latest"] != latest.ID() || tags["slim"] != slimRef.ID() {
+		t.Errorf("expected both tags in the repositories file, got %s", buf)
+	}
+
+	if _, err := r.FetchAll(dest, NewImageRef("example.com/other")); err == nil {
+		t.Error("expected an image of another registry to be refused")
+	}
+
+	// the images of the Docker Hub are named docker.io, its registry
+	// index.docker.io
+	hub := NewRegistry("docker.io")
+	hub.BaseURL = "https://" + tr.Host()
+	if _, err := hub.FetchAll(t.TempDir(), NewImageRef("docker.io/test/image")); err != nil {
+		t.Errorf("expected an image of the Docker Hub to be fetched from its registry, got %v", err)
+	}
+}
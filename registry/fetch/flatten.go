@@ -0,0 +1,31 @@
+package fetch
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// Flatten fetches the layers of the image into a temporary directory, and
+// writes its merged root filesystem to w as a single tar archive. See
+// export.Flatten.
+func (re *RegistryEndpoint) Flatten(img *ImageRef, w io.Writer) error {
+	return re.FlattenContext(context.Background(), img, w)
+}
+
+// FlattenContext is Flatten, giving up when ctx is done.
+func (re *RegistryEndpoint) FlattenContext(ctx context.Context, img *ImageRef, w io.Writer) error {
+	tmp, err := ioutil.TempDir("", "docker-fetch-flatten-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	ancestry, err := re.FetchLayersContext(ctx, img, tmp)
+	if err != nil {
+		return err
+	}
+	return export.Flatten(tmp, ancestry, w)
+}
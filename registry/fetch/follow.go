@@ -0,0 +1,265 @@
+package fetch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// DecompressBufferSize is how far the decompression of a layer reads ahead
+// of the gzip decoder
+var DecompressBufferSize = 1 << 20
+
+// follower tracks a file being downloaded, so that it can be read while it
+// is written, like `tail -f`. This lets a layer be decompressed on other
+// cores as it downloads, without ever holding up the download.
+type follower struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	size    int64
+	done    bool
+	err     error
+}
+
+func newFollower() *follower {
+	f := &follower{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// start is called once the file is opened for writing, at size bytes
+func (f *follower) start(size int64) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.started, f.size = true, size
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// finish is called once the file is complete, or has failed with err
+func (f *follower) finish(err error) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.done, f.err = true, err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// writer wraps w, the writer of the file, to record its growth
+func (f *follower) writer(w io.Writer) io.Writer {
+	if f == nil {
+		return w
+	}
+	return followWriter{w: w, f: f}
+}
+
+type followWriter struct {
+	w io.Writer
+	f *follower
+}
+
+func (fw followWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.mu.Lock()
+	fw.f.size += int64(n)
+	fw.f.cond.Broadcast()
+	fw.f.mu.Unlock()
+	return n, err
+}
+
+// open waits for the writing of filename to start, and returns a reader
+// of its content that follows it until finished
+func (f *follower) open(filename string) (io.ReadCloser, error) {
+	f.mu.Lock()
+	for !f.started && !f.done {
+		f.cond.Wait()
+	}
+	started, err := f.started, f.err
+	f.mu.Unlock()
+	if !started {
+		if err == nil {
+			err = errors.New("download did not start")
+		}
+		return nil, err
+	}
+	fh, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &followReader{fh: fh, f: f}, nil
+}
+
+type followReader struct {
+	fh  *os.File
+	f   *follower
+	pos int64
+}
+
+func (fr *followReader) Read(p []byte) (int, error) {
+	fr.f.mu.Lock()
+	for fr.pos >= fr.f.size && !fr.f.done {
+		fr.f.cond.Wait()
+	}
+	avail, err := fr.f.size-fr.pos, fr.f.err
+	fr.f.mu.Unlock()
+	if avail <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := fr.fh.Read(p)
+	fr.pos += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (fr *followReader) Close() error {
+	return fr.fh.Close()
+}
+
+// gunzipFollowing decompresses the gzip file src, as it is downloaded, to
+// dest, returning the digest of the decompressed content. Inflating a gzip
+// stream is sequential, so as pgzip does the rest of the work is spread over
+// other cores: the stream is inflated up to DecompressBlocks blocks ahead of
+// the hashing and the writing of the content, which each have a goroutine.
+func gunzipFollowing(f *follower, src, dest string) (string, error) {
+	r, err := f.open(src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	gz, err := gzip.NewReader(bufio.NewReaderSize(r, DecompressBufferSize))
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+	fh, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	h := sha256.New()
+	if err := copyBlocks(gz, fh, h); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DecompressBlocks and DecompressBlockSize are how many blocks, and of what
+// size, the decompression of a layer reads ahead of the hashing and writing
+// of its content
+var (
+	DecompressBlocks    = 4
+	DecompressBlockSize = 1 << 20
+)
+
+// block is a block of copyBlocks, back to the free ones once the writers
+// still pending are done with it
+type block struct {
+	buf     []byte
+	n       int
+	pending int32
+}
+
+// copyBlocks copies r to each of writers, in blocks read up to
+// DecompressBlocks ahead of the writers, which each write on their own
+// goroutine
+func copyBlocks(r io.Reader, writers ...io.Writer) error {
+	n := DecompressBlocks
+	if n < 1 {
+		n = 1
+	}
+	free := make(chan *block, n)
+	for i := 0; i < n; i++ {
+		free <- &block{buf: make([]byte, DecompressBlockSize)}
+	}
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		aborted = make(chan struct{})
+		werr    error
+	)
+	queues := make([]chan *block, len(writers))
+	for i, w := range writers {
+		// as many as there are blocks, for the reader never to wait on them
+		queues[i] = make(chan *block, n)
+		wg.Add(1)
+		go func(w io.Writer, queue chan *block) {
+			defer wg.Done()
+			for b := range queue {
+				select {
+				case <-aborted:
+				default:
+					if _, err := w.Write(b.buf[:b.n]); err != nil {
+						once.Do(func() {
+							werr = err
+							close(aborted)
+						})
+					}
+				}
+				if atomic.AddInt32(&b.pending, -1) == 0 {
+					free <- b
+				}
+			}
+		}(w, queues[i])
+	}
+
+	var rerr error
+	for rerr == nil {
+		var b *block
+		select {
+		case b = <-free:
+		case <-aborted:
+		}
+		if b == nil {
+			break
+		}
+		b.n, rerr = fill(r, b.buf)
+		if b.n == 0 {
+			free <- b
+			continue
+		}
+		b.pending = int32(len(queues))
+		for _, queue := range queues {
+			queue <- b
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	if rerr != nil && rerr != io.EOF {
+		return rerr
+	}
+	return werr
+}
+
+// fill reads from r until buf is full, or r fails
+func fill(r io.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
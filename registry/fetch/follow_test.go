@@ -0,0 +1,110 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGunzipFollowing(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.follow.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	content := bytes.Repeat([]byte("some layer content "), 10000)
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	gz.Write(content)
+	gz.Close()
+
+	src, dest := filepath.Join(tdir, "blob"), filepath.Join(tdir, "layer")
+	f := newFollower()
+	done := make(chan error, 1)
+	var digest string
+	go func() {
+		var err error
+		digest, err = gunzipFollowing(f, src, dest)
+		done <- err
+	}()
+
+	fh, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.start(0)
+	w := f.writer(fh)
+	compressed := buf.Bytes()
+	for len(compressed) > 0 {
+		n := 100
+		if n > len(compressed) {
+			n = len(compressed)
+		}
+		if _, err := w.Write(compressed[:n]); err != nil {
+			t.Fatal(err)
+		}
+		compressed = compressed[n:]
+	}
+	fh.Close()
+	f.finish(nil)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected %d bytes decompressed, got %d", len(content), len(got))
+	}
+	if digest != digestOf(content) {
+		t.Errorf("expected digest %s, got %s", digestOf(content), digest)
+	}
+}
+
+type failingWriter struct{ after int }
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.after--; w.after < 0 {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func TestCopyBlocks(t *testing.T) {
+	defer func(n, size int) { DecompressBlocks, DecompressBlockSize = n, size }(DecompressBlocks, DecompressBlockSize)
+	DecompressBlocks, DecompressBlockSize = 3, 7
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	a, b := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	if err := copyBlocks(bytes.NewReader(content), a, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), content) || !bytes.Equal(b.Bytes(), content) {
+		t.Errorf("expected %d bytes to each writer, got %d and %d", len(content), a.Len(), b.Len())
+	}
+
+	// a writer failing stops the copy
+	if err := copyBlocks(bytes.NewReader(content), ioutil.Discard, &failingWriter{after: 10}); err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the error of the writer, got %v", err)
+	}
+	// as does the reader
+	truncated := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(truncated)
+	gz.Write(content)
+	gz.Close()
+	zr, err := gzip.NewReader(bytes.NewReader(truncated.Bytes()[:truncated.Len()/2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyBlocks(zr, ioutil.Discard); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated stream to fail, got %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package fetch
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// ImageFS is the merged filesystem of the image, as an fs.FS, fetched into
+// dest by FetchLayers the first time it is used. See export.ImageFS.
+func (re *RegistryEndpoint) ImageFS(img *ImageRef, dest string) fs.FS {
+	return re.ImageFSContext(context.Background(), img, dest)
+}
+
+// ImageFSContext is ImageFS, the fetch giving up when ctx is done.
+func (re *RegistryEndpoint) ImageFSContext(ctx context.Context, img *ImageRef, dest string) fs.FS {
+	return &lazyImageFS{fetch: func() (*export.ImageFS, error) {
+		ancestry, err := re.FetchLayersContext(ctx, img, dest)
+		if err != nil {
+			return nil, err
+		}
+		return export.NewImageFS(dest, ancestry)
+	}}
+}
+
+// lazyImageFS fetches the image on its first use, the error of which is
+// that of every use
+type lazyImageFS struct {
+	fetch func() (*export.ImageFS, error)
+	once  sync.Once
+	ifs   *export.ImageFS
+	err   error
+}
+
+func (l *lazyImageFS) get(op, name string) (*export.ImageFS, error) {
+	l.once.Do(func() {
+		l.ifs, l.err = l.fetch()
+	})
+	if l.err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: l.err}
+	}
+	return l.ifs, nil
+}
+
+func (l *lazyImageFS) Open(name string) (fs.File, error) {
+	ifs, err := l.get("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return ifs.Open(name)
+}
+
+func (l *lazyImageFS) Stat(name string) (fs.FileInfo, error) {
+	ifs, err := l.get("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return ifs.Stat(name)
+}
+
+func (l *lazyImageFS) Lstat(name string) (fs.FileInfo, error) {
+	ifs, err := l.get("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return ifs.Lstat(name)
+}
+
+func (l *lazyImageFS) ReadLink(name string) (string, error) {
+	ifs, err := l.get("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return ifs.ReadLink(name)
+}
@@ -0,0 +1,103 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+func TestRegistryImageFS(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 9})
+	tw.Write([]byte("ID=test\n\n"))
+	tw.Close()
+	tr := newTestRegistryV2(t, testLayer{ID: strings.Repeat("c", 64), Layer: buf.Bytes()})
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ifs := r.ImageFS(ref, tdir)
+	tr.mu.Lock()
+	requests := len(tr.Requests)
+	tr.mu.Unlock()
+	if requests != 0 {
+		t.Errorf("expected nothing to be fetched before the filesystem is used")
+	}
+	content, err := fs.ReadFile(ifs, "etc/os-release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "ID=test\n\n" {
+		t.Errorf("expected the file of the layer, got %q", content)
+	}
+	if _, err := fs.Stat(ifs, "etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file not to exist, got %v", err)
+	}
+}
+
+func TestRegistryFlatten(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 8})
+	tw.Write([]byte("ID=test\n"))
+	tw.Close()
+	tr := newTestRegistryV2(t, testLayer{ID: strings.Repeat("c", 64), Layer: buf.Bytes()})
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	out := bytes.NewBuffer(nil)
+	if err := r.Flatten(ref, out); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(out).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Name != "etc/" {
+		t.Errorf("expected the directory of the file first, got %s", hdr.Name)
+	}
+}
+
+func TestRegistryExtractRootFS(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.rootfs.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 8, Uid: 0, Gid: 0})
+	tw.Write([]byte("ID=test\n"))
+	tw.Close()
+	tr := newTestRegistryV2(t, testLayer{ID: strings.Repeat("c", 64), Layer: buf.Bytes()})
+
+	ref := tr.Ref()
+	ref.SetIDMapping(&export.IDMapping{
+		UIDs: []export.IDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GIDs: []export.IDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	})
+	r := NewRegistry(ref.Host())
+	if err := r.ExtractRootFS(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(tdir, "etc", "os-release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "ID=test\n" {
+		t.Errorf("expected the file of the layer, got %q", content)
+	}
+}
@@ -0,0 +1,180 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FsckProblem is an entry of a cache or store found at fault by Fsck
+type FsckProblem struct {
+	// Path is of the entry, relative to the directory checked, like
+	// "sha256/<digest>" or "<id>"
+	Path string
+	Err  error
+	// Quarantined is set once the entry was moved out of the way
+	Quarantined bool
+}
+
+func (p FsckProblem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Err)
+}
+
+// FsckReport is what Fsck found of a directory
+type FsckReport struct {
+	Dir string
+	// Checked is the number of entries checked: blobs and keys of a
+	// LayerCache, layers and tags of a store
+	Checked  int
+	Problems []FsckProblem
+}
+
+// Fsck checks every entry of dir, either a LayerCache or a directory of
+// layers in the legacy `docker save` layout, like a DirStore or where
+// FetchLayers fetched images. The blobs of a cache must hash to their
+// digest, and each key must record the digest of a blob there; the blobs
+// being written, of the PartialSuffix, are left alone. The layers of
+// a store must have a json that parses, of their own ID, over a parent that
+// is there, and a layer.tar hashing to the checksum recorded when it was
+// fetched; each image tagged in its `repositories` file must have all its
+// layers. Every entry at fault is reported, and moved under quarantine when
+// it is set, for it not to be used again, with the same path as in dir.
+func Fsck(dir, quarantine string) (*FsckReport, error) {
+	fi, err := os.Stat(filepath.Join(dir, "sha256"))
+	if err == nil && fi.IsDir() {
+		return fsckCache(dir, quarantine)
+	}
+	return fsckStore(dir, quarantine)
+}
+
+// fsckCache is Fsck of the LayerCache in dir
+func fsckCache(dir, quarantine string) (*FsckReport, error) {
+	c := &LayerCache{Dir: dir}
+	report := &FsckReport{Dir: dir}
+	blobs, err := ioutil.ReadDir(filepath.Join(dir, "sha256"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range blobs {
+		if strings.HasSuffix(fi.Name(), PartialSuffix) {
+			// a blob being written by a fetch, or left by one cut off,
+			// which the next resumes
+			continue
+		}
+		report.Checked++
+		name := filepath.Join("sha256", fi.Name())
+		if !isLayerID(fi.Name()) {
+			report.add(dir, quarantine, name, fmt.Errorf("not a blob"))
+			continue
+		}
+		h := sha256.New()
+		if err := hashFile(h, filepath.Join(dir, name)); err != nil {
+			report.add(dir, quarantine, name, err)
+			continue
+		}
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != fi.Name() {
+			report.add(dir, quarantine, name, ErrDigestMismatch{ID: fi.Name(), Expected: "sha256:" + fi.Name(), Actual: "sha256:" + actual})
+		}
+	}
+	keys, err := ioutil.ReadDir(filepath.Join(dir, "keys"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fi := range keys {
+		if strings.HasPrefix(fi.Name(), ".") {
+			// a key being written
+			continue
+		}
+		report.Checked++
+		name := filepath.Join("keys", fi.Name())
+		buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			report.add(dir, quarantine, name, err)
+			continue
+		}
+		digest := strings.TrimSpace(string(buf))
+		if !strings.HasPrefix(digest, "sha256:") || !isLayerID(strings.TrimPrefix(digest, "sha256:")) {
+			report.add(dir, quarantine, name, fmt.Errorf("invalid digest %q", digest))
+			continue
+		}
+		// the blobs at fault were just moved away
+		if _, err := os.Stat(c.blobFile(digest)); err != nil {
+			report.add(dir, quarantine, name, fmt.Errorf("no blob %s", digest))
+		}
+	}
+	return report, nil
+}
+
+// fsckStore is Fsck of the directory of layers dir
+func fsckStore(dir, quarantine string) (*FsckReport, error) {
+	report := &FsckReport{Dir: dir}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, fi := range entries {
+		if fi.IsDir() && isLayerID(fi.Name()) {
+			ids[fi.Name()] = true
+		}
+	}
+	for _, fi := range entries {
+		if !ids[fi.Name()] {
+			continue
+		}
+		report.Checked++
+		if err := fsckLayer(dir, fi.Name(), ids); err != nil {
+			report.add(dir, quarantine, fi.Name(), err)
+		}
+	}
+
+	repos, err := LoadRepositories(dir, false)
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if e, ok := err.(ErrRepositoriesInconsistent); ok {
+		for _, p := range e.Problems {
+			// the tags are left, for the images to be fetched again
+			report.Problems = append(report.Problems, FsckProblem{Path: "repositories", Err: p})
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	for _, name := range repos.names() {
+		report.Checked += len(repos[name])
+	}
+	return report, nil
+}
+
+// fsckLayer checks the layer id of dir, of the layers ids
+func fsckLayer(dir, id string, ids map[string]bool) error {
+	parent, err := checkLayer(dir, id, true)
+	if err != nil {
+		return err
+	}
+	if parent != "" && !ids[parent] {
+		return fmt.Errorf("layer %s: no parent %s", id, parent)
+	}
+	return nil
+}
+
+// add reports the entry name of dir at fault for err, moving it under
+// quarantine if set
+func (r *FsckReport) add(dir, quarantine, name string, err error) {
+	p := FsckProblem{Path: name, Err: err}
+	if quarantine != "" {
+		dest := filepath.Join(quarantine, name)
+		if qerr := os.MkdirAll(filepath.Dir(dest), 0755); qerr != nil {
+			p.Err = fmt.Errorf("%s (not quarantined: %s)", err, qerr)
+		} else if qerr := os.Rename(filepath.Join(dir, name), dest); qerr != nil {
+			p.Err = fmt.Errorf("%s (not quarantined: %s)", err, qerr)
+		} else {
+			p.Quarantined = true
+		}
+	}
+	r.Problems = append(r.Problems, p)
+}
@@ -0,0 +1,104 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFsckCache(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	cache, err := NewLayerCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Cache = cache
+	if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(cache.Dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a blob and a key of each layer
+	if report.Checked != 2*len(testLayers) || len(report.Problems) != 0 {
+		t.Fatalf("expected %d entries fine, got %d and %v", 2*len(testLayers), report.Checked, report.Problems)
+	}
+
+	blobs, err := ioutil.ReadDir(filepath.Join(cache.Dir, "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupted := filepath.Join("sha256", blobs[0].Name())
+	if err := ioutil.WriteFile(filepath.Join(cache.Dir, corrupted), []byte("bit rot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a blob being written is left alone
+	partial := filepath.Join("sha256", blobs[1].Name()+"."+testLayers[0].ID+PartialSuffix)
+	if err := ioutil.WriteFile(filepath.Join(cache.Dir, partial), []byte("half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	quarantine := t.TempDir()
+	if report, err = Fsck(cache.Dir, quarantine); err != nil {
+		t.Fatal(err)
+	}
+	// the blob, and the key recording it
+	if len(report.Problems) != 2 || report.Problems[0].Path != corrupted || !report.Problems[0].Quarantined ||
+		!strings.HasPrefix(report.Problems[1].Path, "keys") || !strings.Contains(report.Problems[1].Error(), "no blob") {
+		t.Fatalf("expected the corrupted blob and its key, got %v", report.Problems)
+	}
+	if buf, err := ioutil.ReadFile(filepath.Join(quarantine, corrupted)); err != nil || string(buf) != "bit rot" {
+		t.Errorf("expected the blob quarantined, got %q, %v", buf, err)
+	}
+	if _, err := os.Stat(filepath.Join(cache.Dir, partial)); err != nil {
+		t.Errorf("expected the partial blob left in the cache, got %v", err)
+	}
+	if report, err = Fsck(cache.Dir, ""); err != nil || len(report.Problems) != 0 {
+		t.Errorf("expected the cache fine once the entries are quarantined, got %v, %v", report.Problems, err)
+	}
+}
+
+func TestFsckStore(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	dir := t.TempDir()
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchLayers(ref, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := FormatRepositories(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "repositories"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Fsck(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each layer, and the tag
+	if report.Checked != len(ids)+1 || len(report.Problems) != 0 {
+		t.Fatalf("expected %d entries fine, got %d and %v", len(ids)+1, report.Checked, report.Problems)
+	}
+
+	base := ids[len(ids)-1]
+	if err := ioutil.WriteFile(filepath.Join(dir, base, "layer.tar"), []byte("bit rot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	quarantine := t.TempDir()
+	if report, err = Fsck(dir, quarantine); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 2 || report.Problems[0].Path != base || !report.Problems[0].Quarantined || report.Problems[1].Path != "repositories" {
+		t.Fatalf("expected the corrupted layer and the tag missing it, got %v", report.Problems)
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, base, "json")); err != nil {
+		t.Errorf("expected the layer quarantined, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package fetch
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// the values of RegistryEndpoint.Incremental, from the cheapest check of the
+// layers already in the destination to the most thorough
+const (
+	// IncrementalExists skips the layers with both a json and a layer.tar
+	IncrementalExists = "exists"
+	// IncrementalSize also requires the layer.tar to have the size and
+	// modification time of the checksum recorded when it was fetched
+	IncrementalSize = "size"
+	// IncrementalChecksum hashes the layer.tar again, and requires it to
+	// match the checksum recorded when it was fetched
+	IncrementalChecksum = "checksum"
+)
+
+// ParseIncremental checks that mode is one of the Incremental modes, or
+// empty to download every layer
+func ParseIncremental(mode string) (string, error) {
+	switch mode {
+	case "", IncrementalExists, IncrementalSize, IncrementalChecksum:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid incremental mode %q: expected exists, size or checksum", mode)
+}
+
+// incremental is the skip of fetchLayers for the Incremental mode of re, or
+// nil to download every layer
+func (re *RegistryEndpoint) incremental(dest string) func(id string) (bool, error) {
+	if re.Incremental == "" {
+		return nil
+	}
+	return func(id string) (bool, error) {
+		ok, err := haveLayer(dest, id, re.Incremental)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			logrus.Debugf("layer %s: already in %s, skipping", id, dest)
+		}
+		return ok, nil
+	}
+}
+
+// haveLayer reports whether the layer id fetched into dest is complete, as
+// the mode checks it. A layer failing the check is downloaded again, rather
+// than failing the fetch.
+func haveLayer(dest, id, mode string) (bool, error) {
+	ok, err := DirStore{Dir: dest}.Exists(id)
+	if err != nil || !ok {
+		return false, err
+	}
+	switch mode {
+	case IncrementalExists:
+		return true, nil
+	case IncrementalSize, IncrementalChecksum:
+		if err := VerifyLayer(dest, id, mode == IncrementalChecksum); err != nil {
+			logrus.Debugf("layer %s: fetching again: %s", id, err)
+			return false, nil
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid incremental mode %q", mode)
+}
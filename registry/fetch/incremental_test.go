@@ -0,0 +1,73 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchLayersIncremental(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	dest := t.TempDir()
+	blobRequests := func() int {
+		n := 0
+		for p, count := range tr.Requests {
+			if strings.Contains(p, "/blobs/") {
+				n += count
+			}
+		}
+		return n
+	}
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchLayers(ref, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []string{IncrementalExists, IncrementalSize, IncrementalChecksum} {
+		r.Incremental = mode
+		before := blobRequests()
+		if _, err := r.FetchLayers(tr.Ref(), dest); err != nil {
+			t.Fatal(err)
+		}
+		// only the config is fetched again
+		if n := blobRequests() - before; n != 1 {
+			t.Errorf("%s: expected no layer to be fetched again, got %d blob requests", mode, n)
+		}
+	}
+
+	// a layer changed since is fetched again, as the mode checks it
+	layer := filepath.Join(dest, ids[0], "layer.tar")
+	if err := ioutil.WriteFile(layer, []byte("top lay3r"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum, _, err := readLayerChecksum(filepath.Join(dest, ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(layer, time.Now(), sum.ModTime); err != nil {
+		t.Fatal(err)
+	}
+	for mode, expected := range map[string]int{IncrementalExists: 1, IncrementalSize: 1, IncrementalChecksum: 2} {
+		r.Incremental = mode
+		before := blobRequests()
+		if _, err := r.FetchLayers(tr.Ref(), dest); err != nil {
+			t.Fatal(err)
+		}
+		if n := blobRequests() - before; n != expected {
+			t.Errorf("%s: expected %d blob requests, got %d", mode, expected, n)
+		}
+	}
+	if buf, err := ioutil.ReadFile(layer); err != nil || string(buf) != string(testLayers[0].Layer) {
+		t.Errorf("expected the changed layer to be fetched again, got %q, %v", buf, err)
+	}
+
+	if _, err := ParseIncremental("sometimes"); err == nil {
+		t.Error("expected an unknown mode to be refused")
+	}
+}
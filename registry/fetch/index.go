@@ -0,0 +1,240 @@
+package fetch
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// LayerIndex records the files of the layers of images fetched in an SQL
+// database, usually sqlite, so that which images have a file can be found
+// without reading their layers again. Layers are indexed once, by the digest
+// of their layer.tar, however many images share them. The database/sql
+// driver is left to the program to import.
+type LayerIndex struct {
+	db *sql.DB
+}
+
+// layerIndexSchema creates the tables of a LayerIndex, in the SQL of sqlite
+var layerIndexSchema = []string{
+	`CREATE TABLE IF NOT EXISTS layers (digest TEXT PRIMARY KEY, indexed TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS files (layer TEXT NOT NULL, path TEXT NOT NULL, size INTEGER NOT NULL, digest TEXT NOT NULL, whiteout INTEGER NOT NULL, PRIMARY KEY (layer, path))`,
+	`CREATE INDEX IF NOT EXISTS files_path ON files (path)`,
+	`CREATE INDEX IF NOT EXISTS files_digest ON files (digest)`,
+	`CREATE TABLE IF NOT EXISTS images (ref TEXT NOT NULL, id TEXT NOT NULL, digest TEXT NOT NULL, position INTEGER NOT NULL, layer TEXT NOT NULL, PRIMARY KEY (ref, position))`,
+}
+
+// OpenLayerIndex opens the LayerIndex in the database dsn of driver, like
+// "sqlite3" and "images.db", creating its tables if need be
+func OpenLayerIndex(driver, dsn string) (*LayerIndex, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range layerIndexSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", dsn, err)
+		}
+	}
+	return &LayerIndex{db: db}, nil
+}
+
+// Close closes the database
+func (x *LayerIndex) Close() error {
+	return x.db.Close()
+}
+
+// IndexedFile is a regular file of a layer, or a whiteout of a path in the
+// layers under it
+type IndexedFile struct {
+	Path string
+	Size int64
+	// Digest is the sha256 digest of the content
+	Digest   string
+	Whiteout bool
+}
+
+// ReadLayerFiles calls fn with each regular file, and each whiteout, of the
+// layer tar archive read from r. Paths are absolute; an opaque directory is
+// a whiteout of the directory, the entries of the layer under it aside.
+func ReadLayerFiles(r io.Reader, fn func(IndexedFile) error) error {
+	t := tar.NewReader(r)
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + hdr.Name)
+		parent, base := path.Split(name)
+		switch {
+		case base == export.WhiteoutOpaque:
+			err = fn(IndexedFile{Path: path.Clean(parent), Whiteout: true})
+		case strings.HasPrefix(base, export.WhiteoutPrefix):
+			err = fn(IndexedFile{Path: path.Join(parent, strings.TrimPrefix(base, export.WhiteoutPrefix)), Whiteout: true})
+		case hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA:
+			h := sha256.New()
+			var size int64
+			if size, err = io.Copy(h, t); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			err = fn(IndexedFile{Path: name, Size: size, Digest: "sha256:" + hex.EncodeToString(h.Sum(nil))})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// IndexImage records img, fetched into src with FetchLayers, with the files
+// of its layers not indexed yet. The layers img had when indexed before are
+// forgotten.
+func (x *LayerIndex) IndexImage(img *ImageRef, src string) error {
+	ancestry := img.Ancestry()
+	if len(ancestry) == 0 {
+		return fmt.Errorf("%s: no layers fetched", img)
+	}
+	digests := []string{}
+	for _, id := range ancestry {
+		dir := filepath.Join(src, id)
+		digest, err := layerDiffID(dir)
+		if err != nil {
+			return err
+		}
+		if err := x.indexLayer(digest, filepath.Join(dir, "layer.tar")); err != nil {
+			return fmt.Errorf("layer %s: %w", id, err)
+		}
+		digests = append(digests, digest)
+	}
+
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM images WHERE ref = ?`, img.String()); err != nil {
+		return err
+	}
+	for i, digest := range digests {
+		if _, err := tx.Exec(`INSERT INTO images (ref, id, digest, position, layer) VALUES (?, ?, ?, ?, ?)`, img.String(), img.ID(), img.Digest(), i, digest); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// indexLayer records the files of the layer.tar at filename, by its digest,
+// unless they are already
+func (x *LayerIndex) indexLayer(digest, filename string) error {
+	var indexed string
+	err := x.db.QueryRow(`SELECT indexed FROM layers WHERE digest = ?`, digest).Scan(&indexed)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO files (layer, path, size, digest, whiteout) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	if err := ReadLayerFiles(fh, func(f IndexedFile) error {
+		_, err := stmt.Exec(digest, f.Path, f.Size, f.Digest, f.Whiteout)
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO layers (digest, indexed) VALUES (?, ?)`, digest, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IndexMatch is a file of an image found by Search
+type IndexMatch struct {
+	Ref     string
+	ImageID string
+	// Layer is the digest of the layer.tar of the layer the file is in
+	Layer  string
+	Path   string
+	Size   int64
+	Digest string
+}
+
+// Search finds the files of the images indexed whose path is like pattern,
+// in the syntax of SQL's LIKE (with % matching any run of characters), or
+// whose content has pattern as its digest when it starts with "sha256:".
+// Files removed, or replaced, in upper layers of an image are not matched for
+// it.
+func (x *LayerIndex) Search(pattern string) ([]IndexMatch, error) {
+	column := "f.path LIKE ?"
+	if strings.HasPrefix(pattern, "sha256:") {
+		column = "f.digest = ?"
+	}
+	rows, err := x.db.Query(`SELECT i.ref, i.id, i.position, f.layer, f.path, f.size, f.digest
+		FROM files f JOIN images i ON i.layer = f.layer
+		WHERE f.whiteout = 0 AND `+column+`
+		ORDER BY i.ref, f.path`, pattern)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		IndexMatch
+		position int
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.Ref, &c.ImageID, &c.position, &c.Layer, &c.Path, &c.Size, &c.Digest); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// the layers above a layer of an image are at lower positions, the
+	// top-most at 0
+	matches := []IndexMatch{}
+	for _, c := range candidates {
+		var n int
+		if err := x.db.QueryRow(`SELECT COUNT(*) FROM files f JOIN images i ON i.layer = f.layer
+			WHERE i.ref = ? AND i.position < ? AND (f.path = ? OR substr(?, 1, length(f.path) + 1) = f.path || '/')`,
+			c.Ref, c.position, c.Path, c.Path).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			matches = append(matches, c.IndexMatch)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,49 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadLayerFiles(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, entry := range []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "usr/lib/libssl.so.1.0.2", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}, "ssl"},
+		{tar.Header{Name: "usr/lib/libssl.so", Typeflag: tar.TypeSymlink, Linkname: "libssl.so.1.0.2"}, ""},
+		{tar.Header{Name: "etc/.wh.motd", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		{tar.Header{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+	} {
+		if err := tw.WriteHeader(&entry.hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []IndexedFile{}
+	if err := ReadLayerFiles(buf, func(f IndexedFile) error {
+		files = append(files, f)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []IndexedFile{
+		{Path: "/usr/lib/libssl.so.1.0.2", Size: 3, Digest: digestOf([]byte("ssl"))},
+		{Path: "/etc/motd", Whiteout: true},
+		{Path: "/var/cache", Whiteout: true},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %#v, got %#v", expected, files)
+	}
+}
@@ -0,0 +1,97 @@
+package fetch
+
+import (
+	"context"
+	"time"
+
+	"github.com/vbatts/docker-utils/attest"
+)
+
+// ImageInspect is what Inspect gathers about an image, like `docker inspect`
+// of an image that has not been pulled
+type ImageInspect struct {
+	Ref  string `json:"ref"`
+	Name string `json:"name"`
+	// Tag is empty for references by digest only
+	Tag string `json:"tag,omitempty"`
+	ID  string `json:"id"`
+	// Digest is of the manifest the reference points at, for images of v2
+	// registries, and ManifestDigest of the manifest of the image itself,
+	// when that is a manifest list
+	Digest         string    `json:"digest,omitempty"`
+	ManifestDigest string    `json:"manifest_digest,omitempty"`
+	Created        time.Time `json:"created"`
+	// Platform is like "linux/arm64/v8"
+	Platform string `json:"platform"`
+	// Size is the total size of the layers, compressed as they are
+	// downloaded from v2 registries
+	Size int64 `json:"size"`
+	// Layers are top-most first
+	Layers []InspectLayer `json:"layers"`
+	Config *ImageConfig   `json:"config"`
+	// Provenance is the SLSA provenance of the image, verified by the
+	// Provenance policy of the registry, when it has one
+	Provenance *attest.Provenance `json:"provenance,omitempty"`
+}
+
+// InspectLayer is a layer of an ImageInspect
+type InspectLayer struct {
+	ID string `json:"id"`
+	// Digest and MediaType are of the blob of the layer, on v2 registries
+	Digest    string `json:"digest,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Size      int64  `json:"size"`
+}
+
+// Inspect gathers the ID, digests, layers and config of the image, and its
+// provenance with a Provenance policy, which refuses the images it does not
+// verify, without fetching any of its layers
+func (re *RegistryEndpoint) Inspect(img *ImageRef) (*ImageInspect, error) {
+	return re.InspectContext(context.Background(), img)
+}
+
+// InspectContext is Inspect, giving up when ctx is done.
+func (re *RegistryEndpoint) InspectContext(ctx context.Context, img *ImageRef) (*ImageInspect, error) {
+	inspect := &ImageInspect{Ref: img.String(), Name: img.Name(), Layers: []InspectLayer{}}
+	if !img.Pinned() || img.hasTag() {
+		inspect.Tag = img.Tag()
+	}
+
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		config, err := re.ImageConfigContext(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		inspect.Config = config
+		v2 := img.v2
+		if v2.manifestDigest != img.Digest() {
+			inspect.ManifestDigest = v2.manifestDigest
+		}
+		for _, id := range v2.ids {
+			desc := v2.layers[id]
+			inspect.Layers = append(inspect.Layers, InspectLayer{ID: id, Digest: desc.Digest, MediaType: desc.MediaType, Size: desc.Size})
+			inspect.Size += desc.Size
+		}
+	} else {
+		config, sizes, err := re.v1ImageConfig(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		inspect.Config = config
+		for i, id := range img.Ancestry() {
+			inspect.Layers = append(inspect.Layers, InspectLayer{ID: id, Size: sizes[i]})
+			inspect.Size += sizes[i]
+		}
+	}
+	if re.Provenance != nil {
+		if err := re.checkProvenance(ctx, img); err != nil {
+			return nil, err
+		}
+		inspect.Provenance = img.Provenance()
+	}
+	inspect.ID = img.ID()
+	inspect.Digest = img.Digest()
+	inspect.Created = inspect.Config.Created
+	inspect.Platform = inspect.Config.Platform().String()
+	return inspect, nil
+}
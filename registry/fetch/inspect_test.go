@@ -0,0 +1,51 @@
+package fetch
+
+import (
+	"testing"
+)
+
+func TestRegistryInspect(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := NewImageRef(tr.Host() + "/test/image:multi")
+	ref.SetPlatform(Platform{OS: "linux", Architecture: "amd64"})
+	r := NewRegistry(ref.Host())
+	inspect, err := r.Inspect(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.Tag != "multi" || inspect.Digest != digestOf(tr.manifestList) || inspect.ManifestDigest != digestOf(tr.manifest) {
+		t.Errorf("expected the digests of the manifest list and of the image, got %q and %q", inspect.Digest, inspect.ManifestDigest)
+	}
+	if inspect.Platform != "linux/amd64" || inspect.Config.Config.Labels["license"] != "MIT" {
+		t.Errorf("expected the config of the image, got %s and %#v", inspect.Platform, inspect.Config)
+	}
+	if len(inspect.Layers) != len(testLayers) || inspect.Layers[0].ID != inspect.ID {
+		t.Fatalf("expected %d layers, the top-most first, got %#v", len(testLayers), inspect.Layers)
+	}
+	var size int64
+	for _, layer := range inspect.Layers {
+		if layer.MediaType != MediaTypeLayerGzip || len(tr.blobs[layer.Digest]) != int(layer.Size) {
+			t.Errorf("expected the descriptor of the blob of layer %s, got %#v", layer.ID, layer)
+		}
+		size += layer.Size
+	}
+	if inspect.Size != size {
+		t.Errorf("expected the size of the layers, %d, got %d", size, inspect.Size)
+	}
+}
+
+func TestRegistryInspectV1(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	inspect, err := r.Inspect(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.ID != testLayers[0].ID || inspect.Digest != "" || inspect.Tag != "latest" {
+		t.Errorf("expected the ID of the top-most layer, and no digest, got %#v", inspect)
+	}
+	if inspect.Size != int64(len(testLayers[0].Layer)+len(testLayers[1].Layer)) {
+		t.Errorf("expected the sizes of the layers from their json, got %d", inspect.Size)
+	}
+}
@@ -0,0 +1,191 @@
+package fetch
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyStore keeps named ed25519 keys for signing bundles in a directory:
+// <name>.key, the PKCS#8 PEM private key, encrypted when generated with a
+// passphrase, and <name>.pub, its public key, to hand out for checking the
+// signatures. Both are like those made with openssl, which can read them.
+type KeyStore struct {
+	Dir string
+}
+
+// KeyInfo is a key of a KeyStore
+type KeyInfo struct {
+	Name string `json:"name"`
+	// KeyID identifies the key in the signatures of a BundleManifest
+	KeyID     string    `json:"key_id"`
+	Encrypted bool      `json:"encrypted"`
+	Created   time.Time `json:"created"`
+}
+
+var keyName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// DefaultKeyDir is the KeyStore of the user, under $XDG_CONFIG_HOME or
+// ~/.config
+func DefaultKeyDir() string {
+	config := os.Getenv("XDG_CONFIG_HOME")
+	if config == "" {
+		config = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(config, "docker-fetch", "keys")
+}
+
+func (ks KeyStore) privatePath(name string) string {
+	return filepath.Join(ks.Dir, name+".key")
+}
+
+func (ks KeyStore) publicPath(name string) string {
+	return filepath.Join(ks.Dir, name+".pub")
+}
+
+// Generate makes a new key, name, encrypted with passphrase unless it is
+// empty. An existing key of that name is never replaced.
+func (ks KeyStore) Generate(name string, passphrase []byte) (KeyInfo, error) {
+	if !keyName.MatchString(name) {
+		return KeyInfo{}, fmt.Errorf("invalid key name %q", name)
+	}
+	if err := os.MkdirAll(ks.Dir, 0700); err != nil {
+		return KeyInfo{}, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	var block *pem.Block
+	if len(passphrase) > 0 {
+		if block, err = encryptPrivateKey(priv, passphrase); err != nil {
+			return KeyInfo{}, err
+		}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return KeyInfo{}, err
+		}
+		block = &pem.Block{Type: pemPrivateKey, Bytes: der}
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	// O_EXCL, so that two generating the same name do not both win
+	fh, err := os.OpenFile(ks.privatePath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return KeyInfo{}, fmt.Errorf("key %q exists already", name)
+	}
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	err = pem.Encode(fh, block)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ioutil.WriteFile(ks.publicPath(name), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	}
+	if err != nil {
+		os.Remove(ks.privatePath(name))
+		return KeyInfo{}, err
+	}
+	return ks.info(name)
+}
+
+// List is the keys of the store, by name
+func (ks KeyStore) List() ([]KeyInfo, error) {
+	infos, err := ioutil.ReadDir(ks.Dir)
+	if os.IsNotExist(err) {
+		return []KeyInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []KeyInfo{}
+	for _, fi := range infos {
+		name := strings.TrimSuffix(fi.Name(), ".key")
+		if name == fi.Name() || !keyName.MatchString(name) {
+			continue
+		}
+		info, err := ks.info(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, info)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Name < keys[j].Name
+	})
+	return keys, nil
+}
+
+// info is what there is to know of the key name without its passphrase
+func (ks KeyStore) info(name string) (KeyInfo, error) {
+	block, err := readPEM(ks.privatePath(name))
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	fi, err := os.Stat(ks.privatePath(name))
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	pub, err := LoadVerifyingKey(ks.publicPath(name))
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	keyID, err := bundleKeyID(pub)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	return KeyInfo{Name: name, KeyID: keyID, Encrypted: block.Type == pemEncryptedPrivateKey, Created: fi.ModTime()}, nil
+}
+
+// PublicKey is the PEM public key of the key name, as given to check the
+// signatures made with it
+func (ks KeyStore) PublicKey(name string) ([]byte, error) {
+	if !keyName.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	if _, err := LoadVerifyingKey(ks.publicPath(name)); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(ks.publicPath(name))
+}
+
+// PrivateKey is the PEM private key name as stored, still encrypted if it
+// is, for moving it to another store
+func (ks KeyStore) PrivateKey(name string) ([]byte, error) {
+	if !keyName.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	return ioutil.ReadFile(ks.privatePath(name))
+}
+
+// SigningKey is the key name, decrypted with passphrase if it is encrypted
+func (ks KeyStore) SigningKey(name string, passphrase []byte) (ed25519.PrivateKey, error) {
+	if !keyName.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	return LoadEncryptedSigningKey(ks.privatePath(name), passphrase)
+}
+
+// VerifyingKey is the public key of the key name, to check the signatures
+// made with it
+func (ks KeyStore) VerifyingKey(name string) (ed25519.PublicKey, error) {
+	if !keyName.MatchString(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+	return LoadVerifyingKey(ks.publicPath(name))
+}
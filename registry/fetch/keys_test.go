@@ -0,0 +1,86 @@
+package fetch
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.keys.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	ks := KeyStore{Dir: filepath.Join(tdir, "keys")}
+
+	if keys, err := ks.List(); err != nil || len(keys) != 0 {
+		t.Fatalf("expected no keys yet, got %v, %v", keys, err)
+	}
+	passphrase := []byte("correct horse")
+	signing, err := ks.Generate("release", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signing.Encrypted {
+		t.Errorf("expected the key to be encrypted")
+	}
+	if _, err := ks.Generate("plain", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Generate("release", passphrase); err == nil {
+		t.Errorf("expected an existing key not to be replaced")
+	}
+	if _, err := ks.Generate("../escape", nil); err == nil {
+		t.Errorf("expected an invalid key name to fail")
+	}
+	keys, err := ks.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Name != "plain" || keys[0].Encrypted || keys[1] != signing {
+		t.Errorf("expected the plain and release keys, got %v", keys)
+	}
+
+	if _, err := ks.SigningKey("release", nil); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("expected the key to need its passphrase, got %v", err)
+	}
+	if _, err := ks.SigningKey("release", []byte("wrong")); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("expected a wrong passphrase to fail, got %v", err)
+	}
+	key, err := ks.SigningKey("release", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bundle signed with the key checks against the public key exported
+	pem, err := ks.PublicKey("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, "release.pub"), pem, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := LoadVerifyingKey(filepath.Join(tdir, "release.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &BundleManifest{Tool: "test"}
+	if err := m.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(pub); err != nil {
+		t.Error(err)
+	}
+	if pub, err = ks.VerifyingKey("release"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(pub); err != nil {
+		t.Error(err)
+	}
+	if m.Signatures[0].KeyID != signing.KeyID {
+		t.Errorf("expected the signature by %s, got %s", signing.KeyID, m.Signatures[0].KeyID)
+	}
+}
@@ -0,0 +1,108 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// MaxMaintenancePause is the longest RunBatches waits, in all, for a
+// registry in maintenance to come back, before the rest of its references
+// fail with the ErrMaintenance.
+var MaxMaintenancePause = 2 * time.Hour
+
+// ErrMaintenance is returned when a registry refuses a request with a 503
+// and a Retry-After, as registries do for a maintenance window, longer than
+// the RetryPolicy waits out (see RetryPolicy.MaxRetryAfter).
+type ErrMaintenance struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e ErrMaintenance) Error() string {
+	return fmt.Sprintf("%s is unavailable, retry after %s", e.Host, e.RetryAfter)
+}
+
+// maintenance is the ErrMaintenance of resp, a 503 from host, or nil if it
+// does not say when to come back
+func maintenance(host string, resp *http.Response) *ErrMaintenance {
+	d := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if d <= 0 {
+		return nil
+	}
+	e := &ErrMaintenance{Host: host, RetryAfter: d}
+	logrus.Debugf("%s", e)
+	return e
+}
+
+// RunBatches calls fetchRef for each reference of batches, a registry at a
+// time, and returns the results in the order they were had. When fetchRef
+// fails with an ErrMaintenance, the queue of that registry is paused for the
+// time asked and the other registries go on meanwhile; the reference is
+// tried again once it resumes, waiting if every registry left is paused.
+// The references not tried when ctx is done have no result.
+func RunBatches(ctx context.Context, batches []HostBatch, fetchRef func(batch HostBatch, ref *ImageRef) FetchResult) []FetchResult {
+	type queue struct {
+		batch  HostBatch
+		next   int
+		resume time.Time
+		paused time.Duration
+	}
+	queues := make([]*queue, len(batches))
+	for i := range batches {
+		queues[i] = &queue{batch: batches[i]}
+	}
+	results := []FetchResult{}
+	for ctx.Err() == nil {
+		// the first registry with references left that is not paused
+		var (
+			q       *queue
+			wake    time.Time
+			pending bool
+			now     = time.Now()
+		)
+		for _, c := range queues {
+			if c.next >= len(c.batch.Refs) {
+				continue
+			}
+			pending = true
+			if !c.resume.After(now) {
+				q = c
+				break
+			}
+			if wake.IsZero() || c.resume.Before(wake) {
+				wake = c.resume
+			}
+		}
+		if !pending {
+			break
+		}
+		if q == nil {
+			logrus.Infof("every registry left is in maintenance, waiting until %s", wake.Format(time.RFC3339))
+			if err := sleep(ctx, nil, wake.Sub(now)); err != nil {
+				break
+			}
+			continue
+		}
+
+		ref := q.batch.Refs[q.next]
+		result := fetchRef(q.batch, ref)
+		var m ErrMaintenance
+		if errors.As(result.Err, &m) {
+			if q.paused+m.RetryAfter <= MaxMaintenancePause {
+				q.paused += m.RetryAfter
+				q.resume = time.Now().Add(m.RetryAfter)
+				logrus.Warnf("%s is in maintenance, pausing its %d references left until %s", q.batch.Host, len(q.batch.Refs)-q.next, q.resume.Format(time.RFC3339))
+				continue
+			}
+			logrus.Errorf("%s is still in maintenance after %s, giving up on it", q.batch.Host, q.paused)
+		}
+		q.next++
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryMaintenance(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	var (
+		mu   sync.Mutex
+		down int
+	)
+	// a registry unavailable for the manifest requests, down times
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		unavailable := strings.Contains(r.URL.Path, "/manifests/") && down > 0
+		if unavailable {
+			down--
+		}
+		mu.Unlock()
+		if !unavailable {
+			tr.serve(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	ref := NewImageRef(strings.TrimPrefix(srv.URL, "https://") + "/test/image")
+
+	down = 2
+	r := NewRegistry(ref.Host())
+	r.Retry = NewRetryPolicy(3, time.Millisecond, time.Millisecond)
+	_, err := r.Resolve(NewImageRef(ref.String()))
+	var m ErrMaintenance
+	if !errors.As(err, &m) || m.RetryAfter != time.Second {
+		t.Fatalf("expected ErrMaintenance for a second, got %v", err)
+	}
+	if down != 1 {
+		t.Errorf("expected a single attempt, got %d", 2-down)
+	}
+
+	// a Retry-After within MaxRetryAfter is waited out
+	r.Retry.MaxRetryAfter = 2 * time.Second
+	if _, err := r.Resolve(NewImageRef(ref.String())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunBatches(t *testing.T) {
+	a, b := NewRegistry("a.example.com"), NewRegistry("b.example.com")
+	batches := []HostBatch{
+		{Host: a.Host, Registry: &a, Refs: ImageRefSet{NewImageRef("a.example.com/one"), NewImageRef("a.example.com/two")}},
+		{Host: b.Host, Registry: &b, Refs: ImageRefSet{NewImageRef("b.example.com/three")}},
+	}
+
+	// a.example.com is in maintenance the first time it is asked
+	down := 1
+	start := time.Now()
+	results := RunBatches(context.Background(), batches, func(batch HostBatch, ref *ImageRef) FetchResult {
+		if batch.Host == "a.example.com" && down > 0 {
+			down--
+			return FetchResult{Ref: ref, Err: LayerErrors{{ID: "x", Err: ErrMaintenance{Host: batch.Host, RetryAfter: 50 * time.Millisecond}}}}
+		}
+		return FetchResult{Ref: ref}
+	})
+	names := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			t.Errorf("%s: %s", result.Ref, result.Err)
+		}
+		names = append(names, result.Ref.Name())
+	}
+	if strings.Join(names, " ") != "three one two" {
+		t.Errorf("expected the registry in maintenance to be resumed after the other, got %v", names)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected to wait for the maintenance, waited %s", time.Since(start))
+	}
+
+	// a registry in maintenance for longer than MaxMaintenancePause fails
+	defer func(d time.Duration) { MaxMaintenancePause = d }(MaxMaintenancePause)
+	MaxMaintenancePause = time.Millisecond
+	results = RunBatches(context.Background(), batches[:1], func(batch HostBatch, ref *ImageRef) FetchResult {
+		return FetchResult{Ref: ref, Err: ErrMaintenance{Host: batch.Host, RetryAfter: time.Hour}}
+	})
+	if len(results) != 2 || results[0].Err == nil || results[1].Err == nil {
+		t.Errorf("expected both references to fail, got %v", results)
+	}
+
+	// nothing is tried once ctx is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if results := RunBatches(ctx, batches, func(batch HostBatch, ref *ImageRef) FetchResult {
+		t.Errorf("unexpected fetch of %s", ref)
+		return FetchResult{Ref: ref}
+	}); len(results) != 0 {
+		t.Errorf("expected no results, got %d", len(results))
+	}
+}
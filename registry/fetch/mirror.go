@@ -0,0 +1,193 @@
+package fetch
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+// parseEndpoints parses the X-Docker-Endpoints header of a v1 index, a list
+// of registry hosts separated by commas, in the order they are to be tried
+func parseEndpoints(header string) []string {
+	endpoints := []string{}
+	for _, e := range strings.Split(header, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// fallbacks are the v1 endpoints given by the index after the one the
+// images are downloaded from, tried in turn when it fails
+func (re *RegistryEndpoint) fallbacks() []string {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if len(re.endpoints) < 2 {
+		return nil
+	}
+	return append([]string{}, re.endpoints[1:]...)
+}
+
+// mirrored reports whether req is a pull from the API of the registry, which
+// its Mirrors may answer
+func (re *RegistryEndpoint) mirrored(req *http.Request) bool {
+	if len(re.Mirrors) == 0 || (req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
+	api, err := url.Parse(re.apiURL(re.v2Host(), "/v2/"))
+	if err != nil {
+		return false
+	}
+	return req.URL.Host == api.Host && strings.HasPrefix(req.URL.Path, api.Path)
+}
+
+// withMirror is req sent to mirror instead, a URL like
+// "https://mirror.example.com" or a host, reached over https
+func (re *RegistryEndpoint) withMirror(req *http.Request, mirror string) (*http.Request, error) {
+	if !strings.Contains(mirror, "://") {
+		mirror = "https://" + mirror
+	}
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid mirror %q", mirror)
+	}
+	api, err := url.Parse(re.apiURL(re.v2Host(), "/v2/"))
+	if err != nil {
+		return nil, err
+	}
+	m := req.Clone(req.Context())
+	m.URL.Scheme = u.Scheme
+	m.URL.Host = u.Host
+	m.URL.Path = strings.TrimSuffix(u.Path, "/") + "/v2/" + strings.TrimPrefix(req.URL.Path, api.Path)
+	m.URL.RawPath = ""
+	m.Host = ""
+	// the credentials of the registry are not for the mirror
+	m.Header.Del("Authorization")
+	return m, nil
+}
+
+// withHost is req sent to the v1 endpoint host instead
+func withHost(req *http.Request, host string) *http.Request {
+	r := req.Clone(req.Context())
+	r.URL.Host = host
+	r.Host = ""
+	return r
+}
+
+// failedOver reports why the response to a request that a mirror or another
+// endpoint may answer instead is not to be taken, or is empty if it is
+func failedOver(resp *http.Response, err error, mirror bool) string {
+	switch {
+	case err != nil:
+		return err.Error()
+	case resp.StatusCode >= 500:
+		return fmt.Sprintf("got %q", resp.Status)
+	case mirror && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		// a mirror not having it, or not willing to give it, is no answer
+		return fmt.Sprintf("got %q", resp.Status)
+	}
+	return ""
+}
+
+// sendMirror sends req to a mirror once, with the Client of the registry
+// but without its retries or circuit breaker, which are of the registry. A
+// mirror challenging it is authenticated to with the Credentials for the
+// host of the mirror, and the request sent again.
+func (re *RegistryEndpoint) sendMirror(req *http.Request) (*http.Response, error) {
+	client, err := re.client()
+	if err != nil {
+		return nil, err
+	}
+	key := req.URL.Host + " " + mirrorScope(req.URL.Path)
+	re.mu.Lock()
+	tok, ok := re.mirrorTokens[key]
+	re.mu.Unlock()
+	if ok && !tok.Expired() {
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	var creds auth.Credentials
+	if re.Credentials != nil {
+		if creds, err = re.Credentials.Credentials(req.URL.Host); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	challenge := auth.ParseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !challenge.IsBearer() {
+		if creds.Empty() || req.Header.Get("Authorization") != "" {
+			// nothing more to try, leave the 401 to failedOver
+			return resp, nil
+		}
+		resp.Body.Close()
+		m := req.Clone(req.Context())
+		m.SetBasicAuth(creds.Username, creds.Password)
+		return client.Do(m)
+	}
+	resp.Body.Close()
+	if tok, err = auth.RequestBearerToken(client, challenge, mirrorScope(req.URL.Path), creds); err != nil {
+		return nil, fmt.Errorf("authenticating to mirror %s: %w", req.URL.Host, err)
+	}
+	re.mu.Lock()
+	if re.mirrorTokens == nil {
+		re.mirrorTokens = map[string]auth.BearerToken{}
+	}
+	re.mirrorTokens[key] = tok
+	re.mu.Unlock()
+	m := req.Clone(req.Context())
+	m.Header.Set("Authorization", "Bearer "+tok.Token)
+	return client.Do(m)
+}
+
+// mirrorScope is the scope of p, the path of a pull from a mirror: that of
+// the repository of a manifest, blob or tag list, or of the catalog
+func mirrorScope(p string) string {
+	i := strings.LastIndex(p, "/v2/")
+	if i < 0 {
+		return ""
+	}
+	name := p[i+len("/v2/"):]
+	if name == "_catalog" {
+		return "registry:catalog:*"
+	}
+	for _, kind := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if j := strings.LastIndex(name, kind); j > 0 {
+			return "repository:" + name[:j] + ":pull"
+		}
+	}
+	return ""
+}
+
+// doMirrors sends the pull req to each of the Mirrors in turn, returning
+// the first response that can be taken, or nil if none did
+func (re *RegistryEndpoint) doMirrors(req *http.Request) *http.Response {
+	for _, mirror := range re.Mirrors {
+		m, err := re.withMirror(req, mirror)
+		if err != nil {
+			logrus.Warnf("mirror of %s: %s", re.Host, err)
+			continue
+		}
+		resp, err := re.sendMirror(m)
+		reason := failedOver(resp, err, true)
+		if reason == "" {
+			return resp
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		logrus.Debugf("%s %s%s: %s, trying the next mirror", req.Method, m.URL.Host, m.URL.Path, reason)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+// closedHost is the address of a server that is no longer there
+func closedHost() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	upstream := newTestRegistryV2(t, testLayers...)
+	mirror := newTestRegistryV2(t, testLayers...)
+	manifest := "/v2/test/image/manifests/latest"
+
+	fetch := func(mirrors ...string) {
+		ref := upstream.Ref()
+		r := NewRegistry(ref.Host())
+		r.Mirrors = mirrors
+		if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the mirror has it all
+	fetch(mirror.Server.URL)
+	for p, n := range upstream.Requests {
+		if strings.HasPrefix(p, "/v2/test/") && n > 0 {
+			t.Errorf("expected nothing pulled from upstream, got %d requests of %s", n, p)
+		}
+	}
+	if mirror.Requests[manifest] == 0 {
+		t.Error("expected the manifest pulled from the mirror")
+	}
+
+	// a mirror down, or without the image, is passed over
+	mirror.Fail[manifest] = http.StatusNotFound
+	fetch("https://"+closedHost(), mirror.Host())
+	if upstream.Requests[manifest] == 0 {
+		t.Error("expected the manifest the mirror does not have pulled from upstream")
+	}
+	for p, n := range upstream.Requests {
+		if strings.Contains(p, "/blobs/") && n > 0 {
+			t.Errorf("expected the blobs pulled from the mirror, got %d requests of %s", n, p)
+		}
+	}
+}
+
+func TestRegistryV1Endpoints(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tr.Endpoints = closedHost() + ", " + tr.Host()
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if endpoints := parseEndpoints(tr.Endpoints); len(endpoints) != 2 || endpoints[1] != tr.Host() {
+		t.Errorf("expected both endpoints, got %v", endpoints)
+	}
+}
+
+func TestRegistryMirrorCredentials(t *testing.T) {
+	upstream := newTestRegistryV2(t, testLayers...)
+	upstream.Auth = "joe:hunter2"
+	upstream.Basic = true
+	mirror := newTestRegistryV2(t, testLayers...)
+	mirror.Auth = "ann:s3cret"
+	manifest := "/v2/test/image/manifests/latest"
+
+	fetch := func(creds map[string]auth.AuthConfig) {
+		ref := upstream.Ref()
+		r := NewRegistry(ref.Host())
+		r.Mirrors = []string{mirror.Host()}
+		r.Credentials = &auth.DockerConfig{Auths: creds}
+		if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each is sent its own credentials
+	fetch(map[string]auth.AuthConfig{
+		upstream.Host(): {Username: "joe", Password: "hunter2"},
+		mirror.Host():   {Username: "ann", Password: "s3cret"},
+	})
+	if upstream.Requests[manifest] != 0 {
+		t.Errorf("expected the manifest pulled from the mirror, got %d requests upstream", upstream.Requests[manifest])
+	}
+	if mirror.Requests["/token"] == 0 {
+		t.Error("expected a token requested of the mirror")
+	}
+
+	// a mirror refusing the credentials of the registry is passed over
+	fetch(map[string]auth.AuthConfig{
+		upstream.Host(): {Username: "joe", Password: "hunter2"},
+	})
+	if upstream.Requests[manifest] == 0 {
+		t.Error("expected the manifest pulled from upstream when the mirror refuses")
+	}
+}
@@ -0,0 +1,115 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LayerNamesFile is written by NameLayersByDigest, mapping the legacy ID of
+// each layer to the digest its directory is now named after
+const LayerNamesFile = "layers.json"
+
+// NameLayersByDigest renames the directory of each layer of imgs, fetched
+// into src with FetchLayers, from its legacy ID to the hex of its chain ID:
+// the digest of its content and of the layers under it, as containerd names
+// its snapshots. Layers are then addressed by what they hold, the random IDs
+// of v1 images cannot collide, and identical layers at different places in
+// a stack stay apart. The mapping from each legacy ID to its "sha256:" digest
+// is written to LayerNamesFile, and returned. The layers of the manifest.json
+// of src, if WriteManifest wrote one, are renamed too, for an archive of src
+// to load on current versions of docker. The exports reading the legacy
+// layout, like WriteOCILayout, cannot read src afterwards.
+func NameLayersByDigest(src string, imgs ...*ImageRef) (map[string]string, error) {
+	names := map[string]string{}
+	for _, img := range imgs {
+		ancestry := img.Ancestry()
+		chainID := ""
+		for i := len(ancestry) - 1; i >= 0; i-- {
+			id := ancestry[i]
+			diffID, err := layerDiffID(filepath.Join(src, id))
+			if err != nil {
+				return nil, err
+			}
+			if chainID == "" {
+				chainID = diffID
+			} else {
+				chainID = digestOf([]byte(chainID + " " + diffID))
+			}
+			names[id] = chainID
+		}
+	}
+	for id, digest := range names {
+		dir := filepath.Join(src, strings.TrimPrefix(digest, "sha256:"))
+		if dir == filepath.Join(src, id) {
+			continue
+		}
+		if _, err := os.Stat(dir); err == nil {
+			// the same layer under another legacy ID
+			if err := os.RemoveAll(filepath.Join(src, id)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := os.Rename(filepath.Join(src, id), dir); err != nil {
+			return nil, err
+		}
+	}
+	if err := renameManifestLayers(src, names); err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	return names, ioutil.WriteFile(filepath.Join(src, LayerNamesFile), buf, 0644)
+}
+
+// renameManifestLayers points the layers of the manifest.json in src, if
+// any, at the directories named by digest
+func renameManifestLayers(src string, names map[string]string) error {
+	filename := filepath.Join(src, "manifest.json")
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []dockerSaveManifest
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return fmt.Errorf("manifest.json: %w", err)
+	}
+	for _, entry := range entries {
+		for i, layer := range entry.Layers {
+			entry.Layers[i] = layerDirName(names, path.Dir(layer)) + "/" + path.Base(layer)
+		}
+	}
+	if buf, err = json.Marshal(entries); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0644)
+}
+
+// layerDiffID is the digest of the layer.tar in dir, as recorded when it was
+// fetched or else hashed now
+func layerDiffID(dir string) (string, error) {
+	sum, ok, err := readLayerChecksum(dir)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return sum.Digest, nil
+	}
+	h := sha256.New()
+	if err := hashFile(h, filepath.Join(dir, "layer.tar")); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
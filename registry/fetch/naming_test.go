@@ -0,0 +1,78 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNameLayersByDigest(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteManifest(tdir, ref); err != nil {
+		t.Fatal(err)
+	}
+	names, err := NameLayersByDigest(tdir, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := digestOf(testLayers[1].Layer)
+	expected := map[string]string{
+		testLayers[1].ID: base,
+		testLayers[0].ID: digestOf([]byte(base + " " + digestOf(testLayers[0].Layer))),
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tdir, LayerNamesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written map[string]string
+	if err := json.Unmarshal(buf, &written); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range testLayers {
+		if names[l.ID] != expected[l.ID] || written[l.ID] != expected[l.ID] {
+			t.Errorf("%s: expected %s, got %s and %s in %s", l.ID, expected[l.ID], names[l.ID], written[l.ID], LayerNamesFile)
+		}
+		if _, err := os.Stat(filepath.Join(tdir, l.ID)); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the legacy directory gone, got %v", l.ID, err)
+		}
+		layer, err := ioutil.ReadFile(filepath.Join(tdir, strings.TrimPrefix(expected[l.ID], "sha256:"), "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(layer) != string(l.Layer) {
+			t.Errorf("%s: expected the layer %q, got %q", l.ID, l.Layer, layer)
+		}
+	}
+
+	// the manifest.json loaded by docker points at the directories renamed
+	if buf, err = ioutil.ReadFile(filepath.Join(tdir, "manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+	var manifest []dockerSaveManifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) != 2 {
+		t.Fatalf("expected an image of two layers, got %s", buf)
+	}
+	for i, l := range []testLayer{testLayers[1], testLayers[0]} {
+		if name := strings.TrimPrefix(expected[l.ID], "sha256:") + "/layer.tar"; manifest[0].Layers[i] != name {
+			t.Errorf("expected layer %d at %s, got %s", i, name, manifest[0].Layers[i])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package fetch
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Normalization rewrites the layers of an image when it is written out
+// again, for redistributable artifacts that do not leak the accounts and
+// times of the build: every file is owned by 0:0 with no user or group
+// names, and no time is later than ModTime. The diff IDs in the config, and
+// so the image ID, change accordingly.
+type Normalization struct {
+	ModTime time.Time
+}
+
+// SetNormalization sets the Normalization applied to the layers of the
+// image when it is written out again
+func (ir *ImageRef) SetNormalization(n *Normalization) {
+	ir.normalization = n
+}
+
+// Normalization is the Normalization set with SetNormalization, if any
+func (ir ImageRef) Normalization() *Normalization {
+	return ir.normalization
+}
+
+// header normalizes hdr in place
+func (n *Normalization) header(hdr *tar.Header) {
+	hdr.Uid, hdr.Gid = 0, 0
+	hdr.Uname, hdr.Gname = "", ""
+	if hdr.ModTime.After(n.ModTime) {
+		hdr.ModTime = n.ModTime
+	}
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	for k := range hdr.PAXRecords {
+		switch k {
+		case "uid", "gid", "uname", "gname", "mtime", "atime", "ctime":
+			delete(hdr.PAXRecords, k)
+		}
+	}
+}
+
+// rewrite copies the layer tar r to w, normalizing each header
+func (n *Normalization) rewrite(r io.Reader, w io.Writer) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		n.header(hdr)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// exportLayer is the layer.tar of the layer id in src to write out for img:
+// the file itself, or a normalized copy of it when img has a Normalization,
+// to be removed with cleanup. The layer is checked against the checksum
+// recorded when it was fetched before it is normalized.
+func exportLayer(img *ImageRef, src, id string) (filename string, cleanup func(), err error) {
+	filename = filepath.Join(src, id, "layer.tar")
+	if img.Normalization() == nil {
+		return filename, func() {}, nil
+	}
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile("", "docker-fetch-layer-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.Remove(out.Name()) }
+	h := sha256.New()
+	if err := img.Normalization().rewrite(io.TeeReader(in, h), out); err != nil {
+		out.Close()
+		cleanup()
+		return "", nil, err
+	}
+	// the rest of the stream, after the end of the archive
+	if _, err := io.Copy(h, in); err != nil {
+		out.Close()
+		cleanup()
+		return "", nil, err
+	}
+	if err := out.Close(); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	if err := checkLayerChecksum(id, filepath.Join(src, id), "sha256:"+hex.EncodeToString(h.Sum(nil))); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return out.Name(), cleanup, nil
+}
+
+// withDiffIDs sets the diff_ids of the rootfs in the image config, keeping
+// the rest of it as is
+func withDiffIDs(config []byte, diffIDs []string) ([]byte, error) {
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(config, &image); err != nil {
+		return nil, err
+	}
+	rootfs := map[string]interface{}{"type": "layers", "diff_ids": diffIDs}
+	var err error
+	if image["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	return json.Marshal(image)
+}
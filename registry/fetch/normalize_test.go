@@ -0,0 +1,107 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ownedTar is a layer tar of a single file, owned by a build account
+func ownedTar(name string, mtime time.Time) []byte {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(name)),
+		Uid:      1000,
+		Gid:      1000,
+		Uname:    "builder",
+		Gname:    "builder",
+		ModTime:  mtime,
+		Format:   tar.FormatPAX,
+	})
+	tw.Write([]byte(name))
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestWriteOCILayoutNormalized(t *testing.T) {
+	clamp := time.Unix(1600000000, 0)
+	layers := []testLayer{
+		{ID: strings.Repeat("d", 64), Parent: strings.Repeat("c", 64), Layer: ownedTar("late", clamp.Add(time.Hour))},
+		{ID: strings.Repeat("c", 64), Layer: ownedTar("early", clamp.Add(-time.Hour))},
+	}
+	tr := newTestRegistryV2(t, layers...)
+	tdir, err := ioutil.TempDir("", "test.normalize.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, filepath.Join(tdir, "fetch")); err != nil {
+		t.Fatal(err)
+	}
+	ref.SetNormalization(&Normalization{ModTime: clamp})
+	desc, err := WriteOCILayout(ref, filepath.Join(tdir, "fetch"), filepath.Join(tdir, "oci"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := func(digest string) []byte {
+		buf, err := ioutil.ReadFile(filepath.Join(tdir, "oci", "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(blob(desc.Digest), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	diffIDs := []string{}
+	for _, l := range manifest.Layers {
+		diffIDs = append(diffIDs, l.Digest)
+		tr := tar.NewReader(bytes.NewReader(blob(l.Digest)))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Uid != 0 || hdr.Gid != 0 || hdr.Uname != "" || hdr.Gname != "" {
+				t.Errorf("%s: expected to be owned by 0:0, got %d:%d (%s:%s)", hdr.Name, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname)
+			}
+			if hdr.ModTime.After(clamp) {
+				t.Errorf("%s: expected the time to be clamped to %s, got %s", hdr.Name, clamp, hdr.ModTime)
+			}
+			if hdr.Name == "early" && !hdr.ModTime.Equal(clamp.Add(-time.Hour)) {
+				t.Errorf("%s: expected an earlier time to be kept, got %s", hdr.Name, hdr.ModTime)
+			}
+		}
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(blob(manifest.Config.Digest), &config); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, diffIDs) {
+		t.Errorf("expected the config diff_ids %v to follow the layers %v", config.RootFS.DiffIDs, diffIDs)
+	}
+}
@@ -0,0 +1,564 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNotaryServer is the Notary server of the Docker Hub
+var DefaultNotaryServer = "https://notary.docker.io"
+
+// ContentTrust resolves the tags of images to the digests signed for them on
+// a Notary server, as docker does with DOCKER_CONTENT_TRUST=1: the TUF
+// metadata of the repository is verified from its root down to the targets
+// (and their targets/releases delegation, which takes precedence), and an
+// image is fetched by the digest signed for its tag, or refused when there is
+// none. Images given by digest are fetched as they are.
+type ContentTrust struct {
+	// Server is the URL of the Notary server, like
+	// "https://notary.example.com"; by default DefaultNotaryServer for the
+	// Docker Hub and port 4443 of the registry host for others, as docker
+	// has it
+	Server string
+	// Dir, when set, is where the root metadata of each repository is kept
+	// once trusted, like ~/.docker/trust, in the same layout as docker. The
+	// root of a repository is trusted on first use, and the roots the server
+	// gives later must be signed by its keys, as a key rotation is. The
+	// timestamp, snapshot and targets verified are kept beside it, and
+	// versions older than those kept refused, as a rollback of the
+	// metadata. Without it, the root the server gives is trusted as it is,
+	// and any version taken.
+	Dir string
+	// Client is used for the Notary server, or else that of the registry
+	// endpoint, with its proxy and dial settings
+	Client *http.Client
+
+	mu        sync.Mutex
+	endpoints map[string]*RegistryEndpoint
+}
+
+// ContentTrustError is returned for an image ContentTrust refuses, having no
+// valid signed digest for its tag
+type ContentTrustError struct {
+	Ref    string
+	Reason string
+}
+
+func (e ContentTrustError) Error() string {
+	return fmt.Sprintf("%s: content trust: %s", e.Ref, e.Reason)
+}
+
+// SignedDigest is the digest signed for the tag of img on the Notary server of
+// the ContentTrust, which must be set, once the TUF metadata of its
+// repository is verified.
+func (re *RegistryEndpoint) SignedDigest(img *ImageRef) (string, error) {
+	return re.SignedDigestContext(context.Background(), img)
+}
+
+// SignedDigestContext is SignedDigest, giving up when ctx is done.
+func (re *RegistryEndpoint) SignedDigestContext(ctx context.Context, img *ImageRef) (string, error) {
+	ct := re.ContentTrust
+	if ct == nil {
+		return "", fmt.Errorf("%s: no content trust configured", img)
+	}
+	untrusted := func(format string, args ...interface{}) error {
+		return ContentTrustError{Ref: img.String(), Reason: fmt.Sprintf(format, args...)}
+	}
+	gun := img.Host() + "/" + img.Name()
+	creds, err := re.credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	n, err := ct.endpoint(re, img)
+	if err != nil {
+		return "", err
+	}
+	// the Notary server is sent the credentials of the registry
+	ctx = WithCredentials(ctx, creds)
+	get := func(role string) ([]byte, error) {
+		urlStr := n.apiURL(n.Host, "/v2/"+gun+"/_trust/tuf/"+role+".json")
+		resp, err := n.v2DoScope(ctx, "repository:"+gun+":pull", "GET", urlStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, untrusted("no trust data for %s", gun)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, newResponseError(urlStr, resp)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+
+	buf, err := get("root")
+	if err != nil {
+		return "", err
+	}
+	root, err := ct.trustedRoot(gun, buf)
+	if err != nil {
+		return "", untrusted("root: %s", err)
+	}
+	// the metadata verified, to be kept once all of it is
+	verified := map[string][]byte{}
+	var timestamp, snapshot tufSnapshot
+	if buf, err = get("timestamp"); err != nil {
+		return "", err
+	}
+	if err := verifyTUF(buf, "Timestamp", root.Keys, root.Roles["timestamp"], &timestamp); err != nil {
+		return "", untrusted("timestamp: %s", err)
+	}
+	if err := ct.checkVersion(gun, "timestamp", timestamp.Version); err != nil {
+		return "", untrusted("%s", err)
+	}
+	verified["timestamp"] = buf
+	if buf, err = get("snapshot"); err != nil {
+		return "", err
+	}
+	if err := timestamp.check("snapshot", buf); err != nil {
+		return "", untrusted("%s", err)
+	}
+	if err := verifyTUF(buf, "Snapshot", root.Keys, root.Roles["snapshot"], &snapshot); err != nil {
+		return "", untrusted("snapshot: %s", err)
+	}
+	if err := ct.checkVersion(gun, "snapshot", snapshot.Version); err != nil {
+		return "", untrusted("%s", err)
+	}
+	verified["snapshot"] = buf
+	var targets tufTargets
+	if buf, err = get("targets"); err != nil {
+		return "", err
+	}
+	if err := snapshot.check("targets", buf); err != nil {
+		return "", untrusted("%s", err)
+	}
+	if err := verifyTUF(buf, "Targets", root.Keys, root.Roles["targets"], &targets); err != nil {
+		return "", untrusted("targets: %s", err)
+	}
+	if err := ct.checkVersion(gun, "targets", targets.Version); err != nil {
+		return "", untrusted("%s", err)
+	}
+	verified["targets"] = buf
+
+	target, ok := tufFileMeta{}, false
+	for _, d := range targets.Delegations.Roles {
+		if d.Name != "targets/releases" {
+			continue
+		}
+		if _, signed := snapshot.Meta[d.Name]; !signed {
+			break
+		}
+		var releases tufTargets
+		if buf, err = get(d.Name); err != nil {
+			return "", err
+		}
+		if err := snapshot.check(d.Name, buf); err != nil {
+			return "", untrusted("%s", err)
+		}
+		if err := verifyTUF(buf, "Targets", targets.Delegations.Keys, d.tufRole, &releases); err != nil {
+			return "", untrusted("%s: %s", d.Name, err)
+		}
+		if err := ct.checkVersion(gun, d.Name, releases.Version); err != nil {
+			return "", untrusted("%s", err)
+		}
+		verified[d.Name] = buf
+		target, ok = releases.Targets[img.Tag()]
+	}
+	if err := ct.keepMetadata(gun, verified); err != nil {
+		return "", err
+	}
+	if !ok {
+		target, ok = targets.Targets[img.Tag()]
+	}
+	if !ok {
+		return "", untrusted("no signed digest for tag %s", img.Tag())
+	}
+	sum, ok := target.Hashes["sha256"]
+	if !ok || len(sum) != sha256.Size {
+		return "", untrusted("no sha256 signed for tag %s", img.Tag())
+	}
+	return "sha256:" + hex.EncodeToString(sum), nil
+}
+
+// checkContentTrust pins img to the digest signed for its tag, unless given
+// by digest, and marks it Signed
+func (re *RegistryEndpoint) checkContentTrust(ctx context.Context, img *ImageRef) error {
+	if img.Pinned() {
+		return nil
+	}
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return ContentTrustError{Ref: img.String(), Reason: "images of v1 registries cannot be signed"}
+	}
+	digest, err := re.SignedDigestContext(ctx, img)
+	if err != nil {
+		return err
+	}
+	// the manifest fetched is then checked against the digest
+	img.pin(digest)
+	img.trustedDigest = digest
+	img.signed = true
+	return nil
+}
+
+// endpoint is the Notary server of the registry of img, as an endpoint whose
+// tokens are kept apart from those of the registry re, but that is reached as
+// re is, through its Client, proxy and dial settings, unless the Client of
+// ct is set
+func (ct *ContentTrust) endpoint(re *RegistryEndpoint, img *ImageRef) (*RegistryEndpoint, error) {
+	server := ct.Server
+	if server == "" && img.Host() == DefaultHubNamespace {
+		server = DefaultNotaryServer
+	} else if server == "" {
+		server = "https://" + img.Hostname() + ":4443"
+	}
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if n, ok := ct.endpoints[server]; ok {
+		return n, nil
+	}
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid Notary server %q", server)
+	}
+	n := NewRegistry(u.Host)
+	n.BaseURL = server
+	n.Client = ct.Client
+	if n.Client == nil {
+		n.Client = re.Client
+		n.ProxyURL = re.ProxyURL
+		n.DisableHTTP2 = re.DisableHTTP2
+		n.Dial = re.Dial
+	}
+	n.Retry = re.Retry
+	if ct.endpoints == nil {
+		ct.endpoints = map[string]*RegistryEndpoint{}
+	}
+	ct.endpoints[server] = &n
+	return &n, nil
+}
+
+// rootFile is where the trusted root of the repository gun is kept in Dir
+func (ct *ContentTrust) rootFile(gun string) string {
+	return ct.metadataFile(gun, "root")
+}
+
+// metadataFile is where the metadata of role of the repository gun is kept
+// in Dir
+func (ct *ContentTrust) metadataFile(gun, role string) string {
+	return filepath.Join(ct.Dir, "tuf", filepath.FromSlash(gun), "metadata", filepath.FromSlash(role)+".json")
+}
+
+// checkVersion refuses version of the metadata of role of the repository
+// gun when older than that kept in Dir, as a rollback to metadata since
+// replaced
+func (ct *ContentTrust) checkVersion(gun, role string, version int) error {
+	if ct.Dir == "" {
+		return nil
+	}
+	filename := ct.metadataFile(gun, role)
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var kept tufCommon
+	if err := unmarshalTUF(buf, &kept); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if version < kept.Version {
+		return fmt.Errorf("%s: version %d is older than the version %d trusted before", role, version, kept.Version)
+	}
+	return nil
+}
+
+// keepMetadata keeps the metadata verified of the repository gun in Dir, by
+// role, for their versions to be checked against
+func (ct *ContentTrust) keepMetadata(gun string, verified map[string][]byte) error {
+	if ct.Dir == "" {
+		return nil
+	}
+	for role, buf := range verified {
+		filename := ct.metadataFile(gun, role)
+		if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, buf, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trustedRoot verifies the root metadata buf of the repository gun, signed by
+// its own keys and, once a root of gun is kept in Dir, by the keys of that
+// one, keeping it there in its place
+func (ct *ContentTrust) trustedRoot(gun string, buf []byte) (*tufRoot, error) {
+	var unverified tufRoot
+	if err := unmarshalTUF(buf, &unverified); err != nil {
+		return nil, err
+	}
+	root := &tufRoot{}
+	if err := verifyTUF(buf, "Root", unverified.Keys, unverified.Roles["root"], root); err != nil {
+		return nil, err
+	}
+	if ct.Dir == "" {
+		return root, nil
+	}
+	filename := ct.rootFile(gun)
+	trusted, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && bytes.Equal(trusted, buf) {
+		return root, nil
+	}
+	if err == nil {
+		var old tufRoot
+		if err := unmarshalTUF(trusted, &old); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		if err := verifyTUFSignatures(buf, old.Keys, old.Roles["root"]); err != nil {
+			return nil, fmt.Errorf("not signed by the root trusted before: %w", err)
+		}
+		if root.Version < old.Version {
+			return nil, fmt.Errorf("version %d is older than the version %d trusted before", root.Version, old.Version)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	return root, ioutil.WriteFile(filename, buf, 0600)
+}
+
+// the TUF metadata of a Notary repository, signed by the keys of a role
+type tufSigned struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []struct {
+		KeyID string `json:"keyid"`
+		Sig   []byte `json:"sig"`
+	} `json:"signatures"`
+}
+
+type tufKey struct {
+	Type  string `json:"keytype"`
+	Value struct {
+		Public []byte `json:"public"`
+	} `json:"keyval"`
+}
+
+type tufRole struct {
+	KeyIDs    []string `json:"keyids"`
+	Threshold int      `json:"threshold"`
+}
+
+type tufCommon struct {
+	Type    string    `json:"_type"`
+	Expires time.Time `json:"expires"`
+	Version int       `json:"version"`
+}
+
+type tufRoot struct {
+	tufCommon
+	Keys  map[string]tufKey  `json:"keys"`
+	Roles map[string]tufRole `json:"roles"`
+}
+
+type tufFileMeta struct {
+	Length int64             `json:"length"`
+	Hashes map[string][]byte `json:"hashes"`
+}
+
+// tufSnapshot is the metadata of the timestamp and snapshot roles
+type tufSnapshot struct {
+	tufCommon
+	Meta map[string]tufFileMeta `json:"meta"`
+}
+
+type tufTargets struct {
+	tufCommon
+	Targets     map[string]tufFileMeta `json:"targets"`
+	Delegations struct {
+		Keys  map[string]tufKey `json:"keys"`
+		Roles []struct {
+			Name string `json:"name"`
+			tufRole
+		} `json:"roles"`
+	} `json:"delegations"`
+}
+
+// check checks buf, the metadata of role, against the length and sha256
+// recorded for it
+func (s tufSnapshot) check(role string, buf []byte) error {
+	meta, ok := s.Meta[role]
+	if !ok {
+		return fmt.Errorf("%s: not in the %s", role, strings.ToLower(s.Type))
+	}
+	if meta.Length > 0 && int64(len(buf)) != meta.Length {
+		return fmt.Errorf("%s: expected %d bytes, got %d", role, meta.Length, len(buf))
+	}
+	sum := sha256.Sum256(buf)
+	if !bytes.Equal(meta.Hashes["sha256"], sum[:]) {
+		return fmt.Errorf("%s: sha256 does not match the %s", role, strings.ToLower(s.Type))
+	}
+	return nil
+}
+
+// unmarshalTUF decodes the signed part of buf into v, unverified
+func unmarshalTUF(buf []byte, v interface{}) error {
+	var s tufSigned
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	return json.Unmarshal(s.Signed, v)
+}
+
+// verifyTUF verifies that buf is signed by the threshold of the keys of role,
+// and decodes its signed part, of the type typ, into v, which must not have
+// expired
+func verifyTUF(buf []byte, typ string, keys map[string]tufKey, role tufRole, v interface{}) error {
+	if err := verifyTUFSignatures(buf, keys, role); err != nil {
+		return err
+	}
+	var common tufCommon
+	if err := unmarshalTUF(buf, &common); err != nil {
+		return err
+	}
+	if common.Type != typ {
+		return fmt.Errorf("expected %s metadata, got %q", typ, common.Type)
+	}
+	if !time.Now().Before(common.Expires) {
+		return fmt.Errorf("expired on %s", common.Expires.Format(time.RFC3339))
+	}
+	return unmarshalTUF(buf, v)
+}
+
+// verifyTUFSignatures verifies that buf is signed by the threshold of the
+// keys of role, over the canonical JSON of its signed part
+func verifyTUFSignatures(buf []byte, keys map[string]tufKey, role tufRole) error {
+	var s tufSigned
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+	msg, err := canonicalJSON(s.Signed)
+	if err != nil {
+		return err
+	}
+	threshold := role.Threshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	valid := map[string]bool{}
+	for _, sig := range s.Signatures {
+		if !stringIn(sig.KeyID, role.KeyIDs) {
+			continue
+		}
+		key, ok := keys[sig.KeyID]
+		if !ok {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			continue
+		}
+		if verifyTUFSignature(pub, msg, sig.Sig) {
+			valid[sig.KeyID] = true
+		}
+	}
+	if len(valid) < threshold {
+		return fmt.Errorf("%d valid signatures of the %d required", len(valid), threshold)
+	}
+	return nil
+}
+
+// publicKey parses the public key of k, of the key types of Notary
+func (k tufKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Type {
+	case "ecdsa", "rsa":
+		return x509.ParsePKIXPublicKey(k.Value.Public)
+	case "ecdsa-x509", "rsa-x509":
+		block, _ := pem.Decode(k.Value.Public)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "ed25519":
+		if len(k.Value.Public) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(k.Value.Public), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Type)
+}
+
+// verifyTUFSignature checks sig of msg by key, as Notary signs: ECDSA the
+// sha256 of msg, with r and s concatenated, RSA the sha256 with PSS, and
+// ed25519 msg itself
+func verifyTUFSignature(key crypto.PublicKey, msg, sig []byte) bool {
+	sum := sha256.Sum256(msg)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, sum[:], r, s)
+	case *rsa.PublicKey:
+		return rsa.VerifyPSS(k, crypto.SHA256, sum[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, msg, sig)
+	}
+	return false
+}
+
+// canonicalJSON is buf with its keys sorted and no insignificant space, as
+// the signatures of TUF metadata are made over
+func canonicalJSON(buf []byte) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+func stringIn(s string, list []string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
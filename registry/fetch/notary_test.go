@@ -0,0 +1,271 @@
+package fetch
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNotary is a minimal in-process Notary server, serving the TUF metadata
+// of a single repository, signed with a key per role
+type testNotary struct {
+	*httptest.Server
+	t    *testing.T
+	gun  string
+	keys map[string]*ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	files map[string][]byte
+	// version is that of the metadata published, 1 when zero
+	version int
+}
+
+func newTestNotary(t *testing.T, gun string) *testNotary {
+	n := &testNotary{t: t, gun: gun, keys: map[string]*ecdsa.PrivateKey{}, files: map[string][]byte{}}
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp", "targets/releases"} {
+		n.keys[role] = newTestECDSAKey(t)
+	}
+	n.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"+gun+"/_trust/tuf/"), ".json")
+		n.mu.Lock()
+		buf, ok := n.files[role]
+		n.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(buf)
+	}))
+	t.Cleanup(n.Server.Close)
+	return n
+}
+
+func newTestECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// tufKeyOf is the public key of key, as an ecdsa-x509 key for the root role
+// as docker has it, and an ecdsa key for the others
+func (n *testNotary) tufKeyOf(role string, key *ecdsa.PrivateKey) map[string]interface{} {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	if role != "root" {
+		return map[string]interface{}{"keytype": "ecdsa", "keyval": map[string]interface{}{"public": der, "private": nil}}
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: n.gun}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	return map[string]interface{}{"keytype": "ecdsa-x509", "keyval": map[string]interface{}{"public": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), "private": nil}}
+}
+
+// sign is the TUF metadata signed, signed by the keys of the roles given
+func (n *testNotary) sign(signed map[string]interface{}, keys map[string]*ecdsa.PrivateKey) []byte {
+	signed["expires"] = time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+	signed["version"] = 1
+	if n.version > 0 {
+		signed["version"] = n.version
+	}
+	buf, err := json.Marshal(signed)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	msg, err := canonicalJSON(buf)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	sum := sha256.Sum256(msg)
+	sigs := []map[string]interface{}{}
+	for id, key := range keys {
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		if err != nil {
+			n.t.Fatal(err)
+		}
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		sigs = append(sigs, map[string]interface{}{"keyid": id, "method": "ecdsa", "sig": sig})
+	}
+	out, err := json.Marshal(map[string]interface{}{"signed": json.RawMessage(buf), "signatures": sigs})
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	return out
+}
+
+func fileMeta(buf []byte) map[string]interface{} {
+	sum := sha256.Sum256(buf)
+	return map[string]interface{}{"length": len(buf), "hashes": map[string]interface{}{"sha256": sum[:]}}
+}
+
+// publish signs the root with the keys of rootSigners as well as its own,
+// and the digests of tags, in targets or targets/releases
+func (n *testNotary) publish(targets, releases map[string]string, rootSigners map[string]*ecdsa.PrivateKey) {
+	keys := map[string]interface{}{}
+	roles := map[string]interface{}{}
+	for _, role := range []string{"root", "targets", "snapshot", "timestamp"} {
+		id := role + "-" + hex.EncodeToString(n.keys[role].PublicKey.X.Bytes()[:4])
+		keys[id] = n.tufKeyOf(role, n.keys[role])
+		roles[role] = map[string]interface{}{"keyids": []string{id}, "threshold": 1}
+	}
+	signers := map[string]*ecdsa.PrivateKey{roles["root"].(map[string]interface{})["keyids"].([]string)[0]: n.keys["root"]}
+	for id, key := range rootSigners {
+		signers[id] = key
+	}
+	keyID := func(role string) string {
+		return roles[role].(map[string]interface{})["keyids"].([]string)[0]
+	}
+	targetsOf := func(tags map[string]string) map[string]interface{} {
+		m := map[string]interface{}{}
+		for tag, digest := range tags {
+			sum, _ := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+			m[tag] = map[string]interface{}{"length": 1, "hashes": map[string]interface{}{"sha256": sum}}
+		}
+		return m
+	}
+
+	files := map[string][]byte{}
+	files["root"] = n.sign(map[string]interface{}{"_type": "Root", "consistent_snapshot": false, "keys": keys, "roles": roles}, signers)
+	files["targets/releases"] = n.sign(map[string]interface{}{"_type": "Targets", "targets": targetsOf(releases), "delegations": map[string]interface{}{"keys": map[string]interface{}{}, "roles": []interface{}{}}},
+		map[string]*ecdsa.PrivateKey{"releases": n.keys["targets/releases"]})
+	files["targets"] = n.sign(map[string]interface{}{"_type": "Targets", "targets": targetsOf(targets), "delegations": map[string]interface{}{
+		"keys":  map[string]interface{}{"releases": n.tufKeyOf("targets/releases", n.keys["targets/releases"])},
+		"roles": []interface{}{map[string]interface{}{"name": "targets/releases", "keyids": []string{"releases"}, "threshold": 1, "paths": []string{""}}},
+	}}, map[string]*ecdsa.PrivateKey{keyID("targets"): n.keys["targets"]})
+	files["snapshot"] = n.sign(map[string]interface{}{"_type": "Snapshot", "meta": map[string]interface{}{
+		"root": fileMeta(files["root"]), "targets": fileMeta(files["targets"]), "targets/releases": fileMeta(files["targets/releases"]),
+	}}, map[string]*ecdsa.PrivateKey{keyID("snapshot"): n.keys["snapshot"]})
+	files["timestamp"] = n.sign(map[string]interface{}{"_type": "Timestamp", "meta": map[string]interface{}{"snapshot": fileMeta(files["snapshot"])}},
+		map[string]*ecdsa.PrivateKey{keyID("timestamp"): n.keys["timestamp"]})
+	n.mu.Lock()
+	n.files = files
+	n.mu.Unlock()
+}
+
+func TestContentTrust(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	notary := newTestNotary(t, tr.Host()+"/test/image")
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	signed := digestOf(tr.manifest)
+	other := "sha256:" + strings.Repeat("0", 64)
+	// the releases take precedence over the targets
+	notary.publish(map[string]string{"latest": other, "1.0": signed}, map[string]string{"latest": signed}, nil)
+	ct := &ContentTrust{Server: notary.URL, Dir: filepath.Join(tdir, "trust")}
+	r := NewRegistry(tr.Host())
+	r.ContentTrust = ct
+
+	ref := tr.Ref()
+	if _, err := r.FetchLayers(ref, filepath.Join(tdir, "image")); err != nil {
+		t.Fatal(err)
+	}
+	if !ref.Pinned() || ref.Digest() != signed || ref.TrustedDigest() != signed || !ref.Signed() {
+		t.Errorf("expected %s to be fetched by its signed digest %s", ref, signed)
+	}
+	if ref.Tag() != "latest" {
+		t.Errorf("expected the tag to be kept, got %s", ref.Tag())
+	}
+	if _, err := os.Stat(ct.rootFile(tr.Host() + "/test/image")); err != nil {
+		t.Errorf("expected the root to be trusted on first use: %s", err)
+	}
+	if digest, err := r.SignedDigest(NewImageRef(tr.Host() + "/test/image:1.0")); err != nil || digest != signed {
+		t.Errorf("expected the digest of the targets for 1.0, got %s (%v)", digest, err)
+	}
+
+	var e ContentTrustError
+	if _, err := r.SignedDigest(NewImageRef(tr.Host() + "/test/image:unsigned")); !errors.As(err, &e) || !strings.Contains(e.Reason, "no signed digest") {
+		t.Errorf("expected an unsigned tag to be refused, got %v", err)
+	}
+	// a tag signed for other content than the registry serves is fetched by
+	// that digest, or not at all
+	notary.publish(nil, map[string]string{"latest": other}, nil)
+	if _, err := r.FetchLayers(tr.Ref(), filepath.Join(tdir, "tampered")); err == nil {
+		t.Errorf("expected content other than signed to be refused, got %v", err)
+	}
+	// metadata changed since it was signed
+	notary.publish(nil, map[string]string{"latest": signed}, nil)
+	notary.mu.Lock()
+	notary.files["targets/releases"] = []byte(strings.Replace(string(notary.files["targets/releases"]), `"Targets"`, `"Targetz"`, 1))
+	notary.mu.Unlock()
+	if _, err := r.SignedDigest(tr.Ref()); !errors.As(err, &e) || !strings.Contains(e.Reason, "does not match the snapshot") {
+		t.Errorf("expected metadata not matching the snapshot to be refused, got %v", err)
+	}
+
+	// a new root must be signed by the root trusted before
+	oldRoot := notary.keys["root"]
+	oldID := "root-" + hex.EncodeToString(oldRoot.PublicKey.X.Bytes()[:4])
+	notary.keys["root"] = newTestECDSAKey(t)
+	notary.publish(nil, map[string]string{"latest": signed}, nil)
+	if _, err := r.SignedDigest(tr.Ref()); !errors.As(err, &e) || !strings.Contains(e.Reason, "root trusted before") {
+		t.Errorf("expected a root not signed by the trusted one to be refused, got %v", err)
+	}
+	notary.publish(nil, map[string]string{"latest": signed}, map[string]*ecdsa.PrivateKey{oldID: oldRoot})
+	if digest, err := r.SignedDigest(tr.Ref()); err != nil || digest != signed {
+		t.Errorf("expected the rotated root to be trusted, got %s (%v)", digest, err)
+	}
+
+	// the metadata trusted is not rolled back to older versions
+	notary.version = 2
+	notary.publish(nil, map[string]string{"latest": signed}, map[string]*ecdsa.PrivateKey{oldID: oldRoot})
+	if _, err := r.SignedDigest(tr.Ref()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ct.metadataFile(tr.Host()+"/test/image", "targets/releases")); err != nil {
+		t.Errorf("expected the metadata verified to be kept: %s", err)
+	}
+	notary.version = 1
+	notary.publish(nil, map[string]string{"latest": other}, map[string]*ecdsa.PrivateKey{oldID: oldRoot})
+	if _, err := r.SignedDigest(tr.Ref()); !errors.As(err, &e) || !strings.Contains(e.Reason, "older than the version 2") {
+		t.Errorf("expected older metadata to be refused, got %v", err)
+	}
+
+	// images given by digest are fetched as they are
+	pinned := NewImageRef(tr.Host() + "/test/image@" + signed)
+	if err := r.checkContentTrust(context.Background(), pinned); err != nil || pinned.TrustedDigest() != "" {
+		t.Errorf("expected %s to be left alone, got %v", pinned, err)
+	}
+}
+
+func TestContentTrustEndpoint(t *testing.T) {
+	r := NewRegistry("registry.example.com")
+	r.Client = &http.Client{}
+	r.ProxyURL = "http://proxy.example.com:3128"
+	ct := &ContentTrust{}
+	n, err := ct.endpoint(&r, NewImageRef("registry.example.com/test/image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reached as the registry is, with tokens of its own
+	if n == &r || n.Host != "registry.example.com:4443" || n.Client != r.Client || n.ProxyURL != r.ProxyURL {
+		t.Errorf("expected the Notary server reached through the transport of the registry, got %#v", n)
+	}
+}
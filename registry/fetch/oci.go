@@ -0,0 +1,342 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// OCILayoutVersion is written to the oci-layout file of a layout
+	OCILayoutVersion = "1.0.0"
+	// AnnotationRefName names a manifest within the index.json of a layout
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationImageName is the fully qualified name of the image of a
+	// manifest within the index.json of a layout, as containerd has it
+	AnnotationImageName = "io.containerd.image.name"
+)
+
+// OCIIndex is the index.json of an OCI image layout, or an OCI index or
+// manifest list served by a registry
+type OCIIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// FetchToOCILayout fetches img into the OCI image layout directory dest
+// (oci-layout, index.json and blobs/sha256/), which is created if needed. The
+// manifest is added to the index.json under the image's tag, or its fully
+// qualified name if the layout has images of other repositories, replacing
+// any manifest already there for that image. Layers are stored uncompressed, and
+// images from v1 registries are given an OCI config built from their legacy
+// json. The descriptor of the manifest written is returned.
+func (re *RegistryEndpoint) FetchToOCILayout(img *ImageRef, dest string) (Descriptor, error) {
+	return re.FetchToOCILayoutContext(context.Background(), img, dest)
+}
+
+// FetchToOCILayoutContext is FetchToOCILayout, giving up when ctx is done.
+func (re *RegistryEndpoint) FetchToOCILayoutContext(ctx context.Context, img *ImageRef, dest string) (Descriptor, error) {
+	tmp, err := ioutil.TempDir("", "docker-fetch-oci-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := re.FetchLayersContext(ctx, img, tmp); err != nil {
+		return Descriptor{}, err
+	}
+	return WriteOCILayout(img, tmp, dest)
+}
+
+// WriteOCILayout adds img, already fetched into src with FetchLayers, to the
+// OCI image layout dest. See FetchToOCILayout. Layers not matching the
+// checksum recorded when they were fetched are refused. The annotations and
+// labels set on img are added to the manifest and config, the history in the
+// config is redacted with its Redaction, and the layers are rewritten with
+// its Normalization.
+func WriteOCILayout(img *ImageRef, src, dest string) (Descriptor, error) {
+	if err := os.MkdirAll(filepath.Join(dest, "blobs", "sha256"), 0755); err != nil {
+		return Descriptor{}, err
+	}
+	layout, err := json.Marshal(map[string]string{"imageLayoutVersion": OCILayoutVersion})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dest, "oci-layout"), layout, 0644); err != nil {
+		return Descriptor{}, err
+	}
+
+	manifest := ManifestV2{SchemaVersion: 2, MediaType: MediaTypeOCIManifest}
+	diffIDs := []string{}
+	ancestry := img.Ancestry()
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		layer, cleanup, err := exportLayer(img, src, ancestry[i])
+		if err != nil {
+			return Descriptor{}, err
+		}
+		desc, err := writeBlobFile(dest, MediaTypeOCILayer, layer)
+		cleanup()
+		if err != nil {
+			return Descriptor{}, err
+		}
+		if img.Normalization() == nil {
+			if err := checkLayerChecksum(ancestry[i], filepath.Join(src, ancestry[i]), desc.Digest); err != nil {
+				return Descriptor{}, err
+			}
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		diffIDs = append(diffIDs, desc.Digest)
+	}
+
+	var config []byte
+	if img.v2 != nil {
+		config = img.v2.config
+		if img.Normalization() != nil {
+			if config, err = withDiffIDs(config, diffIDs); err != nil {
+				return Descriptor{}, err
+			}
+		}
+	} else if config, err = ociConfig(src, ancestry, diffIDs); err != nil {
+		return Descriptor{}, err
+	}
+	if config, err = withLabels(config, img.Labels()); err != nil {
+		return Descriptor{}, err
+	}
+	if config, err = img.Redaction().apply(config); err != nil {
+		return Descriptor{}, err
+	}
+	annotations := map[string]string{}
+	if img.v2 != nil {
+		for k, v := range img.v2.manifest.Annotations {
+			annotations[k] = v
+		}
+	}
+	for k, v := range img.Annotations() {
+		annotations[k] = v
+	}
+	if len(annotations) > 0 {
+		manifest.Annotations = annotations
+	}
+	if manifest.Config, err = writeBlob(dest, MediaTypeOCIImageConfig, bytes.NewReader(config)); err != nil {
+		return Descriptor{}, err
+	}
+
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc, err := writeBlob(dest, MediaTypeOCIManifest, bytes.NewReader(buf))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{AnnotationRefName: img.Tag(), AnnotationImageName: ociImageName(img)}
+	if err := addToOCIIndex(filepath.Join(dest, "index.json"), desc); err != nil {
+		return Descriptor{}, err
+	}
+	// the aliases are the same manifest under their names
+	for _, alias := range img.Aliases() {
+		if ociImageName(alias) == ociImageName(img) {
+			continue
+		}
+		aliasDesc := desc
+		aliasDesc.Annotations = map[string]string{AnnotationRefName: alias.Tag(), AnnotationImageName: ociImageName(alias)}
+		if err := addToOCIIndex(filepath.Join(dest, "index.json"), aliasDesc); err != nil {
+			return Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// ociImageName is the fully qualified "host/name:tag" of img
+func ociImageName(img *ImageRef) string {
+	return img.Host() + "/" + img.Name() + ":" + img.Tag()
+}
+
+// addToOCIIndex adds desc to the index.json at filename, replacing the
+// manifest of the same image name, or of the same ref name for the manifests
+// with no image name. The ref names are the tags of the images while they are
+// all of one repository, and their fully qualified names once there are
+// several, for the images of different repositories with the same tag not to
+// replace one another.
+func addToOCIIndex(filename string, desc Descriptor) error {
+	index := OCIIndex{SchemaVersion: 2}
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &index); err != nil {
+			return err
+		}
+	}
+	manifests := []Descriptor{}
+	for _, m := range index.Manifests {
+		name := m.Annotations[AnnotationImageName]
+		if name == desc.Annotations[AnnotationImageName] || name == "" && m.Annotations[AnnotationRefName] == desc.Annotations[AnnotationRefName] {
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	index.Manifests = qualifyRefNames(append(manifests, desc))
+	if buf, err = json.Marshal(index); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0644)
+}
+
+// qualifyRefNames names the manifests by their tag while the images are all
+// of one repository, and by their image name once there are several
+func qualifyRefNames(manifests []Descriptor) []Descriptor {
+	repos := map[string]bool{}
+	for _, m := range manifests {
+		if name := m.Annotations[AnnotationImageName]; name != "" {
+			repo, _ := splitImageName(name)
+			repos[repo] = true
+		}
+	}
+	for _, m := range manifests {
+		name := m.Annotations[AnnotationImageName]
+		if name == "" {
+			continue
+		}
+		if len(repos) > 1 {
+			m.Annotations[AnnotationRefName] = name
+		} else {
+			_, m.Annotations[AnnotationRefName] = splitImageName(name)
+		}
+	}
+	return manifests
+}
+
+// splitImageName splits the fully qualified name of an image into its
+// repository and tag
+func splitImageName(name string) (string, string) {
+	i := strings.LastIndex(name, ":")
+	if i < 0 || i < strings.LastIndex(name, "/") {
+		return name, ""
+	}
+	return name[:i], name[i+1:]
+}
+
+// writeBlob stores the content of r under blobs/sha256/ in the layout dest
+func writeBlob(dest, mediaType string, r io.Reader) (Descriptor, error) {
+	dir := filepath.Join(dest, "blobs", "sha256")
+	fh, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(fh.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(fh, h), r)
+	if err != nil {
+		fh.Close()
+		return Descriptor{}, err
+	}
+	if err := fh.Close(); err != nil {
+		return Descriptor{}, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(fh.Name(), filepath.Join(dir, sum)); err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{MediaType: mediaType, Size: size, Digest: "sha256:" + sum}, nil
+}
+
+// writeBlobFile stores the file filename under blobs/sha256/ in the layout
+// dest, as a reflink of it where the filesystem allows
+func writeBlobFile(dest, mediaType, filename string) (Descriptor, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	h := sha256.New()
+	if err := hashFile(h, filename); err != nil {
+		return Descriptor{}, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	desc := Descriptor{MediaType: mediaType, Size: fi.Size(), Digest: "sha256:" + sum}
+	blob := filepath.Join(dest, "blobs", "sha256", sum)
+	if _, err := os.Stat(blob); err == nil {
+		return desc, nil
+	}
+	if err := copyFile(filename, blob+PartialSuffix); err != nil {
+		os.Remove(blob + PartialSuffix)
+		return Descriptor{}, err
+	}
+	return desc, os.Rename(blob+PartialSuffix, blob)
+}
+
+// ociConfig builds an OCI image config from the legacy json of each layer
+// in ancestry (top-most first), and the diffIDs of the layers (base first)
+func ociConfig(src string, ancestry, diffIDs []string) ([]byte, error) {
+	type legacyJSON struct {
+		Created         time.Time       `json:"created"`
+		Author          string          `json:"author,omitempty"`
+		Architecture    string          `json:"architecture,omitempty"`
+		OS              string          `json:"os,omitempty"`
+		Comment         string          `json:"comment,omitempty"`
+		Config          json.RawMessage `json:"config,omitempty"`
+		ContainerConfig struct {
+			Cmd []string
+		} `json:"container_config"`
+	}
+	type history struct {
+		Created   time.Time `json:"created"`
+		CreatedBy string    `json:"created_by,omitempty"`
+		Author    string    `json:"author,omitempty"`
+		Comment   string    `json:"comment,omitempty"`
+	}
+	config := struct {
+		Created      time.Time       `json:"created"`
+		Author       string          `json:"author,omitempty"`
+		Architecture string          `json:"architecture"`
+		OS           string          `json:"os"`
+		Config       json.RawMessage `json:"config,omitempty"`
+		RootFS       struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []history `json:"history"`
+	}{}
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = diffIDs
+
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		buf, err := ioutil.ReadFile(filepath.Join(src, ancestry[i], "json"))
+		if err != nil {
+			return nil, err
+		}
+		var md legacyJSON
+		if err := json.Unmarshal(buf, &md); err != nil {
+			return nil, err
+		}
+		config.History = append(config.History, history{
+			Created:   md.Created,
+			CreatedBy: strings.Join(md.ContainerConfig.Cmd, " "),
+			Author:    md.Author,
+			Comment:   md.Comment,
+		})
+		if i == 0 {
+			config.Created = md.Created
+			config.Author = md.Author
+			config.Architecture = md.Architecture
+			config.OS = md.OS
+			config.Config = md.Config
+		}
+	}
+	if config.Architecture == "" {
+		config.Architecture = "amd64"
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	return json.Marshal(config)
+}
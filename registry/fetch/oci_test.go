@@ -0,0 +1,116 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchToOCILayout(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		tdir, err := ioutil.TempDir("", "test.oci.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		desc, err := r.FetchToOCILayout(ref, tdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// fetching again must not duplicate the tag in the index
+		if _, err := r.FetchToOCILayout(ref, tdir); err != nil {
+			t.Fatal(err)
+		}
+
+		var index OCIIndex
+		buf, err := ioutil.ReadFile(filepath.Join(tdir, "index.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(buf, &index); err != nil {
+			t.Fatal(err)
+		}
+		if len(index.Manifests) != 1 || index.Manifests[0].Digest != desc.Digest || index.Manifests[0].Annotations[AnnotationRefName] != ref.Tag() {
+			t.Fatalf("%s: unexpected index %s", r.APIVersion(), buf)
+		}
+
+		blob := func(digest string) []byte {
+			buf, err := ioutil.ReadFile(filepath.Join(tdir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digestOf(buf) != digest {
+				t.Errorf("blob %s has digest %s", digest, digestOf(buf))
+			}
+			return buf
+		}
+		var manifest ManifestV2
+		if err := json.Unmarshal(blob(desc.Digest), &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.Layers) != len(testLayers) {
+			t.Fatalf("%s: expected %d layers, got %d", r.APIVersion(), len(testLayers), len(manifest.Layers))
+		}
+		var config struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		if err := json.Unmarshal(blob(manifest.Config.Digest), &config); err != nil {
+			t.Fatal(err)
+		}
+		for i, layer := range manifest.Layers {
+			// testLayers are top-most first, the manifest is base first
+			if string(blob(layer.Digest)) != string(testLayers[len(testLayers)-1-i].Layer) {
+				t.Errorf("%s: unexpected content for layer %d", r.APIVersion(), i)
+			}
+			if config.RootFS.DiffIDs[i] != layer.Digest {
+				t.Errorf("%s: expected diff_id %s, got %s", r.APIVersion(), layer.Digest, config.RootFS.DiffIDs[i])
+			}
+		}
+	}
+}
+
+func TestOCILayoutRepositories(t *testing.T) {
+	busybox, alpine := newTestRegistryV2(t, testLayers...), newTestRegistryV2(t, testLayers[1:]...)
+	dest := t.TempDir()
+	descs := map[string]string{}
+	for _, tr := range []*testRegistry{busybox, alpine} {
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		desc, err := r.FetchToOCILayout(ref, dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs[ref.String()] = desc.Digest
+	}
+	// fetching again replaces the manifest of the same image only
+	r := NewRegistry(busybox.Host())
+	if _, err := r.FetchToOCILayout(busybox.Ref(), dest); err != nil {
+		t.Fatal(err)
+	}
+
+	var index OCIIndex
+	buf, err := ioutil.ReadFile(filepath.Join(dest, "index.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("expected both images of the tag latest, got %s", buf)
+	}
+	for _, m := range index.Manifests {
+		name := m.Annotations[AnnotationRefName]
+		if descs[name] == "" || descs[name] != m.Digest || m.Annotations[AnnotationImageName] != name {
+			t.Errorf("expected the images under their fully qualified names, got %s for %s", name, m.Digest)
+		}
+	}
+}
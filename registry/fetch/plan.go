@@ -0,0 +1,140 @@
+package fetch
+
+import (
+	"context"
+)
+
+// the sources of the layers of a FetchPlan
+const (
+	// PlanDownload is a layer downloaded from the registry
+	PlanDownload = "download"
+	// PlanCache is a layer taken from the Cache of the registry
+	PlanCache = "cache"
+	// PlanDestination is a layer already in the destination, skipped by the
+	// Incremental mode of the registry
+	PlanDestination = "destination"
+)
+
+// PlannedLayer is a layer of a FetchPlan, with where it would come from and
+// the size of its download from the registry, whether it is downloaded or
+// not, for the bytes saved to be in the same units as those downloaded
+type PlannedLayer struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+}
+
+// FetchPlan is what FetchLayers would fetch of an image, and from where,
+// without fetching it
+type FetchPlan struct {
+	Ref    string         `json:"ref"`
+	Layers []PlannedLayer `json:"layers"`
+	// Download, Cached and Present are the bytes downloaded, and those
+	// saved by the layers taken from the cache and already in the
+	// destination
+	Download int64 `json:"download"`
+	Cached   int64 `json:"cached"`
+	Present  int64 `json:"present"`
+}
+
+// add adds l to the layers of p, and its size to the bytes of its source
+func (p *FetchPlan) add(l PlannedLayer) {
+	p.Layers = append(p.Layers, l)
+	switch l.Source {
+	case PlanDownload:
+		p.Download += l.Size
+	case PlanCache:
+		p.Cached += l.Size
+	case PlanDestination:
+		p.Present += l.Size
+	}
+}
+
+// Plan works out what FetchLayers would fetch of img into dest, and how much
+// of it would be taken from the Cache, or skipped for being in dest by the
+// Incremental mode, rather than downloaded, for a sync to be scheduled by the
+// bandwidth it takes. Only the manifest, or the layer jsons on v1
+// registries, are fetched; the size of each layer is found as Size finds
+// it. The image is not vetted.
+func (re *RegistryEndpoint) Plan(img *ImageRef, dest string) (*FetchPlan, error) {
+	return re.PlanContext(context.Background(), img, dest)
+}
+
+// PlanContext is Plan, giving up when ctx is done.
+func (re *RegistryEndpoint) PlanContext(ctx context.Context, img *ImageRef, dest string) (*FetchPlan, error) {
+	return NewFetchPlanner(dest).PlanContext(ctx, re, img)
+}
+
+// FetchPlanner plans the fetches of several images into the same
+// destination, in turn, as a sync fetches them: the layers an image shares
+// with one planned before it are downloaded once, and then found in the Cache
+// or, with the Incremental mode, in the destination.
+type FetchPlanner struct {
+	Dest string
+
+	// downloaded are the IDs of the layers planned to be downloaded
+	downloaded map[string]bool
+}
+
+// NewFetchPlanner returns a FetchPlanner of the fetches into dest
+func NewFetchPlanner(dest string) *FetchPlanner {
+	return &FetchPlanner{Dest: dest, downloaded: map[string]bool{}}
+}
+
+// Plan is the FetchPlan of img, from the registry re, after those planned
+// before
+func (p *FetchPlanner) Plan(re *RegistryEndpoint, img *ImageRef) (*FetchPlan, error) {
+	return p.PlanContext(context.Background(), re, img)
+}
+
+// PlanContext is Plan, giving up when ctx is done.
+func (p *FetchPlanner) PlanContext(ctx context.Context, re *RegistryEndpoint, img *ImageRef) (*FetchPlan, error) {
+	if err := re.resolveAncestry(ctx, img); err != nil {
+		return nil, err
+	}
+	apiV2 := re.APIVersionContext(ctx) == APIVersion2
+	plan := &FetchPlan{Ref: img.String(), Layers: []PlannedLayer{}}
+	for _, id := range img.Ancestry() {
+		size, err := re.layerSize(ctx, img, id)
+		if err != nil {
+			return nil, err
+		}
+		source, err := p.source(re, img, id, apiV2)
+		if err != nil {
+			return nil, err
+		}
+		p.downloaded[id] = true
+		plan.add(PlannedLayer{ID: id, Source: source, Size: size})
+	}
+	return plan, nil
+}
+
+// source is where the layer id of img would come from, the layers planned
+// before being in the destination, or the Cache, by the time img is fetched
+func (p *FetchPlanner) source(re *RegistryEndpoint, img *ImageRef, id string, apiV2 bool) (string, error) {
+	if re.Incremental != "" {
+		if p.downloaded[id] {
+			return PlanDestination, nil
+		}
+		ok, err := haveLayer(p.Dest, id, re.Incremental)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return PlanDestination, nil
+		}
+	}
+	if re.Cache != nil {
+		if p.downloaded[id] {
+			return PlanCache, nil
+		}
+		_, fi, err := re.Cache.lookup(layerCacheKey(img, id, apiV2), img.LayerDigest(id))
+		if err != nil {
+			return "", err
+		}
+		if fi != nil {
+			return PlanCache, nil
+		}
+	}
+	return PlanDownload, nil
+}
@@ -0,0 +1,89 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.plan.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	cache, err := NewLayerCache(filepath.Join(tdir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	var compressed int64
+	for _, l := range manifest.Layers {
+		compressed += l.Size
+	}
+	downloads := func() int {
+		n := 0
+		for _, l := range manifest.Layers {
+			n += tr.Requests["/v2/test/image/blobs/"+l.Digest]
+		}
+		return n
+	}
+
+	r := NewRegistry(tr.Host())
+	r.Cache = cache
+	planner := NewFetchPlanner(filepath.Join(tdir, "image"))
+	plan, err := planner.Plan(&r, tr.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Layers) != len(testLayers) || plan.Download != compressed || plan.Cached != 0 {
+		t.Errorf("expected %d layers and %d bytes to download, got %#v", len(testLayers), compressed, plan)
+	}
+	for _, l := range plan.Layers {
+		if l.Source != PlanDownload {
+			t.Errorf("expected layer %s to be downloaded, got %s", l.ID, l.Source)
+		}
+	}
+	// the same layers again are in the cache by then
+	if plan, err = planner.Plan(&r, tr.Ref()); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Download != 0 || plan.Cached != compressed {
+		t.Errorf("expected the layers planned before to be cached, got %#v", plan)
+	}
+	if downloads() != 0 {
+		t.Errorf("expected no layer to be downloaded while planning, got %d downloads", downloads())
+	}
+
+	if _, err := r.FetchLayers(tr.Ref(), filepath.Join(tdir, "image")); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = r.Plan(tr.Ref(), filepath.Join(tdir, "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bytes saved are those not downloaded, not of the layers as cached
+	if plan.Download != 0 || plan.Cached != compressed {
+		t.Errorf("expected the %d bytes of the cached layers, got %#v", compressed, plan)
+	}
+	for _, l := range plan.Layers {
+		if l.Source != PlanCache {
+			t.Errorf("expected layer %s from the cache, got %s", l.ID, l.Source)
+		}
+	}
+
+	// the layers in the destination are skipped by the incremental mode
+	r.Incremental = IncrementalExists
+	if plan, err = r.Plan(tr.Ref(), filepath.Join(tdir, "image")); err != nil {
+		t.Fatal(err)
+	}
+	if plan.Present != compressed || plan.Cached != 0 || plan.Download != 0 {
+		t.Errorf("expected the layers in the destination, got %#v", plan)
+	}
+}
@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// Platform is what an image of a manifest list, or OCI index, runs on
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// DefaultPlatform is the platform fetched from manifest lists when none is
+// set with ImageRef.SetPlatform: the one this program runs on. Images are
+// nearly all for linux, so on other systems a linux platform is usually
+// wanted instead.
+var DefaultPlatform = Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+
+// ParsePlatform parses a platform like "linux/amd64" or "linux/arm/v7"
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// matches reports whether an image for other runs on p. A platform without
+// a variant takes any variant.
+func (p Platform) matches(other Platform) bool {
+	return p.OS == other.OS && p.Architecture == other.Architecture &&
+		(p.Variant == "" || p.Variant == other.Variant)
+}
+
+// SetPlatform sets the platform whose image is fetched when the reference
+// points at a manifest list
+func (ir *ImageRef) SetPlatform(p Platform) {
+	ir.platform = &p
+}
+
+// Platform is the platform set with SetPlatform, or else DefaultPlatform
+func (ir ImageRef) Platform() Platform {
+	if ir.platform == nil {
+		return DefaultPlatform
+	}
+	return *ir.platform
+}
+
+// selectPlatform picks the manifest for p out of a manifest list
+func selectPlatform(img *ImageRef, list OCIIndex, p Platform) (Descriptor, error) {
+	available := []string{}
+	for _, desc := range list.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if p.matches(*desc.Platform) {
+			return desc, nil
+		}
+		available = append(available, desc.Platform.String())
+	}
+	return Descriptor{}, fmt.Errorf("%s has no image for %s, only for %s", img, p, strings.Join(available, ", "))
+}
@@ -0,0 +1,63 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for s, expected := range map[string]Platform{
+		"linux/amd64":   {OS: "linux", Architecture: "amd64"},
+		"linux/arm/v7":  {OS: "linux", Architecture: "arm", Variant: "v7"},
+		"windows/amd64": {OS: "windows", Architecture: "amd64"},
+	} {
+		p, err := ParsePlatform(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if p != expected || p.String() != s {
+			t.Errorf("%s: expected %#v, got %#v", s, expected, p)
+		}
+	}
+	for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/arm/v7/extra"} {
+		if _, err := ParsePlatform(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestRegistryV2FetchManifestList(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := NewImageRef(tr.Host() + "/test/image:multi")
+	ref.SetPlatform(Platform{OS: "linux", Architecture: "amd64"})
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(testLayers) {
+		t.Fatalf("expected %d layers, got %d", len(testLayers), len(ids))
+	}
+	if ref.Digest() != digestOf(tr.manifestList) {
+		t.Errorf("expected the digest of the manifest list, got %s", ref.Digest())
+	}
+	if digest, err := r.Resolve(NewImageRef(ref.String())); err != nil || digest != ref.Digest() {
+		t.Errorf("expected Resolve to return %s, got %q, %v", ref.Digest(), digest, err)
+	}
+
+	other := NewImageRef(tr.Host() + "/test/image:multi")
+	other.SetPlatform(Platform{OS: "linux", Architecture: "s390x"})
+	_, err = r.FetchLayers(other, tdir)
+	if err == nil || !strings.Contains(err.Error(), "linux/arm/v7") {
+		t.Errorf("expected an error listing the platforms available, got %v", err)
+	}
+}
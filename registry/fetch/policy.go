@@ -0,0 +1,208 @@
+package fetch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Policy governs which images may be fetched. It is usually loaded from a
+// JSON file like:
+//
+//	{
+//	  "allowed_registries": ["docker.io", "*.example.com"],
+//	  "denied_images": ["docker.io/library/*:*-rc*"],
+//	  "require_signature": false,
+//	  "max_size": 2147483648,
+//	  "forbidden_licenses": ["AGPL-3.0"]
+//	}
+//
+// Registry and image patterns are matched with path.Match. Images are matched
+// as "host/name:tag".
+type Policy struct {
+	AllowedRegistries []string `json:"allowed_registries,omitempty"`
+	DeniedRegistries  []string `json:"denied_registries,omitempty"`
+	DeniedImages      []string `json:"denied_images,omitempty"`
+	// RequireSignature refuses the images whose signatures were not
+	// verified, by the Trust policy or ContentTrust of the registry
+	RequireSignature bool `json:"require_signature,omitempty"`
+	// MaxSize is the largest total size of the layers, in bytes
+	MaxSize           int64    `json:"max_size,omitempty"`
+	ForbiddenLicenses []string `json:"forbidden_licenses,omitempty"`
+	// LicenseLabels are the config labels holding the license of an image.
+	// Defaults to DefaultLicenseLabels.
+	LicenseLabels []string `json:"license_labels,omitempty"`
+}
+
+// DefaultLicenseLabels are the labels looked at for an image's license
+var DefaultLicenseLabels = []string{"org.opencontainers.image.licenses", "org.label-schema.license", "license"}
+
+// LoadPolicy reads a Policy from a JSON file
+func LoadPolicy(filename string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return p, nil
+}
+
+// ErrNoSignatureVerifier is returned for the images checked against a Policy
+// with RequireSignature by a registry with neither a Trust policy nor
+// ContentTrust to verify their signatures, which could never be satisfied
+var ErrNoSignatureVerifier = errors.New("require_signature is unsupported without a trust policy or content trust to verify signatures")
+
+// PolicyViolation is a single rule of a Policy that an image breaks
+type PolicyViolation struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// PolicyError is returned when an image violates the Policy
+type PolicyError struct {
+	Ref        string            `json:"ref"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+func (e PolicyError) Error() string {
+	reasons := []string{}
+	for _, v := range e.Violations {
+		reasons = append(reasons, v.Rule+": "+v.Reason)
+	}
+	return fmt.Sprintf("%s violates policy (%s)", e.Ref, strings.Join(reasons, "; "))
+}
+
+// ImageFacts are what the Policy checks an image by, gathered from its
+// metadata before any layers are downloaded
+type ImageFacts struct {
+	// Size is the total size of the layers
+	Size   int64
+	Labels map[string]string
+	// Signed is set when the image's signature has been verified, as
+	// required by a TrustPolicy
+	Signed bool
+}
+
+// layerMetadata is the part of the v1 layer json that is of interest here
+type layerMetadata struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+	Size   int64  `json:"Size"`
+	Config struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// LoadImageFacts gathers the ImageFacts from the layer json files fetched
+// into dir, for the ancestry (top-most first)
+func LoadImageFacts(dir string, ancestry []string) (ImageFacts, error) {
+	facts := ImageFacts{}
+	for i, id := range ancestry {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, id, "json"))
+		if err != nil {
+			return facts, err
+		}
+		if err := facts.add(i, id, buf); err != nil {
+			return facts, err
+		}
+	}
+	return facts, nil
+}
+
+// add adds the json buf of the layer id, the i-th of the ancestry, to the
+// facts
+func (facts *ImageFacts) add(i int, id string, buf []byte) error {
+	md := layerMetadata{}
+	if err := json.Unmarshal(buf, &md); err != nil {
+		return fmt.Errorf("layer %s: %w", id, err)
+	}
+	facts.Size += md.Size
+	if i == 0 {
+		facts.Labels = md.Config.Labels
+	}
+	return nil
+}
+
+// CheckRef checks the rules that only need the reference, so that a denied
+// image is refused before even contacting the registry
+func (p *Policy) CheckRef(img *ImageRef) error {
+	violations := []PolicyViolation{}
+	if len(p.AllowedRegistries) > 0 && !matchAny(p.AllowedRegistries, img.Host()) {
+		violations = append(violations, PolicyViolation{"allowed_registries", fmt.Sprintf("registry %s is not allowed", img.Host())})
+	}
+	if matchAny(p.DeniedRegistries, img.Host()) {
+		violations = append(violations, PolicyViolation{"denied_registries", fmt.Sprintf("registry %s is denied", img.Host())})
+	}
+	if matchAny(p.DeniedImages, img.String()) {
+		violations = append(violations, PolicyViolation{"denied_images", fmt.Sprintf("image %s is denied", img)})
+	}
+	return p.result(img, violations)
+}
+
+// CheckImage checks all of the rules against the reference and the facts
+// gathered about the image
+func (p *Policy) CheckImage(img *ImageRef, facts ImageFacts) error {
+	violations := []PolicyViolation{}
+	if err := p.CheckRef(img); err != nil {
+		violations = append(violations, err.(PolicyError).Violations...)
+	}
+	if p.RequireSignature && !facts.Signed {
+		violations = append(violations, PolicyViolation{"require_signature", "image signature was not verified"})
+	}
+	if p.MaxSize > 0 && facts.Size > p.MaxSize {
+		violations = append(violations, PolicyViolation{"max_size", fmt.Sprintf("size %d exceeds %d", facts.Size, p.MaxSize)})
+	}
+	licenseLabels := p.LicenseLabels
+	if len(licenseLabels) == 0 {
+		licenseLabels = DefaultLicenseLabels
+	}
+	for _, label := range licenseLabels {
+		for _, license := range splitLicenses(facts.Labels[label]) {
+			for _, forbidden := range p.ForbiddenLicenses {
+				if strings.EqualFold(license, forbidden) {
+					violations = append(violations, PolicyViolation{"forbidden_licenses", fmt.Sprintf("license %s (label %s) is forbidden", license, label)})
+				}
+			}
+		}
+	}
+	return p.result(img, violations)
+}
+
+func (p *Policy) result(img *ImageRef, violations []PolicyViolation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return PolicyError{Ref: img.String(), Violations: violations}
+}
+
+// splitLicenses splits an SPDX-ish expression like "MIT OR Apache-2.0" into
+// its licenses
+func splitLicenses(expr string) []string {
+	licenses := []string{}
+	for _, f := range strings.FieldsFunc(expr, func(r rune) bool {
+		return r == ' ' || r == ',' || r == '(' || r == ')'
+	}) {
+		switch strings.ToUpper(f) {
+		case "AND", "OR", "WITH":
+			continue
+		}
+		licenses = append(licenses, f)
+	}
+	return licenses
+}
+
+func matchAny(patterns []string, str string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, str); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package fetch
+
+import (
+	"testing"
+)
+
+func TestPolicyCheckRef(t *testing.T) {
+	p := Policy{
+		AllowedRegistries: []string{"docker.io", "*.example.com"},
+		DeniedImages:      []string{"docker.io/library/*:*-rc*"},
+	}
+	cases := []struct {
+		Ref     string
+		Allowed bool
+	}{
+		{"busybox", true},
+		{"registry.example.com/team/app:1.0", true},
+		{"localhost:5000/fedora", false},
+		{"docker.io/library/golang:1.5-rc1", false},
+	}
+	for _, c := range cases {
+		err := p.CheckRef(NewImageRef(c.Ref))
+		if (err == nil) != c.Allowed {
+			t.Errorf("%s: expected allowed to be %t, got %v", c.Ref, c.Allowed, err)
+		}
+	}
+}
+
+func TestPolicyCheckImage(t *testing.T) {
+	p := Policy{
+		RequireSignature:  true,
+		MaxSize:           1000,
+		ForbiddenLicenses: []string{"AGPL-3.0"},
+	}
+	facts := ImageFacts{
+		Size:   2000,
+		Labels: map[string]string{"org.opencontainers.image.licenses": "MIT OR agpl-3.0"},
+	}
+	err := p.CheckImage(NewImageRef("busybox"), facts)
+	perr, ok := err.(PolicyError)
+	if !ok {
+		t.Fatalf("expected a PolicyError, got %#v", err)
+	}
+	rules := map[string]bool{}
+	for _, v := range perr.Violations {
+		rules[v.Rule] = true
+	}
+	for _, rule := range []string{"require_signature", "max_size", "forbidden_licenses"} {
+		if !rules[rule] {
+			t.Errorf("expected a violation of %s, got %v", rule, perr.Violations)
+		}
+	}
+
+	facts = ImageFacts{Size: 10, Signed: true, Labels: map[string]string{"license": "MIT"}}
+	if err := p.CheckImage(NewImageRef("busybox"), facts); err != nil {
+		t.Errorf("expected no violations, got %s", err)
+	}
+}
@@ -0,0 +1,31 @@
+package fetch
+
+// ProgressFunc is told how far the download of the layer layerID has got:
+// written bytes of total, where total is -1 when the registry does not say.
+// A resumed download starts at the bytes already there, and a layer taken
+// from a LayerCache is reported once, complete. It is called from the
+// goroutine downloading the layer, so from several goroutines at once when
+// layers are downloaded in parallel.
+type ProgressFunc func(layerID string, written, total int64)
+
+// layerProgress is the Progress of the layer id, or nil
+func (re *RegistryEndpoint) layerProgress(id string) func(written, total int64) {
+	if re.Progress == nil {
+		return nil
+	}
+	return func(written, total int64) {
+		re.Progress(id, written, total)
+	}
+}
+
+// progressWriter reports the bytes written through it to fn
+type progressWriter struct {
+	fn             func(written, total int64)
+	written, total int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.written += int64(len(p))
+	pw.fn(pw.written, pw.total)
+	return len(p), nil
+}
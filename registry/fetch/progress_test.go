@@ -0,0 +1,48 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestRegistryFetchLayersProgress(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	var (
+		mu       sync.Mutex
+		reported = map[string][2]int64{}
+	)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Parallelism = 2
+	r.Progress = func(id string, written, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		if last := reported[id]; written < last[0] {
+			t.Errorf("layer %s: progress went back from %d to %d bytes", id, last[0], written)
+		}
+		reported[id] = [2]int64{written, total}
+	}
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		size := manifest.Layers[len(manifest.Layers)-1-i].Size
+		if reported[id] != [2]int64{size, size} {
+			t.Errorf("layer %d: expected %d of %d bytes reported, got %v", i, size, size, reported[id])
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/vbatts/docker-utils/attest"
+)
+
+// Cosign-style attestations: the attestations of the manifest sha256:<hex>
+// are the layers of the manifest tagged sha256-<hex>.att in the same
+// repository, each a DSSE envelope of an in-toto statement
+const (
+	MediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+)
+
+// checkProvenance checks img against the Provenance policy: one of the
+// attestations of its manifest list, or of the manifest of the platform
+// fetched, must be a SLSA provenance signed by one of its keys, by one of its
+// trusted builders. The provenance verified is kept on img.
+func (re *RegistryEndpoint) checkProvenance(ctx context.Context, img *ImageRef) error {
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return fmt.Errorf("%s: %w", img, attest.ProvenanceError{Reason: "images of v1 registries have no attestations"})
+	}
+	v2, err := re.v2Resolve(ctx, img)
+	if err != nil {
+		return err
+	}
+	digests := []string{img.Digest()}
+	if v2.manifestDigest != img.Digest() {
+		digests = append(digests, v2.manifestDigest)
+	}
+	var refused error = attest.ProvenanceError{Reason: "no provenance attestation"}
+	for _, digest := range digests {
+		prov, err := re.verifyProvenance(ctx, img, digest)
+		if err != nil {
+			if _, ok := err.(attest.ProvenanceError); !ok {
+				return err
+			}
+			refused = err
+			continue
+		}
+		if prov != nil {
+			img.provenance = prov
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %w", img, refused)
+}
+
+// verifyProvenance returns the first of the attestations of the manifest
+// digest of img that verifies against the Provenance policy, nil if it has
+// none, or the attest.ProvenanceError of the last that does not verify
+func (re *RegistryEndpoint) verifyProvenance(ctx context.Context, img *ImageRef, digest string) (*attest.Provenance, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, nil
+	}
+	buf, _, _, err := re.v2Manifest(ctx, img, "sha256-"+strings.TrimPrefix(digest, "sha256:")+".att")
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m ManifestV2
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("%s: attestations of %s: %w", img, digest, err)
+	}
+	var refused error
+	for _, layer := range m.Layers {
+		if layer.MediaType != MediaTypeDSSE {
+			continue
+		}
+		envelope, err := re.v2Blob(ctx, img, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if digestOf(envelope) != layer.Digest {
+			return nil, fmt.Errorf("%s: attestation %s has digest %s", img, layer.Digest, digestOf(envelope))
+		}
+		prov, err := attest.VerifyProvenance(envelope, *re.Provenance, digest)
+		if err != nil {
+			refused = err
+			continue
+		}
+		return prov, nil
+	}
+	return nil, refused
+}
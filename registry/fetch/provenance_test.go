@@ -0,0 +1,123 @@
+package fetch
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vbatts/docker-utils/attest"
+)
+
+// attestTestImage serves a cosign-style attestation of the manifest digest of
+// the image of tr: a SLSA provenance by builder, signed by key
+func attestTestImage(t *testing.T, tr *testRegistry, digest, builder string, key *ecdsa.PrivateKey) {
+	payload, err := json.Marshal(attest.Statement{
+		Type:          "https://in-toto.io/Statement/v0.1",
+		Subject:       []attest.Subject{{Name: tr.Host() + "/test/image", Digest: map[string]string{"sha256": strings.TrimPrefix(digest, "sha256:")}}},
+		PredicateType: "https://slsa.dev/provenance/v0.2",
+		Predicate:     json.RawMessage(`{"builder":{"id":"` + builder + `"},"buildType":"https://example.com/build@v1"}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(attest.PAE(attest.InTotoPayloadType, payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := json.Marshal(attest.Envelope{
+		PayloadType: attest.InTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []attest.Signature{{KeyID: "ci", Sig: base64.StdEncoding.EncodeToString(sig)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := json.Marshal(ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{MediaType: MediaTypeImageConfig, Size: 2, Digest: digestOf([]byte("{}"))},
+		Layers:        []Descriptor{{MediaType: MediaTypeDSSE, Size: int64(len(envelope)), Digest: digestOf(envelope)}},
+	})
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.blobs[digestOf(envelope)] = envelope
+	tr.Pushed["test/image:sha256-"+strings.TrimPrefix(digest, "sha256:")+".att"] = m
+}
+
+func TestRegistryFetchProvenance(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := &attest.ProvenancePolicy{
+		Keys:            attest.Keys{"ci": &key.PublicKey},
+		TrustedBuilders: []string{"https://github.com/*/runner"},
+	}
+	fetch := func() (*ImageRef, error) {
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		r.Provenance = policy
+		_, err := r.FetchLayers(ref, t.TempDir())
+		return ref, err
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	layers := func() int {
+		n := 0
+		for _, l := range manifest.Layers {
+			n += tr.Requests["/v2/test/image/blobs/"+l.Digest]
+		}
+		return n
+	}
+
+	var perr attest.ProvenanceError
+	if _, err := fetch(); !errors.As(err, &perr) {
+		t.Errorf("expected the image without attestations to be refused, got %v", err)
+	}
+	if layers() != 0 {
+		t.Errorf("expected no layer of a refused image to be fetched")
+	}
+
+	digest := digestOf(tr.manifest)
+	attestTestImage(t, tr, digest, "https://github.com/actions/runner", other)
+	if _, err := fetch(); !errors.As(err, &perr) {
+		t.Errorf("expected the image attested by another key to be refused, got %v", err)
+	}
+	attestTestImage(t, tr, digest, "https://ci.example.com/builder", key)
+	if _, err := fetch(); !errors.As(err, &perr) || !strings.Contains(err.Error(), "not trusted") {
+		t.Errorf("expected the image of an untrusted builder to be refused, got %v", err)
+	}
+
+	attestTestImage(t, tr, digest, "https://github.com/actions/runner", key)
+	ref, err := fetch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov := ref.Provenance(); prov == nil || prov.BuilderID != "https://github.com/actions/runner" || prov.KeyID != "ci" {
+		t.Errorf("expected the provenance of the image, got %#v", prov)
+	}
+
+	r := NewRegistry(tr.Host())
+	r.Provenance = policy
+	inspect, err := r.Inspect(tr.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.Provenance == nil || inspect.Provenance.BuilderID != "https://github.com/actions/runner" {
+		t.Errorf("expected the provenance in the inspect, got %#v", inspect.Provenance)
+	}
+}
@@ -0,0 +1,357 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// PushImage pushes img, already fetched into src with FetchLayers, to the
+// repository of dest on this registry, under the tag of dest. The image is
+// pushed as it would be written by WriteOCILayout: an OCI manifest with
+// uncompressed layers, unless a PushCompression is set. See PushOCILayout.
+func (re *RegistryEndpoint) PushImage(img *ImageRef, src string, dest *ImageRef) (Descriptor, error) {
+	return re.PushImageContext(context.Background(), img, src, dest)
+}
+
+// PushImageContext is PushImage, giving up when ctx is done.
+func (re *RegistryEndpoint) PushImageContext(ctx context.Context, img *ImageRef, src string, dest *ImageRef) (Descriptor, error) {
+	tmp, err := ioutil.TempDir("", "docker-fetch-push-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.RemoveAll(tmp)
+	desc, err := WriteOCILayout(img, src, tmp)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return re.pushLayoutManifest(ctx, tmp, desc, dest)
+}
+
+// PushOCILayout pushes the image tagged with the tag of dest in the OCI image
+// layout src (or the only image there) to the repository of dest on this
+// registry, which must speak the v2 API. The blobs the registry already has
+// are skipped, the others are uploaded (in chunks of PushChunkSize if set,
+// and the uncompressed layers compressed with PushCompression if set), and the
+// manifest is put last, under the tag of dest, or under its digest if dest
+// is pinned without a tag. The descriptor of the manifest pushed is returned.
+func (re *RegistryEndpoint) PushOCILayout(src string, dest *ImageRef) (Descriptor, error) {
+	return re.PushOCILayoutContext(context.Background(), src, dest)
+}
+
+// PushOCILayoutContext is PushOCILayout, giving up when ctx is done.
+func (re *RegistryEndpoint) PushOCILayoutContext(ctx context.Context, src string, dest *ImageRef) (Descriptor, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(src, "index.json"))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return Descriptor{}, err
+	}
+	for _, desc := range index.Manifests {
+		if dest.Pinned() && desc.Digest == dest.Digest() ||
+			!dest.Pinned() && desc.Annotations[AnnotationRefName] == dest.Tag() ||
+			len(index.Manifests) == 1 {
+			return re.pushLayoutManifest(ctx, src, desc, dest)
+		}
+	}
+	return Descriptor{}, fmt.Errorf("%s: no image for %s", src, dest)
+}
+
+// pushLayoutManifest pushes the blobs of the manifest desc in the OCI image
+// layout src, then the manifest, to dest
+func (re *RegistryEndpoint) pushLayoutManifest(ctx context.Context, src string, desc Descriptor, dest *ImageRef) (Descriptor, error) {
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return Descriptor{}, fmt.Errorf("%s: pushing needs a v2 registry", re.Host)
+	}
+	buf, err := ioutil.ReadFile(layoutBlob(src, desc.Digest))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return Descriptor{}, err
+	}
+	if manifest.SchemaVersion != 2 {
+		return Descriptor{}, fmt.Errorf("%s: unsupported manifest schema version %d", src, manifest.SchemaVersion)
+	}
+	// the layers compressed are kept apart, to leave src as it is
+	blobs := src
+	if re.PushCompression.Algorithm != "" {
+		tmp, err := ioutil.TempDir("", "docker-fetch-compress-")
+		if err != nil {
+			return Descriptor{}, err
+		}
+		defer os.RemoveAll(tmp)
+		if buf, err = re.compressLayers(&manifest, src, tmp); err != nil {
+			return Descriptor{}, err
+		}
+		desc.Digest = digestOf(buf)
+		blobs = tmp
+	}
+	if dest.Pinned() && desc.Digest != dest.Digest() {
+		return Descriptor{}, fmt.Errorf("%s: manifest has digest %s", dest, desc.Digest)
+	}
+	if err := re.pushBlobs(ctx, dest, append(manifest.Layers, manifest.Config), func(blob Descriptor) func(offset, size int64) *requestBody {
+		filename := layoutBlob(src, blob.Digest)
+		if _, err := os.Stat(layoutBlob(blobs, blob.Digest)); err == nil {
+			filename = layoutBlob(blobs, blob.Digest)
+		}
+		return func(offset, size int64) *requestBody {
+			return fileBody(filename, offset, size)
+		}
+	}); err != nil {
+		return Descriptor{}, err
+	}
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	return re.pushManifest(ctx, dest, mediaType, buf)
+}
+
+// compressLayers compresses the uncompressed layers of manifest, in the OCI
+// image layout src, with the PushCompression, into the layout dest, and
+// returns the manifest with the compressed layers
+func (re *RegistryEndpoint) compressLayers(manifest *ManifestV2, src, dest string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Join(dest, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	for i, layer := range manifest.Layers {
+		if layer.MediaType != MediaTypeOCILayer {
+			continue
+		}
+		compressed, err := re.PushCompression.compressBlob(layoutBlob(src, layer.Digest), dest)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer.Digest, err)
+		}
+		compressed.Annotations = layer.Annotations
+		logrus.Debugf("compressed layer %s with %s, %d bytes to %d", layer.Digest, re.PushCompression, layer.Size, compressed.Size)
+		manifest.Layers[i] = compressed
+	}
+	return json.Marshal(manifest)
+}
+
+// pushManifest puts the manifest buf to dest, once its blobs are pushed
+func (re *RegistryEndpoint) pushManifest(ctx context.Context, dest *ImageRef, mediaType string, buf []byte) (Descriptor, error) {
+	reference := dest.Tag()
+	if dest.Pinned() && !dest.hasTag() {
+		reference = dest.Digest()
+	}
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/manifests/%s", re.v2Name(dest), reference))
+	resp, err := re.v2DoBody(ctx, re.v2PushScope(dest), "PUT", urlStr, http.Header{"Content-Type": {mediaType}}, bytesBody(buf))
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return Descriptor{}, newResponseError(urlStr, resp)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != digestOf(buf) {
+		return Descriptor{}, fmt.Errorf("%s: registry has the manifest as %s, not %s", dest, digest, digestOf(buf))
+	}
+	return Descriptor{MediaType: mediaType, Size: int64(len(buf)), Digest: digestOf(buf)}, nil
+}
+
+// layoutBlob is where the blob digest is in the OCI image layout src
+func layoutBlob(src, digest string) string {
+	return filepath.Join(src, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// v2PushScope is the token scope for pushing to the repository of img
+func (re *RegistryEndpoint) v2PushScope(img *ImageRef) string {
+	return fmt.Sprintf("repository:%s:pull,push", re.v2Name(img))
+}
+
+// pushBlobs pushes blobs to the repository of dest, PushParallelism at a
+// time, content giving the content of each like for pushBlob. On the first
+// failure the uploads in flight are canceled, no more are started, and that
+// failure is returned.
+func (re *RegistryEndpoint) pushBlobs(ctx context.Context, dest *ImageRef, blobs []Descriptor, content func(blob Descriptor) func(offset, size int64) *requestBody) error {
+	workers := re.PushParallelism
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(blobs) {
+		workers = len(blobs)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+		todo = make(chan Descriptor)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range todo {
+				if err := re.pushBlob(ctx, dest, blob, content(blob)); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+dispatch:
+	for _, blob := range blobs {
+		select {
+		case todo <- blob:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(todo)
+	wg.Wait()
+
+	if len(errs) > 0 {
+		// the first, not those of the uploads it canceled
+		return errs[0]
+	}
+	return ctx.Err()
+}
+
+// pushBlob uploads the blob desc to the repository of dest, unless the
+// registry has it already. content gives the size bytes of the blob from
+// offset, as the body of an upload request.
+func (re *RegistryEndpoint) pushBlob(ctx context.Context, dest *ImageRef, desc Descriptor, content func(offset, size int64) *requestBody) error {
+	if re.PushThrottle != nil {
+		unthrottled := content
+		content = func(offset, size int64) *requestBody {
+			return re.PushThrottle.requestBody(unthrottled(offset, size))
+		}
+	}
+	scope := re.v2PushScope(dest)
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(dest), desc.Digest))
+	resp, err := re.v2DoScope(ctx, scope, "HEAD", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		logrus.Debugf("%s: the registry has %s already", dest, desc.Digest)
+		return nil
+	case http.StatusNotFound:
+	default:
+		return newResponseError(urlStr, resp)
+	}
+
+	urlStr = re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/uploads/", re.v2Name(dest)))
+	resp, err = re.v2DoScope(ctx, scope, "POST", urlStr, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return newResponseError(urlStr, resp)
+	}
+	if urlStr, err = uploadURL(urlStr, resp.Header.Get("Location"), ""); err != nil {
+		return err
+	}
+
+	// the content goes with the PUT closing the upload, unless it is sent
+	// in chunks first
+	var body *requestBody
+	if re.PushChunkSize <= 0 || desc.Size <= re.PushChunkSize {
+		body = content(0, desc.Size)
+	} else {
+		for offset := int64(0); offset < desc.Size; offset += re.PushChunkSize {
+			n := re.PushChunkSize
+			if offset+n > desc.Size {
+				n = desc.Size - offset
+			}
+			resp, err := re.v2DoBody(ctx, scope, "PATCH", urlStr, http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+n-1)},
+			}, content(offset, n))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusAccepted {
+				return newResponseError(urlStr, resp)
+			}
+			if urlStr, err = uploadURL(urlStr, resp.Header.Get("Location"), ""); err != nil {
+				return err
+			}
+		}
+	}
+	putURL, err := uploadURL(urlStr, urlStr, desc.Digest)
+	if err != nil {
+		return err
+	}
+	resp, err = re.v2DoBody(ctx, scope, "PUT", putURL, http.Header{"Content-Type": {"application/octet-stream"}}, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newResponseError(putURL, resp)
+	}
+	return nil
+}
+
+// uploadURL resolves the Location of an upload, given in the response to a
+// request for urlStr, adding the digest to it if set
+func uploadURL(urlStr, location, digest string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("%s: no upload location given", urlStr)
+	}
+	base, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	u := base.ResolveReference(loc)
+	if digest != "" {
+		q := u.Query()
+		q.Set("digest", digest)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// fileBody is the size bytes of filename from offset, as a request body
+func fileBody(filename string, offset, size int64) *requestBody {
+	if size == 0 {
+		return nil
+	}
+	return &requestBody{size: size, open: func() (io.ReadCloser, error) {
+		fh, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.NewSectionReader(fh, offset, size), fh}, nil
+	}}
+}
+
+// bytesBody is buf as a request body
+func bytesBody(buf []byte) *requestBody {
+	return &requestBody{size: int64(len(buf)), open: func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}}
+}
@@ -0,0 +1,150 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegistryPushImage(t *testing.T) {
+	src := newTestRegistryV2(t, testLayers...)
+	dst := newTestRegistryV2(t)
+	tdir, err := ioutil.TempDir("", "test.push.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := src.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, filepath.Join(tdir, "src")); err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks smaller than the layers, to push them in several, and several
+	// blobs at once
+	dest := NewImageRef(dst.Host() + "/test/copy:v1")
+	pr := NewRegistry(dest.Host())
+	pr.PushChunkSize = 5
+	pr.PushParallelism = 3
+	pr.PushThrottle = NewThrottle(1 << 20)
+	desc, err := pr.PushImage(ref, filepath.Join(tdir, "src"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed := dst.Pushed["test/copy:v1"]; pushed == nil || digestOf(pushed) != desc.Digest {
+		t.Fatalf("expected the manifest %s pushed, got %q", desc.Digest, pushed)
+	}
+
+	// the image pushed is the image fetched
+	copied := NewImageRef(dest.String())
+	cr := NewRegistry(copied.Host())
+	if _, err := cr.FetchLayers(copied, filepath.Join(tdir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(copied.Ancestry(), ",") != strings.Join(ref.Ancestry(), ",") {
+		t.Errorf("expected the layers %v, got %v", ref.Ancestry(), copied.Ancestry())
+	}
+	for i, id := range copied.Ancestry() {
+		buf, err := ioutil.ReadFile(filepath.Join(tdir, "copy", id, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("%s: expected the layer %q, got %q", id, testLayers[i].Layer, buf)
+		}
+	}
+
+	// pushing from a layout again uploads nothing
+	if _, err := WriteOCILayout(ref, filepath.Join(tdir, "src"), filepath.Join(tdir, "layout")); err != nil {
+		t.Fatal(err)
+	}
+	uploads := dst.Requests["/v2/test/copy/blobs/uploads/"]
+	if _, err := pr.PushOCILayout(filepath.Join(tdir, "layout"), NewImageRef(dst.Host()+"/test/copy:v2")); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Requests["/v2/test/copy/blobs/uploads/"] != uploads {
+		t.Errorf("expected no more uploads, got %d", dst.Requests["/v2/test/copy/blobs/uploads/"]-uploads)
+	}
+	if string(dst.Pushed["test/copy:v2"]) != string(dst.Pushed["test/copy:v1"]) {
+		t.Errorf("expected the same manifest pushed as v2")
+	}
+}
+
+func TestRegistryPushCompression(t *testing.T) {
+	src := newTestRegistryV2(t, testLayers...)
+	dst := newTestRegistryV2(t)
+	tdir, err := ioutil.TempDir("", "test.push.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := src.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, filepath.Join(tdir, "src")); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := NewImageRef(dst.Host() + "/test/copy:gzip")
+	pr := NewRegistry(dest.Host())
+	if pr.PushCompression, err = ParseCompression("gzip:1"); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := pr.PushImage(ref, filepath.Join(tdir, "src"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ManifestV2
+	if err := json.Unmarshal(dst.Pushed["test/copy:gzip"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if digestOf(dst.Pushed["test/copy:gzip"]) != desc.Digest {
+		t.Errorf("expected the manifest pushed to have the digest %s", desc.Digest)
+	}
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != MediaTypeOCILayerGzip {
+			t.Errorf("%s: expected a gzip layer, got %s", layer.Digest, layer.MediaType)
+		}
+	}
+
+	// the layers fetched back are those pushed, uncompressed
+	copied := NewImageRef(dest.String())
+	cr := NewRegistry(copied.Host())
+	if _, err := cr.FetchLayers(copied, filepath.Join(tdir, "copy")); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range copied.Ancestry() {
+		buf, err := ioutil.ReadFile(filepath.Join(tdir, "copy", id, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("%s: expected the layer %q, got %q", id, testLayers[i].Layer, buf)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for s, expected := range map[string]Compression{
+		"none":    {},
+		"gzip":    {Algorithm: CompressionGzip},
+		"gzip:1":  {Algorithm: CompressionGzip, Level: 1},
+		"zstd:19": {Algorithm: CompressionZstd, Level: 19},
+	} {
+		c, err := ParseCompression(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if c != expected {
+			t.Errorf("%s: expected %#v, got %#v", s, expected, c)
+		}
+	}
+	for _, s := range []string{"", "xz", "gzip:0", "gzip:10", "zstd:20", "none:1", "gzip:fast"} {
+		if _, err := ParseCompression(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package fetch
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ErrRateLimited is returned when a registry refuses a request with a 429,
+// like the Docker Hub does past its pull rate limit. See
+// RetryPolicy.MaxRetryAfter for waiting such limits out.
+type ErrRateLimited struct {
+	Host string
+	// RetryAfter is how long the registry asked to wait, or 0 if it did not
+	// say
+	RetryAfter time.Duration
+	// Remaining is the RateLimit-Remaining header of the response, if any,
+	// like "0;w=21600"
+	Remaining string
+}
+
+func (e ErrRateLimited) Error() string {
+	msg := fmt.Sprintf("rate limited by %s", e.Host)
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	if e.Remaining != "" {
+		msg += fmt.Sprintf(" (remaining %s)", e.Remaining)
+	}
+	return msg
+}
+
+// rateLimited is the ErrRateLimited of resp, a 429 from host
+func rateLimited(host string, resp *http.Response) *ErrRateLimited {
+	e := &ErrRateLimited{
+		Host:       host,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		Remaining:  resp.Header.Get("RateLimit-Remaining"),
+	}
+	logrus.Debugf("%s", e)
+	return e
+}
+
+// parseRetryAfter is the wait asked for by a Retry-After header, given in
+// seconds or as an HTTP date, from now
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(header)
+	if err != nil || !t.After(now) {
+		return 0
+	}
+	return t.Sub(now)
+}
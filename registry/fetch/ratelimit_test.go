@@ -0,0 +1,86 @@
+package fetch
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for header, expected := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-1":                            0,
+		"Wed, 01 Jan 2020 12:00:30 GMT": 30 * time.Second,
+		"Wed, 01 Jan 2020 11:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if d := parseRetryAfter(header, now); d != expected {
+			t.Errorf("%q: expected %s, got %s", header, expected, d)
+		}
+	}
+}
+
+func TestRegistryRateLimited(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	var (
+		mu      sync.Mutex
+		limited int
+	)
+	// a registry rate limiting the manifest requests, limited times
+	hub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		limit := strings.Contains(r.URL.Path, "/manifests/") && limited > 0
+		if limit {
+			limited--
+		}
+		mu.Unlock()
+		if !limit {
+			tr.serve(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		w.Header().Set("RateLimit-Remaining", "0;w=21600")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	}))
+	defer hub.Close()
+	ref := NewImageRef(strings.TrimPrefix(hub.URL, "https://") + "/test/image")
+
+	limited = 1
+	r := NewRegistry(ref.Host())
+	_, err := r.Resolve(NewImageRef(ref.String()))
+	var rl ErrRateLimited
+	if !errors.As(err, &rl) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if rl.RetryAfter != time.Second || rl.Remaining != "0;w=21600" {
+		t.Errorf("expected to retry after 1s with 0 remaining, got %s and %q", rl.RetryAfter, rl.Remaining)
+	}
+
+	// a Retry-After longer than MaxRetryAfter is not waited for
+	limited = 2
+	r = NewRegistry(ref.Host())
+	r.Retry = NewRetryPolicy(3, time.Millisecond, time.Millisecond)
+	if _, err := r.Resolve(NewImageRef(ref.String())); !errors.As(err, &rl) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	if limited != 1 {
+		t.Errorf("expected a single attempt, got %d", 2-limited)
+	}
+
+	// and one within it is
+	limited = 1
+	r.Retry.MaxRetryAfter = 2 * time.Second
+	start := time.Now()
+	if _, err := r.Resolve(NewImageRef(ref.String())); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < time.Second {
+		t.Errorf("expected to wait the second asked for, waited %s", time.Since(start))
+	}
+}
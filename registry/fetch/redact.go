@@ -0,0 +1,149 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// RedactedText replaces what a Redaction removes
+var RedactedText = "[redacted]"
+
+// RedactionRule replaces the matches of Pattern with Replacement, which is
+// expanded like with regexp.ReplaceAllString
+type RedactionRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// DefaultRedactionRules redact the credentials of URLs (like those of
+// proxies), and the values of build args and environment variables named
+// like passwords, secrets, tokens, keys and proxies
+var DefaultRedactionRules = []RedactionRule{
+	{regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`), "${1}" + RedactedText + "@"},
+	{regexp.MustCompile(`(?i)\b([a-z0-9_]*(?:password|passwd|secret|token|key|proxy)[a-z0-9_]*)=(?:"[^"]*"|'[^']*'|\S+)`), "${1}=" + RedactedText},
+}
+
+// Redaction removes sensitive values from the history of an image when it
+// is written out again: build args echoed into the created_by of history
+// entries, proxy URLs and the like. The config, and so its digest and the
+// image ID, changes accordingly.
+type Redaction struct {
+	Rules []RedactionRule
+	// Strip drops the created_by and comment of every history entry
+	// altogether
+	Strip bool
+}
+
+// NewRedaction returns a Redaction with the DefaultRedactionRules and
+// patterns, each of which is replaced with RedactedText
+func NewRedaction(patterns ...string) (*Redaction, error) {
+	r := &Redaction{Rules: append([]RedactionRule{}, DefaultRedactionRules...)}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.Rules = append(r.Rules, RedactionRule{Pattern: re, Replacement: RedactedText})
+	}
+	return r, nil
+}
+
+// SetRedaction sets the Redaction applied to the history of the image when
+// it is written out again
+func (ir *ImageRef) SetRedaction(r *Redaction) {
+	ir.redaction = r
+}
+
+// Redaction is the Redaction set with SetRedaction, if any
+func (ir ImageRef) Redaction() *Redaction {
+	return ir.redaction
+}
+
+// RedactLayerJSON rewrites the json of each layer of img fetched into src
+// with its Redaction, for when the fetched layers are exported as they are
+func RedactLayerJSON(img *ImageRef, src string) error {
+	if img.Redaction() == nil {
+		return nil
+	}
+	for _, id := range img.Ancestry() {
+		filename := filepath.Join(src, id, "json")
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if buf, err = img.Redaction().apply(buf); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, buf, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Redaction) redact(s string) string {
+	for _, rule := range r.Rules {
+		s = rule.Pattern.ReplaceAllString(s, rule.Replacement)
+	}
+	return s
+}
+
+// apply redacts the history of an image config, or the command of the
+// container_config of a legacy layer json, keeping the rest as it is
+func (r *Redaction) apply(config []byte) ([]byte, error) {
+	if r == nil {
+		return config, nil
+	}
+	var image map[string]json.RawMessage
+	if err := json.Unmarshal(config, &image); err != nil {
+		return nil, err
+	}
+	if buf, ok := image["history"]; ok && string(buf) != "null" {
+		var history []map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &history); err != nil {
+			return nil, err
+		}
+		for _, entry := range history {
+			for _, key := range []string{"created_by", "comment"} {
+				var s string
+				if buf, ok := entry[key]; !ok || json.Unmarshal(buf, &s) != nil {
+					continue
+				}
+				if r.Strip {
+					delete(entry, key)
+					continue
+				}
+				entry[key], _ = json.Marshal(r.redact(s))
+			}
+		}
+		var err error
+		if image["history"], err = json.Marshal(history); err != nil {
+			return nil, err
+		}
+	}
+	if buf, ok := image["container_config"]; ok && string(buf) != "null" {
+		var cc map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &cc); err != nil {
+			return nil, err
+		}
+		var cmd []string
+		if buf, ok := cc["Cmd"]; ok && json.Unmarshal(buf, &cmd) == nil && cmd != nil {
+			if r.Strip {
+				cmd = []string{}
+			}
+			for i := range cmd {
+				cmd[i] = r.redact(cmd[i])
+			}
+			var err error
+			if cc["Cmd"], err = json.Marshal(cmd); err != nil {
+				return nil, err
+			}
+			if image["container_config"], err = json.Marshal(cc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(image)
+}
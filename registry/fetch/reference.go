@@ -0,0 +1,297 @@
+package fetch
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/vbatts/docker-utils/attest"
+	"github.com/vbatts/docker-utils/export"
+)
+
+// NewImageRef returns a reference to the image name, like "busybox",
+// "fedora:22", "localhost:5000/vbatts/slackware:latest" or
+// "[::1]:5000/vbatts/slackware". The name may be
+// pinned to the digest of a manifest, like "busybox@sha256:..." or
+// "busybox:1.36@sha256:...", in which case that content is fetched whatever
+// the tag points to. Names that are not valid references are taken as they
+// are, to fail when the registry is asked for them; ParseImageRef reports
+// them instead.
+func NewImageRef(name string) *ImageRef {
+	ir, _ := ParseImageRef(name)
+	return ir
+}
+
+// ParseImageRef is NewImageRef, returning an error for a name that is not a
+// valid reference, by the grammar of docker/distribution: a registry host
+// (with a dot or a port, "localhost", or an IPv6 address in brackets, all
+// with an optional port), path components of lowercase
+// letters and digits joined by ".", "_", "__" or dashes, a tag of up to 128
+// letters, digits, "_", "." and "-", and a digest of an algorithm and at
+// least 32 hex digits. Names on the Docker Hub are in the "library/"
+// namespace when given without one, so "busybox" is
+// "docker.io/library/busybox:latest". The invalid reference is still
+// returned, as NewImageRef returns it.
+func ParseImageRef(name string) (*ImageRef, error) {
+	ir := &ImageRef{orig: name}
+	rest := name
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		rest, ir.digest, ir.pinned = rest[:i], rest[i+1:], true
+	}
+	emptyTag := false
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		rest, ir.tag = rest[:i], rest[i+1:]
+		emptyTag = ir.tag == ""
+	}
+	ir.host, ir.name = DefaultHubNamespace, rest
+	if i := strings.Index(rest, "/"); i >= 0 {
+		if first := rest[:i]; isRegistryHost(first) {
+			ir.host, ir.name, ir.qualified = first, rest[i+1:], true
+		}
+	}
+	if ir.host == DefaultRegistryHost {
+		ir.host = DefaultHubNamespace
+	}
+	if ir.host == DefaultHubNamespace && ir.name != "" && !strings.Contains(ir.name, "/") {
+		ir.name = "library/" + ir.name
+	}
+	if emptyTag {
+		return ir, fmt.Errorf("invalid reference %q: empty tag", name)
+	}
+	return ir, ir.validate()
+}
+
+// isRegistryHost reports whether first, the first component of a reference,
+// is the host of a registry rather than part of a name on the Docker Hub
+func isRegistryHost(first string) bool {
+	return strings.ContainsAny(first, ".:") || first == "localhost" || strings.ToLower(first) != first
+}
+
+var (
+	referenceHost    = regexp.MustCompile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(\.([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[([a-fA-F0-9:.]+)\])(:[0-9]+)?$`)
+	referencePath    = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+	referenceTag     = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	referenceDigest  = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*([-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+	maxReferenceName = 255
+)
+
+// validate checks the parts of the reference against the grammar
+func (ir ImageRef) validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("invalid reference %q: %s", ir.orig, fmt.Sprintf(format, args...))
+	}
+	if ir.name == "" {
+		return invalid("no repository name")
+	}
+	m := referenceHost.FindStringSubmatch(ir.host)
+	if m == nil {
+		return invalid("invalid registry host %q", ir.host)
+	}
+	if ip := m[5]; ip != "" && (net.ParseIP(ip) == nil || !strings.Contains(ip, ":")) {
+		return invalid("invalid IPv6 address %q", ip)
+	}
+	for _, component := range strings.Split(ir.name, "/") {
+		if !referencePath.MatchString(component) {
+			return invalid("invalid repository name component %q", component)
+		}
+	}
+	if len(ir.host)+1+len(ir.name) > maxReferenceName {
+		return invalid("name longer than %d characters", maxReferenceName)
+	}
+	if ir.tag != "" && !referenceTag.MatchString(ir.tag) {
+		return invalid("invalid tag %q", ir.tag)
+	}
+	if ir.pinned && !referenceDigest.MatchString(ir.digest) {
+		return invalid("invalid digest %q", ir.digest)
+	}
+	return nil
+}
+
+type ImageRef struct {
+	// orig is the reference as given, and host, name and tag its parts;
+	// tag is empty when none was given
+	orig   string
+	host   string
+	name   string
+	tag    string
+	digest string
+	// pinned is set when the digest was given in the reference, rather
+	// than resolved from the tag
+	pinned bool
+	// qualified is set when the registry host was given in the reference
+	qualified bool
+	// signed is set once the signatures the Trust policy requires, or
+	// those of ContentTrust, are verified
+	signed   bool
+	id       string
+	ancestry []string
+	timings  *Timings
+	scan     *ScanResult
+	v2       *v2Image
+	// trustedDigest is the digest signed for the tag, once verified by
+	// ContentTrust
+	trustedDigest string
+	// provenance is the SLSA provenance verified by the Provenance policy
+	provenance *attest.Provenance
+	// digests expected of the layers, by ID
+	layerDigests map[string]string
+	// annotations and labels to add when the image is written out again
+	annotations   map[string]string
+	labels        map[string]string
+	aliases       []*ImageRef
+	redaction     *Redaction
+	normalization *Normalization
+	platform      *Platform
+	idMapping     *export.IDMapping
+}
+
+// Host is the registry host of the reference, with its port if it has one,
+// like "localhost:5000" or "[::1]:5000"
+func (ir ImageRef) Host() string {
+	return ir.host
+}
+
+// Hostname is Host, without the port or the brackets of an IPv6 address
+func (ir ImageRef) Hostname() string {
+	host, _ := splitHostPort(ir.host)
+	return host
+}
+
+// Port is the port of the registry host, empty if the reference has none
+func (ir ImageRef) Port() string {
+	_, port := splitHostPort(ir.host)
+	return port
+}
+
+// splitHostPort splits host, like "example.com", "localhost:5000", "[::1]" or
+// "[::1]:5000", into its hostname and port
+func splitHostPort(host string) (string, string) {
+	i := strings.LastIndex(host, ":")
+	if i < 0 || i < strings.LastIndex(host, "]") {
+		return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host[:i], "["), "]"), host[i+1:]
+}
+
+func (ir ImageRef) ID() string {
+	return ir.id
+}
+func (ir *ImageRef) SetID(id string) {
+	ir.id = id
+}
+
+func (ir ImageRef) Ancestry() []string {
+	return ir.ancestry
+}
+func (ir *ImageRef) SetAncestry(ids []string) {
+	ir.ancestry = make([]string, len(ids))
+	for i := range ids {
+		ir.ancestry[i] = ids[i]
+	}
+}
+
+// Timings is the breakdown of time spent fetching this image so far
+func (ir *ImageRef) Timings() *Timings {
+	if ir.timings == nil {
+		ir.timings = &Timings{}
+	}
+	return ir.timings
+}
+
+// LayerDigest is the digest set for the layer id with SetLayerDigest, if any
+func (ir ImageRef) LayerDigest(id string) string {
+	return ir.layerDigests[id]
+}
+
+// SetLayerDigest sets the sha256 digest (like "sha256:...") that the
+// download of the layer id must have. For v2 registries this is the digest
+// of the blob, which is checked in addition to the digest in the manifest.
+func (ir *ImageRef) SetLayerDigest(id, digest string) {
+	if ir.layerDigests == nil {
+		ir.layerDigests = map[string]string{}
+	}
+	ir.layerDigests[id] = digest
+}
+
+// ScanResult is the outcome of scanning the image, if a Scanner was used
+func (ir ImageRef) ScanResult() *ScanResult {
+	return ir.scan
+}
+func (ir *ImageRef) SetScanResult(result *ScanResult) {
+	ir.scan = result
+}
+
+func (ir ImageRef) Name() string {
+	return ir.name
+}
+func (ir ImageRef) Tag() string {
+	if ir.tag == "" {
+		return DefaultTag
+	}
+	return ir.tag
+}
+
+// Digest is the digest of the image's manifest, either given in the
+// reference or, once resolved from a v2 registry, of what the tag points to
+func (ir ImageRef) Digest() string {
+	return ir.digest
+}
+
+// Signed reports whether the signatures of the image were verified, as
+// required by the Trust policy or the ContentTrust of the registry it was
+// fetched from
+func (ir ImageRef) Signed() bool {
+	return ir.signed
+}
+
+// Provenance is the SLSA provenance of the image, once verified by the
+// Provenance policy of the registry it was fetched from; nil otherwise
+func (ir ImageRef) Provenance() *attest.Provenance {
+	return ir.provenance
+}
+
+// TrustedDigest is the digest signed for the tag of the image on a Notary
+// server, once verified by the ContentTrust of the registry it was fetched
+// from, and which it was then fetched by; empty otherwise, as for images given
+// by digest
+func (ir ImageRef) TrustedDigest() string {
+	return ir.trustedDigest
+}
+
+// Qualified reports whether the reference names its registry host, as
+// opposed to a short name like "busybox", on the Docker Hub unless resolved
+// by ShortNames
+func (ir ImageRef) Qualified() bool {
+	return ir.qualified
+}
+
+// Pinned reports whether the reference names a manifest digest, which is
+// then fetched instead of the tag
+func (ir ImageRef) Pinned() bool {
+	return ir.pinned
+}
+
+func (ir ImageRef) String() string {
+	if ir.pinned {
+		if ir.hasTag() {
+			return ir.Host() + "/" + ir.Name() + ":" + ir.Tag() + "@" + ir.digest
+		}
+		return ir.Host() + "/" + ir.Name() + "@" + ir.digest
+	}
+	return ir.Host() + "/" + ir.Name() + ":" + ir.Tag()
+}
+
+// hasTag reports whether a tag was given in the reference
+func (ir ImageRef) hasTag() bool {
+	return ir.tag != ""
+}
+
+// manifestReference is what to fetch the manifest of the image by: its
+// digest if pinned, otherwise its tag
+func (ir ImageRef) manifestReference() string {
+	if ir.pinned {
+		return ir.digest
+	}
+	return ir.Tag()
+}
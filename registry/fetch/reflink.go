@@ -0,0 +1,28 @@
+package fetch
+
+import (
+	"io"
+	"os"
+)
+
+// copyFile copies src to dest, cloning it with a reflink where the
+// filesystem supports it (btrfs, XFS), so that the copy shares the blocks of
+// src rather than duplicating them. Otherwise the bytes are copied.
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := reflink(out, in); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fetch
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only supported on linux
+func reflink(dest, src *os.File) error {
+	return errors.New("reflink: not supported on this platform")
+}
@@ -0,0 +1,38 @@
+package fetch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.reflink.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	content := bytes.Repeat([]byte("layer data "), 10000)
+	src := filepath.Join(tdir, "src")
+	dest := filepath.Join(tdir, "dest")
+	if err := ioutil.WriteFile(src, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// an existing, longer dest is replaced
+	if err := ioutil.WriteFile(dest, append(content, content...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dest); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content) {
+		t.Errorf("expected the content of src, got %d bytes", len(buf))
+	}
+}
@@ -0,0 +1,142 @@
+package fetch
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ImageRefSet is an ordered collection of unique image references, as used by
+// the bulk workflows (fetching many, syncing, pinning).
+type ImageRefSet []*ImageRef
+
+// ParseImageRefs reads one image reference per line from r. Anything from a
+// '#' on is a comment, and blank lines are skipped. Duplicate references are
+// dropped, keeping the first occurrence. A line that is not a valid reference
+// fails, see ParseImageRef.
+func ParseImageRefs(r io.Reader) (ImageRefSet, error) {
+	set := ImageRefSet{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ref, err := ParseImageRef(line)
+		if err != nil {
+			return nil, err
+		}
+		set = set.Add(ref)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// LoadImageRefs reads the references from each of the files named. A filename
+// of "-" reads from stdin.
+func LoadImageRefs(filenames ...string) (ImageRefSet, error) {
+	set := ImageRefSet{}
+	for _, filename := range filenames {
+		var (
+			fh  *os.File
+			err error
+		)
+		if filename == "-" {
+			fh = os.Stdin
+		} else {
+			fh, err = os.Open(filename)
+			if err != nil {
+				return nil, err
+			}
+		}
+		refs, err := ParseImageRefs(fh)
+		if fh != os.Stdin {
+			fh.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		set = set.Add(refs...)
+	}
+	return set, nil
+}
+
+// Add appends the refs not already present in the set and returns the
+// updated set.
+func (s ImageRefSet) Add(refs ...*ImageRef) ImageRefSet {
+	for _, ref := range refs {
+		if !s.Contains(ref) {
+			s = append(s, ref)
+		}
+	}
+	return s
+}
+
+// Contains reports whether a reference equivalent to ref is in the set.
+func (s ImageRefSet) Contains(ref *ImageRef) bool {
+	for _, r := range s {
+		if r.String() == ref.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Dedup returns a copy of the set with equivalent references removed.
+func (s ImageRefSet) Dedup() ImageRefSet {
+	return ImageRefSet{}.Add(s...)
+}
+
+// Sort orders the set in place by host, then name, then tag.
+func (s ImageRefSet) Sort() {
+	sort.Sort(s)
+}
+
+// Hosts returns the sorted, unique registry hosts referenced in the set.
+func (s ImageRefSet) Hosts() []string {
+	hosts := []string{}
+	for host := range s.ByHost() {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// ByHost groups the references in the set by their registry host. The order
+// of references within each group is preserved.
+func (s ImageRefSet) ByHost() map[string]ImageRefSet {
+	groups := map[string]ImageRefSet{}
+	for _, ref := range s {
+		groups[ref.Host()] = append(groups[ref.Host()], ref)
+	}
+	return groups
+}
+
+// Strings returns the string form of each reference in the set.
+func (s ImageRefSet) Strings() []string {
+	strs := make([]string, len(s))
+	for i := range s {
+		strs[i] = s[i].String()
+	}
+	return strs
+}
+
+func (s ImageRefSet) Len() int      { return len(s) }
+func (s ImageRefSet) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ImageRefSet) Less(i, j int) bool {
+	if s[i].Host() != s[j].Host() {
+		return s[i].Host() < s[j].Host()
+	}
+	if s[i].Name() != s[j].Name() {
+		return s[i].Name() < s[j].Name()
+	}
+	return s[i].Tag() < s[j].Tag()
+}
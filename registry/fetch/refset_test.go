@@ -0,0 +1,62 @@
+package fetch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImageRefs(t *testing.T) {
+	input := `# images to mirror
+busybox
+localhost:5000/fedora:22   # the dev registry
+tianon/true
+
+busybox:latest
+docker.io/tianon/true
+`
+	set, err := ParseImageRefs(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set) != 3 {
+		t.Fatalf("expected 3 unique refs, got %d: %v", len(set), set.Strings())
+	}
+
+	set.Sort()
+	expected := []string{
+		"docker.io/library/busybox:latest",
+		"docker.io/tianon/true:latest",
+		"localhost:5000/fedora:22",
+	}
+	for i, str := range set.Strings() {
+		if str != expected[i] {
+			t.Errorf("at %d: expected %q, got %q", i, expected[i], str)
+		}
+	}
+
+	groups := set.ByHost()
+	if len(groups[DefaultHubNamespace]) != 2 {
+		t.Errorf("expected 2 refs for %q, got %d", DefaultHubNamespace, len(groups[DefaultHubNamespace]))
+	}
+	if hosts := set.Hosts(); len(hosts) != 2 || hosts[0] != DefaultHubNamespace || hosts[1] != "localhost:5000" {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestImageRefSetBatches(t *testing.T) {
+	set := ImageRefSet{}.Add(
+		NewImageRef("localhost:5000/fedora"),
+		NewImageRef("busybox"),
+		NewImageRef("localhost:5000/centos"),
+	)
+	batches := set.Batches()
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	if batches[0].Host != DefaultHubNamespace || batches[0].Registry.Host != DefaultRegistryHost {
+		t.Errorf("unexpected first batch %q (%q)", batches[0].Host, batches[0].Registry.Host)
+	}
+	if len(batches[1].Refs) != 2 || batches[1].Refs[0].Name() != "fedora" {
+		t.Errorf("expected host order to be kept within a batch, got %v", batches[1].Refs.Strings())
+	}
+}
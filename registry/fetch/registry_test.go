@@ -0,0 +1,393 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLayer is a layer served by a testRegistry
+type testLayer struct {
+	ID     string
+	Parent string
+	Layer  []byte
+}
+
+// testRegistry is a minimal in-process v1 registry, serving the layers
+// given for the single tag "latest" of the repository "test/image"
+type testRegistry struct {
+	*httptest.Server
+	Layers []testLayer // top-most layer first
+	// Requests counts the requests made per path
+	Requests map[string]int
+	// Fail is the status to respond with instead, per path
+	Fail map[string]int
+	// Flaky is how many requests to a path fail with a 503 before it works
+	Flaky map[string]int
+	mu    sync.Mutex
+
+	// V2 makes the registry speak the v2 API, with bearer token auth, instead
+	// of v1
+	V2       bool
+	blobs    map[string][]byte
+	manifest []byte
+	// manifestList is served as the "multi" tag, with manifest as the image
+	// for linux/amd64
+	manifestList []byte
+	// Auth, as "username:password", is required of token requests, or of
+	// every request when Basic is set
+	Auth  string
+	Basic bool
+	// Standalone makes the registry have no token service: v1 sends
+	// StandaloneToken (if any) as the X-Docker-Token and refuses tokens, and
+	// v2 never challenges
+	Standalone      bool
+	StandaloneToken string
+	// Endpoints is the X-Docker-Endpoints of v1, its own host if empty
+	Endpoints string
+	// Pushed are the manifests pushed, by "<repository>:<tag or digest>".
+	// The blobs pushed are added to the blobs served, which are shared by
+	// all repositories.
+	Pushed  map[string][]byte
+	uploads map[string]*bytes.Buffer
+}
+
+func newTestRegistry(t *testing.T, layers ...testLayer) *testRegistry {
+	tr := &testRegistry{Layers: layers, Requests: map[string]int{}, Fail: map[string]int{}, Flaky: map[string]int{}}
+	tr.Server = httptest.NewTLSServer(http.HandlerFunc(tr.serve))
+	origClient := http.DefaultClient
+	http.DefaultClient = tr.Server.Client()
+	t.Cleanup(func() {
+		http.DefaultClient = origClient
+		tr.Server.Close()
+	})
+	return tr
+}
+
+// Host is the address to use in image references to this registry
+func (tr *testRegistry) Host() string {
+	return strings.TrimPrefix(tr.Server.URL, "https://")
+}
+
+// Ref is a reference to the image served
+func (tr *testRegistry) Ref() *ImageRef {
+	return NewImageRef(tr.Host() + "/test/image")
+}
+
+func (tr *testRegistry) layer(id string) (testLayer, bool) {
+	for _, l := range tr.Layers {
+		if l.ID == id {
+			return l, true
+		}
+	}
+	return testLayer{}, false
+}
+
+// newTestRegistryV2 is a newTestRegistry speaking the v2 API
+func newTestRegistryV2(t *testing.T, layers ...testLayer) *testRegistry {
+	tr := newTestRegistry(t, layers...)
+	tr.V2 = true
+	tr.blobs = map[string][]byte{}
+	tr.Pushed = map[string][]byte{}
+	tr.uploads = map[string]*bytes.Buffer{}
+	manifest := ManifestV2{SchemaVersion: 2, MediaType: MediaTypeManifestV2}
+	diffIDs := []string{}
+	for i := len(layers) - 1; i >= 0; i-- {
+		buf := bytes.NewBuffer(nil)
+		gz := gzip.NewWriter(buf)
+		gz.Write(layers[i].Layer)
+		gz.Close()
+		digest := digestOf(buf.Bytes())
+		tr.blobs[digest] = buf.Bytes()
+		manifest.Layers = append(manifest.Layers, Descriptor{MediaType: MediaTypeLayerGzip, Size: int64(buf.Len()), Digest: digest})
+		diffIDs = append(diffIDs, digestOf(layers[i].Layer))
+	}
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Labels": map[string]string{"license": "MIT"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	tr.blobs[digestOf(config)] = config
+	manifest.Config = Descriptor{MediaType: MediaTypeImageConfig, Size: int64(len(config)), Digest: digestOf(config)}
+	tr.manifest, _ = json.Marshal(manifest)
+	tr.manifestList, _ = json.Marshal(OCIIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifestList,
+		Manifests: []Descriptor{
+			{MediaType: MediaTypeManifestV2, Size: 1234, Digest: "sha256:" + strings.Repeat("c", 64), Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+			{MediaType: MediaTypeManifestV2, Size: int64(len(tr.manifest)), Digest: digestOf(tr.manifest), Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		},
+	})
+	return tr
+}
+
+func (tr *testRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	tr.mu.Lock()
+	tr.Requests[r.URL.Path]++
+	status, fail := tr.Fail[r.URL.Path]
+	if tr.Requests[r.URL.Path] <= tr.Flaky[r.URL.Path] {
+		status, fail = http.StatusServiceUnavailable, true
+	}
+	tr.mu.Unlock()
+	if fail {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if tr.V2 {
+		tr.serveV2(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.NotFound(w, r)
+		return
+	}
+	if tr.Standalone && strings.HasPrefix(r.Header.Get("Authorization"), "Token ") {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	switch {
+	case r.URL.Path == "/v1/repositories/test/image/images" && tr.Standalone:
+		if tr.StandaloneToken != "" {
+			w.Header().Set("X-Docker-Token", tr.StandaloneToken)
+		}
+		fmt.Fprint(w, "[]")
+	case r.URL.Path == "/v1/repositories/test/image/images":
+		w.Header().Set("X-Docker-Token", `signature=abc,repository="test/image",access=read`)
+		endpoints := tr.Endpoints
+		if endpoints == "" {
+			endpoints = tr.Host()
+		}
+		w.Header().Set("X-Docker-Endpoints", endpoints)
+		fmt.Fprint(w, "[]")
+	case r.URL.Path == "/v1/search":
+		fmt.Fprintf(w, `{"query":%q,"num_results":1,"results":[{"name":"test/image","description":"a test image","star_count":3,"is_official":false,"is_trusted":true}]}`, r.URL.Query().Get("q"))
+	case r.URL.Path == "/v1/repositories/test/image/tags":
+		fmt.Fprintf(w, `{"v1.0": %q, "latest": %q}`, tr.Layers[0].ID, tr.Layers[0].ID)
+	case r.URL.Path == "/v1/repositories/test/image/tags/latest":
+		fmt.Fprintf(w, "%q", tr.Layers[0].ID)
+	case len(parts) == 3 && parts[0] == "images":
+		l, ok := tr.layer(parts[1])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[2] {
+		case "ancestry":
+			ids := []string{}
+			for _, l := range tr.Layers {
+				ids = append(ids, l.ID)
+			}
+			json.NewEncoder(w).Encode(ids)
+		case "json":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": l.ID, "parent": l.Parent, "Size": len(l.Layer)})
+		case "layer":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(l.Layer))
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (tr *testRegistry) serveV2(w http.ResponseWriter, r *http.Request) {
+	if tr.Basic {
+		if u, p, ok := r.BasicAuth(); !ok || u+":"+p != tr.Auth {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer sekrit-push")
+	}
+	if r.URL.Path == "/token" {
+		if u, p, _ := r.BasicAuth(); tr.Auth != "" && u+":"+p != tr.Auth {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch scope := r.URL.Query().Get("scope"); {
+		case strings.HasPrefix(scope, "repository:test/") && strings.HasSuffix(scope, ":pull") || scope == "registry:catalog:*":
+			fmt.Fprint(w, `{"token":"sekrit"}`)
+		case strings.HasPrefix(scope, "repository:test/") && strings.HasSuffix(scope, ":pull,push"):
+			fmt.Fprint(w, `{"token":"sekrit-push"}`)
+		default:
+			http.Error(w, "bad scope", http.StatusBadRequest)
+		}
+		return
+	}
+	authz := r.Header.Get("Authorization")
+	if r.Method == "GET" || r.Method == "HEAD" {
+		authz = strings.TrimSuffix(authz, "-push")
+	}
+	if authz != "Bearer sekrit" && authz != "Bearer sekrit-push" && !tr.Standalone {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, tr.Server.URL))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	tr.mu.Lock()
+	pushed := tr.Pushed[pushedName(r.URL.Path)]
+	tr.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v2/":
+		fmt.Fprint(w, "{}")
+	case strings.Contains(r.URL.Path, "/blobs/uploads/"):
+		tr.serveUpload(w, r)
+	case r.Method == "PUT" && strings.Contains(r.URL.Path, "/manifests/"):
+		tr.servePushManifest(w, r)
+	case pushed != nil:
+		w.Header().Set("Content-Type", MediaTypeOCIManifest)
+		w.Header().Set("Docker-Content-Digest", digestOf(pushed))
+		if r.Method != "HEAD" {
+			w.Write(pushed)
+		}
+	case r.URL.Path == "/v2/test/image/manifests/latest" || r.URL.Path == "/v2/test/image/manifests/"+digestOf(tr.manifest):
+		w.Header().Set("Content-Type", MediaTypeManifestV2)
+		w.Header().Set("Docker-Content-Digest", digestOf(tr.manifest))
+		if r.Method != "HEAD" {
+			w.Write(tr.manifest)
+		}
+	case r.URL.Path == "/v2/test/image/manifests/multi" || r.URL.Path == "/v2/test/image/manifests/"+digestOf(tr.manifestList):
+		w.Header().Set("Content-Type", MediaTypeManifestList)
+		w.Header().Set("Docker-Content-Digest", digestOf(tr.manifestList))
+		if r.Method != "HEAD" {
+			w.Write(tr.manifestList)
+		}
+	case strings.HasPrefix(r.URL.Path, "/v2/test/image/manifests/"):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":{"Tag":%q}}]}`, path.Base(r.URL.Path))
+	case r.URL.Path == "/v2/_catalog":
+		fmt.Fprint(w, `{"repositories":["test/image","test/other"]}`)
+	case r.URL.Path == "/v2/test/image/tags/list":
+		// two pages, to exercise the pagination
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/test/image/tags/list?last=latest&n=1>; rel="next"`)
+			fmt.Fprint(w, `{"name":"test/image","tags":["latest"]}`)
+		} else {
+			fmt.Fprint(w, `{"name":"test/image","tags":["v1.0"]}`)
+		}
+	case strings.Contains(r.URL.Path, "/blobs/"):
+		tr.mu.Lock()
+		blob, ok := tr.blobs[path.Base(r.URL.Path)]
+		tr.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testLayers is a two layer image, with layer tars that are not valid tars
+var testLayers = []testLayer{
+	{ID: strings.Repeat("b", 64), Parent: strings.Repeat("a", 64), Layer: []byte("top layer")},
+	{ID: strings.Repeat("a", 64), Layer: []byte("base layer")},
+}
+
+// pushedName is the key in Pushed of the manifest at urlPath
+func pushedName(urlPath string) string {
+	i := strings.LastIndex(urlPath, "/manifests/")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimPrefix(urlPath[:i], "/v2/") + ":" + urlPath[i+len("/manifests/"):]
+}
+
+// serveUpload serves the blob upload API: a POST starts an upload, PATCH
+// requests add to it, and a PUT with the digest of the whole completes it
+func (tr *testRegistry) serveUpload(w http.ResponseWriter, r *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	i := strings.Index(r.URL.Path, "/blobs/uploads/")
+	base, id := r.URL.Path[:i+len("/blobs/uploads/")], r.URL.Path[i+len("/blobs/uploads/"):]
+	if r.Method == "POST" && id == "" {
+		id = fmt.Sprintf("upload-%d", len(tr.uploads))
+		tr.uploads[id] = bytes.NewBuffer(nil)
+		w.Header().Set("Location", base+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	upload, ok := tr.uploads[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if cr := r.Header.Get("Content-Range"); cr != "" && !strings.HasPrefix(cr, fmt.Sprintf("%d-", upload.Len())) {
+		http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if _, err := upload.ReadFrom(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "PATCH":
+		w.Header().Set("Location", base+id)
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		digest := r.URL.Query().Get("digest")
+		if digest != digestOf(upload.Bytes()) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"provided digest did not match uploaded content"}]}`)
+			return
+		}
+		tr.blobs[digest] = upload.Bytes()
+		delete(tr.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// servePushManifest takes a manifest pushed, refusing it if any of its blobs
+// is missing
+func (tr *testRegistry) servePushManifest(w http.ResponseWriter, r *http.Request) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	buf := bytes.NewBuffer(nil)
+	buf.ReadFrom(r.Body)
+	var manifest struct {
+		ManifestV2
+		Manifests []Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the manifests of a list must have been pushed before it
+	for _, desc := range manifest.Manifests {
+		name := pushedName(r.URL.Path)
+		if _, ok := tr.Pushed[name[:strings.Index(name, ":")]+":"+desc.Digest]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":%q}]}`, desc.Digest)
+			return
+		}
+	}
+	if len(manifest.Manifests) > 0 {
+		tr.Pushed[pushedName(r.URL.Path)] = buf.Bytes()
+		w.Header().Set("Docker-Content-Digest", digestOf(buf.Bytes()))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	for _, desc := range append(manifest.Layers, manifest.Config) {
+		if _, ok := tr.blobs[desc.Digest]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors":[{"code":"MANIFEST_BLOB_UNKNOWN","message":"blob unknown to registry","detail":%q}]}`, desc.Digest)
+			return
+		}
+	}
+	tr.Pushed[pushedName(r.URL.Path)] = buf.Bytes()
+	w.Header().Set("Docker-Content-Digest", digestOf(buf.Bytes()))
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,172 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Repositories is the content of the legacy `repositories` file, mapping
+// each repository to its tags and the ID of the image each tag is, like
+//
+//	{"busybox":{"latest":"4986bf8c15363d1c5d15512d5266f8777bfba4974ac56e3270e7760f6f0a8125"}}
+type Repositories map[string]map[string]string
+
+// RepositoriesProblem is a tag of a `repositories` file whose image is not
+// (all) there
+type RepositoriesProblem struct {
+	Repository string
+	Tag        string
+	// ID is of the layer at fault, the image itself or one under it
+	ID  string
+	Err error
+}
+
+func (p RepositoriesProblem) Error() string {
+	return fmt.Sprintf("%s:%s: %s", p.Repository, p.Tag, p.Err)
+}
+
+// ErrRepositoriesInconsistent is returned by LoadRepositories for the tags
+// whose images are missing layers, or have layers corrupted
+type ErrRepositoriesInconsistent struct {
+	Dir      string
+	Problems []RepositoriesProblem
+}
+
+func (e ErrRepositoriesInconsistent) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return fmt.Sprintf("%s: repositories inconsistent with the layers: %s", e.Dir, strings.Join(msgs, "; "))
+}
+
+// ReadRepositories reads the `repositories` file in dir, as is
+func ReadRepositories(dir string) (Repositories, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "repositories"))
+	if err != nil {
+		return nil, err
+	}
+	repos := Repositories{}
+	if err := json.Unmarshal(buf, &repos); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "repositories"), err)
+	}
+	return repos, nil
+}
+
+// LoadRepositories reads the `repositories` file in dir, a directory in the
+// legacy `docker save` layout, and checks that every layer of each image it
+// tags is there: the image's own, and each parent its json names down to the
+// base. With hashes set, the layer.tar of each is also hashed and checked
+// against the checksum recorded when it was fetched, layers without one
+// failing. Each tag at fault is reported, in an ErrRepositoriesInconsistent,
+// rather than the first only.
+func LoadRepositories(dir string, hashes bool) (Repositories, error) {
+	repos, err := ReadRepositories(dir)
+	if err != nil {
+		return nil, err
+	}
+	problems := []RepositoriesProblem{}
+	// what was found of each layer already, for the images sharing them
+	checked := map[string]checkedLayer{}
+	for _, name := range repos.names() {
+		tags := []string{}
+		for tag := range repos[name] {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			if id, err := checkLayerChain(dir, repos[name][tag], hashes, checked); err != nil {
+				problems = append(problems, RepositoriesProblem{Repository: name, Tag: tag, ID: id, Err: err})
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return repos, ErrRepositoriesInconsistent{Dir: dir, Problems: problems}
+	}
+	return repos, nil
+}
+
+// names are the repositories, sorted
+func (repos Repositories) names() []string {
+	names := []string{}
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkLayerChain checks the layer id in dir and each of its parents,
+// returning the ID of the first at fault
+func checkLayerChain(dir, id string, hashes bool, checked map[string]checkedLayer) (string, error) {
+	if id == "" {
+		return id, fmt.Errorf("no image ID")
+	}
+	seen := map[string]bool{}
+	for id != "" {
+		if seen[id] {
+			return id, fmt.Errorf("layer %s is its own ancestor", id)
+		}
+		seen[id] = true
+		c, ok := checked[id]
+		if !ok {
+			c.parent, c.err = checkLayer(dir, id, hashes)
+			checked[id] = c
+		}
+		if c.err != nil {
+			return id, c.err
+		}
+		id = c.parent
+	}
+	return "", nil
+}
+
+// checkedLayer is what checkLayer found of a layer
+type checkedLayer struct {
+	parent string
+	err    error
+}
+
+// checkLayer checks that the layer id has its json and layer.tar in dir,
+// that the json parses and is of the layer id, and with hashes, that the
+// layer.tar is as fetched. It returns the parent the json names. It is the
+// check of the layers shared by LoadRepositories, VerifyLocal and Fsck.
+func checkLayer(dir, id string, hashes bool) (string, error) {
+	// a name of a directory of dir, not a path out of it
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("%q is not a layer ID", id)
+	}
+	for _, name := range []string{"json", "layer.tar"} {
+		if _, err := os.Stat(filepath.Join(dir, id, name)); err != nil {
+			if os.IsNotExist(err) {
+				return "", fmt.Errorf("layer %s: no %s", id, name)
+			}
+			return "", err
+		}
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, id, "json"))
+	if err != nil {
+		return "", err
+	}
+	var md struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+	}
+	if err := json.Unmarshal(buf, &md); err != nil {
+		return "", fmt.Errorf("layer %s: invalid json: %w", id, err)
+	}
+	if md.ID != "" && md.ID != id {
+		return "", fmt.Errorf("layer %s: json is of layer %s", id, md.ID)
+	}
+	if hashes {
+		if err := VerifyLayer(dir, id, true); err != nil {
+			return "", err
+		}
+	}
+	return md.Parent, nil
+}
@@ -0,0 +1,57 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRepositories(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.repositories.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := FormatRepositories(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, "repositories"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := LoadRepositories(tdir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repos[ref.Name()][ref.Tag()] != ref.ID() {
+		t.Errorf("expected %s to be tagged %s, got %#v", ref.ID(), ref, repos)
+	}
+
+	// corrupt the base layer, which only hashing notices
+	base := ref.Ancestry()[len(ref.Ancestry())-1]
+	layer := filepath.Join(tdir, base, "layer.tar")
+	if err := ioutil.WriteFile(layer, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRepositories(tdir, false); err != nil {
+		t.Errorf("expected the layers to be found, got %s", err)
+	}
+	_, err = LoadRepositories(tdir, true)
+	if e, ok := err.(ErrRepositoriesInconsistent); !ok || len(e.Problems) != 1 || e.Problems[0].ID != base {
+		t.Errorf("expected the corrupted base layer to be reported, got %v", err)
+	}
+
+	os.Remove(filepath.Join(tdir, ref.ID(), "layer.tar"))
+	_, err = LoadRepositories(tdir, false)
+	if e, ok := err.(ErrRepositoriesInconsistent); !ok || len(e.Problems) != 1 || e.Problems[0].ID != ref.ID() || e.Problems[0].Tag != ref.Tag() {
+		t.Errorf("expected the missing top layer to be reported, got %v", err)
+	}
+}
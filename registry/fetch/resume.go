@@ -0,0 +1,153 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vbatts/docker-utils/export"
+)
+
+// PartialSuffix is appended to the name of a file while it is downloaded.
+// A download that is interrupted leaves the partial file behind, to be
+// resumed from where it stopped on the next attempt. The partial files are
+// left out of the archives of the images.
+const PartialSuffix = export.PartialSuffix
+
+// resumeDownload downloads to filename+PartialSuffix with get, asking for
+// only the rest of the content when a partial file is already there, and
+// falling back to the whole content when the server does not do ranges. When
+// the server says how large the content is, the size of the finished file is
+// checked. It returns the bytes transferred and the sha256 digest of the
+// whole file, which is computed as it is written; the caller renames the
+// partial file once satisfied with it. Large downloads are checkpointed (see
+// CheckpointSuffix). The progress of the download is reported to follow, if
+// not nil, so the file can be read as it grows. A download cut off part way
+// by a network error is resumed as retry allows. The bytes written, of the
+// total expected, are reported to progress if not nil.
+func resumeDownload(ctx context.Context, filename string, get func(header http.Header) (*http.Response, error), cancel <-chan struct{}, follow *follower, retry *RetryPolicy, progress func(written, total int64)) (n int64, digest string, err error) {
+	defer func() { follow.finish(err) }()
+	for attempt := 1; ; attempt++ {
+		var m int64
+		m, digest, err = resume(filename, get, cancel, follow, attempt > 1, progress)
+		n += m
+		// failures before any progress were already retried by get
+		if err == nil || m == 0 || !retryableError(err) || !retry.allows(attempt) {
+			return n, digest, err
+		}
+		logrus.Warnf("downloading %s: %s, resuming (attempt %d of %d)", filename, err, attempt+1, retry.Attempts)
+		if err := sleep(ctx, cancel, retry.delay(attempt)); err != nil {
+			return n, "", err
+		}
+	}
+}
+
+func resume(filename string, get func(header http.Header) (*http.Response, error), cancel <-chan struct{}, follow *follower, retrying bool, progress func(written, total int64)) (int64, string, error) {
+	partial := filename + PartialSuffix
+	var offset int64
+	if fi, err := os.Stat(partial); err == nil {
+		offset = fi.Size()
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := get(header)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	var (
+		fh    *os.File
+		total int64 = -1
+	)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if total, err = contentRangeTotal(resp.Header.Get("Content-Range")); err != nil {
+			return 0, "", err
+		}
+		fh, err = os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0644)
+	case http.StatusOK:
+		if retrying && follow != nil {
+			// the file is already being read as it is written
+			return 0, "", fmt.Errorf("%s: the server cannot resume the download", filename)
+		}
+		offset, total = 0, resp.ContentLength
+		os.Remove(partial + CheckpointSuffix)
+		fh, err = os.Create(partial)
+	case http.StatusRequestedRangeNotSatisfiable:
+		if retrying && follow != nil {
+			return 0, "", fmt.Errorf("%s: the server cannot resume the download", filename)
+		}
+		// the partial file is no good, start again
+		resp.Body.Close()
+		if err := os.Remove(partial); err != nil {
+			return 0, "", err
+		}
+		os.Remove(partial + CheckpointSuffix)
+		return resume(filename, get, cancel, follow, retrying, progress)
+	default:
+		return 0, "", newResponseError(resp.Request.URL.String(), resp)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if offset > 0 {
+		logrus.Debugf("resuming %s at %d bytes", filename, offset)
+		if err := restoreHash(h, partial, offset); err != nil {
+			return 0, "", err
+		}
+	}
+
+	follow.start(offset)
+	w := io.MultiWriter(follow.writer(fh), h, newCheckpointer(fh, h, offset))
+	if progress != nil {
+		progress(offset, total)
+		w = io.MultiWriter(w, &progressWriter{fn: progress, written: offset, total: total})
+	}
+	defer closeOnCancel(resp.Body, cancel)()
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, "", canceledErr(err, cancel)
+	}
+	if total >= 0 && offset+n != total {
+		return n, "", fmt.Errorf("%s: expected %d bytes, got %d", filename, total, offset+n)
+	}
+	os.Remove(partial + CheckpointSuffix)
+	return n, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(h hash.Hash, filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(h, fh)
+	return err
+}
+
+// contentRangeTotal is the complete length from a `bytes 100-199/200`
+// Content-Range header, or -1 when the server does not know it
+func contentRangeTotal(header string) (int64, error) {
+	i := strings.LastIndex(header, "/")
+	if !strings.HasPrefix(header, "bytes ") || i < 0 {
+		return 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	if header[i+1:] == "*" {
+		return -1, nil
+	}
+	return strconv.ParseInt(header[i+1:], 10, 64)
+}
@@ -0,0 +1,76 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRegistryFetchLayersResume(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		tdir, err := ioutil.TempDir("", "test.fetch.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tdir)
+
+		// what the registry serves for each layer, top-most first
+		served := [][]byte{}
+		partial := "layer.tar" + PartialSuffix
+		if tr.V2 {
+			var manifest ManifestV2
+			if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			for i := len(manifest.Layers) - 1; i >= 0; i-- {
+				served = append(served, tr.blobs[manifest.Layers[i].Digest])
+			}
+			partial = "layer.blob" + PartialSuffix
+		} else {
+			for _, l := range testLayers {
+				served = append(served, l.Layer)
+			}
+		}
+
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		ids, err := r.Ancestry(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a good start of the top layer, and junk longer than the base layer
+		for i, content := range [][]byte{served[0][:4], append(served[1], "junk"...)} {
+			if err := os.MkdirAll(path.Join(tdir, ids[i]), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path.Join(tdir, ids[i], partial), content, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := r.FetchLayers(ref, tdir); err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range ids {
+			buf, err := ioutil.ReadFile(path.Join(tdir, id, "layer.tar"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != string(testLayers[i].Layer) {
+				t.Errorf("%s: layer %d: expected %q, got %q", r.APIVersion(), i, testLayers[i].Layer, buf)
+			}
+			if _, err := os.Stat(path.Join(tdir, id, partial)); !os.IsNotExist(err) {
+				t.Errorf("%s: expected the partial file of layer %d to be gone", r.APIVersion(), i)
+			}
+		}
+		timings := ref.Timings().Layers
+		if timings[0].Bytes != int64(len(served[0])-4) {
+			t.Errorf("%s: expected the top layer to be resumed, got %d of %d bytes", r.APIVersion(), timings[0].Bytes, len(served[0]))
+		}
+		if timings[1].Bytes != int64(len(served[1])) {
+			t.Errorf("%s: expected the base layer to be fetched again, got %d of %d bytes", r.APIVersion(), timings[1].Bytes, len(served[1]))
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaults of the RetryPolicy used by the docker-fetch command
+const (
+	DefaultRetryAttempts   = 4
+	DefaultRetryBackoff    = time.Second
+	DefaultRetryMaxBackoff = 30 * time.Second
+	DefaultRetryJitter     = 0.2
+)
+
+// NewRetryPolicy returns a RetryPolicy trying each request up to attempts
+// times, waiting backoff before the first retry and doubling the wait for each
+// retry after it, up to maxBackoff.
+func NewRetryPolicy(attempts int, backoff, maxBackoff time.Duration) *RetryPolicy {
+	return &RetryPolicy{
+		Attempts:   attempts,
+		Backoff:    backoff,
+		MaxBackoff: maxBackoff,
+		Jitter:     DefaultRetryJitter,
+	}
+}
+
+// RetryPolicy retries the requests to a registry that fail with a network
+// error (like a connection reset or a timeout), or with a 429 or a 5xx
+// status. This covers the token, metadata and blob requests; a blob download
+// cut off part way is resumed from where it stopped.
+type RetryPolicy struct {
+	// Attempts is how many times a request is tried in all
+	Attempts int
+	// Backoff is the wait before the first retry, doubled for each retry
+	// after it
+	Backoff time.Duration
+	// MaxBackoff, when set, caps the wait between two attempts
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each wait, from 0 to 1, that is random, so
+	// that concurrent downloads do not all retry at the same moment
+	Jitter float64
+	// MaxRetryAfter is the longest Retry-After of a 429 or 503 that is
+	// waited out in place of the backoff. A 429 asking for a longer wait
+	// fails at once with ErrRateLimited, and a 503 with ErrMaintenance.
+	MaxRetryAfter time.Duration
+}
+
+// allows reports whether another attempt may follow the attempt-th one
+func (p *RetryPolicy) allows(attempt int) bool {
+	return p != nil && attempt < p.Attempts
+}
+
+// delay is the wait after the attempt-th attempt
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// maxRetryAfter is the MaxRetryAfter of p, if any
+func (p *RetryPolicy) maxRetryAfter() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.MaxRetryAfter
+}
+
+// sleep waits for d, unless ctx is done or cancel is closed first
+func sleep(ctx context.Context, cancel <-chan struct{}, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cancel:
+		return errLayerCanceled
+	}
+}
+
+// retryReason says why a request that got resp and err is worth retrying,
+// or is empty if it is not
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if retryableError(err) {
+			return err.Error()
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Sprintf("got %q", resp.Status)
+	}
+	return ""
+}
+
+// retryableError reports whether err is a network failure that may not
+// happen again, rather than one that will, like a bad certificate
+func retryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retry sends req with send, trying again as the Retry policy allows
+func (re *RegistryEndpoint) retry(req *http.Request, send func(req *http.Request) (*http.Response, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := send(req)
+		var (
+			limited *ErrRateLimited
+			down    *ErrMaintenance
+			wait    time.Duration
+		)
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			limited = rateLimited(req.URL.Host, resp)
+			wait = limited.RetryAfter
+		}
+		if err == nil && resp.StatusCode == http.StatusServiceUnavailable {
+			if down = maintenance(req.URL.Host, resp); down != nil {
+				wait = down.RetryAfter
+			}
+		}
+		reason := retryReason(resp, err)
+		if wait > re.Retry.maxRetryAfter() {
+			// not worth waiting for
+			reason = ""
+		}
+		if reason == "" || !re.Retry.allows(attempt) || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			if limited != nil {
+				resp.Body.Close()
+				return nil, *limited
+			}
+			if down != nil {
+				resp.Body.Close()
+				return nil, *down
+			}
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		delay := re.Retry.delay(attempt)
+		if wait > 0 {
+			delay = wait
+		}
+		logrus.Warnf("%s %s%s: %s, retrying in %s (attempt %d of %d)", req.Method, req.URL.Host, req.URL.Path, reason, delay, attempt+1, re.Retry.Attempts)
+		if err := sleep(req.Context(), nil, delay); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
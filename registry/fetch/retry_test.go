@@ -0,0 +1,117 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := NewRetryPolicy(10, time.Second, 5*time.Second)
+	p.Jitter = 0
+	for attempt, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if attempt == 0 {
+			continue
+		}
+		if d := p.delay(attempt); d != expected {
+			t.Errorf("attempt %d: expected to wait %s, got %s", attempt, expected, d)
+		}
+	}
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.delay(1); d < 500*time.Millisecond || d > time.Second {
+			t.Fatalf("expected the jitter to shorten the wait by at most half, got %s", d)
+		}
+	}
+	if p.allows(10) || !p.allows(9) {
+		t.Errorf("expected 10 attempts in all")
+	}
+	if (*RetryPolicy)(nil).allows(1) {
+		t.Errorf("expected no retries without a policy")
+	}
+}
+
+func TestRegistryRetry(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tr.Flaky["/token"] = 1
+	tr.Flaky["/v2/test/image/manifests/latest"] = 2
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	layers := map[string]bool{}
+	for _, l := range manifest.Layers {
+		layers["/v2/test/image/blobs/"+l.Digest] = true
+	}
+	// a registry that cuts off the first download of each layer half way
+	cut := map[string]bool{}
+	cuts := 0
+	flaky := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		first := layers[r.URL.Path] && !cut[r.URL.Path] && r.Header.Get("Authorization") != ""
+		if first {
+			cut[r.URL.Path] = true
+			cuts++
+		}
+		tr.mu.Unlock()
+		if !first {
+			tr.serve(w, r)
+			return
+		}
+		blob := tr.blobs[strings.TrimPrefix(r.URL.Path, "/v2/test/image/blobs/")]
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.Write(blob[:len(blob)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer flaky.Close()
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := NewImageRef(strings.TrimPrefix(flaky.URL, "https://") + "/test/image")
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err == nil {
+		t.Fatalf("expected a 503 to fail without a retry policy")
+	}
+
+	tr.Flaky["/v2/test/image/manifests/latest"] = tr.Requests["/v2/test/image/manifests/latest"] + 2
+	ref = NewImageRef(ref.String())
+	r = NewRegistry(ref.Host())
+	r.Retry = NewRetryPolicy(3, time.Millisecond, 10*time.Millisecond)
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		buf, err := ioutil.ReadFile(path.Join(tdir, id, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("layer %d: expected %q once resumed, got %q", i, testLayers[i].Layer, buf)
+		}
+	}
+	if cuts != len(layers) {
+		t.Errorf("expected every layer download to have been cut off, got %d", cuts)
+	}
+
+	// errors that will not go away are not retried
+	tr.Fail["/v2/test/image/manifests/latest"] = http.StatusNotFound
+	n := tr.Requests["/v2/test/image/manifests/latest"]
+	if _, err := r.Resolve(NewImageRef(ref.String())); err == nil {
+		t.Fatalf("expected a 404 to fail")
+	}
+	if tr.Requests["/v2/test/image/manifests/latest"] != n+1 {
+		t.Errorf("expected a 404 not to be retried, got %d requests", tr.Requests["/v2/test/image/manifests/latest"]-n)
+	}
+}
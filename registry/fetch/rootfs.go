@@ -0,0 +1,42 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// SetIDMapping sets how the owners of the files of the image are mapped
+// when its root filesystem is extracted, for rootless use
+func (ir *ImageRef) SetIDMapping(m *export.IDMapping) {
+	ir.idMapping = m
+}
+
+// IDMapping is the mapping set with SetIDMapping, if any
+func (ir ImageRef) IDMapping() *export.IDMapping {
+	return ir.idMapping
+}
+
+// ExtractRootFS fetches the layers of the image into a temporary directory,
+// and unpacks them onto dir, base first, honoring whiteouts and never
+// writing outside of dir. The owners of the files are mapped with the
+// image's IDMapping, if one is set. See export.ExtractLayers.
+func (re *RegistryEndpoint) ExtractRootFS(img *ImageRef, dir string) error {
+	return re.ExtractRootFSContext(context.Background(), img, dir)
+}
+
+// ExtractRootFSContext is ExtractRootFS, giving up when ctx is done.
+func (re *RegistryEndpoint) ExtractRootFSContext(ctx context.Context, img *ImageRef, dir string) error {
+	tmp, err := ioutil.TempDir("", "docker-fetch-rootfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	ancestry, err := re.FetchLayersContext(ctx, img, tmp)
+	if err != nil {
+		return err
+	}
+	return img.idMapping.ExtractLayers(tmp, ancestry, dir)
+}
@@ -0,0 +1,326 @@
+package fetch
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Store is a LayerStore in a bucket of S3, or of an object storage with
+// its API like MinIO or Ceph, the json and layer.tar of each layer stored as
+// the objects <Prefix><id>/json and <Prefix><id>/layer.tar. The requests are
+// signed with AWS Signature Version 4; the content of the layers is not
+// hashed for the signature, and is sent as it is read. The layers above
+// 5 GiB, the most a single PUT takes, or of a size not known, are uploaded in
+// parts.
+type S3Store struct {
+	// Endpoint is the URL of the storage, like "https://s3.eu-west-1.amazonaws.com"
+	// or "http://localhost:9000", the bucket being addressed in the path
+	Endpoint string
+	Bucket   string
+	// Prefix is put before the keys of the objects, like "layers/"
+	Prefix string
+	Region string
+	// AccessKey and SecretKey are the credentials, and SessionToken the
+	// token of temporary ones
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Client, when set, is used instead of http.DefaultClient
+	Client *http.Client
+	// PartSize is the size of the parts of the layers uploaded in parts,
+	// each held in memory as it is sent, DefaultS3PartSize when zero. S3
+	// takes parts of 5 MiB at least, but for the last, and 10000 parts at
+	// most.
+	PartSize int64
+
+	// now is the time the requests are signed at, for tests
+	now func() time.Time
+}
+
+// DefaultS3PartSize is the PartSize of an S3Store when zero, for layers of
+// up to 625 GiB
+const DefaultS3PartSize = 64 << 20
+
+// s3MaxPutSize is the size of the largest object a single PUT uploads
+const s3MaxPutSize = 5 << 30
+
+// NewS3Store returns an S3Store of bucket in region, at the AWS endpoint of
+// the region, with the credentials of the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables
+func NewS3Store(region, bucket, prefix string) *S3Store {
+	return &S3Store{
+		Endpoint:     fmt.Sprintf("https://s3.%s.amazonaws.com", region),
+		Bucket:       bucket,
+		Prefix:       prefix,
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// Exists reports whether both the json and layer.tar objects of the layer id
+// are in the bucket
+func (s *S3Store) Exists(id string) (bool, error) {
+	for _, name := range []string{"json", "layer.tar"} {
+		resp, err := s.do("HEAD", id, name, nil, nil, 0)
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			continue
+		case http.StatusNotFound:
+			return false, nil
+		}
+		return false, newResponseError(resp.Request.URL.String(), resp)
+	}
+	return true, nil
+}
+
+// PutJSON uploads buf as the json object of the layer id
+func (s *S3Store) PutJSON(id string, buf []byte) error {
+	return s.put(id, "json", bytes.NewReader(buf), int64(len(buf)))
+}
+
+// PutLayer uploads the size bytes of r as the layer.tar object of the layer
+// id, in a single request, or in parts when above 5 GiB or of size -1
+func (s *S3Store) PutLayer(id string, r io.Reader, size int64) error {
+	if size < 0 || size > s3MaxPutSize {
+		return s.putParts(id, "layer.tar", r)
+	}
+	return s.put(id, "layer.tar", r, size)
+}
+
+func (s *S3Store) put(id, name string, r io.Reader, size int64) error {
+	resp, err := s.do("PUT", id, name, nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newResponseError(resp.Request.URL.String(), resp)
+	}
+	return nil
+}
+
+// s3Part is a part of a multipart upload, as CompleteMultipartUpload lists
+// them
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putParts uploads r as the object name of the layer id in parts of
+// PartSize, with a multipart upload that is aborted if reading r or sending
+// a part fails, for the object not to be created
+func (s *S3Store) putParts(id, name string, r io.Reader) error {
+	resp, err := s.do("POST", id, name, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s3Result(resp, &initiated); err != nil {
+		return err
+	}
+	if initiated.UploadID == "" {
+		return fmt.Errorf("%s: no upload ID", name)
+	}
+	upload := url.Values{"uploadId": {initiated.UploadID}}
+	if err := s.sendParts(id, name, upload, r); err != nil {
+		if resp, abortErr := s.do("DELETE", id, name, upload, nil, 0); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// sendParts sends the parts of r for the multipart upload, and completes it
+func (s *S3Store) sendParts(id, name string, upload url.Values, r io.Reader) error {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = DefaultS3PartSize
+	}
+	buf := make([]byte, partSize)
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{}
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && number > 1 {
+			break
+		}
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": upload["uploadId"]}
+		resp, err := s.do("PUT", id, name, query, bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return newResponseError(resp.Request.URL.String(), resp)
+		}
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		if last {
+			break
+		}
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("POST", id, name, upload, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	return s3Result(resp, nil)
+}
+
+// s3Result decodes the XML result of resp into v, if not nil. S3 may answer
+// a request it failed with a 200 and an Error, which is returned.
+func s3Result(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newResponseError(resp.Request.URL.String(), resp)
+	}
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var failed struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(buf, &failed) == nil {
+		return fmt.Errorf("%s: %s: %s", resp.Request.URL, failed.Code, failed.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(buf, v)
+}
+
+// do sends the signed request method for the object name of the layer id,
+// with the query if any
+func (s *S3Store) do(method, id, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	if !isLayerID(id) {
+		return nil, fmt.Errorf("invalid layer ID %q", id)
+	}
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket + "/" + s.Prefix + id + "/" + name
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body, req.ContentLength = ioutil.NopCloser(body), size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	s.sign(req, now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// s3UnsignedPayload is the hash of the content of the requests, which is not
+// signed
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign adds the AWS Signature Version 4 of req, made at t, to its headers
+func (s *S3Store) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	names := []string{}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(sigV4Key(s.SecretKey, date, s.Region, "s3"), []byte(stringToSign)))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+// sigV4Key is the signing key of secret for the date, region and service
+func sigV4Key(secret, date, region, service string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	k = hmacSHA256(k, []byte(region))
+	k = hmacSHA256(k, []byte(service))
+	return hmacSHA256(k, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
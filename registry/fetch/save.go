@@ -0,0 +1,254 @@
+package fetch
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dockerSaveManifest is an entry of the manifest.json of a `docker save`
+// archive
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// FetchDockerSaveTar fetches img and writes it to w as a `docker save` style
+// archive (the layer directories, manifest.json, the image config and
+// repositories), ready to be piped into `docker load`. The layers are staged
+// in a temporary directory while fetching.
+func (re *RegistryEndpoint) FetchDockerSaveTar(img *ImageRef, w io.Writer) error {
+	return re.FetchDockerSaveTarContext(context.Background(), img, w)
+}
+
+// FetchDockerSaveTarContext is FetchDockerSaveTar, giving up when ctx is done.
+func (re *RegistryEndpoint) FetchDockerSaveTarContext(ctx context.Context, img *ImageRef, w io.Writer) error {
+	tmp, err := ioutil.TempDir("", "docker-fetch-save-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	if _, err := re.FetchLayersContext(ctx, img, tmp); err != nil {
+		return err
+	}
+	return WriteDockerSaveTar(img, tmp, w)
+}
+
+// WriteDockerSaveTar writes img, already fetched into src with FetchLayers,
+// to w as a `docker save` style archive. See FetchDockerSaveTar. A layer not
+// matching the checksum recorded when it was fetched fails the write. The
+// labels set on img are added to its config; annotations have no place in
+// this format. The history in the config and layer json is redacted with the
+// Redaction of img, and the layers are rewritten with its Normalization.
+func WriteDockerSaveTar(img *ImageRef, src string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	ancestry := img.Ancestry()
+	layers := []string{}
+	diffIDs := []string{}
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		id := ancestry[i]
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     id + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+		}); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, id+"/VERSION", []byte("1.0")); err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(src, id, "json"))
+		if err != nil {
+			return err
+		}
+		if buf, err = img.Redaction().apply(buf); err != nil {
+			return err
+		}
+		if err := writeTarFile(tw, id+"/json", buf); err != nil {
+			return err
+		}
+		layer, cleanup, err := exportLayer(img, src, id)
+		if err != nil {
+			return err
+		}
+		diffID, err := writeTarLayer(tw, id+"/layer.tar", layer)
+		cleanup()
+		if err != nil {
+			return err
+		}
+		if img.Normalization() == nil {
+			if err := checkLayerChecksum(id, filepath.Join(src, id), diffID); err != nil {
+				return err
+			}
+		}
+		layers = append(layers, id+"/layer.tar")
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	configName, config, err := dockerSaveConfig(img, src, diffIDs)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, configName, config); err != nil {
+		return err
+	}
+
+	manifest, err := json.Marshal([]dockerSaveManifest{{
+		Config:   configName,
+		RepoTags: img.repoTags(),
+		Layers:   layers,
+	}})
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", manifest); err != nil {
+		return err
+	}
+	repositories, err := FormatRepositories(img)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "repositories", repositories); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// dockerSaveConfig is the image config of img, fetched into src, with the
+// diffIDs of its layers as they are written out, and the name of its file in
+// a `docker save` archive
+func dockerSaveConfig(img *ImageRef, src string, diffIDs []string) (string, []byte, error) {
+	var (
+		config []byte
+		err    error
+	)
+	if img.v2 != nil {
+		config = img.v2.config
+		if img.Normalization() != nil {
+			if config, err = withDiffIDs(config, diffIDs); err != nil {
+				return "", nil, err
+			}
+		}
+	} else if config, err = ociConfig(src, img.Ancestry(), diffIDs); err != nil {
+		return "", nil, err
+	}
+	if config, err = withLabels(config, img.Labels()); err != nil {
+		return "", nil, err
+	}
+	if config, err = img.Redaction().apply(config); err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(config)
+	return hex.EncodeToString(sum[:]) + ".json", config, nil
+}
+
+// FormatManifest returns the manifest.json of a `docker save` archive of
+// refs, fetched into src with FetchLayers, which `docker load` reads on
+// current versions of docker rather than the `repositories` file, and the
+// image configs it names, by file name, to be written beside it. The
+// references to the same image are tags of a single entry.
+func FormatManifest(src string, refs ...*ImageRef) ([]byte, map[string][]byte, error) {
+	entries := []dockerSaveManifest{}
+	configs := map[string][]byte{}
+	index := map[string]int{}
+	for _, img := range refs {
+		ancestry := img.Ancestry()
+		if len(ancestry) == 0 {
+			return nil, nil, fmt.Errorf("%s: no layers fetched", img)
+		}
+		layers := []string{}
+		diffIDs := []string{}
+		for i := len(ancestry) - 1; i >= 0; i-- {
+			diffID, err := layerDiffID(filepath.Join(src, ancestry[i]))
+			if err != nil {
+				return nil, nil, err
+			}
+			layers = append(layers, ancestry[i]+"/layer.tar")
+			diffIDs = append(diffIDs, diffID)
+		}
+		configName, config, err := dockerSaveConfig(img, src, diffIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i, ok := index[configName]; ok {
+			entries[i].RepoTags = append(entries[i].RepoTags, img.repoTags()...)
+			continue
+		}
+		index[configName] = len(entries)
+		configs[configName] = config
+		entries = append(entries, dockerSaveManifest{Config: configName, RepoTags: img.repoTags(), Layers: layers})
+	}
+	buf, err := json.Marshal(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, configs, nil
+}
+
+// WriteManifest writes the manifest.json of refs, fetched into src with
+// FetchLayers, and the image configs it names, into src, so that an archive
+// of src loads on current versions of docker. See FormatManifest.
+func WriteManifest(src string, refs ...*ImageRef) error {
+	manifest, configs, err := FormatManifest(src, refs...)
+	if err != nil {
+		return err
+	}
+	for name, config := range configs {
+		if err := ioutil.WriteFile(filepath.Join(src, name), config, 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(src, "manifest.json"), manifest, 0644)
+}
+
+func writeTarFile(tw *tar.Writer, name string, buf []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(buf)),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(buf)
+	return err
+}
+
+// writeTarLayer copies the layer at filename into tw as name, returning its
+// diff ID
+func writeTarLayer(tw *tar.Writer, name, filename string) (string, error) {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  time.Unix(0, 0),
+	}); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), fh); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
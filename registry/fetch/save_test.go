@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchDockerSaveTar(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		var buf bytes.Buffer
+		if err := r.FetchDockerSaveTar(ref, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		files := map[string][]byte{}
+		rdr := tar.NewReader(&buf)
+		for {
+			hdr, err := rdr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files[hdr.Name], err = ioutil.ReadAll(rdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range []string{"manifest.json", "repositories", ref.ID() + "/json", ref.ID() + "/VERSION"} {
+			if _, ok := files[name]; !ok {
+				t.Errorf("%s: expected %s in the archive", r.APIVersion(), name)
+			}
+		}
+
+		var manifest []dockerSaveManifest
+		if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest) != 1 || len(manifest[0].Layers) != len(testLayers) || manifest[0].RepoTags[0] != ref.Name()+":"+ref.Tag() {
+			t.Fatalf("%s: unexpected manifest.json %s", r.APIVersion(), files["manifest.json"])
+		}
+		var config struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		if err := json.Unmarshal(files[manifest[0].Config], &config); err != nil {
+			t.Fatal(err)
+		}
+		for i, layer := range manifest[0].Layers {
+			if d := digestOf(files[layer]); d != config.RootFS.DiffIDs[i] {
+				t.Errorf("%s: expected diff_id %s for %s, got %s", r.APIVersion(), d, layer, config.RootFS.DiffIDs[i])
+			}
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		src := t.TempDir()
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		if _, err := r.FetchLayers(ref, src); err != nil {
+			t.Fatal(err)
+		}
+		// another tag of the same image
+		again := NewImageRef(tr.Host() + "/test/image:again")
+		again.SetID(ref.ID())
+		again.SetAncestry(ref.Ancestry())
+		again.v2 = ref.v2
+		if err := WriteManifest(src, ref, again); err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(src, "manifest.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var manifest []dockerSaveManifest
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest) != 1 || len(manifest[0].RepoTags) != 2 || manifest[0].RepoTags[1] != ref.Name()+":again" {
+			t.Fatalf("%s: expected one image with both tags, got %s", r.APIVersion(), buf)
+		}
+		var config struct {
+			RootFS struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		buf, err = ioutil.ReadFile(filepath.Join(src, manifest[0].Config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(buf, &config); err != nil {
+			t.Fatal(err)
+		}
+		if len(config.RootFS.DiffIDs) != len(manifest[0].Layers) {
+			t.Fatalf("%s: expected a diff_id for each layer, got %v", r.APIVersion(), config.RootFS.DiffIDs)
+		}
+		for i, layer := range manifest[0].Layers {
+			buf, err := ioutil.ReadFile(filepath.Join(src, layer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := digestOf(buf); d != config.RootFS.DiffIDs[i] {
+				t.Errorf("%s: expected diff_id %s for %s, got %s", r.APIVersion(), d, layer, config.RootFS.DiffIDs[i])
+			}
+		}
+	}
+}
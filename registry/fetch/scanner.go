@@ -0,0 +1,225 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// Scanner inspects images as they are fetched, e.g. for known
+// vulnerabilities.
+type Scanner interface {
+	// Layer is called with the content of each layer once downloaded
+	Layer(img *ImageRef, id string, layer io.Reader) error
+	// Finish is called with the image's config json once all of its layers
+	// have been given to Layer, and returns the findings
+	Finish(img *ImageRef, config []byte) (*ScanResult, error)
+}
+
+// ScanResult is what a Scanner found in an image
+type ScanResult struct {
+	Scanner  string    `json:"scanner"`
+	Findings []Finding `json:"findings"`
+	// Raw is the scanner's own report, when it is JSON
+	Raw json.RawMessage `json:"raw,omitempty"`
+}
+
+// Finding is a single issue reported by a Scanner
+type Finding struct {
+	ID               string `json:"id"`
+	Severity         string `json:"severity,omitempty"`
+	Package          string `json:"package,omitempty"`
+	InstalledVersion string `json:"installed_version,omitempty"`
+	FixedVersion     string `json:"fixed_version,omitempty"`
+	Title            string `json:"title,omitempty"`
+}
+
+// Count returns the number of findings of each severity
+func (sr ScanResult) Count() map[string]int {
+	counts := map[string]int{}
+	for _, f := range sr.Findings {
+		counts[f.Severity]++
+	}
+	return counts
+}
+
+func scanLayer(s Scanner, img *ImageRef, id, filename string) error {
+	fh, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return s.Layer(img, id, fh)
+}
+
+// ExecScanner hands images to an external scanner (like trivy or clair)
+// through a directory. Each layer is written to <Dir>/<id>/layer.tar and the
+// config to <Dir>/config.json, and the layers are unpacked from the base up
+// into <Dir>/rootfs. Then Command is run with "{dir}" in its arguments
+// replaced by that directory, and "{rootfs}" by the unpacked rootfs. The
+// command's stdout is kept as the raw report, and findings are read from it
+// when it is in the JSON format of trivy. An ExecScanner may scan several
+// images at once.
+type ExecScanner struct {
+	// Dir is where the scanned images are staged. A temporary directory is
+	// used when empty, and removed afterwards.
+	Dir     string
+	Command []string
+
+	mu   sync.Mutex
+	dirs map[string]string
+}
+
+// NewExecScanner returns an ExecScanner for the command line, like
+// "trivy rootfs --format json {rootfs}"
+func NewExecScanner(commandLine string) *ExecScanner {
+	return &ExecScanner{Command: strings.Fields(commandLine)}
+}
+
+func (es *ExecScanner) dir(img *ImageRef) (string, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.dirs == nil {
+		es.dirs = map[string]string{}
+	}
+	if dir, ok := es.dirs[img.String()]; ok {
+		return dir, nil
+	}
+	var (
+		dir string
+		err error
+	)
+	if es.Dir == "" {
+		dir, err = ioutil.TempDir("", "docker-fetch-scan-")
+	} else {
+		dir = filepath.Join(es.Dir, strings.NewReplacer("/", "_", ":", "_").Replace(img.String()))
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return "", err
+	}
+	es.dirs[img.String()] = dir
+	return dir, nil
+}
+
+// done forgets the directory of img, removing it if it is temporary
+func (es *ExecScanner) done(img *ImageRef, dir string) {
+	es.mu.Lock()
+	delete(es.dirs, img.String())
+	es.mu.Unlock()
+	if es.Dir == "" {
+		os.RemoveAll(dir)
+	}
+}
+
+func (es *ExecScanner) Layer(img *ImageRef, id string, layer io.Reader) (err error) {
+	dir, err := es.dir(img)
+	if err != nil {
+		return err
+	}
+	// Finish is not called for an image whose layer failed
+	defer func() {
+		if err != nil {
+			es.done(img, dir)
+		}
+	}()
+	if err := os.MkdirAll(filepath.Join(dir, id), 0755); err != nil {
+		return err
+	}
+	fh, err := os.Create(filepath.Join(dir, id, "layer.tar"))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(fh, layer)
+	return err
+}
+
+func (es *ExecScanner) Finish(img *ImageRef, config []byte) (*ScanResult, error) {
+	dir, err := es.dir(img)
+	if err != nil {
+		return nil, err
+	}
+	defer es.done(img, dir)
+	if len(es.Command) == 0 {
+		return nil, fmt.Errorf("no scanner command")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), config, 0644); err != nil {
+		return nil, err
+	}
+	// the layers given, in the order of the ancestry, which may not be the
+	// order they were given in
+	layers := []string{}
+	for _, id := range img.Ancestry() {
+		if _, err := os.Stat(filepath.Join(dir, id, "layer.tar")); err == nil {
+			layers = append(layers, id)
+		}
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.RemoveAll(rootfs); err != nil {
+		return nil, err
+	}
+	if err := export.ExtractLayers(dir, layers, rootfs); err != nil {
+		return nil, err
+	}
+
+	args := make([]string, len(es.Command)-1)
+	for i, arg := range es.Command[1:] {
+		args[i] = strings.NewReplacer("{dir}", dir, "{rootfs}", rootfs).Replace(arg)
+	}
+	stdout, stderr := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd := exec.Command(es.Command[0], args...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", es.Command[0], err, stderr.String())
+	}
+
+	result := &ScanResult{Scanner: filepath.Base(es.Command[0])}
+	if json.Valid(stdout.Bytes()) {
+		result.Raw = json.RawMessage(stdout.Bytes())
+		result.Findings = trivyFindings(stdout.Bytes())
+	}
+	return result, nil
+}
+
+// trivyFindings reads the vulnerabilities from a trivy JSON report
+func trivyFindings(report []byte) []Finding {
+	var tr struct {
+		Results []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID  string
+				PkgName          string
+				InstalledVersion string
+				FixedVersion     string
+				Severity         string
+				Title            string
+			}
+		}
+	}
+	findings := []Finding{}
+	if err := json.Unmarshal(report, &tr); err != nil {
+		return findings
+	}
+	for _, r := range tr.Results {
+		for _, v := range r.Vulnerabilities {
+			findings = append(findings, Finding{
+				ID:               v.VulnerabilityID,
+				Severity:         v.Severity,
+				Package:          v.PkgName,
+				InstalledVersion: v.InstalledVersion,
+				FixedVersion:     v.FixedVersion,
+				Title:            v.Title,
+			})
+		}
+	}
+	return findings
+}
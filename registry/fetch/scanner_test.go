@@ -0,0 +1,143 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+type recordingScanner struct {
+	layers map[string]string
+	config []byte
+}
+
+func (rs *recordingScanner) Layer(img *ImageRef, id string, layer io.Reader) error {
+	buf, err := ioutil.ReadAll(layer)
+	rs.layers[id] = string(buf)
+	return err
+}
+
+func (rs *recordingScanner) Finish(img *ImageRef, config []byte) (*ScanResult, error) {
+	rs.config = config
+	return &ScanResult{Scanner: "recording", Findings: []Finding{{ID: "CVE-0000-0000", Severity: "HIGH"}}}, nil
+}
+
+func TestRegistryFetchLayersScanner(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	rs := &recordingScanner{layers: map[string]string{}}
+	r.Scanner = rs
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range testLayers {
+		if rs.layers[l.ID] != string(l.Layer) {
+			t.Errorf("expected layer %s to be scanned, got %q", l.ID, rs.layers[l.ID])
+		}
+	}
+	if len(rs.config) == 0 {
+		t.Errorf("expected the config to be scanned")
+	}
+	if ref.ScanResult() == nil || ref.ScanResult().Count()["HIGH"] != 1 {
+		t.Errorf("expected the scan result on the ImageRef, got %#v", ref.ScanResult())
+	}
+}
+
+func TestExecScanner(t *testing.T) {
+	layer := func(files map[string]string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		for name, content := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+	tr := newTestRegistryV2(t,
+		testLayer{ID: strings.Repeat("d", 64), Parent: strings.Repeat("c", 64), Layer: layer(map[string]string{"etc/.wh.motd": "", "etc/os-release": "ID=new\n"})},
+		testLayer{ID: strings.Repeat("c", 64), Layer: layer(map[string]string{"etc/motd": "hello\n", "etc/os-release": "ID=old\n"})},
+	)
+	staged := t.TempDir()
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.Scanner = &ExecScanner{Dir: staged, Command: []string{"true", "{rootfs}"}}
+	if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if ref.ScanResult() == nil || ref.ScanResult().Scanner != "true" {
+		t.Errorf("expected the scan result on the ImageRef, got %#v", ref.ScanResult())
+	}
+	rootfs := filepath.Join(staged, strings.NewReplacer("/", "_", ":", "_").Replace(ref.String()), "rootfs")
+	if buf, err := ioutil.ReadFile(filepath.Join(rootfs, "etc", "os-release")); err != nil || string(buf) != "ID=new\n" {
+		t.Errorf("expected the layers to be unpacked from the base up, got %q, %v", buf, err)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc", "motd")); !os.IsNotExist(err) {
+		t.Errorf("expected the whiteout to remove etc/motd, got %v", err)
+	}
+
+	// images scanned at once, each in its own temporary directory, all
+	// removed afterwards
+	es := &ExecScanner{Command: []string{"true"}}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img := NewImageRef("test/image:" + string(rune('a'+i)))
+			if err := es.Layer(img, strings.Repeat("c", 64), bytes.NewReader(layer(map[string]string{"file": "data"}))); err != nil {
+				errs <- err
+				return
+			}
+			img.SetAncestry([]string{strings.Repeat("c", 64)})
+			_, err := es.Finish(img, []byte("{}"))
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if len(es.dirs) != 0 {
+		t.Errorf("expected every directory to be forgotten, got %v", es.dirs)
+	}
+
+	failing := &ExecScanner{Command: []string{"true"}}
+	img := NewImageRef("test/image")
+	if err := failing.Layer(img, "bad", iotest.ErrReader(io.ErrUnexpectedEOF)); err == nil {
+		t.Fatal("expected the layer to fail")
+	}
+	if len(failing.dirs) != 0 {
+		t.Errorf("expected the directory of the failed image to be removed, got %v", failing.dirs)
+	}
+}
+
+func TestTrivyFindings(t *testing.T) {
+	report := `{"Results":[{"Target":"rootfs","Vulnerabilities":[
+	{"VulnerabilityID":"CVE-2014-0160","PkgName":"openssl","InstalledVersion":"1.0.1e","FixedVersion":"1.0.1g","Severity":"CRITICAL","Title":"heartbleed"}]}]}`
+	findings := trivyFindings([]byte(report))
+	if len(findings) != 1 {
+		t.Fatalf("expected 1 finding, got %d", len(findings))
+	}
+	if findings[0].ID != "CVE-2014-0160" || findings[0].Package != "openssl" || findings[0].Severity != "CRITICAL" {
+		t.Errorf("unexpected finding %#v", findings[0])
+	}
+}
@@ -0,0 +1,90 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var (
+	// HubSearchURL is where the repositories of the Docker Hub are searched,
+	// which does not serve /v1/search any more
+	HubSearchURL = "https://hub.docker.com/v2/search/repositories/"
+
+	// SearchLimit is how many results Search returns at most
+	SearchLimit = 25
+)
+
+// SearchResult is a repository found by Search
+type SearchResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Stars       int    `json:"star_count"`
+	Official    bool   `json:"is_official"`
+	Automated   bool   `json:"is_automated"`
+}
+
+// Search searches the repositories of the registry for query, returning up
+// to SearchLimit of the best matches, with /v1/search, or the search API of
+// the Docker Hub for it.
+func (re *RegistryEndpoint) Search(query string) ([]SearchResult, error) {
+	return re.SearchContext(context.Background(), query)
+}
+
+// SearchContext is Search, giving up when ctx is done.
+func (re *RegistryEndpoint) SearchContext(ctx context.Context, query string) ([]SearchResult, error) {
+	q := url.Values{}
+	var urlStr string
+	if re.Host == DefaultRegistryHost {
+		q.Set("query", query)
+		q.Set("page_size", fmt.Sprint(SearchLimit))
+		urlStr = HubSearchURL + "?" + q.Encode()
+	} else {
+		q.Set("q", query)
+		q.Set("n", fmt.Sprint(SearchLimit))
+		urlStr = re.apiURL(re.Host, "/v1/search?"+q.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := re.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newResponseError(urlStr, resp)
+	}
+
+	// the Docker Hub has its own names for the same fields
+	var body struct {
+		Results []struct {
+			SearchResult
+			RepoName         string `json:"repo_name"`
+			ShortDescription string `json:"short_description"`
+			IsTrusted        bool   `json:"is_trusted"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("%s: %w", urlStr, err)
+	}
+	results := []SearchResult{}
+	for _, r := range body.Results {
+		result := r.SearchResult
+		if result.Name == "" {
+			result.Name = r.RepoName
+		}
+		if result.Description == "" {
+			result.Description = r.ShortDescription
+		}
+		result.Automated = result.Automated || r.IsTrusted
+		results = append(results, result)
+		if len(results) == SearchLimit {
+			break
+		}
+	}
+	return results, nil
+}
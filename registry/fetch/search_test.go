@@ -0,0 +1,47 @@
+package fetch
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRegistrySearch(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	r := NewRegistry(tr.Host())
+	results, err := r.Search("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []SearchResult{{Name: "test/image", Description: "a test image", Stars: 3, Automated: true}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+
+	// the Docker Hub has its own search API
+	hub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/search/repositories/" || r.URL.Query().Get("query") != "busybox" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"count":2,"results":[`+
+			`{"repo_name":"busybox","short_description":"Busybox base image.","star_count":3000,"is_official":true,"is_automated":false},`+
+			`{"repo_name":"someone/busybox","short_description":"","star_count":1,"is_official":false,"is_automated":true}]}`)
+	}))
+	defer hub.Close()
+	defer func(u string) { HubSearchURL = u }(HubSearchURL)
+	HubSearchURL = hub.URL + "/v2/search/repositories/"
+	r = NewRegistry("docker.io")
+	if results, err = r.Search("busybox"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []SearchResult{
+		{Name: "busybox", Description: "Busybox base image.", Stars: 3000, Official: true},
+		{Name: "someone/busybox", Stars: 1, Automated: true},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected %#v, got %#v", expected, results)
+	}
+}
@@ -0,0 +1,150 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// ShortNames resolves the short names of images, given without a registry
+// host like "busybox" or "fedora:39", to the first of Registries that has the
+// image, like the unqualified-search-registries of containers-registries.conf,
+// rather than to the Docker Hub alone. With no Registries, short names are
+// left on the Docker Hub.
+type ShortNames struct {
+	// Registries are the hosts tried, in order, like "registry.fedoraproject.org"
+	// or "docker.io"
+	Registries []string
+	// Registry, when set, returns the endpoint to look for images of host on,
+	// to configure it like the others; NewRegistry's otherwise. Images its
+	// Policy refuses are not looked for.
+	Registry func(host string) (*RegistryEndpoint, error)
+}
+
+// shortNamesKey is the key of the search registries in registries.conf
+const shortNamesKey = "unqualified-search-registries"
+
+// tomlTrailingComma is the comma TOML allows after the last element of an
+// array, which JSON does not
+var tomlTrailingComma = regexp.MustCompile(`,\s*\]`)
+
+// LoadShortNames reads the unqualified-search-registries of a
+// containers-registries.conf (version 2) file, like
+//
+//	unqualified-search-registries = ["registry.fedoraproject.org", "docker.io"]
+//
+// The rest of the file is ignored.
+func LoadShortNames(filename string) (*ShortNames, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		value   string
+		inValue bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if inValue {
+			value += " " + line
+		} else if strings.HasPrefix(line, "[") {
+			// the tables that follow are not about the search
+			break
+		} else if key := strings.SplitN(line, "=", 2); len(key) == 2 && strings.TrimSpace(key[0]) == shortNamesKey {
+			value, inValue = strings.TrimSpace(key[1]), true
+		}
+		if inValue && strings.Contains(value, "]") {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	s := &ShortNames{Registries: []string{}}
+	if value == "" {
+		return s, nil
+	}
+	value = tomlTrailingComma.ReplaceAllString(value, "]")
+	if err := json.Unmarshal([]byte(value), &s.Registries); err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", filename, shortNamesKey, err)
+	}
+	for _, host := range s.Registries {
+		if !referenceHost.MatchString(host) {
+			return nil, fmt.Errorf("%s: %s: invalid registry host %q", filename, shortNamesKey, host)
+		}
+	}
+	return s, nil
+}
+
+// Resolve returns img on the first of the Registries that has it, as found
+// by resolving its tag there, or img itself when it names its registry or
+// there are no Registries to search. An error lists what each registry
+// answered when none has the image. Any other error of a registry, like one
+// refusing access or down, is returned rather than the next one searched.
+func (s *ShortNames) Resolve(img *ImageRef) (*ImageRef, error) {
+	return s.ResolveContext(context.Background(), img)
+}
+
+// ResolveContext is Resolve, giving up when ctx is done.
+func (s *ShortNames) ResolveContext(ctx context.Context, img *ImageRef) (*ImageRef, error) {
+	if s == nil || img.Qualified() || len(s.Registries) == 0 {
+		return img, nil
+	}
+	msgs := []string{}
+	for _, host := range s.Registries {
+		candidate, err := img.withHost(host)
+		if err != nil {
+			return nil, err
+		}
+		var re *RegistryEndpoint
+		if s.Registry != nil {
+			if re, err = s.Registry(candidate.Host()); err != nil {
+				return nil, err
+			}
+		} else {
+			r := NewRegistry(candidate.Host())
+			re = &r
+		}
+		if re.Policy != nil {
+			if err := re.Policy.CheckRef(candidate); err != nil {
+				msgs = append(msgs, fmt.Sprintf("%s: %s", host, err))
+				continue
+			}
+		}
+		// only a registry that does not have the image moves on to the
+		// next: any other error of a registry searched before would have
+		// the name resolved on a later one, which may not be the image
+		// meant
+		if _, err := re.ImageIDContext(ctx, candidate); err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var unknown ErrManifestUnknown
+			if !isNotFound(err) && !errors.As(err, &unknown) {
+				return nil, fmt.Errorf("%s: searching %s: %w", img.orig, host, err)
+			}
+			msgs = append(msgs, fmt.Sprintf("%s: %s", host, err))
+			continue
+		}
+		return candidate, nil
+	}
+	return nil, fmt.Errorf("%s: not found in any of the search registries (%s)", img.orig, strings.Join(msgs, "; "))
+}
+
+// withHost is the short name img on the registry host, parsed again for the
+// "library/" namespace to apply to the Docker Hub alone
+func (ir ImageRef) withHost(host string) (*ImageRef, error) {
+	ref, err := ParseImageRef(host + "/" + ir.orig)
+	if err != nil {
+		return nil, err
+	}
+	ref.platform = ir.platform
+	return ref, nil
+}
@@ -0,0 +1,102 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShortNames(t *testing.T) {
+	missing := newTestRegistryV2(t, testLayers...)
+	missing.Fail["/v2/test/image/manifests/latest"] = http.StatusNotFound
+	tr := newTestRegistryV2(t, testLayers...)
+
+	hosts := []string{}
+	s := &ShortNames{
+		Registries: []string{missing.Host(), tr.Host()},
+		Registry: func(host string) (*RegistryEndpoint, error) {
+			hosts = append(hosts, host)
+			r := NewRegistry(host)
+			return &r, nil
+		},
+	}
+	ref, err := s.Resolve(NewImageRef("test/image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Host() != tr.Host() || ref.Name() != "test/image" || ref.ID() == "" {
+		t.Errorf("expected the image resolved on %s, got %s (%q)", tr.Host(), ref, ref.ID())
+	}
+	if strings.Join(hosts, ",") != missing.Host()+","+tr.Host() {
+		t.Errorf("expected the registries tried in order, got %v", hosts)
+	}
+
+	// names with a registry are not searched
+	hosts = hosts[:0]
+	qualified := NewImageRef(missing.Host() + "/test/image")
+	if ref, err := s.Resolve(qualified); err != nil || ref != qualified || len(hosts) != 0 {
+		t.Errorf("expected the qualified name as it is, got %v, %v", ref, err)
+	}
+
+	// nor are the registries the policy refuses
+	s.Registry = func(host string) (*RegistryEndpoint, error) {
+		r := NewRegistry(host)
+		r.Policy = &Policy{DeniedRegistries: []string{tr.Host()}}
+		return &r, nil
+	}
+	if _, err := s.Resolve(NewImageRef("test/image")); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("expected the image on the denied registry not to be found, got %v", err)
+	}
+
+	s.Registries = []string{missing.Host()}
+	if _, err := s.Resolve(NewImageRef("test/image")); err == nil || !strings.Contains(err.Error(), missing.Host()) {
+		t.Errorf("expected the image not to be found, got %v", err)
+	}
+
+	// a registry failing otherwise than not having the image is not
+	// skipped for the next
+	down := newTestRegistryV2(t, testLayers...)
+	down.Fail["/v2/test/image/manifests/latest"] = http.StatusServiceUnavailable
+	s.Registries = []string{down.Host(), tr.Host()}
+	s.Registry = nil
+	if ref, err := s.Resolve(NewImageRef("test/image")); err == nil || !strings.Contains(err.Error(), down.Host()) {
+		t.Errorf("expected the error of %s, got %v, %v", down.Host(), ref, err)
+	}
+
+	// the Docker Hub namespace only applies to it
+	if ref, _ := NewImageRef("busybox").withHost("quay.io"); ref.String() != "quay.io/busybox:latest" {
+		t.Errorf("expected quay.io/busybox:latest, got %s", ref)
+	}
+	if ref, _ := NewImageRef("busybox:1.36").withHost("docker.io"); ref.String() != "docker.io/library/busybox:1.36" {
+		t.Errorf("expected docker.io/library/busybox:1.36, got %s", ref)
+	}
+}
+
+func TestLoadShortNames(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registries.conf")
+	for conf, expected := range map[string]string{
+		"unqualified-search-registries = [\"registry.fedoraproject.org\", \"docker.io\"]\n":                                        "registry.fedoraproject.org,docker.io",
+		"# the search\nunqualified-search-registries = [\n  \"quay.io\",\n  \"docker.io\",\n]\n\n[[registry]]\nlocation = \"x\"\n": "quay.io,docker.io",
+		"[[registry]]\nunqualified-search-registries = [\"quay.io\"]\n":                                                            "",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		s, err := LoadShortNames(filename)
+		if err != nil {
+			t.Errorf("%q: %s", conf, err)
+			continue
+		}
+		if strings.Join(s.Registries, ",") != expected {
+			t.Errorf("%q: expected %s, got %v", conf, expected, s.Registries)
+		}
+	}
+	if err := ioutil.WriteFile(filename, []byte("unqualified-search-registries = [\"not a host\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadShortNames(filename); err == nil {
+		t.Error("expected an invalid host to be refused")
+	}
+}
@@ -0,0 +1,152 @@
+package fetch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// SidecarImage is what the sidecar file written beside an export says of
+// each image in it, so that the files of an air-gap share can be told apart
+// without any tooling
+type SidecarImage struct {
+	Ref string `json:"ref"`
+	// Aliases are the other names the image is tagged with, see AddAlias
+	Aliases []string `json:"aliases,omitempty"`
+	// Registry is the host the image was fetched from
+	Registry string `json:"registry"`
+	ID       string `json:"id"`
+	// Digest is the digest of the manifest, for images from v2 registries
+	Digest   string `json:"digest,omitempty"`
+	Platform string `json:"platform"`
+	// Created is when the image was built
+	Created time.Time         `json:"created"`
+	Fetched time.Time         `json:"fetched"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Layers  int               `json:"layers"`
+	Size    int64             `json:"size"`
+}
+
+// NewSidecarImage describes img, fetched into src with FetchLayers at
+// fetched, its layers named by NameLayersByDigest or not. The labels are those
+// of its config, with any set with SetLabel.
+func NewSidecarImage(src string, img *ImageRef, fetched time.Time) (SidecarImage, error) {
+	ancestry := img.Ancestry()
+	if len(ancestry) == 0 {
+		return SidecarImage{}, fmt.Errorf("%s: no layers fetched", img)
+	}
+	names, err := readLayerNames(src)
+	if err != nil {
+		return SidecarImage{}, err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(src, layerDirName(names, ancestry[0]), "json"))
+	if err != nil {
+		return SidecarImage{}, err
+	}
+	var config ImageConfig
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return SidecarImage{}, fmt.Errorf("layer %s: %w", ancestry[0], err)
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	if config.Architecture == "" {
+		config.Architecture = "amd64"
+	}
+	s := SidecarImage{
+		Ref:      img.String(),
+		Registry: img.Host(),
+		ID:       img.ID(),
+		Digest:   img.Digest(),
+		Platform: config.Platform().String(),
+		Created:  config.Created.UTC(),
+		Fetched:  fetched.UTC(),
+		Labels:   config.Config.Labels,
+		Layers:   len(ancestry),
+	}
+	for _, alias := range img.Aliases() {
+		s.Aliases = append(s.Aliases, alias.String())
+	}
+	for k, v := range img.Labels() {
+		if s.Labels == nil {
+			s.Labels = map[string]string{}
+		}
+		s.Labels[k] = v
+	}
+	for _, id := range ancestry {
+		fi, err := os.Stat(filepath.Join(src, layerDirName(names, id), "layer.tar"))
+		if os.IsNotExist(err) {
+			// only the metadata was fetched
+			continue
+		}
+		if err != nil {
+			return SidecarImage{}, err
+		}
+		s.Size += fi.Size()
+	}
+	return s, nil
+}
+
+// SidecarFormats are the formats WriteSidecar writes, by the extension of
+// the sidecar file
+var SidecarFormats = map[string]string{
+	"text": ".txt",
+	"json": ".json",
+}
+
+// WriteSidecar writes images to w, as "text" to be read as it is, or as
+// "json"
+func WriteSidecar(w io.Writer, format string, images ...SidecarImage) error {
+	switch format {
+	case "json":
+		buf, err := json.MarshalIndent(images, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(buf, '\n'))
+		return err
+	case "text":
+	default:
+		return fmt.Errorf("unknown sidecar format %q", format)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+	for i, s := range images {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", s.Ref)
+		if len(s.Aliases) > 0 {
+			fmt.Fprintf(tw, "  Aliases:\t%s\n", strings.Join(s.Aliases, ", "))
+		}
+		fmt.Fprintf(tw, "  Registry:\t%s\n", s.Registry)
+		if s.Digest != "" {
+			fmt.Fprintf(tw, "  Digest:\t%s\n", s.Digest)
+		}
+		fmt.Fprintf(tw, "  ID:\t%s\n", s.ID)
+		fmt.Fprintf(tw, "  Platform:\t%s\n", s.Platform)
+		if !s.Created.IsZero() {
+			fmt.Fprintf(tw, "  Created:\t%s\n", s.Created.Format(time.RFC3339))
+		}
+		fmt.Fprintf(tw, "  Fetched:\t%s\n", s.Fetched.Format(time.RFC3339))
+		fmt.Fprintf(tw, "  Layers:\t%d (%d bytes)\n", s.Layers, s.Size)
+		if len(s.Labels) > 0 {
+			keys := []string{}
+			for k := range s.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			fmt.Fprintf(tw, "  Labels:\n")
+			for _, k := range keys {
+				fmt.Fprintf(tw, "    %s=%s\n", k, s.Labels[k])
+			}
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,68 @@
+package fetch
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSidecar(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	src := t.TempDir()
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, src); err != nil {
+		t.Fatal(err)
+	}
+	ref.SetLabel("org.example.mirror", "air-gap")
+
+	fetched := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	image, err := NewSidecarImage(src, ref, fetched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Ref != ref.String() || image.Registry != tr.Host() || image.Digest == "" || image.ID != ref.ID() {
+		t.Errorf("unexpected image %+v", image)
+	}
+	if image.Layers != len(testLayers) || image.Size != int64(len("top layer")+len("base layer")) {
+		t.Errorf("expected %d layers of %d bytes, got %d of %d", len(testLayers), len("top layer")+len("base layer"), image.Layers, image.Size)
+	}
+	if image.Labels["org.example.mirror"] != "air-gap" {
+		t.Errorf("expected the label set, got %v", image.Labels)
+	}
+	// as well once the layers are named by digest
+	if _, err := NameLayersByDigest(src, ref); err != nil {
+		t.Fatal(err)
+	}
+	if named, err := NewSidecarImage(src, ref, fetched); err != nil || named.Size != image.Size || named.Platform != image.Platform {
+		t.Errorf("expected the same image with its layers named by digest, got %+v, %v", named, err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := WriteSidecar(buf, "text", image); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{ref.String() + "\n", "  Digest:   " + image.Digest + "\n", "  Fetched:  2024-01-02T03:04:05Z\n", "    org.example.mirror=air-gap\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected %q in:\n%s", line, buf)
+		}
+	}
+
+	buf.Reset()
+	if err := WriteSidecar(buf, "json", image); err != nil {
+		t.Fatal(err)
+	}
+	var images []SidecarImage
+	if err := json.Unmarshal(buf.Bytes(), &images); err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Digest != image.Digest || !images[0].Fetched.Equal(fetched) {
+		t.Errorf("unexpected images %+v", images)
+	}
+
+	if err := WriteSidecar(buf, "yaml", image); err == nil {
+		t.Error("expected an unknown format to be refused")
+	}
+}
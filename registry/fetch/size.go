@@ -0,0 +1,85 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Size is the number of bytes the layers of img take to download, for a tool
+// to check the space left, or warn, before fetching them: the sizes of the
+// blobs listed in the manifest on v2 registries, and the Content-Length of a
+// HEAD request for each layer on v1 ones, or the size in its json when the
+// registry does not give one. Nothing of the layers is downloaded.
+func (re *RegistryEndpoint) Size(img *ImageRef) (int64, error) {
+	return re.SizeContext(context.Background(), img)
+}
+
+// SizeContext is Size, giving up when ctx is done.
+func (re *RegistryEndpoint) SizeContext(ctx context.Context, img *ImageRef) (int64, error) {
+	if err := re.resolveAncestry(ctx, img); err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, id := range img.Ancestry() {
+		size, err := re.layerSize(ctx, img, id)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// layerSize is the size of the download of the layer id of img, once its
+// ancestry is resolved
+func (re *RegistryEndpoint) layerSize(ctx context.Context, img *ImageRef, id string) (int64, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		return img.v2.layers[id].Size, nil
+	}
+	size, err := re.v1LayerSize(ctx, img, id)
+	if err != nil {
+		return 0, LayerError{ID: id, Err: err}
+	}
+	return size, nil
+}
+
+// v1LayerSize is the size of the download of the layer id of img, from a v1
+// registry
+func (re *RegistryEndpoint) v1LayerSize(ctx context.Context, img *ImageRef, id string) (int64, error) {
+	endpoint := re.v1Endpoint()
+	urlStr := re.apiURL(endpoint, fmt.Sprintf("/v1/images/%s/layer", id))
+	req, err := http.NewRequestWithContext(ctx, "HEAD", urlStr, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := re.authorize(req, img); err != nil {
+		return 0, err
+	}
+	resp, err := re.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, newResponseError(urlStr, resp)
+	}
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+	buf, err := re.v1LayerJSON(ctx, img, endpoint, id)
+	if err != nil {
+		return 0, err
+	}
+	var md struct {
+		Size *int64
+	}
+	if err := json.Unmarshal(buf, &md); err != nil {
+		return 0, err
+	}
+	if md.Size == nil {
+		return 0, fmt.Errorf("the registry gives no size")
+	}
+	return *md.Size, nil
+}
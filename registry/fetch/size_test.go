@@ -0,0 +1,51 @@
+package fetch
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestRegistrySize(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		var expected int64
+		layerPaths := []string{}
+		if tr.manifest != nil {
+			// the compressed blobs
+			var manifest ManifestV2
+			if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range manifest.Layers {
+				expected += l.Size
+				layerPaths = append(layerPaths, "/v2/test/image/blobs/"+l.Digest)
+			}
+		} else {
+			for _, l := range testLayers {
+				expected += int64(len(l.Layer))
+			}
+		}
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		size, err := r.Size(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != expected {
+			t.Errorf("expected %d bytes, got %d", expected, size)
+		}
+		for _, p := range layerPaths {
+			if n := tr.Requests[p]; n != 0 {
+				t.Errorf("%s: expected no layer downloaded, got %d requests", p, n)
+			}
+		}
+	}
+
+	tr := newTestRegistry(t, testLayers...)
+	tr.Fail["/v1/images/"+testLayers[1].ID+"/layer"] = http.StatusNotFound
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.Size(ref); !isNotFound(err) {
+		t.Errorf("expected the missing layer to fail, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/docker-utils/export"
+)
+
+// Squash merges the top-most n layers of img, fetched into src, into a
+// single layer, like an image built with many RUN steps committed at once,
+// and returns the ID of the new layer. The layers below are kept as they are,
+// so a shared base stays shared. The new layer takes the json of the
+// top-most, and img its shortened ancestry. The layers squashed are left in
+// src, for the other images fetched there that may have them.
+func Squash(img *ImageRef, src string, n int) (string, error) {
+	ancestry := img.Ancestry()
+	if n < 1 || n > len(ancestry) {
+		return "", fmt.Errorf("%s: cannot squash %d of its %d layers", img, n, len(ancestry))
+	}
+	if n == 1 {
+		return ancestry[0], nil
+	}
+	parent := ""
+	if n < len(ancestry) {
+		parent = ancestry[n]
+	}
+
+	tmp, err := ioutil.TempDir(src, ".squash-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	fh, err := os.Create(filepath.Join(tmp, "layer.tar"))
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = export.SquashLayers(src, ancestry[:n], io.MultiWriter(fh, h))
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: squashing: %w", img, err)
+	}
+	diffID := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	// like the IDs of the layers of v2 images, derived from the chain of
+	// layers and, through the top-most ID, the config
+	id := strings.TrimPrefix(digestOf([]byte(parent+" "+diffID+" "+ancestry[0])), "sha256:")
+
+	buf, err := ioutil.ReadFile(filepath.Join(src, ancestry[0], "json"))
+	if err != nil {
+		return "", err
+	}
+	md := map[string]interface{}{}
+	if err := json.Unmarshal(buf, &md); err != nil {
+		return "", fmt.Errorf("layer %s: %w", ancestry[0], err)
+	}
+	md["id"] = id
+	delete(md, "parent")
+	if parent != "" {
+		md["parent"] = parent
+	}
+	fi, err := os.Stat(filepath.Join(tmp, "layer.tar"))
+	if err != nil {
+		return "", err
+	}
+	md["Size"] = fi.Size()
+	if buf, err = json.Marshal(md); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "json"), buf, 0644); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "VERSION"), []byte("1.0"), 0644); err != nil {
+		return "", err
+	}
+	if err := writeLayerChecksum(tmp, diffID); err != nil {
+		return "", err
+	}
+	dest := filepath.Join(src, id)
+	if err := os.RemoveAll(dest); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
+
+	img.SetAncestry(append([]string{id}, ancestry[n:]...))
+	img.SetID(id)
+	// the manifest and config fetched are no longer those of the image, which
+	// is written out from the json of its layers
+	img.v2 = nil
+	return id, nil
+}
+
+// SquashAbove is Squash, for the layers of img above the layer id, which
+// becomes the parent of the new layer
+func SquashAbove(img *ImageRef, src, id string) (string, error) {
+	for i, ancestor := range img.Ancestry() {
+		if ancestor != id {
+			continue
+		}
+		if i == 0 {
+			// nothing above it
+			return id, nil
+		}
+		return Squash(img, src, i)
+	}
+	return "", fmt.Errorf("%s: layer %s is not one of its layers", img, id)
+}
@@ -0,0 +1,67 @@
+package fetch
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	layer := func(name, content string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+		tw.Close()
+		return buf.Bytes()
+	}
+	tr := newTestRegistryV2(t,
+		testLayer{ID: strings.Repeat("e", 64), Parent: strings.Repeat("d", 64), Layer: layer("app/run", "#!/bin/sh\n")},
+		testLayer{ID: strings.Repeat("d", 64), Parent: strings.Repeat("c", 64), Layer: layer("app/lib", "lib\n")},
+		testLayer{ID: strings.Repeat("c", 64), Layer: layer("etc/os-release", "ID=test\n")},
+	)
+	tdir, err := ioutil.TempDir("", "test.squash.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	ancestry := ref.Ancestry()
+	id, err := SquashAbove(ref, tdir, ancestry[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := ref.Ancestry(); len(a) != 2 || a[0] != id || a[1] != ancestry[2] || ref.ID() != id {
+		t.Fatalf("expected the squashed layer on the base, got %v", a)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(tdir, id, "json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md struct {
+		ID     string `json:"id"`
+		Parent string `json:"parent"`
+	}
+	if err := json.Unmarshal(buf, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.ID != id || md.Parent != ancestry[2] {
+		t.Errorf("expected the json of the squashed layer to name it and its parent, got %s", buf)
+	}
+	if err := VerifyLayers(ref, tdir, true); err != nil {
+		t.Error(err)
+	}
+	if _, err := Squash(ref, tdir, 3); err == nil {
+		t.Errorf("expected squashing more layers than the image has to fail")
+	}
+}
@@ -0,0 +1,320 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+// LayerStore is where FetchLayersToStore puts the layers it fetches: the
+// json and layer.tar of each, by layer ID, like the legacy `docker save`
+// layout. A LayerStore may be used by concurrent fetches.
+type LayerStore interface {
+	// Exists reports whether the store has both the json and the layer.tar
+	// of the layer id
+	Exists(id string) (bool, error)
+	// PutJSON stores buf as the json of the layer id
+	PutJSON(id string, buf []byte) error
+	// PutLayer stores the size bytes read from r as the layer.tar of the
+	// layer id, or all of them when size is -1, for the layers not known
+	// before the download is over. An error reading r, like the
+	// ErrDigestMismatch of a layer that does not match its digest, must
+	// leave the layer.tar out of the store.
+	PutLayer(id string, r io.Reader, size int64) error
+}
+
+// FetchLayersToStore is FetchLayers, putting the layers into store rather
+// than a directory. The layers the store has already are not fetched again,
+// nor scanned. The others are streamed into the store one after the other,
+// from the base up, each layer.tar before its json, once the image has been
+// vetted as FetchLayers vets it, without staging them on disk: a layer
+// failing its digest is not put, but those before it are. Unlike
+// FetchLayers, a download cut off is not resumed.
+func (re *RegistryEndpoint) FetchLayersToStore(img *ImageRef, store LayerStore) ([]string, error) {
+	return re.FetchLayersToStoreContext(context.Background(), img, store)
+}
+
+// FetchLayersToStoreContext is FetchLayersToStore, giving up when ctx is
+// done.
+func (re *RegistryEndpoint) FetchLayersToStoreContext(ctx context.Context, img *ImageRef, store LayerStore) ([]string, error) {
+	emptySet := []string{}
+	if err := re.vet(ctx, img); err != nil {
+		return emptySet, err
+	}
+	ancestry := img.Ancestry()
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		id := ancestry[i]
+		ok, err := store.Exists(id)
+		if err != nil {
+			return emptySet, fmt.Errorf("layer %s: %w", id, err)
+		}
+		if ok {
+			continue
+		}
+		if err := re.putLayer(ctx, img, store, id); err != nil {
+			return emptySet, LayerError{ID: id, Err: err}
+		}
+	}
+	if re.Scanner != nil {
+		config, err := re.layerJSON(ctx, img, img.ID())
+		if err != nil {
+			return emptySet, err
+		}
+		result, err := re.Scanner.Finish(img, config)
+		if err != nil {
+			return emptySet, err
+		}
+		img.SetScanResult(result)
+	}
+	return ancestry, nil
+}
+
+// putLayer streams the layer id of img into store, and gives it to the
+// Scanner as it goes, if any
+func (re *RegistryEndpoint) putLayer(ctx context.Context, img *ImageRef, store LayerStore, id string) error {
+	rc, size, err := re.FetchLayerStreamContext(ctx, img, id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if size >= 0 {
+		r = &endReader{r: rc, remaining: size}
+	}
+	if re.Scanner == nil {
+		err = store.PutLayer(id, r, size)
+	} else {
+		pr, pw := io.Pipe()
+		scanned := make(chan error, 1)
+		go func() {
+			err := re.Scanner.Layer(img, id, pr)
+			// for the store not to wait on a scanner done early
+			io.Copy(ioutil.Discard, pr)
+			scanned <- err
+		}()
+		err = store.PutLayer(id, io.TeeReader(r, pw), size)
+		pw.CloseWithError(err)
+		if scanErr := <-scanned; err == nil {
+			err = scanErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	buf, err := re.layerJSON(ctx, img, id)
+	if err != nil {
+		return err
+	}
+	return store.PutJSON(id, buf)
+}
+
+// endReader reads the remaining bytes of r, reading on to the end of r with
+// the last of them, so that a store taking only those bytes, like a single
+// PUT of their size, still gets the error of a stream checked at its end
+type endReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *endReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return e.end(0)
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == nil && e.remaining == 0 {
+		return e.end(n)
+	}
+	return n, err
+}
+
+// end reads r to its end once the n last bytes expected have been read
+func (e *endReader) end(n int) (int, error) {
+	var probe [1]byte
+	m, err := io.ReadFull(e.r, probe[:])
+	if m > 0 {
+		return n, fmt.Errorf("layer.tar: more than the bytes expected")
+	}
+	if err == io.EOF {
+		if n > 0 {
+			return n, nil
+		}
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+// DirStore is a LayerStore in a local directory, in the layout FetchLayers
+// writes, with the checksum of each layer.tar recorded beside it
+type DirStore struct {
+	Dir string
+}
+
+// Exists reports whether the layer id has its json and layer.tar in the
+// directory
+func (s DirStore) Exists(id string) (bool, error) {
+	if !isLayerID(id) {
+		return false, fmt.Errorf("invalid layer ID %q", id)
+	}
+	for _, name := range []string{"json", "layer.tar"} {
+		if _, err := os.Stat(filepath.Join(s.Dir, id, name)); os.IsNotExist(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// PutJSON writes buf as the json of the layer id
+func (s DirStore) PutJSON(id string, buf []byte) error {
+	return s.put(id, "json", bytes.NewReader(buf), nil)
+}
+
+// PutLayer writes r as the layer.tar of the layer id, recording its checksum
+func (s DirStore) PutLayer(id string, r io.Reader, size int64) error {
+	h := sha256.New()
+	if err := s.put(id, "layer.tar", io.TeeReader(r, h), &size); err != nil {
+		return err
+	}
+	return writeLayerChecksum(filepath.Join(s.Dir, id), "sha256:"+hex.EncodeToString(h.Sum(nil)))
+}
+
+// put writes r to the file name of the layer id through a temporary file, so
+// that a partial write is never taken for the file
+func (s DirStore) put(id, name string, r io.Reader, size *int64) error {
+	if !isLayerID(id) {
+		return fmt.Errorf("invalid layer ID %q", id)
+	}
+	dir := filepath.Join(s.Dir, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(dir, "."+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	n, err := io.Copy(fh, r)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size != nil && *size >= 0 && n != *size {
+		return fmt.Errorf("%s: expected %d bytes, got %d", name, *size, n)
+	}
+	if err := os.Chmod(fh.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), filepath.Join(dir, name))
+}
+
+// layerID is the form of the legacy layer IDs, which name the directories of
+// the layers
+var layerID = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// isLayerID reports whether id may name the directory of a layer, rather
+// than a path out of the store
+func isLayerID(id string) bool {
+	return layerID.MatchString(id)
+}
+
+// checkLayerIDs returns an error for the first of ids, as a registry gave
+// them, that is not a layer ID, before any is used in a path
+func checkLayerIDs(ids ...string) error {
+	for _, id := range ids {
+		if !isLayerID(id) {
+			return fmt.Errorf("invalid layer ID %q", id)
+		}
+	}
+	return nil
+}
+
+// MemoryStore is a LayerStore in memory, for tests and small images
+type MemoryStore struct {
+	mu     sync.Mutex
+	jsons  map[string][]byte
+	layers map[string][]byte
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{jsons: map[string][]byte{}, layers: map[string][]byte{}}
+}
+
+// Exists reports whether the layer id was put, json and layer.tar
+func (s *MemoryStore) Exists(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, okJSON := s.jsons[id]
+	_, okLayer := s.layers[id]
+	return okJSON && okLayer, nil
+}
+
+// PutJSON keeps a copy of buf as the json of the layer id
+func (s *MemoryStore) PutJSON(id string, buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jsons[id] = append([]byte{}, buf...)
+	return nil
+}
+
+// PutLayer reads r into memory as the layer.tar of the layer id
+func (s *MemoryStore) PutLayer(id string, r io.Reader, size int64) error {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(buf)) != size {
+		return fmt.Errorf("layer.tar: expected %d bytes, got %d", size, len(buf))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.layers[id] = buf
+	return nil
+}
+
+// JSON is the json put for the layer id, if any
+func (s *MemoryStore) JSON(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.jsons[id]
+	return buf, ok
+}
+
+// Layer is the layer.tar put for the layer id, if any
+func (s *MemoryStore) Layer(id string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, ok := s.layers[id]
+	return buf, ok
+}
+
+// IDs are the layers put, whole or in part
+func (s *MemoryStore) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id := range s.jsons {
+		ids = append(ids, id)
+	}
+	for id := range s.layers {
+		if _, ok := s.jsons[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
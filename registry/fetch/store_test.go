@@ -0,0 +1,243 @@
+package fetch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestFetchLayersToStore(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	store := NewMemoryStore()
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	ids, err := r.FetchLayersToStore(ref, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(testLayers) {
+		t.Fatalf("expected %d layers, got %d", len(testLayers), len(ids))
+	}
+	for i, id := range ids {
+		if buf, ok := store.Layer(id); !ok || string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("layer %d: expected %q in the store, got %q", i, testLayers[i].Layer, buf)
+		}
+		if _, ok := store.JSON(id); !ok {
+			t.Errorf("layer %d: expected its json in the store", i)
+		}
+	}
+
+	// the layers the store has are not fetched again
+	blobs := 0
+	for p, n := range tr.Requests {
+		if strings.Contains(p, "/blobs/") {
+			blobs += n
+		}
+	}
+	ref = tr.Ref()
+	if _, err := r.FetchLayersToStore(ref, store); err != nil {
+		t.Fatal(err)
+	}
+	after := 0
+	for p, n := range tr.Requests {
+		if strings.Contains(p, "/blobs/") {
+			after += n
+		}
+	}
+	// only the config is fetched again
+	if after != blobs+1 {
+		t.Errorf("expected no layer to be fetched again, got %d more blob requests", after-blobs)
+	}
+
+	// a directory store has the layout and checksums of FetchLayers
+	dir := DirStore{Dir: t.TempDir()}
+	if _, err := r.FetchLayersToStore(tr.Ref(), dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if ok, err := dir.Exists(id); err != nil || !ok {
+			t.Errorf("layer %s: expected it in the directory, got %v", id, err)
+		}
+		if err := VerifyLayer(dir.Dir, id, true); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := dir.Exists("../escape"); err == nil {
+		t.Error("expected an ID with a path to be refused")
+	}
+
+	// a layer not matching its digest is not put
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(tampered)
+	gz.Write([]byte("tampered"))
+	gz.Close()
+	tr.mu.Lock()
+	tr.blobs[manifest.Layers[0].Digest] = tampered.Bytes()
+	tr.mu.Unlock()
+	dir = DirStore{Dir: t.TempDir()}
+	var mismatch ErrDigestMismatch
+	if _, err := r.FetchLayersToStore(tr.Ref(), dir); !errors.As(err, &mismatch) {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if ok, _ := dir.Exists(ids[len(ids)-1]); ok {
+		t.Error("expected the tampered layer not to be put")
+	}
+}
+
+func TestEndReader(t *testing.T) {
+	failed := errors.New("digest mismatch")
+	// a store taking only the bytes expected still gets the error at the end
+	r := &endReader{r: io.MultiReader(strings.NewReader("layer"), iotest.ErrReader(failed)), remaining: 5}
+	if _, err := ioutil.ReadAll(io.LimitReader(r, 5)); err != failed {
+		t.Errorf("expected the error of the end of the stream, got %v", err)
+	}
+	r = &endReader{r: strings.NewReader("layer"), remaining: 5}
+	if buf, err := ioutil.ReadAll(r); err != nil || string(buf) != "layer" {
+		t.Errorf("expected the layer, got %q, %v", buf, err)
+	}
+	r = &endReader{r: strings.NewReader("layer and more"), remaining: 5}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected more bytes than expected to be an error")
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		objects = map[string][]byte{}
+		parts   = map[string][]byte{}
+		aborted = 0
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authz := r.Header.Get("Authorization")
+		if !strings.HasPrefix(authz, "AWS4-HMAC-SHA256 Credential=AKID/20240102/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") ||
+			r.Header.Get("X-Amz-Date") != "20240102T030405Z" || r.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+			http.Error(w, "bad signature: "+authz, http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "HEAD":
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "PUT":
+			if r.ContentLength < 0 {
+				http.Error(w, "no length", http.StatusLengthRequired)
+				return
+			}
+			buf, _ := ioutil.ReadAll(r.Body)
+			if number := r.URL.Query().Get("partNumber"); number != "" {
+				parts[number] = buf
+				w.Header().Set("ETag", `"etag-`+number+`"`)
+				return
+			}
+			objects[r.URL.Path] = buf
+		case "POST":
+			if _, ok := r.URL.Query()["uploads"]; ok {
+				fmt.Fprint(w, `<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>`)
+				return
+			}
+			var complete struct {
+				Parts []s3Part `xml:"Part"`
+			}
+			if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil || r.URL.Query().Get("uploadId") != "upload-1" {
+				http.Error(w, "bad completion", http.StatusBadRequest)
+				return
+			}
+			var object []byte
+			for i, part := range complete.Parts {
+				number := strconv.Itoa(i + 1)
+				if part.ETag != `"etag-`+number+`"` {
+					fmt.Fprintf(w, `<Error><Code>InvalidPart</Code><Message>%s</Message></Error>`, part.ETag)
+					return
+				}
+				object = append(object, parts[number]...)
+			}
+			objects[r.URL.Path] = object
+			parts = map[string][]byte{}
+		case "DELETE":
+			aborted++
+			parts = map[string][]byte{}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected", http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	s := &S3Store{Endpoint: srv.URL + "/", Bucket: "images", Prefix: "layers/", Region: "eu-west-1", AccessKey: "AKID", SecretKey: "secret"}
+	s.now = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+	id := strings.Repeat("a", 64)
+	if ok, err := s.Exists(id); err != nil || ok {
+		t.Fatalf("expected the layer not to exist, got %t, %v", ok, err)
+	}
+	if err := s.PutLayer(id, strings.NewReader("layer"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists(id); err != nil || ok {
+		t.Fatalf("expected the layer without its json not to exist, got %t, %v", ok, err)
+	}
+	if err := s.PutJSON(id, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Exists(id); err != nil || !ok {
+		t.Fatalf("expected the layer to exist, got %t, %v", ok, err)
+	}
+	if string(objects["/images/layers/"+id+"/layer.tar"]) != "layer" || string(objects["/images/layers/"+id+"/json"]) != "{}" {
+		t.Errorf("expected the objects under the prefix, got %v", objects)
+	}
+
+	// in parts, when of a size not known
+	s.PartSize = 4
+	if err := s.PutLayer(id, strings.NewReader("0123456789"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if buf := objects["/images/layers/"+id+"/layer.tar"]; string(buf) != "0123456789" {
+		t.Errorf("expected the layer uploaded in parts, got %q", buf)
+	}
+	// and aborted when the layer fails
+	failing := io.MultiReader(strings.NewReader("01234"), iotest.ErrReader(ErrDigestMismatch{}))
+	if err := s.PutLayer(strings.Repeat("b", 64), failing, -1); err == nil {
+		t.Error("expected the failing layer not to be uploaded")
+	}
+	if _, ok := objects["/images/layers/"+strings.Repeat("b", 64)+"/layer.tar"]; ok || aborted != 1 {
+		t.Errorf("expected the upload aborted, got %d aborted", aborted)
+	}
+
+	s.SecretKey = "wrong"
+	s.AccessKey = "other"
+	if _, err := s.Exists(id); err == nil {
+		t.Error("expected the refused request to fail")
+	}
+}
+
+func TestSigV4Key(t *testing.T) {
+	// the example of the AWS documentation
+	key := sigV4Key("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	if expected := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; hex.EncodeToString(key) != expected {
+		t.Errorf("expected the signing key %s, got %x", expected, key)
+	}
+}
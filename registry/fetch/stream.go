@@ -0,0 +1,256 @@
+package fetch
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// FetchLayerStream returns the layer.tar of the layer id of img as it
+// downloads, without writing anything to disk, and its size, or -1 when it
+// is not known before the download is over (for the compressed layers of v2
+// registries). The download is checked against the digest of the layer in
+// the manifest, and any set with ImageRef.SetLayerDigest, as it is read: a
+// mismatch is an ErrDigestMismatch returned by Read at the end, instead of
+// io.EOF, so the content must not be trusted until then. Unlike FetchLayers,
+// a download cut off is not resumed.
+func (re *RegistryEndpoint) FetchLayerStream(img *ImageRef, id string) (io.ReadCloser, int64, error) {
+	return re.FetchLayerStreamContext(context.Background(), img, id)
+}
+
+// FetchLayerStreamContext is FetchLayerStream, giving up when ctx is done.
+func (re *RegistryEndpoint) FetchLayerStreamContext(ctx context.Context, img *ImageRef, id string) (io.ReadCloser, int64, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		return re.v2LayerStream(ctx, img, id)
+	}
+	return re.v1LayerStream(ctx, img, id)
+}
+
+// FetchBlob returns the blob digest of the repository of img, like a layer
+// or a config, as it downloads, and its size, or -1 if the registry does not
+// say. It is checked against digest as it is read, as FetchLayerStream
+// checks layers: the bytes are returned as they download, and a mismatch is
+// only known from the ErrDigestMismatch of the last Read, so they must not
+// be trusted before then. Only sha256 digests are supported, and only v2
+// registries serve blobs by digest.
+func (re *RegistryEndpoint) FetchBlob(img *ImageRef, digest string) (io.ReadCloser, int64, error) {
+	return re.FetchBlobContext(context.Background(), img, digest)
+}
+
+// FetchBlobContext is FetchBlob, giving up when ctx is done.
+func (re *RegistryEndpoint) FetchBlobContext(ctx context.Context, img *ImageRef, digest string) (io.ReadCloser, int64, error) {
+	if !referenceDigest.MatchString(digest) {
+		return nil, 0, fmt.Errorf("invalid digest %q", digest)
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, 0, fmt.Errorf("unsupported digest %q", digest)
+	}
+	if re.Policy != nil {
+		if err := re.Policy.CheckRef(img); err != nil {
+			return nil, 0, err
+		}
+	}
+	if re.APIVersionContext(ctx) != APIVersion2 {
+		return nil, 0, fmt.Errorf("%s: blobs are only served by v2 registries", re.Host)
+	}
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(img), digest))
+	resp, err := re.v2Do(ctx, img, "GET", urlStr, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, newResponseError(urlStr, resp)
+	}
+	resp = re.throttle(resp)
+	return newDigestReader(digest, resp.Body, digest), resp.ContentLength, nil
+}
+
+// EachLayer calls fn with the stream of each layer of img, from the base up,
+// as FetchLayerStream returns them, once the image has been vetted as
+// FetchLayers vets it, by the Policy, ContentTrust, DigestChecker and Trust,
+// and the LayerDenyList for the images of v2 registries. Each stream is
+// closed when fn returns; an error reading it to the end is returned after
+// fn's. The first error stops the iteration.
+func (re *RegistryEndpoint) EachLayer(img *ImageRef, fn func(id string, r io.Reader, size int64) error) error {
+	return re.EachLayerContext(context.Background(), img, fn)
+}
+
+// EachLayerContext is EachLayer, giving up when ctx is done.
+func (re *RegistryEndpoint) EachLayerContext(ctx context.Context, img *ImageRef, fn func(id string, r io.Reader, size int64) error) error {
+	if err := re.vet(ctx, img); err != nil {
+		return err
+	}
+	ancestry := img.Ancestry()
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		id := ancestry[i]
+		rc, size, err := re.FetchLayerStreamContext(ctx, img, id)
+		if err != nil {
+			return LayerError{ID: id, Err: err}
+		}
+		err = fn(id, rc, size)
+		if err == nil {
+			// the digest is only checked once the stream is read to the end
+			_, err = io.Copy(ioutil.Discard, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return LayerError{ID: id, Err: err}
+		}
+	}
+	return nil
+}
+
+// resolveAncestry resolves the ancestry of img, unless it is known already
+func (re *RegistryEndpoint) resolveAncestry(ctx context.Context, img *ImageRef) error {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		_, err := re.v2Resolve(ctx, img)
+		return err
+	}
+	if !re.hasToken(ctx, img) {
+		if _, err := re.TokenContext(ctx, img); err != nil {
+			return err
+		}
+	}
+	if len(img.Ancestry()) == 0 {
+		if _, err := re.AncestryContext(ctx, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// layerJSON is the legacy json of the layer id of img, from the registry
+func (re *RegistryEndpoint) layerJSON(ctx context.Context, img *ImageRef, id string) ([]byte, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		v2, err := re.v2Resolve(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+		return v2.layerJSON(id)
+	}
+	return re.v1LayerJSON(ctx, img, re.v1Endpoint(), id)
+}
+
+// v1LayerStream is FetchLayerStream, from a v1 registry
+func (re *RegistryEndpoint) v1LayerStream(ctx context.Context, img *ImageRef, id string) (io.ReadCloser, int64, error) {
+	if err := re.resolveAncestry(ctx, img); err != nil {
+		return nil, 0, err
+	}
+	urlStr := re.apiURL(re.v1Endpoint(), fmt.Sprintf("/v1/images/%s/layer", id))
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := re.authorize(req, img); err != nil {
+		return nil, 0, err
+	}
+	resp, err := re.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, newResponseError(urlStr, resp)
+	}
+	resp = re.throttle(resp)
+	return newDigestReader(id, resp.Body, img.LayerDigest(id)), resp.ContentLength, nil
+}
+
+// v2LayerStream is FetchLayerStream, from a v2 registry
+func (re *RegistryEndpoint) v2LayerStream(ctx context.Context, img *ImageRef, id string) (io.ReadCloser, int64, error) {
+	v2, err := re.v2Resolve(ctx, img)
+	if err != nil {
+		return nil, 0, err
+	}
+	desc, ok := v2.layers[id]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: layer %s is not one of its layers", img, id)
+	}
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(img), desc.Digest))
+	resp, err := re.v2Do(ctx, img, "GET", urlStr, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, newResponseError(urlStr, resp)
+	}
+	resp = re.throttle(resp)
+	blob := newDigestReader(id, resp.Body, desc.Digest, img.LayerDigest(id))
+	if desc.MediaType == MediaTypeOCILayer {
+		return blob, desc.Size, nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReaderSize(blob, DecompressBufferSize))
+	if err != nil {
+		blob.Close()
+		return nil, 0, LayerError{ID: id, Err: err}
+	}
+	return &gunzipReader{gz: gz, blob: blob}, -1, nil
+}
+
+// digestReader reads r, checking its digest against each of the expected
+// digests set once it is read to the end
+type digestReader struct {
+	id       string
+	r        io.ReadCloser
+	h        hash.Hash
+	expected []string
+	err      error
+}
+
+func newDigestReader(id string, r io.ReadCloser, expected ...string) *digestReader {
+	return &digestReader{id: id, r: r, h: sha256.New(), expected: expected}
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		digest := "sha256:" + hex.EncodeToString(d.h.Sum(nil))
+		// there is no file to remove on a mismatch
+		if verr := verifyDigest(d.id, "", digest, d.expected...); verr != nil {
+			err = verr
+		}
+	}
+	d.err = err
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	return d.r.Close()
+}
+
+// gunzipReader decompresses a blob, reading it to the end so that its
+// digest is checked
+type gunzipReader struct {
+	gz   *gzip.Reader
+	blob *digestReader
+}
+
+func (g *gunzipReader) Read(p []byte) (int, error) {
+	n, err := g.gz.Read(p)
+	if err == io.EOF {
+		// what follows the gzip stream, if anything, is part of the blob
+		if _, err := io.Copy(ioutil.Discard, g.blob); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (g *gunzipReader) Close() error {
+	g.gz.Close()
+	return g.blob.Close()
+}
@@ -0,0 +1,162 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestFetchLayerStream(t *testing.T) {
+	for _, tr := range []*testRegistry{newTestRegistry(t, testLayers...), newTestRegistryV2(t, testLayers...)} {
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		if err := r.resolveAncestry(context.Background(), ref); err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range ref.Ancestry() {
+			rc, size, err := r.FetchLayerStream(ref, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != string(testLayers[i].Layer) {
+				t.Errorf("layer %d: expected %q, got %q", i, testLayers[i].Layer, buf)
+			}
+			// the compressed blobs of v2 are not of the size of the layer
+			if expected := int64(len(buf)); tr.V2 && size != -1 || !tr.V2 && size != expected {
+				t.Errorf("layer %d: unexpected size %d", i, size)
+			}
+		}
+
+		// a digest that does not match is an error once read to the end
+		id := ref.Ancestry()[0]
+		ref.SetLayerDigest(id, "sha256:"+strings.Repeat("0", 64))
+		rc, _, err := r.FetchLayerStream(ref, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		var mismatch ErrDigestMismatch
+		if !errors.As(err, &mismatch) {
+			t.Errorf("expected a digest mismatch, got %v", err)
+		}
+	}
+}
+
+func TestEachLayer(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	i := len(testLayers)
+	err := r.EachLayer(ref, func(id string, rd io.Reader, size int64) error {
+		i--
+		if id != ref.Ancestry()[i] {
+			t.Errorf("expected the layers from the base up, got %s for %d", id, i)
+		}
+		buf, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return err
+		}
+		if string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("layer %d: expected %q, got %q", i, testLayers[i].Layer, buf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 0 {
+		t.Errorf("expected every layer, %d were not", i)
+	}
+
+	// an error of fn stops the iteration
+	stop := errors.New("stop")
+	calls := 0
+	err = r.EachLayer(tr.Ref(), func(id string, rd io.Reader, size int64) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("expected the iteration to stop at the first error, got %v after %d calls", err, calls)
+	}
+
+	// the policy is checked before any layer is downloaded
+	blobs := 0
+	for p, n := range tr.Requests {
+		if strings.Contains(p, "/blobs/") {
+			blobs += n
+		}
+	}
+	r.Policy = &Policy{DeniedRegistries: []string{tr.Host()}}
+	err = r.EachLayer(tr.Ref(), func(id string, rd io.Reader, size int64) error {
+		t.Errorf("unexpected layer %s of a denied registry", id)
+		return nil
+	})
+	var perr PolicyError
+	if !errors.As(err, &perr) {
+		t.Errorf("expected a policy error, got %v", err)
+	}
+	after := 0
+	for p, n := range tr.Requests {
+		if strings.Contains(p, "/blobs/") {
+			after += n
+		}
+	}
+	if after != blobs {
+		t.Errorf("expected no blob of a denied registry to be fetched, got %d", after-blobs)
+	}
+}
+
+func TestFetchBlob(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	var manifest ManifestV2
+	if err := json.Unmarshal(tr.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	digest := manifest.Config.Digest
+	rc, size, err := r.FetchBlob(ref, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(tr.blobs[digest]) || size != int64(len(buf)) {
+		t.Errorf("expected the config of %d bytes, got %d of %d: %s", len(tr.blobs[digest]), len(buf), size, buf)
+	}
+
+	// a blob not matching its digest is an error once read to the end
+	tr.mu.Lock()
+	tr.blobs[digest] = []byte("{}")
+	tr.mu.Unlock()
+	rc, _, err = r.FetchBlob(ref, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(ioutil.Discard, rc)
+	rc.Close()
+	var mismatch ErrDigestMismatch
+	if !errors.As(err, &mismatch) {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+
+	if _, _, err := r.FetchBlob(ref, "latest"); err == nil {
+		t.Error("expected an invalid digest to be refused")
+	}
+	if _, _, err := r.FetchBlob(ref, "sha512:"+strings.Repeat("0", 128)); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected a sha512 digest to be refused, got %v", err)
+	}
+}
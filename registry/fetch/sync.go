@@ -0,0 +1,126 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SyncState records, per reference, the content last synced, so that a
+// mirror sync can skip references whose tag still points at the same thing.
+type SyncState struct {
+	filename string
+	mu       sync.Mutex
+	// Synced maps the reference (ImageRef.String()) to its content digest, or
+	// image ID for v1 registries
+	Synced map[string]string `json:"synced"`
+}
+
+// LoadSyncState reads the state from filename. A missing file is an empty
+// state that will be created on Save.
+func LoadSyncState(filename string) (*SyncState, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	state := &SyncState{filename: filename, Synced: map[string]string{}}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, err
+	}
+	if state.Synced == nil {
+		state.Synced = map[string]string{}
+	}
+	return state, nil
+}
+
+// Save writes the state back to the file it was loaded from
+func (s *SyncState) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.filename)
+}
+
+// Unchanged reports whether ref was last synced at digest
+func (s *SyncState) Unchanged(ref *ImageRef, digest string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return digest != "" && s.Synced[ref.String()] == digest
+}
+
+// Mark records that ref has been synced at digest
+func (s *SyncState) Mark(ref *ImageRef, digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Synced[ref.String()] = digest
+}
+
+// Digest returns the digest ref was last synced at, if it has been
+func (s *SyncState) Digest(ref *ImageRef) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	digest, ok := s.Synced[ref.String()]
+	return digest, ok
+}
+
+// Forget drops what was recorded of ref
+func (s *SyncState) Forget(ref *ImageRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Synced, ref.String())
+}
+
+// Resolve returns the identifier of the content the reference currently
+// points to, without fetching any of it. For v1 registries this is the image
+// ID of the tag, and for v2 registries the manifest digest, found with a
+// HEAD request.
+func (re *RegistryEndpoint) Resolve(img *ImageRef) (string, error) {
+	return re.ResolveContext(context.Background(), img)
+}
+
+// ResolveContext is Resolve, giving up when ctx is done.
+func (re *RegistryEndpoint) ResolveContext(ctx context.Context, img *ImageRef) (string, error) {
+	if re.APIVersionContext(ctx) == APIVersion2 {
+		return re.v2ManifestDigest(ctx, img)
+	}
+	return re.ImageIDContext(ctx, img)
+}
+
+// SyncSet is like FetchSet, but consults state first and skips references
+// that still resolve to what was last synced. The state is updated for each
+// reference fetched successfully; saving it is left to the caller. A
+// registry in maintenance is paused while the others are synced, and resumed
+// once it is back.
+func SyncSet(set ImageRefSet, dest string, state *SyncState) []FetchResult {
+	return RunBatches(context.Background(), set.Batches(), func(batch HostBatch, ref *ImageRef) FetchResult {
+		digest, err := batch.Registry.Resolve(ref)
+		if err != nil {
+			return FetchResult{Ref: ref, Err: err}
+		}
+		if state.Unchanged(ref, digest) {
+			return FetchResult{Ref: ref, Skipped: true}
+		}
+		layers, err := batch.Registry.FetchLayers(ref, dest)
+		if err == nil {
+			state.Mark(ref, digest)
+		}
+		return FetchResult{Ref: ref, Layers: layers, Err: err}
+	})
+}
@@ -0,0 +1,41 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncState(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.sync.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	filename := filepath.Join(tdir, "state.json")
+	state, err := LoadSyncState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := NewImageRef("busybox")
+	if state.Unchanged(ref, "abc") {
+		t.Errorf("expected an empty state to have nothing synced")
+	}
+	state.Mark(ref, "abc")
+	if err := state.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = LoadSyncState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Unchanged(NewImageRef("docker.io/busybox:latest"), "abc") {
+		t.Errorf("expected the reloaded state to have %s synced", ref)
+	}
+	if state.Unchanged(ref, "def") {
+		t.Errorf("expected a new digest to be a change")
+	}
+}
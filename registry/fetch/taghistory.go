@@ -0,0 +1,208 @@
+package fetch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+// HubRepositoriesURL is where the Docker Hub serves the tags of its
+// repositories, with when they were last pushed
+var HubRepositoriesURL = "https://hub.docker.com/v2/repositories/"
+
+// TagHistoryEntry is a manifest a tag pointed to, from Start until End, which
+// is zero while it still does
+type TagHistoryEntry struct {
+	Digest string
+	Start  time.Time
+	End    time.Time
+}
+
+// ErrNoTagHistory is returned by PinTagAt when the history of the tag of Ref
+// does not go back to When, and by TagHistory, without a When, when the
+// registry keeps no history
+type ErrNoTagHistory struct {
+	Ref  string
+	When time.Time
+}
+
+func (e ErrNoTagHistory) Error() string {
+	if e.When.IsZero() {
+		return fmt.Sprintf("%s: the registry keeps no history of the tag", e.Ref)
+	}
+	return fmt.Sprintf("%s: no history of the tag on %s", e.Ref, e.When.Format(time.RFC3339))
+}
+
+// TagHistory returns the manifests the tag of img pointed to, the most recent
+// first, as the registry keeps them: the Docker Hub only has the manifest the
+// tag points to since it was last pushed, a Quay registry the whole history
+// of the tag, with its /api/v1 tag API. Other registries keep no history,
+// which is an ErrNoTagHistory. The credentials of the registry are sent to
+// the APIs that ask for them.
+func (re *RegistryEndpoint) TagHistory(img *ImageRef) ([]TagHistoryEntry, error) {
+	return re.TagHistoryContext(context.Background(), img)
+}
+
+// TagHistoryContext is TagHistory, giving up when ctx is done.
+func (re *RegistryEndpoint) TagHistoryContext(ctx context.Context, img *ImageRef) ([]TagHistoryEntry, error) {
+	var (
+		history []TagHistoryEntry
+		err     error
+	)
+	if re.Host == DefaultRegistryHost {
+		history, err = re.hubTagHistory(ctx, img)
+	} else {
+		history, err = re.quayTagHistory(ctx, img)
+		if isNotFound(err) {
+			// not a Quay registry, or no such repository on one
+			return nil, ErrNoTagHistory{Ref: img.String()}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Start.After(history[j].Start)
+	})
+	return history, nil
+}
+
+// PinTagAt pins img to the digest of the manifest its tag pointed to at when,
+// to fetch that rather than what it points to now, or returns
+// ErrNoTagHistory when the TagHistory of the registry does not say.
+func (re *RegistryEndpoint) PinTagAt(img *ImageRef, when time.Time) error {
+	return re.PinTagAtContext(context.Background(), img, when)
+}
+
+// PinTagAtContext is PinTagAt, giving up when ctx is done.
+func (re *RegistryEndpoint) PinTagAtContext(ctx context.Context, img *ImageRef, when time.Time) error {
+	if img.Pinned() {
+		return fmt.Errorf("%s is already pinned to a digest", img)
+	}
+	history, err := re.TagHistoryContext(ctx, img)
+	if err != nil {
+		return err
+	}
+	for _, entry := range history {
+		if !entry.Start.After(when) && (entry.End.IsZero() || entry.End.After(when)) {
+			img.pin(entry.Digest)
+			return nil
+		}
+	}
+	return ErrNoTagHistory{Ref: img.String(), When: when}
+}
+
+// pin pins ir to digest, forgetting what was resolved of its tag before; the
+// tag is kept, for the image to be tagged as it was then
+func (ir *ImageRef) pin(digest string) {
+	ir.tag, ir.digest, ir.pinned = ir.Tag(), digest, true
+	ir.id, ir.ancestry, ir.v2 = "", nil, nil
+}
+
+// hubTagHistory is the TagHistory of img on the Docker Hub
+func (re *RegistryEndpoint) hubTagHistory(ctx context.Context, img *ImageRef) ([]TagHistoryEntry, error) {
+	urlStr := HubRepositoriesURL + img.Name() + "/tags/" + url.PathEscape(img.Tag())
+	var tag struct {
+		Digest        string    `json:"digest"`
+		LastUpdated   time.Time `json:"last_updated"`
+		TagLastPushed time.Time `json:"tag_last_pushed"`
+	}
+	if err := re.getJSON(ctx, urlStr, &tag); err != nil {
+		return nil, err
+	}
+	if tag.Digest == "" {
+		return []TagHistoryEntry{}, nil
+	}
+	start := tag.TagLastPushed
+	if start.IsZero() {
+		start = tag.LastUpdated
+	}
+	return []TagHistoryEntry{{Digest: tag.Digest, Start: start}}, nil
+}
+
+// quayTagHistory is the TagHistory of img on a Quay registry, a page of its
+// tag API at a time
+func (re *RegistryEndpoint) quayTagHistory(ctx context.Context, img *ImageRef) ([]TagHistoryEntry, error) {
+	history := []TagHistoryEntry{}
+	for page := 1; ; page++ {
+		q := url.Values{}
+		q.Set("specificTag", img.Tag())
+		q.Set("onlyActiveTags", "false")
+		q.Set("page", fmt.Sprint(page))
+		urlStr := re.apiURL(re.Host, "/api/v1/repository/"+img.Name()+"/tag/?"+q.Encode())
+		var body struct {
+			Tags []struct {
+				Name           string `json:"name"`
+				ManifestDigest string `json:"manifest_digest"`
+				StartTS        int64  `json:"start_ts"`
+				EndTS          int64  `json:"end_ts"`
+			} `json:"tags"`
+			HasAdditional bool `json:"has_additional"`
+		}
+		if err := re.getJSON(ctx, urlStr, &body); err != nil {
+			return nil, err
+		}
+		for _, t := range body.Tags {
+			if t.Name != img.Tag() || t.ManifestDigest == "" {
+				continue
+			}
+			entry := TagHistoryEntry{Digest: t.ManifestDigest, Start: time.Unix(t.StartTS, 0).UTC()}
+			if t.EndTS != 0 {
+				entry.End = time.Unix(t.EndTS, 0).UTC()
+			}
+			history = append(history, entry)
+		}
+		if !body.HasAdditional || len(body.Tags) == 0 {
+			return history, nil
+		}
+	}
+}
+
+// getJSON decodes the JSON document at urlStr into v, sending the
+// credentials of the registry if asked for them
+func (re *RegistryEndpoint) getJSON(ctx context.Context, urlStr string, v interface{}) error {
+	resp, err := re.getAPI(ctx, urlStr, auth.Credentials{})
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		creds, credsErr := re.credentials(ctx)
+		if credsErr != nil {
+			resp.Body.Close()
+			return credsErr
+		}
+		if !creds.Empty() {
+			resp.Body.Close()
+			resp, err = re.getAPI(ctx, urlStr, creds)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newResponseError(urlStr, resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s: %w", urlStr, err)
+	}
+	return nil
+}
+
+// getAPI sends a GET of urlStr with creds, if not empty: an identity token
+// as a bearer token, like the OAuth2 tokens of Quay, or else basic auth
+func (re *RegistryEndpoint) getAPI(ctx context.Context, urlStr string, creds auth.Credentials) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if creds.IdentityToken != "" {
+		req.Header.Set("Authorization", "Bearer "+creds.IdentityToken)
+	} else if !creds.Empty() {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	return re.do(req)
+}
@@ -0,0 +1,92 @@
+package fetch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+func TestRegistryPinTagAt(t *testing.T) {
+	old, current := "sha256:"+strings.Repeat("1", 64), "sha256:"+strings.Repeat("2", 64)
+	quay := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "joe" || p != "hunter2" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		if r.URL.Path != "/api/v1/repository/test/image/tag/" || q.Get("specificTag") != "latest" || q.Get("onlyActiveTags") != "false" {
+			http.NotFound(w, r)
+			return
+		}
+		switch q.Get("page") {
+		case "1":
+			fmt.Fprintf(w, `{"tags":[{"name":"latest","manifest_digest":%q,"start_ts":2000}],"page":1,"has_additional":true}`, current)
+		case "2":
+			fmt.Fprintf(w, `{"tags":[{"name":"latest","manifest_digest":%q,"start_ts":1000,"end_ts":2000}],"page":2,"has_additional":false}`, old)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer quay.Close()
+	defer func(c *http.Client) { http.DefaultClient = c }(http.DefaultClient)
+	http.DefaultClient = quay.Client()
+	host := strings.TrimPrefix(quay.URL, "https://")
+	r := NewRegistry(host)
+	var unauthorized ErrUnauthorized
+	if _, err := r.TagHistory(NewImageRef(host + "/test/image")); !errors.As(err, &unauthorized) {
+		t.Errorf("expected the history refused without credentials, got %v", err)
+	}
+	r.Credentials = auth.Basic("joe", "hunter2")
+
+	for when, expected := range map[int64]string{1000: old, 1999: old, 2000: current, 5000: current} {
+		img := NewImageRef(host + "/test/image")
+		if err := r.PinTagAt(img, time.Unix(when, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if !img.Pinned() || img.Digest() != expected {
+			t.Errorf("at %d: expected %s, got %s", when, expected, img)
+		}
+	}
+	img := NewImageRef(host + "/test/image")
+	if err := r.PinTagAt(img, time.Unix(999, 0)); err == nil {
+		t.Fatal("expected an error before the history")
+	} else if _, ok := err.(ErrNoTagHistory); !ok {
+		t.Errorf("expected an ErrNoTagHistory, got %#v", err)
+	}
+	if img.Pinned() {
+		t.Errorf("expected %s to be left as it was", img)
+	}
+	// a registry without the API of Quay
+	if _, err := r.TagHistory(NewImageRef(host + "/other/image")); !errors.As(err, new(ErrNoTagHistory)) {
+		t.Errorf("expected an ErrNoTagHistory, got %v", err)
+	}
+
+	// the Docker Hub only has the manifest the tag points to now
+	hub := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/repositories/library/busybox/tags/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"name":"latest","digest":%q,"last_updated":"2024-05-02T00:00:00Z","tag_last_pushed":"2024-05-01T00:00:00Z"}`, current)
+	}))
+	defer hub.Close()
+	defer func(u string) { HubRepositoriesURL = u }(HubRepositoriesURL)
+	HubRepositoriesURL = hub.URL + "/v2/repositories/"
+	r = NewRegistry("docker.io")
+	img = NewImageRef("busybox")
+	if err := r.PinTagAt(img, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if img.String() != "docker.io/library/busybox:latest@"+current {
+		t.Errorf("expected busybox pinned to %s, got %s", current, img)
+	}
+	if err := r.PinTagAt(NewImageRef("busybox"), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("expected an error before the tag was last pushed")
+	}
+}
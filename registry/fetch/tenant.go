@@ -0,0 +1,67 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+type credentialsKey struct{}
+
+// WithCredentials returns a copy of ctx, for the requests made with which
+// creds are sent to the registry and its auth server instead of those of
+// the endpoint's Credentials. This lets one RegistryEndpoint serve several
+// tenants, like the jobs of the daemon: the tokens each is given are kept
+// apart, and never sent with the requests of another.
+func WithCredentials(ctx context.Context, creds auth.Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// credentialsID identifies creds among the tokens kept, without keeping the
+// secrets themselves. Anonymous access has an empty ID.
+func credentialsID(creds auth.Credentials) string {
+	if creds.Empty() {
+		return ""
+	}
+	h := sha256.New()
+	for _, s := range []string{creds.Username, creds.Password, creds.IdentityToken} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tokenKey is what the token for scope, a v2 scope or a v1 repository name,
+// is kept under for the credentials of ctx
+func (re *RegistryEndpoint) tokenKey(ctx context.Context, scope string) (string, error) {
+	creds, err := re.credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	if id := credentialsID(creds); id != "" {
+		return id + " " + scope, nil
+	}
+	return scope, nil
+}
+
+// token is the v1 Token for the repository of img, given for the
+// credentials of ctx, if there is one
+func (re *RegistryEndpoint) token(ctx context.Context, img *ImageRef) (Token, bool) {
+	key, err := re.tokenKey(ctx, img.Name())
+	if err != nil {
+		return emptyToken, false
+	}
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	tok, ok := re.tokens[key]
+	return tok, ok
+}
+
+// hasToken reports whether a v1 Token for the repository of img has been
+// given for the credentials of ctx, even an empty one
+func (re *RegistryEndpoint) hasToken(ctx context.Context, img *ImageRef) bool {
+	_, ok := re.token(ctx, img)
+	return ok
+}
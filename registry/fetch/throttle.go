@@ -0,0 +1,106 @@
+package fetch
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bytes per second read through the readers it wraps,
+// all together, so that transfers sharing it never go faster between them
+type Throttle struct {
+	rate int64
+
+	mu sync.Mutex
+	// next is when the bytes read so far are all due, at rate
+	next time.Time
+}
+
+// NewThrottle returns a Throttle of bytesPerSecond
+func NewThrottle(bytesPerSecond int64) *Throttle {
+	return &Throttle{rate: bytesPerSecond}
+}
+
+// Rate is the bytes per second of t
+func (t *Throttle) Rate() int64 {
+	return t.rate
+}
+
+// wait sleeps until the n bytes just read are due, at rate. Bytes not read
+// for up to a second are not made up for later.
+func (t *Throttle) wait(n int) {
+	if n <= 0 || t.rate <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now.Add(-time.Second)) {
+		t.next = now.Add(-time.Second)
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Reader wraps r, to be read no faster than the rate of t
+func (t *Throttle) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, t: t}
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *Throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	// in reads of a tenth of a second at most, for the transfers sharing t to
+	// take turns
+	if max := tr.t.rate / 10; max > 0 && int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
+
+// throttle wraps the body of resp, a download of a layer or blob, to be read
+// no faster than the PullConnectionRate, and the PullThrottle shared with the
+// other downloads. resp may be nil.
+func (re *RegistryEndpoint) throttle(resp *http.Response) *http.Response {
+	if resp == nil || (re.PullThrottle == nil && re.PullConnectionRate <= 0) {
+		return resp
+	}
+	var r io.Reader = resp.Body
+	if re.PullConnectionRate > 0 {
+		r = NewThrottle(re.PullConnectionRate).Reader(r)
+	}
+	if re.PullThrottle != nil {
+		r = re.PullThrottle.Reader(r)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}
+	return resp
+}
+
+// requestBody wraps body, to be sent no faster than the rate of t
+func (t *Throttle) requestBody(body *requestBody) *requestBody {
+	if body == nil {
+		return nil
+	}
+	return &requestBody{size: body.size, open: func() (io.ReadCloser, error) {
+		rc, err := body.open()
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{t.Reader(rc), rc}, nil
+	}}
+}
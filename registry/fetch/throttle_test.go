@@ -0,0 +1,66 @@
+package fetch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	// a second's worth goes at once, the rest at the rate, shared by both
+	// readers
+	th := NewThrottle(1 << 20)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, th.Reader(bytes.NewReader(make([]byte, 1<<20))))
+			if err != nil || n != 1<<20 {
+				t.Errorf("expected %d bytes, got %d, %v", 1<<20, n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected about a second for 2MiB at 1MiB/s, took %s", elapsed)
+	}
+}
+
+func TestRegistryPullThrottle(t *testing.T) {
+	layer := make([]byte, 64<<10)
+	tr := newTestRegistry(t, testLayer{ID: strings.Repeat("c", 64), Layer: layer})
+
+	// a second's worth goes at once, the rest at the rate
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.PullThrottle = NewThrottle(32 << 10)
+	start := time.Now()
+	if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected about a second for 64KiB at 32KiB/s, took %s", elapsed)
+	}
+
+	ref = tr.Ref()
+	r = NewRegistry(ref.Host())
+	r.PullConnectionRate = 32 << 10
+	start = time.Now()
+	rc, _, err := r.FetchLayerStream(ref, strings.Repeat("c", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if buf, err := ioutil.ReadAll(rc); err != nil || !bytes.Equal(buf, layer) {
+		t.Fatalf("expected the layer, got %d bytes, %v", len(buf), err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("expected about a second for 64KiB at 32KiB/s, took %s", elapsed)
+	}
+}
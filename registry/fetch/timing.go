@@ -0,0 +1,93 @@
+package fetch
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Timings is the breakdown of where the time went while fetching an image.
+// It is accumulated on the ImageRef as the RegistryEndpoint works on it.
+type Timings struct {
+	// Auth is the time spent acquiring tokens
+	Auth time.Duration
+	// Resolve is the time spent resolving the tag to an ID and its ancestry
+	Resolve time.Duration
+	// Layers has the download of each layer, in the order fetched
+	Layers []LayerTiming
+	// Verify is the time spent checking the digests of the fetched content,
+	// as downloaded and with VerifyLayers
+	Verify time.Duration
+	// Export is the time spent writing out the final archive the image is
+	// in, if the caller records it
+	Export time.Duration
+}
+
+// LayerTiming is the time taken to download a single layer (json and
+// layer.tar)
+type LayerTiming struct {
+	ID       string
+	Bytes    int64
+	Duration time.Duration
+}
+
+// Download is the total time spent downloading layers
+func (t Timings) Download() time.Duration {
+	var d time.Duration
+	for _, l := range t.Layers {
+		d += l.Duration
+	}
+	return d
+}
+
+// Total is the sum of all the phases
+func (t Timings) Total() time.Duration {
+	return t.Auth + t.Resolve + t.Download() + t.Verify + t.Export
+}
+
+// WriteReport writes a human readable breakdown of the timings to w
+func (t Timings) WriteReport(w io.Writer) error {
+	lines := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"auth", t.Auth},
+		{"resolve", t.Resolve},
+		{"download", t.Download()},
+		{"verify", t.Verify},
+		{"export", t.Export},
+		{"total", t.Total()},
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintf(w, "  %-10s %s\n", l.name, l.d); err != nil {
+			return err
+		}
+	}
+	for _, l := range t.Layers {
+		rate := float64(0)
+		if l.Duration > 0 {
+			rate = float64(l.Bytes) / l.Duration.Seconds() / 1024
+		}
+		if _, err := fmt.Fprintf(w, "    %.12s %10d bytes %s (%.1f KiB/s)\n", l.ID, l.Bytes, l.Duration, rate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func since(start time.Time, d *time.Duration) {
+	*d += time.Since(start)
+}
+
+// verifyMu guards the Verify timings, added to by the concurrent downloads
+// of the layers of an image
+var verifyMu sync.Mutex
+
+// addVerify adds the time since start to the Verify timing
+func (t *Timings) addVerify(start time.Time) {
+	d := time.Since(start)
+	verifyMu.Lock()
+	t.Verify += d
+	verifyMu.Unlock()
+}
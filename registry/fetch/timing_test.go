@@ -0,0 +1,59 @@
+package fetch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingsReport(t *testing.T) {
+	tm := Timings{
+		Auth:    time.Second,
+		Resolve: 2 * time.Second,
+		Layers: []LayerTiming{
+			{ID: "511136ea3c5a64f264b78b5433614aec563103b4d4702f3ba7d4d2698e22c158", Bytes: 1024, Duration: time.Second},
+			{ID: "42eed7f1bf2ac3f1610c5e616d2ab1ee9c7290234240388d6297bc0f32c34229", Bytes: 2048, Duration: 3 * time.Second},
+		},
+	}
+	if tm.Download() != 4*time.Second {
+		t.Errorf("expected 4s of download, got %s", tm.Download())
+	}
+	if tm.Total() != 7*time.Second {
+		t.Errorf("expected 7s total, got %s", tm.Total())
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tm.WriteReport(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "511136ea3c5a") {
+		t.Errorf("expected the layer IDs in the report, got %q", buf.String())
+	}
+}
+
+func TestTimingsVerify(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	fetched := ref.Timings().Verify
+	if fetched <= 0 {
+		t.Errorf("expected the digest checks of the downloads timed, got %s", fetched)
+	}
+	if err := VerifyLayers(ref, tdir, true); err != nil {
+		t.Fatal(err)
+	}
+	if ref.Timings().Verify <= fetched {
+		t.Errorf("expected VerifyLayers timed, got %s", ref.Timings().Verify-fetched)
+	}
+}
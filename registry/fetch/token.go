@@ -0,0 +1,49 @@
+package fetch
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrTokenHeaderEmpty if the response from the registry did not provide a Token.
+	//
+	// Deprecated: registries without a token service are given an empty
+	// Token, and this is no longer returned.
+	ErrTokenHeaderEmpty = fmt.Errorf("HTTP Header x-docker-token is empty")
+
+	emptyToken = Token("")
+)
+
+// Token is access token from a docker registry
+type Token string
+
+func (t Token) Signature() string {
+	return t.getFieldValue("Signature")
+}
+
+func (t Token) Repository() string {
+	return t.getFieldValue("Repository")
+}
+
+func (t Token) Access() string {
+	return t.getFieldValue("Access")
+}
+
+func (t Token) getFieldValue(key string) string {
+	for _, part := range strings.Split(t.String(), ",") {
+		if strings.HasPrefix(strings.ToLower(part), strings.ToLower(key)) {
+			chunks := strings.SplitN(part, "=", 2)
+			if len(chunks) > 2 {
+				continue
+			}
+			return chunks[1]
+		}
+	}
+	return ""
+}
+
+// String to satisfy the fmt.Stringer interface
+func (t Token) String() string {
+	return string(t)
+}
@@ -0,0 +1,104 @@
+package fetch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+// TokenCache keeps the bearer tokens of v2 registries on disk until they
+// expire, for repeated runs, and the processes sharing it, to ask the auth
+// servers for them once. The tokens are kept by registry host, credentials
+// and scope, each in a file only its owner can read.
+type TokenCache struct {
+	Dir string
+}
+
+// NewTokenCache returns the TokenCache in dir, creating it if needed
+func NewTokenCache(dir string) (*TokenCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &TokenCache{Dir: dir}, nil
+}
+
+// tokenFile is where the token of host kept under key is
+func (c *TokenCache) tokenFile(host, key string) string {
+	sum := sha256.Sum256([]byte(host + " " + key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the token of host kept under key, if there is one that has not
+// expired
+func (c *TokenCache) get(host, key string) (auth.BearerToken, bool) {
+	var tok auth.BearerToken
+	buf, err := ioutil.ReadFile(c.tokenFile(host, key))
+	if err != nil {
+		return tok, false
+	}
+	if err := json.Unmarshal(buf, &tok); err != nil || tok.Token == "" {
+		return auth.BearerToken{}, false
+	}
+	if tok.Expired() {
+		os.Remove(c.tokenFile(host, key))
+		return auth.BearerToken{}, false
+	}
+	return tok, true
+}
+
+// put keeps the token of host under key, replacing any other
+func (c *TokenCache) put(host, key string, tok auth.BearerToken) error {
+	buf, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(c.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if err := fh.Chmod(0600); err != nil {
+		fh.Close()
+		return err
+	}
+	if _, err := fh.Write(buf); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), c.tokenFile(host, key))
+}
+
+// Prune removes the tokens that have expired
+func (c *TokenCache) Prune() error {
+	entries, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		if strings.HasPrefix(fi.Name(), ".") {
+			// a token being written
+			continue
+		}
+		name := filepath.Join(c.Dir, fi.Name())
+		var tok auth.BearerToken
+		buf, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(buf, &tok)
+		}
+		if err != nil || tok.Expired() {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package fetch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+func TestRegistryTokenCache(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	dir, err := ioutil.TempDir("", "token-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := NewTokenCache(filepath.Join(dir, "tokens"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry(tr.Host())
+	r.TokenCache = cache
+	if _, err := r.ImageID(tr.Ref()); err != nil {
+		t.Fatal(err)
+	}
+	n := tr.Requests["/token"]
+	if n == 0 {
+		t.Fatal("expected a token to be requested")
+	}
+	// as another process would
+	r = NewRegistry(tr.Host())
+	r.TokenCache = cache
+	if _, err := r.ImageID(tr.Ref()); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Requests["/token"] != n {
+		t.Errorf("expected the cached token to be used, got %d token requests", tr.Requests["/token"]-n)
+	}
+
+	// a token the registry rejects is replaced
+	entries, err := ioutil.ReadDir(cache.Dir)
+	if err != nil || len(entries) == 0 {
+		t.Fatalf("expected the tokens in %s, got %v (%v)", cache.Dir, entries, err)
+	}
+	for _, fi := range entries {
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("expected %s to be private, got %s", fi.Name(), fi.Mode())
+		}
+		if err := ioutil.WriteFile(filepath.Join(cache.Dir, fi.Name()), []byte(`{"Token":"revoked","Expires":"2999-01-01T00:00:00Z"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r = NewRegistry(tr.Host())
+	r.TokenCache = cache
+	if _, err := r.ImageID(tr.Ref()); err != nil {
+		t.Fatal(err)
+	}
+	if tr.Requests["/token"] == n {
+		t.Error("expected a new token to be requested")
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(cache.Dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) == `{"Token":"revoked","Expires":"2999-01-01T00:00:00Z"}` {
+		t.Error("expected the rejected token to be replaced")
+	}
+
+	if err := cache.put("example.com", "scope", auth.BearerToken{Token: "old", Expires: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("example.com", "scope"); ok {
+		t.Error("expected an expired token not to be used")
+	}
+	if err := cache.put("example.com", "scope", auth.BearerToken{Token: "old", Expires: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cache.tokenFile("example.com", "scope")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired token to be pruned, got %v", err)
+	}
+}
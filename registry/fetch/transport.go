@@ -0,0 +1,151 @@
+package fetch
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// DefaultCertsDir is where docker keeps the certificates for each registry
+var DefaultCertsDir = "/etc/docker/certs.d"
+
+// TLSConfig is how to connect to a registry over TLS
+type TLSConfig struct {
+	// CAFiles are PEM files of CA certificates, trusted along with the
+	// system's
+	CAFiles []string
+	// CertFile and KeyFile are a client certificate and its key, for
+	// registries requiring one
+	CertFile string
+	KeyFile  string
+	// Insecure skips verifying the certificate of the registry
+	Insecure bool
+}
+
+// Client returns an http.Client connecting with these settings
+func (c TLSConfig) Client() (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: c.Insecure}
+	if len(c.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, filename := range c.CAFiles {
+			buf, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(buf) {
+				return nil, fmt.Errorf("%s: no certificates found", filename)
+			}
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	// with a TLSClientConfig of its own, HTTP/2 is only tried when forced
+	transport.ForceAttemptHTTP2 = true
+	return &http.Client{Transport: transport}, nil
+}
+
+// LoadCertsDir reads the TLS settings for host from dir, laid out like
+// docker's /etc/docker/certs.d: in <dir>/<host>/, *.crt files are CA
+// certificates, and a *.cert file and the *.key of the same name are a
+// client certificate. A host without a directory gets empty settings.
+func LoadCertsDir(dir, host string) (TLSConfig, error) {
+	config := TLSConfig{}
+	infos, err := ioutil.ReadDir(filepath.Join(dir, host))
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	for _, info := range infos {
+		filename := filepath.Join(dir, host, info.Name())
+		switch filepath.Ext(info.Name()) {
+		case ".crt":
+			config.CAFiles = append(config.CAFiles, filename)
+		case ".cert":
+			key := strings.TrimSuffix(filename, ".cert") + ".key"
+			if _, err := os.Stat(key); err != nil {
+				return config, fmt.Errorf("%s: missing key %s", filename, key)
+			}
+			config.CertFile, config.KeyFile = filename, key
+		}
+	}
+	return config, nil
+}
+
+// the defaults of DialConfig
+const (
+	DefaultConnectTimeout = 15 * time.Second
+	DefaultFallbackDelay  = 300 * time.Millisecond
+)
+
+// DialConfig is how the connections to a registry are made. Hosts with both
+// IPv6 and IPv4 addresses are dialed "happy eyeballs" style (RFC 6555): the
+// first address family is given FallbackDelay before a connection over the
+// other is raced against it, the first to connect being used, so that a
+// host with broken AAAA records only costs that delay.
+type DialConfig struct {
+	// Timeout is how long a connection may take, across all the addresses
+	// of the host tried. Zero is DefaultConnectTimeout.
+	Timeout time.Duration
+	// FallbackDelay is how long the first address family is tried alone.
+	// Zero is DefaultFallbackDelay, and a negative delay tries the
+	// addresses one after the other.
+	FallbackDelay time.Duration
+	// Network, when set to "tcp4" or "tcp6", only connects over IPv4 or
+	// IPv6
+	Network string
+}
+
+// dialContext is the DialContext of a transport dialing with c
+func (c DialConfig) dialContext() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	switch c.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", c.Network)
+	}
+	d := &net.Dialer{
+		Timeout:       c.Timeout,
+		FallbackDelay: c.FallbackDelay,
+		KeepAlive:     30 * time.Second,
+	}
+	if d.Timeout == 0 {
+		d.Timeout = DefaultConnectTimeout
+	}
+	if d.FallbackDelay == 0 {
+		d.FallbackDelay = DefaultFallbackDelay
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if c.Network != "" && c.Network != "tcp" && network == "tcp" {
+			network = c.Network
+		}
+		start := time.Now()
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		logrus.Debugf("%s: connected to %s in %s", addr, conn.RemoteAddr(), time.Since(start))
+		return conn, nil
+	}, nil
+}
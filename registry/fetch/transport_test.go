@@ -0,0 +1,244 @@
+package fetch
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryPlainHTTP(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	plain := httptest.NewServer(http.HandlerFunc(tr.serve))
+	defer plain.Close()
+
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := NewImageRef(plain.Listener.Addr().String() + "/test/image")
+	r := NewRegistry(ref.Host())
+	r.PlainHTTP = true
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSConfigClient(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.tls.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	// the default client no longer trusts the test registry
+	testClient := http.DefaultClient
+	http.DefaultClient = &http.Client{}
+	defer func() { http.DefaultClient = testClient }()
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	r.apiVersion = APIVersion2
+	if _, err := r.Ancestry(NewImageRef(ref.String())); err == nil {
+		t.Fatalf("expected the registry's certificate to be refused")
+	}
+
+	ca := filepath.Join(tdir, "ca.crt")
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tr.Server.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []TLSConfig{{CAFiles: []string{ca}}, {Insecure: true}} {
+		if r.Client, err = config.Client(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Ancestry(NewImageRef(ref.String())); err != nil {
+			t.Errorf("%#v: %s", config, err)
+		}
+	}
+
+	if _, err := (TLSConfig{CAFiles: []string{filepath.Join(tdir, "missing.crt")}}).Client(); err == nil {
+		t.Errorf("expected a missing CA file to fail")
+	}
+}
+
+func TestLoadCertsDir(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.certs.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	host := "registry.example.com:5000"
+	dir := filepath.Join(tdir, host)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ca.crt", "client.cert", "client.key", "README"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := LoadCertsDir(tdir, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := TLSConfig{
+		CAFiles:  []string{filepath.Join(dir, "ca.crt")},
+		CertFile: filepath.Join(dir, "client.cert"),
+		KeyFile:  filepath.Join(dir, "client.key"),
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected %#v, got %#v", expected, config)
+	}
+
+	if config, err := LoadCertsDir(tdir, "other.example.com"); err != nil || !reflect.DeepEqual(config, TLSConfig{}) {
+		t.Errorf("expected no settings for another host, got %#v, %v", config, err)
+	}
+
+	os.Remove(filepath.Join(dir, "client.key"))
+	if _, err := LoadCertsDir(tdir, host); err == nil {
+		t.Errorf("expected a client certificate without its key to fail")
+	}
+}
+
+func TestRegistryProxyURL(t *testing.T) {
+	tr := newTestRegistry(t, testLayers...)
+	proxied := 0
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != auth {
+			http.Error(w, "proxy auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		proxied++
+		tr.serve(w, r)
+	}))
+	defer proxy.Close()
+
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	// the registry host only exists behind the proxy
+	ref := NewImageRef("registry.invalid/test/image")
+	r := NewRegistry(ref.Host())
+	r.PlainHTTP = true
+	r.ProxyURL = "http://user:pass@" + proxy.Listener.Addr().String()
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	if proxied == 0 {
+		t.Errorf("expected the requests to go through the proxy")
+	}
+
+	r = NewRegistry(ref.Host())
+	r.ProxyURL = "://"
+	if _, err := r.FetchLayers(NewImageRef(ref.String()), tdir); err == nil {
+		t.Errorf("expected an invalid proxy URL to fail")
+	}
+}
+
+func TestRegistryHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	host := strings.TrimPrefix(ts.URL, "https://")
+	r := NewRegistry(host)
+	r.Client = ts.Client()
+	if r.Proto() != "" {
+		t.Errorf("expected no protocol before the first response, got %q", r.Proto())
+	}
+	if v := r.APIVersion(); v != APIVersion2 {
+		t.Fatalf("expected %s, got %s", APIVersion2, v)
+	}
+	if r.Proto() != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2 to be negotiated, got %q", r.Proto())
+	}
+
+	r = NewRegistry(host)
+	r.Client = ts.Client()
+	r.DisableHTTP2 = true
+	if v := r.APIVersion(); v != APIVersion2 {
+		t.Fatalf("expected %s, got %s", APIVersion2, v)
+	}
+	if r.Proto() != "HTTP/1.1" {
+		t.Errorf("expected HTTP/1.1 with HTTP/2 disabled, got %q", r.Proto())
+	}
+}
+
+func TestRegistryDial(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+
+	r := NewRegistry(ref.Host())
+	r.Dial = &DialConfig{Timeout: time.Second, FallbackDelay: 50 * time.Millisecond, Network: "tcp4"}
+	if _, err := r.FetchLayers(ref, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test registry only listens on IPv4
+	r = NewRegistry(ref.Host())
+	r.Dial = &DialConfig{Network: "tcp6"}
+	if _, err := r.Ancestry(tr.Ref()); err == nil {
+		t.Error("expected an IPv6 only connection to an IPv4 address to fail")
+	}
+
+	r = NewRegistry(ref.Host())
+	r.Dial = &DialConfig{Network: "udp"}
+	if _, err := r.Ancestry(tr.Ref()); err == nil || !strings.Contains(err.Error(), "unsupported network") {
+		t.Errorf("expected the network to be refused, got %v", err)
+	}
+
+	// an address that does not answer is given up on after the Timeout
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dial, err := DialConfig{Timeout: 200 * time.Millisecond}.dialContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	start := time.Now()
+	// a non-routable address, which either hangs or fails straight away
+	if conn, err := dial(context.Background(), "tcp", "10.255.255.1:9"); err == nil {
+		conn.Close()
+		t.Skip("10.255.255.1 is reachable here")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected the connection to time out after 200ms, took %s", d)
+	}
+}
@@ -0,0 +1,327 @@
+package fetch
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// the types of TrustRequirements
+const (
+	TrustAcceptAnything = "insecureAcceptAnything"
+	TrustReject         = "reject"
+	TrustSigned         = "sigstoreSigned"
+)
+
+// Cosign-style signatures: the signatures of the manifest sha256:<hex> are
+// the layers of the manifest tagged sha256-<hex>.sig in the same repository,
+// each a simple signing payload with the signature in an annotation
+const (
+	MediaTypeSimpleSigning = "application/vnd.dev.cosign.simplesigning.v1+json"
+	AnnotationSignature    = "dev.cosignproject.cosign/signature"
+)
+
+// TrustPolicy declares, per registry or repository, what it takes for an
+// image to be trusted, like the policy.json of containers/image:
+//
+//	{
+//	  "default": [{"type": "reject"}],
+//	  "transports": {
+//	    "docker": {
+//	      "docker.io/library": [{"type": "insecureAcceptAnything"}],
+//	      "registry.example.com": [{"type": "sigstoreSigned", "keyPath": "release.pub"}],
+//	      "*.internal.example.com": [{"type": "insecureAcceptAnything"}]
+//	    }
+//	  }
+//	}
+//
+// The scopes of the "docker" transport are a repository, a namespace, a
+// registry host or a wildcard subdomain like "*.example.com", the most
+// specific matching an image applying to it, and "default" to the images
+// none match. An image must meet every requirement of its scope.
+type TrustPolicy struct {
+	Default    []TrustRequirement                       `json:"default"`
+	Transports map[string]map[string][]TrustRequirement `json:"transports,omitempty"`
+}
+
+// TrustRequirement is one of TrustAcceptAnything, TrustReject, or
+// TrustSigned by one of its keys: ed25519 or ECDSA public keys (PEM) read
+// from KeyPath or KeyPaths, relative to the policy file, or given in KeyData
+// as the base64 of the PEM
+type TrustRequirement struct {
+	Type     string   `json:"type"`
+	KeyPath  string   `json:"keyPath,omitempty"`
+	KeyPaths []string `json:"keyPaths,omitempty"`
+	KeyData  string   `json:"keyData,omitempty"`
+
+	keys []crypto.PublicKey
+}
+
+// TrustError is returned for an image its TrustPolicy does not trust
+type TrustError struct {
+	Ref    string `json:"ref"`
+	Scope  string `json:"scope"`
+	Reason string `json:"reason"`
+}
+
+func (e TrustError) Error() string {
+	return fmt.Sprintf("%s is not trusted by the policy for %s: %s", e.Ref, e.Scope, e.Reason)
+}
+
+// LoadTrustPolicy reads a TrustPolicy from a JSON file, with the keys of its
+// requirements
+func LoadTrustPolicy(filename string) (*TrustPolicy, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &TrustPolicy{}
+	if err := json.Unmarshal(buf, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if p.Default == nil {
+		return nil, fmt.Errorf("%s: no default requirements", filename)
+	}
+	dir := filepath.Dir(filename)
+	if err := loadTrustKeys(dir, p.Default); err != nil {
+		return nil, fmt.Errorf("%s: default: %w", filename, err)
+	}
+	for scope, reqs := range p.Transports["docker"] {
+		if len(reqs) == 0 {
+			return nil, fmt.Errorf("%s: %s: no requirements", filename, scope)
+		}
+		if err := loadTrustKeys(dir, reqs); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", filename, scope, err)
+		}
+	}
+	return p, nil
+}
+
+// loadTrustKeys checks the types of reqs and loads their keys
+func loadTrustKeys(dir string, reqs []TrustRequirement) error {
+	for i := range reqs {
+		req := &reqs[i]
+		switch req.Type {
+		case TrustAcceptAnything, TrustReject:
+			continue
+		case TrustSigned:
+		default:
+			return fmt.Errorf("unsupported requirement type %q", req.Type)
+		}
+		filenames := req.KeyPaths
+		if req.KeyPath != "" {
+			filenames = append([]string{req.KeyPath}, filenames...)
+		}
+		for _, filename := range filenames {
+			if !filepath.IsAbs(filename) {
+				filename = filepath.Join(dir, filename)
+			}
+			buf, err := ioutil.ReadFile(filename)
+			if err != nil {
+				return err
+			}
+			key, err := parseTrustKey(buf)
+			if err != nil {
+				return fmt.Errorf("%s: %w", filename, err)
+			}
+			req.keys = append(req.keys, key)
+		}
+		if req.KeyData != "" {
+			buf, err := base64.StdEncoding.DecodeString(req.KeyData)
+			if err != nil {
+				return fmt.Errorf("keyData: %w", err)
+			}
+			key, err := parseTrustKey(buf)
+			if err != nil {
+				return fmt.Errorf("keyData: %w", err)
+			}
+			req.keys = append(req.keys, key)
+		}
+		if len(req.keys) == 0 {
+			return fmt.Errorf("%s needs keyPath, keyPaths or keyData", TrustSigned)
+		}
+	}
+	return nil
+}
+
+// parseTrustKey parses an ed25519 or ECDSA public key in PEM
+func parseTrustKey(buf []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("not an ed25519 or ECDSA key")
+}
+
+// Requirements are those of the scope of the policy matching img, with the
+// scope, "default" when none does
+func (p *TrustPolicy) Requirements(img *ImageRef) (string, []TrustRequirement) {
+	scopes := p.Transports["docker"]
+	name := img.Host() + "/" + img.Name()
+	for {
+		if reqs, ok := scopes[name]; ok {
+			return name, reqs
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	hostname := img.Hostname()
+	for {
+		i := strings.Index(hostname, ".")
+		if i < 0 {
+			break
+		}
+		hostname = hostname[i+1:]
+		if reqs, ok := scopes["*."+hostname]; ok {
+			return "*." + hostname, reqs
+		}
+	}
+	return "default", p.Default
+}
+
+// checkTrust checks img against the Trust policy, fetching and verifying its
+// signatures if the policy asks for them, and marks it Signed once they are
+func (re *RegistryEndpoint) checkTrust(ctx context.Context, img *ImageRef) error {
+	scope, reqs := re.Trust.Requirements(img)
+	untrusted := func(format string, args ...interface{}) error {
+		return TrustError{Ref: img.String(), Scope: scope, Reason: fmt.Sprintf(format, args...)}
+	}
+	for _, req := range reqs {
+		switch req.Type {
+		case TrustAcceptAnything:
+			continue
+		case TrustReject:
+			return untrusted("rejected")
+		case TrustSigned:
+		default:
+			return untrusted("unsupported requirement type %q", req.Type)
+		}
+		if re.APIVersionContext(ctx) != APIVersion2 {
+			return untrusted("images of v1 registries cannot be signed")
+		}
+		v2, err := re.v2Resolve(ctx, img)
+		if err != nil {
+			return err
+		}
+		// a signature of the manifest list, or of the manifest of the
+		// platform fetched, will do
+		digests := []string{img.Digest()}
+		if v2.manifestDigest != img.Digest() {
+			digests = append(digests, v2.manifestDigest)
+		}
+		signed := false
+		for _, digest := range digests {
+			if signed, err = re.verifySignatures(ctx, img, digest, req.keys); err != nil {
+				return err
+			}
+			if signed {
+				break
+			}
+		}
+		if !signed {
+			return untrusted("no signature by a trusted key")
+		}
+		img.signed = true
+	}
+	return nil
+}
+
+// simpleSigning is the payload of a cosign-style signature
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifySignatures reports whether one of the signatures of the manifest
+// digest of img, for its repository, is by one of keys
+func (re *RegistryEndpoint) verifySignatures(ctx context.Context, img *ImageRef, digest string, keys []crypto.PublicKey) (bool, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return false, nil
+	}
+	buf, _, _, err := re.v2Manifest(ctx, img, "sha256-"+strings.TrimPrefix(digest, "sha256:")+".sig")
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var m ManifestV2
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return false, fmt.Errorf("%s: signatures of %s: %w", img, digest, err)
+	}
+	for _, layer := range m.Layers {
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[AnnotationSignature])
+		if layer.MediaType != MediaTypeSimpleSigning || err != nil || len(sig) == 0 {
+			continue
+		}
+		payload, err := re.v2Blob(ctx, img, layer.Digest)
+		if err != nil {
+			return false, err
+		}
+		if digestOf(payload) != layer.Digest {
+			return false, fmt.Errorf("%s: signature payload %s has digest %s", img, layer.Digest, digestOf(payload))
+		}
+		var ss simpleSigning
+		if err := json.Unmarshal(payload, &ss); err != nil || ss.Critical.Image.DockerManifestDigest != digest || !sameRepository(img, ss.Critical.Identity.DockerReference) {
+			continue
+		}
+		for _, key := range keys {
+			if verifySignature(key, payload, sig) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// sameRepository reports whether the docker-reference signed, like
+// "registry.example.com/team/app", is of the repository of img, for the
+// signature of an image not to be taken for another
+func sameRepository(img *ImageRef, dockerReference string) bool {
+	ref, err := ParseImageRef(dockerReference)
+	if err != nil {
+		return false
+	}
+	return NewRegistry(ref.Host()).Host == NewRegistry(img.Host()).Host && ref.Name() == img.Name()
+}
+
+// verifySignature checks sig of payload by key: ed25519 signs the payload
+// itself, ECDSA its sha256
+func verifySignature(key crypto.PublicKey, payload, sig []byte) bool {
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+package fetch
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTrustPolicy writes policy as the policy.json of a temporary directory
+func writeTrustPolicy(t *testing.T, dir, policy string) string {
+	filename := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(filename, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// writePublicKey writes the PEM of key to dir/name
+func writePublicKey(t *testing.T, dir, name string, key interface{}) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// signTestImage serves a cosign-style signature of the manifest digest of the
+// image of tr, made by sign, for the repository given
+func signTestImage(tr *testRegistry, repository, digest string, sign func(payload []byte) []byte) {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":%q},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, repository, digest))
+	m, _ := json.Marshal(ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config:        Descriptor{MediaType: MediaTypeImageConfig, Size: 2, Digest: digestOf([]byte("{}"))},
+		Layers: []Descriptor{{
+			MediaType:   MediaTypeSimpleSigning,
+			Size:        int64(len(payload)),
+			Digest:      digestOf(payload),
+			Annotations: map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sign(payload))},
+		}},
+	})
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.blobs[digestOf(payload)] = payload
+	tr.Pushed["test/image:sha256-"+strings.TrimPrefix(digest, "sha256:")+".sig"] = m
+}
+
+func TestLoadTrustPolicy(t *testing.T) {
+	tdir := t.TempDir()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := writePublicKey(t, tdir, "release.pub", pub)
+
+	filename := writeTrustPolicy(t, tdir, fmt.Sprintf(`{
+		"default": [{"type": "reject"}],
+		"transports": {"docker": {
+			"docker.io/library": [{"type": "insecureAcceptAnything"}],
+			"docker.io/library/redis": [{"type": "sigstoreSigned", "keyPath": "release.pub"}],
+			"registry.example.com": [{"type": "sigstoreSigned", "keyData": %q}],
+			"*.example.com": [{"type": "insecureAcceptAnything"}]
+		}}
+	}`, base64.StdEncoding.EncodeToString(keyPEM)))
+	p, err := LoadTrustPolicy(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"busybox":                          "docker.io/library",
+		"redis:7":                          "docker.io/library/redis",
+		"redis-stack":                      "docker.io/library",
+		"tianon/true":                      "default",
+		"registry.example.com/team/app":    "registry.example.com",
+		"eu.registry.example.com/team/app": "*.example.com",
+		"example.com/app":                  "default",
+		"localhost:5000/fedora":            "default",
+	} {
+		scope, reqs := p.Requirements(NewImageRef(name))
+		if scope != expected {
+			t.Errorf("%s: expected the scope %s, got %s", name, expected, scope)
+		}
+		if len(reqs) != 1 {
+			t.Errorf("%s: expected one requirement, got %d", name, len(reqs))
+		}
+	}
+	if _, reqs := p.Requirements(NewImageRef("redis")); len(reqs[0].keys) != 1 {
+		t.Errorf("expected the key of keyPath to be loaded, got %d keys", len(reqs[0].keys))
+	}
+
+	for _, policy := range []string{
+		`{}`,
+		`{"default": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": "release.gpg"}]}`,
+		`{"default": [{"type": "sigstoreSigned"}]}`,
+		`{"default": [{"type": "sigstoreSigned", "keyPath": "missing.pub"}]}`,
+		`{"default": [{"type": "reject"}], "transports": {"docker": {"example.com": []}}}`,
+	} {
+		if _, err := LoadTrustPolicy(writeTrustPolicy(t, tdir, policy)); err == nil {
+			t.Errorf("%s: expected an error", policy)
+		}
+	}
+}
+
+func TestRegistryFetchTrust(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir := t.TempDir()
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, tdir, "ed25519.pub", edPub)
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePublicKey(t, tdir, "ecdsa.pub", &ecPriv.PublicKey)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(policy string) (*ImageRef, error) {
+		trust, err := LoadTrustPolicy(writeTrustPolicy(t, tdir, policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := tr.Ref()
+		r := NewRegistry(ref.Host())
+		r.Trust = trust
+		_, err = r.FetchLayers(ref, t.TempDir())
+		return ref, err
+	}
+	signed := fmt.Sprintf(`{"default": [{"type": "reject"}], "transports": {"docker": {%q: [{"type": "sigstoreSigned", "keyPaths": ["ed25519.pub", "ecdsa.pub"]}]}}}`, tr.Host())
+
+	var terr TrustError
+	if _, err := fetch(`{"default": [{"type": "reject"}]}`); !errors.As(err, &terr) || terr.Scope != "default" {
+		t.Errorf("expected the default scope to reject the image, got %v", err)
+	}
+	if tr.Requests["/v2/test/image/manifests/latest"] != 0 {
+		t.Errorf("expected nothing of a rejected image to be fetched")
+	}
+	if ref, err := fetch(`{"default": [{"type": "insecureAcceptAnything"}]}`); err != nil || ref.Signed() {
+		t.Errorf("expected the image to be fetched unsigned, got %v", err)
+	}
+	if _, err := fetch(signed); !errors.As(err, &terr) || terr.Scope != tr.Host() {
+		t.Errorf("expected the image without signatures to be refused, got %v", err)
+	}
+
+	// signed by a key the policy does not trust
+	digest := digestOf(tr.manifest)
+	signTestImage(tr, tr.Host()+"/test/image", digest, func(payload []byte) []byte {
+		return ed25519.Sign(otherPriv, payload)
+	})
+	if _, err := fetch(signed); !errors.As(err, &terr) {
+		t.Errorf("expected the image signed by another key to be refused, got %v", err)
+	}
+
+	for name, sign := range map[string]func([]byte) []byte{
+		"ed25519": func(payload []byte) []byte {
+			return ed25519.Sign(edPriv, payload)
+		},
+		"ecdsa": func(payload []byte) []byte {
+			sum := sha256.Sum256(payload)
+			sig, err := ecdsa.SignASN1(rand.Reader, ecPriv, sum[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		},
+	} {
+		signTestImage(tr, tr.Host()+"/test/image", digest, sign)
+		ref, err := fetch(signed)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !ref.Signed() {
+			t.Errorf("%s: expected the image to be marked signed", name)
+		}
+	}
+
+	// nor does a signature of the same manifest in another repository
+	signTestImage(tr, tr.Host()+"/test/other", digest, func(payload []byte) []byte {
+		return ed25519.Sign(edPriv, payload)
+	})
+	if _, err := fetch(signed); !errors.As(err, &terr) {
+		t.Errorf("expected a signature for another repository to be refused, got %v", err)
+	}
+
+	// a signature that is not of the payload does not do
+	signTestImage(tr, tr.Host()+"/test/image", digest, func(payload []byte) []byte {
+		return ed25519.Sign(edPriv, []byte(strings.Replace(string(payload), digest, digestOf(tr.manifestList), 1)))
+	})
+	if _, err := fetch(signed); !errors.As(err, &terr) {
+		t.Errorf("expected a signature not of the payload to be refused, got %v", err)
+	}
+}
+
+func TestSameRepository(t *testing.T) {
+	for _, c := range []struct {
+		img, signed string
+		same        bool
+	}{
+		{"busybox", "index.docker.io/library/busybox", true},
+		{"docker.io/library/busybox:1.36", "busybox", true},
+		{"registry.example.com/team/app:v1", "registry.example.com/team/app", true},
+		{"registry.example.com/team/app", "registry.example.com/team/other", false},
+		{"registry.example.com/team/app", "mirror.example.com/team/app", false},
+		{"registry.example.com/team/app", "", false},
+	} {
+		if same := sameRepository(NewImageRef(c.img), c.signed); same != c.same {
+			t.Errorf("%s signed as %q: expected %v, got %v", c.img, c.signed, c.same, same)
+		}
+	}
+}
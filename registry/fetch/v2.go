@@ -0,0 +1,597 @@
+package fetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+var (
+	// DefaultV2RegistryHost is where the Docker Hub serves the v2 API, as
+	// opposed to the v1 index at DefaultRegistryHost
+	DefaultV2RegistryHost = "registry-1.docker.io"
+
+	// ManifestV2Accept are the manifest media types requested from v2
+	// registries
+	ManifestV2Accept = []string{
+		MediaTypeManifestV2,
+		MediaTypeOCIManifest,
+		MediaTypeManifestList,
+		MediaTypeOCIIndex,
+	}
+)
+
+const (
+	MediaTypeManifestV2     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageConfig    = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayerGzip      = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeOCILayerGzip   = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayer       = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerZstd   = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeOCIImageConfig = "application/vnd.oci.image.config.v1+json"
+)
+
+// API versions of the docker registry
+const (
+	APIVersion1 = "v1"
+	APIVersion2 = "v2"
+)
+
+// Descriptor points at a blob in a v2 registry
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+	// Annotations are only used in the index.json of OCI layouts, and the
+	// layers of signatures
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Platform is only in manifest lists
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// ManifestV2 is an image manifest (schema 2, or OCI)
+type ManifestV2 struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	// Annotations are only in OCI manifests
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// v2Image is what has been resolved about an image from a v2 registry
+type v2Image struct {
+	manifest       ManifestV2
+	manifestDigest string
+	// the manifest as the registry gave it, and its media type
+	manifestBytes     []byte
+	manifestMediaType string
+	config            []byte
+	// the legacy IDs of the layers, top-most first, and the layer
+	// descriptor each is for
+	ids    []string
+	layers map[string]Descriptor
+}
+
+// APIVersion returns the version of the registry API to use with this
+// registry, pinging the v2 API to find out on first use. Registries that do
+// not speak v2 are used with the v1 API.
+func (re *RegistryEndpoint) APIVersion() string {
+	return re.APIVersionContext(context.Background())
+}
+
+// APIVersionContext is APIVersion, giving up when ctx is done. Concurrent
+// callers wait for the ping of the first.
+func (re *RegistryEndpoint) APIVersionContext(ctx context.Context) string {
+	if version := re.knownAPIVersion(); version != "" {
+		return version
+	}
+	re.pingMu.Lock()
+	defer re.pingMu.Unlock()
+	if version := re.knownAPIVersion(); version != "" {
+		return version
+	}
+	version := re.pingV2(ctx)
+	if version == "" {
+		// not a verdict on the registry, so ask again next time
+		return APIVersion1
+	}
+	re.mu.Lock()
+	re.apiVersion = version
+	re.mu.Unlock()
+	logrus.Debugf("using the %s API of %s", version, re.Host)
+	return version
+}
+
+// knownAPIVersion is the API version found by the ping of the registry, if
+// it was pinged
+func (re *RegistryEndpoint) knownAPIVersion() string {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	return re.apiVersion
+}
+
+// pingV2 pings the v2 API of the registry, returning the API version to use
+// with it, or "" if ctx was done first
+func (re *RegistryEndpoint) pingV2(ctx context.Context) string {
+	req, err := http.NewRequestWithContext(ctx, "GET", re.apiURL(re.v2Host(), "/v2/"), nil)
+	if err != nil {
+		return APIVersion1
+	}
+	resp, err := re.do(req)
+	if err != nil && ctx.Err() != nil {
+		return ""
+	}
+	if err != nil {
+		logrus.Debugf("v2 ping of %s failed, using v1: %s", re.v2Host(), err)
+		return APIVersion1
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusUnauthorized {
+		return APIVersion2
+	}
+	return APIVersion1
+}
+
+func (re *RegistryEndpoint) v2Host() string {
+	if re.Host == DefaultRegistryHost {
+		return DefaultV2RegistryHost
+	}
+	return re.Host
+}
+
+// v2Name is the repository name as the v2 API expects it, which on the
+// Docker Hub includes the implicit "library/" namespace
+func (re *RegistryEndpoint) v2Name(img *ImageRef) string {
+	name := img.Name()
+	if re.Host == DefaultRegistryHost && !strings.Contains(name, "/") {
+		return "library/" + name
+	}
+	return name
+}
+
+// v2Do sends an authenticated request for the repository of img, fetching a
+// bearer token when the registry challenges for one
+func (re *RegistryEndpoint) v2Do(ctx context.Context, img *ImageRef, method, urlStr string, header http.Header) (*http.Response, error) {
+	return re.v2DoScope(ctx, fmt.Sprintf("repository:%s:pull", re.v2Name(img)), method, urlStr, header)
+}
+
+// v2DoScope is v2Do, for a request needing a token for scope. Tokens are
+// cached per scope until they expire, in the TokenCache too if set, and
+// fetched again when the registry rejects one. Registries challenging for
+// basic auth are sent the endpoint's Credentials instead.
+func (re *RegistryEndpoint) v2DoScope(ctx context.Context, scope, method, urlStr string, header http.Header) (*http.Response, error) {
+	return re.v2DoBody(ctx, scope, method, urlStr, header, nil)
+}
+
+// requestBody is the body of a request, opened again each time the request
+// is sent
+type requestBody struct {
+	open func() (io.ReadCloser, error)
+	size int64
+}
+
+// v2DoBody is v2DoScope, for a request with a body
+func (re *RegistryEndpoint) v2DoBody(ctx context.Context, scope, method, urlStr string, header http.Header, body *requestBody) (*http.Response, error) {
+	key, err := re.tokenKey(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	retried := false
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, urlStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			if req.Body, err = body.open(); err != nil {
+				return nil, err
+			}
+			req.GetBody = body.open
+			req.ContentLength = body.size
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		re.mu.Lock()
+		tok, ok := re.bearerTokens[key]
+		basic := re.basicAuth
+		re.mu.Unlock()
+		if (!ok || tok.Expired()) && !retried && re.TokenCache != nil {
+			// another process may have fetched it
+			if cached, found := re.TokenCache.get(re.Host, key); found {
+				tok, ok = cached, true
+				re.mu.Lock()
+				re.bearerTokens[key] = tok
+				re.mu.Unlock()
+			}
+		}
+		if ok && (!tok.Expired() || retried) {
+			req.Header.Set("Authorization", "Bearer "+tok.Token)
+		} else if basic {
+			creds, err := re.credentials(ctx)
+			if err != nil {
+				return nil, err
+			}
+			req.SetBasicAuth(creds.Username, creds.Password)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := re.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := auth.ParseChallenge(resp.Header.Get("WWW-Authenticate"))
+	creds, err := re.credentials(ctx)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if !challenge.IsBearer() {
+		re.mu.Lock()
+		retry := !re.basicAuth && !creds.Empty()
+		re.basicAuth = true
+		re.mu.Unlock()
+		if !retry {
+			// nothing more to try, leave the 401 to the caller
+			return resp, nil
+		}
+		resp.Body.Close()
+	} else {
+		resp.Body.Close()
+		tok, err := auth.RequestBearerToken(auth.DoerFunc(func(req *http.Request) (*http.Response, error) {
+			return re.do(req.WithContext(ctx))
+		}), challenge, scope, creds)
+		var status auth.StatusError
+		if errors.As(err, &status) {
+			// for the failure modes of ResponseError
+			return nil, ResponseError{Method: status.Method, URL: status.URL, Status: status.Status, StatusCode: status.StatusCode}
+		}
+		if err != nil {
+			return nil, err
+		}
+		re.mu.Lock()
+		re.bearerTokens[key] = tok
+		re.mu.Unlock()
+		if re.TokenCache != nil {
+			if err := re.TokenCache.put(re.Host, key, tok); err != nil {
+				logrus.Debugf("cannot cache the token for %s: %s", scope, err)
+			}
+		}
+	}
+	retried = true
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	return re.do(req)
+}
+
+// v2Resolve fetches the manifest and config of img, and works out the
+// legacy layer IDs, ancestry and image ID from them
+func (re *RegistryEndpoint) v2Resolve(ctx context.Context, img *ImageRef) (*v2Image, error) {
+	if img.v2 != nil {
+		return img.v2, nil
+	}
+	start := time.Now()
+	defer since(start, &img.Timings().Resolve)
+
+	buf, mediaType, digest, err := re.v2Manifest(ctx, img, img.manifestReference())
+	if err != nil {
+		return nil, err
+	}
+	if img.Pinned() {
+		if !strings.HasPrefix(img.Digest(), "sha256:") {
+			return nil, fmt.Errorf("%s: unsupported digest %q", img, img.Digest())
+		}
+		// the content must match the digest asked for, whatever the
+		// registry claims
+		if actual := digestOf(buf); actual != img.Digest() {
+			return nil, fmt.Errorf("%s: manifest has digest %s", img, actual)
+		}
+		digest = img.Digest()
+	}
+	// what the reference points at, which for a manifest list is not the
+	// manifest of the image fetched
+	refDigest := digest
+	if isManifestList(mediaType, buf) {
+		var list OCIIndex
+		if err := json.Unmarshal(buf, &list); err != nil {
+			return nil, err
+		}
+		desc, err := selectPlatform(img, list, img.Platform())
+		if err != nil {
+			return nil, err
+		}
+		logrus.Debugf("%s: fetching the image for %s, %s", img, img.Platform(), desc.Digest)
+		if buf, mediaType, _, err = re.v2Manifest(ctx, img, desc.Digest); err != nil {
+			return nil, err
+		}
+		if actual := digestOf(buf); actual != desc.Digest {
+			return nil, fmt.Errorf("%s: manifest for %s has digest %s, not %s", img, img.Platform(), actual, desc.Digest)
+		}
+		if isManifestList(mediaType, buf) {
+			return nil, fmt.Errorf("%s: manifest for %s is a manifest list itself", img, img.Platform())
+		}
+		digest = desc.Digest
+	}
+
+	v2 := &v2Image{
+		manifestDigest:    digest,
+		manifestBytes:     buf,
+		manifestMediaType: mediaType,
+		layers:            map[string]Descriptor{},
+	}
+	if err := json.Unmarshal(buf, &v2.manifest); err != nil {
+		return nil, err
+	}
+	if v2.manifest.SchemaVersion != 2 {
+		return nil, fmt.Errorf("%s has an unsupported manifest schema version %d", img, v2.manifest.SchemaVersion)
+	}
+	if v2.manifest.MediaType != "" {
+		v2.manifestMediaType = v2.manifest.MediaType
+	}
+
+	if v2.config, err = re.v2Blob(ctx, img, v2.manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	var config struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(v2.config, &config); err != nil {
+		return nil, err
+	}
+	if len(config.RootFS.DiffIDs) != len(v2.manifest.Layers) {
+		return nil, fmt.Errorf("%s: config has %d diff_ids for %d layers", img, len(config.RootFS.DiffIDs), len(v2.manifest.Layers))
+	}
+
+	// the legacy IDs are derived from the chain of layers, with the
+	// top-most also depending on the config
+	chainID := ""
+	ids := []string{}
+	for i, diffID := range config.RootFS.DiffIDs {
+		if chainID == "" {
+			chainID = diffID
+		} else {
+			chainID = digestOf([]byte(chainID + " " + diffID))
+		}
+		id := strings.TrimPrefix(chainID, "sha256:")
+		if i == len(config.RootFS.DiffIDs)-1 {
+			id = strings.TrimPrefix(digestOf([]byte(chainID+" "+v2.manifest.Config.Digest)), "sha256:")
+		}
+		ids = append([]string{id}, ids...)
+		v2.layers[id] = v2.manifest.Layers[i]
+	}
+	v2.ids = ids
+	if err := checkLayerIDs(ids...); err != nil {
+		return nil, fmt.Errorf("%s: %w", img, err)
+	}
+
+	img.v2 = v2
+	img.digest = refDigest
+	if len(ids) > 0 {
+		img.SetID(ids[0])
+	}
+	img.SetAncestry(ids)
+	return v2, nil
+}
+
+// v2Manifest fetches the manifest, or manifest list, of img by reference (a
+// tag or digest), with its media type and digest
+func (re *RegistryEndpoint) v2Manifest(ctx context.Context, img *ImageRef, reference string) (buf []byte, mediaType, digest string, err error) {
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/manifests/%s", re.v2Name(img), reference))
+	resp, err := re.v2Do(ctx, img, "GET", urlStr, http.Header{"Accept": ManifestV2Accept})
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", newResponseError(urlStr, resp)
+	}
+	if buf, err = ioutil.ReadAll(resp.Body); err != nil {
+		return nil, "", "", err
+	}
+	digest = resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = digestOf(buf)
+	}
+	return buf, resp.Header.Get("Content-Type"), digest, nil
+}
+
+// isManifestList reports whether the manifest buf, served as mediaType, is a
+// manifest list or OCI index rather than the manifest of an image
+func isManifestList(mediaType string, buf []byte) bool {
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return false
+	}
+	for _, mt := range []string{m.MediaType, mediaType} {
+		if mt == MediaTypeManifestList || mt == MediaTypeOCIIndex {
+			return true
+		}
+	}
+	return m.MediaType == "" && len(m.Manifests) > 0
+}
+
+// v2Blob fetches a whole blob into memory, for small blobs like configs
+func (re *RegistryEndpoint) v2Blob(ctx context.Context, img *ImageRef, digest string) ([]byte, error) {
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(img), digest))
+	resp, err := re.v2Do(ctx, img, "GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newResponseError(urlStr, resp)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// layerJSON is the legacy json for the layer id of the image, which for
+// the top-most layer is the image config
+func (v2 *v2Image) layerJSON(id string) ([]byte, error) {
+	parent := ""
+	for i := range v2.ids {
+		if v2.ids[i] == id && i+1 < len(v2.ids) {
+			parent = v2.ids[i+1]
+		}
+	}
+	md := map[string]interface{}{}
+	if id == v2.ids[0] {
+		if err := json.Unmarshal(v2.config, &md); err != nil {
+			return nil, err
+		}
+		delete(md, "rootfs")
+		delete(md, "history")
+	} else {
+		md["created"] = time.Time{}
+		md["container_config"] = map[string][]string{"Cmd": {""}}
+	}
+	md["id"] = id
+	if parent != "" {
+		md["parent"] = parent
+	}
+	md["Size"] = v2.layers[id].Size
+	return json.Marshal(md)
+}
+
+// v2FetchMetadata writes the legacy json of each layer, derived from the
+// manifest and config, without downloading any layers
+func (re *RegistryEndpoint) v2FetchMetadata(ctx context.Context, img *ImageRef, dest string) ([]string, error) {
+	v2, err := re.v2Resolve(ctx, img)
+	if err != nil {
+		return []string{}, err
+	}
+	for _, id := range v2.ids {
+		if err := os.MkdirAll(path.Join(dest, id), 0755); err != nil {
+			return []string{}, err
+		}
+		buf, err := v2.layerJSON(id)
+		if err != nil {
+			return []string{}, err
+		}
+		if err := ioutil.WriteFile(path.Join(dest, id, "json"), buf, 0644); err != nil {
+			return []string{}, err
+		}
+	}
+	return v2.ids, nil
+}
+
+// v2FetchLayer downloads the blob of the layer id to dest/<id>/layer.tar,
+// and returns the bytes downloaded. Compressed blobs are decompressed on
+// another goroutine as they download. An interrupted download of the blob is
+// resumed (see PartialSuffix). The blob is checked against the digest in the
+// manifest, and any set with ImageRef.SetLayerDigest. The download is aborted
+// if cancel is closed.
+func (re *RegistryEndpoint) v2FetchLayer(ctx context.Context, img *ImageRef, id, dest string, cancel <-chan struct{}) (int64, error) {
+	desc := img.v2.layers[id]
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/blobs/%s", re.v2Name(img), desc.Digest))
+	blob := path.Join(dest, id, "layer.blob")
+	layer := path.Join(dest, id, "layer.tar")
+
+	var (
+		follow       *follower
+		diffID       string
+		decompressed = make(chan error, 1)
+	)
+	if desc.MediaType != MediaTypeOCILayer {
+		follow = newFollower()
+		go func() {
+			var err error
+			diffID, err = gunzipFollowing(follow, blob+PartialSuffix, layer+PartialSuffix)
+			decompressed <- err
+		}()
+	}
+	n, digest, err := resumeDownload(ctx, blob, func(header http.Header) (*http.Response, error) {
+		resp, err := re.v2Do(ctx, img, "GET", urlStr, header)
+		return re.throttle(resp), err
+	}, cancel, follow, re.Retry, re.layerProgress(id))
+	var gzErr error
+	if follow != nil {
+		gzErr = <-decompressed
+		defer os.Remove(layer + PartialSuffix)
+	}
+	if err != nil {
+		return n, err
+	}
+	blob += PartialSuffix
+	start := time.Now()
+	err = verifyDigest(id, blob, digest, desc.Digest, img.LayerDigest(id))
+	img.Timings().addVerify(start)
+	if err != nil {
+		return n, err
+	}
+	if follow == nil {
+		if err := os.Rename(blob, layer); err != nil {
+			return n, err
+		}
+		return n, writeLayerChecksum(path.Join(dest, id), digest)
+	}
+	if gzErr != nil {
+		return n, gzErr
+	}
+	if err := os.Rename(layer+PartialSuffix, layer); err != nil {
+		return n, err
+	}
+	if err := os.Remove(blob); err != nil {
+		return n, err
+	}
+	return n, writeLayerChecksum(path.Join(dest, id), diffID)
+}
+
+// v2ManifestDigest returns the digest of the manifest the reference points to, with
+// a HEAD request
+func (re *RegistryEndpoint) v2ManifestDigest(ctx context.Context, img *ImageRef) (string, error) {
+	if img.Pinned() {
+		return img.Digest(), nil
+	}
+	urlStr := re.apiURL(re.v2Host(), fmt.Sprintf("/v2/%s/manifests/%s", re.v2Name(img), img.Tag()))
+	resp, err := re.v2Do(ctx, img, "HEAD", urlStr, http.Header{"Accept": ManifestV2Accept})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newResponseError(urlStr, resp)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	if _, err := re.v2Resolve(ctx, img); err != nil {
+		return "", err
+	}
+	return img.Digest(), nil
+}
+
+func digestOf(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
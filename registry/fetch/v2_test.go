@@ -0,0 +1,176 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vbatts/docker-utils/registry/auth"
+)
+
+func TestRegistryV2FetchLayers(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if r.APIVersion() != APIVersion2 {
+		t.Fatalf("expected the v2 API, got %s", r.APIVersion())
+	}
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(testLayers) {
+		t.Fatalf("expected %d layers, got %d", len(testLayers), len(ids))
+	}
+	if ref.ID() != ids[0] || ref.Digest() != digestOf(tr.manifest) {
+		t.Errorf("expected the ID and digest to be resolved, got %q and %q", ref.ID(), ref.Digest())
+	}
+	for i, id := range ids {
+		buf, err := ioutil.ReadFile(path.Join(tdir, id, "layer.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(testLayers[i].Layer) {
+			t.Errorf("layer %d: expected the decompressed %q, got %q", i, testLayers[i].Layer, buf)
+		}
+	}
+	facts, err := LoadImageFacts(tdir, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facts.Labels["license"] != "MIT" {
+		t.Errorf("expected the config labels in the top-most json, got %v", facts.Labels)
+	}
+
+	digest, err := r.Resolve(NewImageRef(ref.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != ref.Digest() {
+		t.Errorf("expected Resolve to return %q, got %q", ref.Digest(), digest)
+	}
+}
+
+func TestRegistryV2TokenExpiry(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	scope := "repository:test/image:pull"
+
+	cases := []struct {
+		Name     string
+		Token    auth.BearerToken
+		Requests int
+	}{
+		{"valid", auth.BearerToken{Token: "sekrit", Expires: time.Now().Add(time.Hour)}, 0},
+		{"expired", auth.BearerToken{Token: "sekrit", Expires: time.Now().Add(-time.Second)}, 1},
+		{"revoked", auth.BearerToken{Token: "stale", Expires: time.Now().Add(time.Hour)}, 1},
+	}
+	for _, c := range cases {
+		r.bearerTokens[scope] = c.Token
+		tr.mu.Lock()
+		tr.Requests["/token"] = 0
+		tr.mu.Unlock()
+		if _, err := r.Ancestry(NewImageRef(ref.String())); err != nil {
+			t.Fatalf("%s: %s", c.Name, err)
+		}
+		tr.mu.Lock()
+		n := tr.Requests["/token"]
+		tr.mu.Unlock()
+		if n != c.Requests {
+			t.Errorf("%s: expected %d token requests, got %d", c.Name, c.Requests, n)
+		}
+		if tok := r.bearerTokens[scope]; tok.Token != "sekrit" || tok.Expired() {
+			t.Errorf("%s: expected a fresh token to be cached, got %#v", c.Name, tok)
+		}
+	}
+}
+
+func TestRegistryBaseURL(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	// a gateway serving the registry under /gw, with a static key
+	gw := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if !strings.HasPrefix(r.URL.Path, "/gw/v2/") || q.Get("key") != "x" {
+			http.NotFound(w, r)
+			return
+		}
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/gw")
+		q.Del("key")
+		r.URL.RawQuery = q.Encode()
+		tr.serve(w, r)
+	}))
+	defer gw.Close()
+
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	ref := NewImageRef("gateway.example.com/test/image")
+	r := NewRegistry(ref.Host())
+	r.BaseURL = gw.URL + "/gw/?key=x"
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(testLayers) {
+		t.Errorf("expected %d layers, got %d", len(testLayers), len(ids))
+	}
+	// the pages of tags are linked without the prefix
+	tags, err := r.v2Tags(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"latest", "v1.0"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+}
+
+func TestRegistryV2FetchByDigest(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	tdir, err := ioutil.TempDir("", "test.fetch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	digest := digestOf(tr.manifest)
+	ref := NewImageRef(tr.Host() + "/test/image@" + digest)
+	r := NewRegistry(ref.Host())
+	if resolved, err := r.Resolve(ref); err != nil || resolved != digest {
+		t.Errorf("expected to resolve to %s, got %q, %v", digest, resolved, err)
+	}
+	ids, err := r.FetchLayers(ref, tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != len(testLayers) || ref.Digest() != digest {
+		t.Errorf("expected %d layers of %s, got %d of %s", len(testLayers), digest, len(ids), ref.Digest())
+	}
+	tr.mu.Lock()
+	byTag := tr.Requests["/v2/test/image/manifests/latest"]
+	tr.mu.Unlock()
+	if byTag != 0 {
+		t.Errorf("expected the manifest to be fetched by digest, not by tag")
+	}
+
+	missing := NewImageRef(tr.Host() + "/test/image@" + digestOf([]byte("other")))
+	if _, err := r.FetchLayers(missing, tdir); err == nil {
+		t.Errorf("expected fetching an unknown digest to fail")
+	}
+}
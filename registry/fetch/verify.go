@@ -0,0 +1,99 @@
+package fetch
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LocalProblem is a layer of an image on disk found at fault by VerifyLocal
+type LocalProblem struct {
+	ID  string
+	Err error
+}
+
+func (p LocalProblem) Error() string {
+	return p.Err.Error()
+}
+
+// ErrLocalCorrupted is returned by VerifyLocal for an image whose layers on
+// disk are missing or corrupted
+type ErrLocalCorrupted struct {
+	Dir      string
+	Ref      string
+	Problems []LocalProblem
+}
+
+func (e ErrLocalCorrupted) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = p.Error()
+	}
+	return fmt.Sprintf("%s: %s is corrupted: %s", e.Dir, e.Ref, strings.Join(msgs, "; "))
+}
+
+// VerifyLocal audits img, fetched into dest with FetchLayers, without
+// contacting the registry: the json of each layer must parse and name the
+// layer below it as its parent, down to a base without one, and each
+// layer.tar must hash to the checksum recorded when it was fetched. The
+// layers of img are its ancestry, or when it has none, the chain of parents
+// from its ID, or from the ID the `repositories` file of dest tags it with.
+// Every layer at fault is reported, in an ErrLocalCorrupted, rather than the
+// first only.
+func VerifyLocal(dest string, img *ImageRef) error {
+	ancestry, err := localAncestry(dest, img)
+	if err != nil {
+		return err
+	}
+	problems := []LocalProblem{}
+	for i, id := range ancestry {
+		parent := ""
+		if i+1 < len(ancestry) {
+			parent = ancestry[i+1]
+		}
+		if err := verifyLocalLayer(dest, id, parent); err != nil {
+			problems = append(problems, LocalProblem{ID: id, Err: err})
+		}
+	}
+	if len(problems) > 0 {
+		return ErrLocalCorrupted{Dir: dest, Ref: img.String(), Problems: problems}
+	}
+	return nil
+}
+
+// localAncestry is the ancestry of img, or that found in dest from its ID
+// with LocalAncestry. The chain stops short at a layer whose json cannot be
+// read, which verifyLocalLayer reports.
+func localAncestry(dest string, img *ImageRef) ([]string, error) {
+	if ancestry := img.Ancestry(); len(ancestry) > 0 {
+		return ancestry, nil
+	}
+	id := img.ID()
+	if id == "" {
+		repos, err := ReadRepositories(dest)
+		if err != nil {
+			return nil, err
+		}
+		if id = repos[img.Name()][img.Tag()]; id == "" {
+			return nil, fmt.Errorf("%s: %s is not in the repositories file", dest, img)
+		}
+	}
+	ancestry, err := LocalAncestry(dest, id)
+	if err != nil && len(ancestry) == 0 {
+		// a loop of parents
+		return nil, fmt.Errorf("%s: %w", dest, err)
+	}
+	return ancestry, nil
+}
+
+// verifyLocalLayer checks the json and layer.tar of the layer id in dest,
+// which should have parent below it
+func verifyLocalLayer(dest, id, parent string) error {
+	actual, err := checkLayer(dest, id, true)
+	if err != nil {
+		return err
+	}
+	if actual != parent {
+		return fmt.Errorf("layer %s: json names the parent %q, not %q", id, actual, parent)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package fetch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyLocal(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.verify.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	tr := newTestRegistryV2(t, testLayers...)
+	ref := tr.Ref()
+	r := NewRegistry(ref.Host())
+	if _, err := r.FetchLayers(ref, tdir); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLocal(tdir, ref); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := FormatRepositories(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, "repositories"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the layers are found from the tag alone
+	if err := VerifyLocal(tdir, NewImageRef(ref.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyLocal(tdir, NewImageRef(ref.Host()+"/other/image")); err == nil {
+		t.Errorf("expected an image not on disk to fail")
+	}
+
+	// corrupt the base layer, and have the top one name another parent
+	ancestry := ref.Ancestry()
+	base, top := ancestry[len(ancestry)-1], ancestry[0]
+	if err := ioutil.WriteFile(filepath.Join(tdir, base, "layer.tar"), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf, err = json.Marshal(map[string]string{"id": top, "parent": "0123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tdir, top, "json"), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = VerifyLocal(tdir, ref)
+	e, ok := err.(ErrLocalCorrupted)
+	if !ok || len(e.Problems) != 2 || e.Problems[0].ID != top || e.Problems[1].ID != base {
+		t.Fatalf("expected the top and base layers to be reported, got %v", err)
+	}
+	if _, ok := e.Problems[1].Err.(ErrDigestMismatch); !ok {
+		t.Errorf("expected the base layer not to match its checksum, got %v", e.Problems[1].Err)
+	}
+
+	// followed from the tag, the chain stops at the parent not there
+	err = VerifyLocal(tdir, NewImageRef(ref.String()))
+	if e, ok = err.(ErrLocalCorrupted); !ok || len(e.Problems) != 1 || e.Problems[0].ID != "0123" {
+		t.Errorf("expected the missing parent to be reported, got %v", err)
+	}
+}
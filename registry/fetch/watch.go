@@ -0,0 +1,157 @@
+package fetch
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// the Actions of TagEvents
+const (
+	TagAdded   = "added"
+	TagChanged = "changed"
+	TagRemoved = "removed"
+)
+
+// TagEvent is a change of a tag noticed by a Watcher
+type TagEvent struct {
+	Time time.Time `json:"time"`
+	// Ref is the reference to the tag
+	Ref    string `json:"ref"`
+	Tag    string `json:"tag"`
+	Action string `json:"action"`
+	// Digest is what the tag points at now, empty once removed, and
+	// Previous what it pointed at, empty when added. These are image IDs
+	// for v1 registries.
+	Digest   string `json:"digest,omitempty"`
+	Previous string `json:"previous,omitempty"`
+}
+
+// Watcher polls the tags of a repository for changes of what they point at
+type Watcher struct {
+	Registry *RegistryEndpoint
+	// Repository is the repository watched; its tag is ignored
+	Repository *ImageRef
+	// Tags are the tags watched, or all of them when empty
+	Tags []string
+	// Interval is the time between polls
+	Interval time.Duration
+	// State, when set, is where the digests seen are kept across runs, so
+	// that the changes made while not watching, tags added and removed
+	// included, are noticed by the first poll. Otherwise, or when the State
+	// has nothing of the repository, the first poll only records what the
+	// tags point at.
+	State *SyncState
+
+	digests map[string]string
+}
+
+// tagRef is the reference to tag in the repository watched
+func (w *Watcher) tagRef(tag string) *ImageRef {
+	return NewImageRef(w.Repository.Host() + "/" + w.Repository.Name() + ":" + tag)
+}
+
+// Poll resolves the tags watched, and returns how they changed since the
+// last poll
+func (w *Watcher) Poll(ctx context.Context) ([]TagEvent, error) {
+	tags := w.Tags
+	if len(tags) == 0 {
+		var err error
+		if tags, err = w.Registry.TagsContext(ctx, w.Repository); err != nil {
+			return nil, err
+		}
+	}
+	if w.digests == nil && w.State != nil {
+		w.digests = w.stateDigests()
+	}
+	first := w.digests == nil
+	digests := map[string]string{}
+	events := []TagEvent{}
+	now := time.Now().UTC()
+	for _, tag := range tags {
+		ref := w.tagRef(tag)
+		digest, err := w.Registry.ResolveContext(ctx, ref)
+		if err != nil {
+			if !isNotFound(err) {
+				return nil, err
+			}
+			// a tag watched by name that does not exist (any more)
+			continue
+		}
+		digests[tag] = digest
+		previous, known := w.digests[tag]
+		switch {
+		case !known && !first:
+			events = append(events, TagEvent{Time: now, Ref: ref.String(), Tag: tag, Action: TagAdded, Digest: digest})
+		case known && previous != digest:
+			events = append(events, TagEvent{Time: now, Ref: ref.String(), Tag: tag, Action: TagChanged, Digest: digest, Previous: previous})
+		}
+		if w.State != nil {
+			w.State.Mark(ref, digest)
+		}
+	}
+	for tag, previous := range w.digests {
+		if _, ok := digests[tag]; !ok {
+			ref := w.tagRef(tag)
+			events = append(events, TagEvent{Time: now, Ref: ref.String(), Tag: tag, Action: TagRemoved, Previous: previous})
+			if w.State != nil {
+				w.State.Forget(ref)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Tag < events[j].Tag
+	})
+	w.digests = digests
+	return events, nil
+}
+
+// stateDigests are the digests of the tags watched kept in the State, or nil
+// if it has none of the repository
+func (w *Watcher) stateDigests() map[string]string {
+	watched := map[string]bool{}
+	for _, tag := range w.Tags {
+		watched[tag] = true
+	}
+	w.State.mu.Lock()
+	defer w.State.mu.Unlock()
+	var digests map[string]string
+	for name, digest := range w.State.Synced {
+		ref := NewImageRef(name)
+		if ref.Host() != w.Repository.Host() || ref.Name() != w.Repository.Name() || !ref.hasTag() {
+			continue
+		}
+		if len(watched) > 0 && !watched[ref.Tag()] {
+			continue
+		}
+		if digests == nil {
+			digests = map[string]string{}
+		}
+		digests[ref.Tag()] = digest
+	}
+	return digests
+}
+
+// Watch polls every Interval until ctx is done, calling fn with each change
+// noticed. A failed poll is logged and tried again at the next interval; an
+// error from fn stops the watch.
+func (w *Watcher) Watch(ctx context.Context, fn func(TagEvent) error) error {
+	for {
+		events, err := w.Poll(ctx)
+		if err != nil && ctx.Err() == nil {
+			logrus.Warnf("watching %s: %s", w.Repository, err)
+		}
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.Interval):
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package fetch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWatcherPoll(t *testing.T) {
+	tr := newTestRegistryV2(t, testLayers...)
+	repo := NewImageRef(tr.Host() + "/test/image")
+	r := NewRegistry(repo.Host())
+	w := &Watcher{Registry: &r, Repository: repo}
+
+	// all the tags listed, v1.0 having no manifest
+	events, err := w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 0 {
+		t.Errorf("expected the first poll to only record the tags, got %#v", events)
+	}
+	if len(w.digests) != 1 || w.digests["latest"] != digestOf(tr.manifest) {
+		t.Errorf("expected the digest of latest to be recorded, got %#v", w.digests)
+	}
+
+	w.Tags = []string{"latest", "multi"}
+	events, err = w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != TagAdded || events[0].Tag != "multi" || events[0].Digest != digestOf(tr.manifestList) {
+		t.Errorf("expected multi to be added, got %#v", events)
+	}
+
+	w.Tags = []string{"latest"}
+	events, err = w.Poll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Action != TagRemoved || events[0].Previous != digestOf(tr.manifestList) || events[0].Ref != repo.Host()+"/test/image:multi" {
+		t.Errorf("expected multi to be removed, got %#v", events)
+	}
+}
+
+func TestWatcherState(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "test.watch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+
+	tr := newTestRegistryV2(t, testLayers...)
+	repo := NewImageRef(tr.Host() + "/test/image")
+	r := NewRegistry(repo.Host())
+	state, err := LoadSyncState(filepath.Join(tdir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latest := NewImageRef(tr.Host() + "/test/image:latest")
+	state.Mark(latest, "sha256:old")
+	// removed while not watching
+	state.Mark(NewImageRef(tr.Host()+"/test/image:v1.0"), "sha256:gone")
+	// of another repository
+	state.Mark(NewImageRef(tr.Host()+"/test/other:multi"), "sha256:other")
+	w := &Watcher{Registry: &r, Repository: repo, Tags: []string{"latest", "multi", "v1.0"}, State: state}
+
+	var events []TagEvent
+	ctx, cancel := context.WithCancel(context.Background())
+	err = w.Watch(ctx, func(event TagEvent) error {
+		events = append(events, event)
+		cancel()
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the watch to stop when canceled, got %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected the changes since the state was saved, got %#v", events)
+	}
+	if events[0].Tag != "latest" || events[0].Action != TagChanged || events[0].Previous != "sha256:old" || events[0].Digest != digestOf(tr.manifest) {
+		t.Errorf("expected latest to be changed, got %#v", events[0])
+	}
+	if events[1].Tag != "multi" || events[1].Action != TagAdded || events[1].Digest != digestOf(tr.manifestList) {
+		t.Errorf("expected multi to be added, got %#v", events[1])
+	}
+	if events[2].Tag != "v1.0" || events[2].Action != TagRemoved || events[2].Previous != "sha256:gone" {
+		t.Errorf("expected v1.0 to be removed, got %#v", events[2])
+	}
+	if _, ok := state.Digest(NewImageRef(tr.Host() + "/test/image:v1.0")); ok {
+		t.Error("expected the state to forget v1.0")
+	}
+	if digest, _ := state.Digest(NewImageRef(tr.Host() + "/test/image:multi")); digest != digestOf(tr.manifestList) {
+		t.Errorf("expected the state to record multi, got %q", digest)
+	}
+}
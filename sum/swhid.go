@@ -0,0 +1,84 @@
+package sum
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+)
+
+// SWHIDPrefix is prepended to a git blob ID to make a Software Heritage
+// content identifier
+const SWHIDPrefix = "swh:1:cnt:"
+
+// GitBlobID returns the git-style sha1 of the content read from r, which must
+// be exactly size bytes. This is the same as `git hash-object`.
+func GitBlobID(r io.Reader, size int64) (string, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", size)
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	if n != size {
+		return "", fmt.Errorf("expected %d bytes of content, but read %d", size, n)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SWHID returns the Software Heritage identifier for the content read from r
+func SWHID(r io.Reader, size int64) (string, error) {
+	id, err := GitBlobID(r, size)
+	if err != nil {
+		return "", err
+	}
+	return SWHIDPrefix + id, nil
+}
+
+// SWHIDTarFiles returns the SWHID of each regular file in the tar archive,
+// keyed by its path in the archive.
+func SWHIDTarFiles(tarReader io.Reader) (map[string]string, error) {
+	t := tar.NewReader(tarReader)
+	ids := map[string]string{}
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		if ids[hdr.Name], err = SWHID(t, hdr.Size); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// SWHIDAllDockerSave returns the SWHID of each layer.tar in a `docker save`
+// archive, keyed by the layer ID.
+func SWHIDAllDockerSave(saved io.Reader) (map[string]string, error) {
+	t := tar.NewReader(saved)
+	ids := map[string]string{}
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Base(hdr.Name) != "layer.tar" {
+			continue
+		}
+		if ids[path.Dir(hdr.Name)], err = SWHID(t, hdr.Size); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,50 @@
+package sum
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGitBlobID(t *testing.T) {
+	cases := []struct {
+		Content  string
+		Expected string
+	}{
+		{"", "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391"},
+		{"hello\n", "ce013625030ba8dba906f756967f9e9ca394464a"},
+	}
+	for _, c := range cases {
+		id, err := GitBlobID(strings.NewReader(c.Content), int64(len(c.Content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != c.Expected {
+			t.Errorf("for %q: expected %q, got %q", c.Content, c.Expected, id)
+		}
+	}
+	if _, err := GitBlobID(strings.NewReader("short"), 10); err == nil {
+		t.Error("expected an error for a short read")
+	}
+}
+
+func TestSWHIDTarFiles(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644, Size: 6})
+	tw.Write([]byte("hello\n"))
+	tw.Close()
+
+	ids, err := SWHIDTarFiles(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("expected only the regular file, got %v", ids)
+	}
+	if ids["etc/motd"] != SWHIDPrefix+"ce013625030ba8dba906f756967f9e9ca394464a" {
+		t.Errorf("unexpected SWHID %q", ids["etc/motd"])
+	}
+}